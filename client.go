@@ -4,15 +4,89 @@ import (
 	"context"
 	"errors"
 	"io"
-	"net"
+	"math/rand"
+	"strconv"
 	"sync"
 	"time"
+	"unsafe"
 )
 
+// defaultDecoderBufferSize is the size of the UserBuffer of the decoder picked by
+// [NewClient] when none is set in ClientConfig.
+const defaultDecoderBufferSize = 4 * 1024
+
 var (
 	errDisconnected = errors.New("natiu-mqtt: disconnected")
+	errYetToConnect = errors.New("yet to connect")
+	// ErrSubscribeInProgress is returned when a subscribe is attempted while the
+	// MaxConcurrentSubscribes limit of SUBSCRIBE packets awaiting their SUBACK is reached.
+	ErrSubscribeInProgress = errors.New("natiu-mqtt: subscribe in progress")
+	// ErrUnsubscribeInProgress is returned when an unsubscribe is attempted while
+	// a subscribe or unsubscribe is still awaiting its acknowledgement.
+	ErrUnsubscribeInProgress = errors.New("natiu-mqtt: unsubscribe in progress")
+	// ErrTooManyPendingSubs is returned when a subscribe would exceed the
+	// MaxPendingSubs limit set in ClientConfig.
+	ErrTooManyPendingSubs = errors.New("natiu-mqtt: too many pending subscriptions")
+	// ErrNoPacketIDs is returned when an operation needs a packet identifier and
+	// none are available, either because the MaxInflight limit set in ClientConfig
+	// was reached or because all packet identifiers are in use.
+	ErrNoPacketIDs = errors.New("natiu-mqtt: no packet identifiers available")
+	// ErrPublishGaveUp is returned when a QoS1 PUBLISH was sent MaxPublishAttempts
+	// times, as set in ClientConfig, without receiving a PUBACK.
+	ErrPublishGaveUp = errors.New("natiu-mqtt: gave up on unacknowledged publish")
+	// ErrKeepAliveTimeout is returned by [Client.KeepAliveLoop] when the server sends
+	// no packets within the keepalive interval.
+	ErrKeepAliveTimeout = errors.New("natiu-mqtt: keepalive timeout")
+	// ErrUnexpectedPubrel is returned when a PUBREL is received for a packet identifier
+	// with no prior QoS2 PUBLISH acknowledged with a PUBREC. The client disconnects.
+	ErrUnexpectedPubrel = errors.New("natiu-mqtt: PUBREL with no matching PUBREC")
+	// ErrExpectedConnack is returned when the first packet received after a CONNECT
+	// is not a CONNACK. The client disconnects.
+	ErrExpectedConnack = errors.New("natiu-mqtt: expected CONNACK as first packet")
+	// ErrReceiveMaximum is returned when the server sends a QoS1 or QoS2 PUBLISH while
+	// the ReceiveMaximum set in ClientConfig of incoming exchanges are in flight. The client disconnects.
+	ErrReceiveMaximum = errors.New("natiu-mqtt: server exceeded receive maximum")
+	// ErrGracefulDisconnect is returned by [Client.Err] after [Client.DisconnectAndClose].
+	ErrGracefulDisconnect = errors.New("natiu-mqtt: graceful disconnect")
 )
 
+// ErrSubackQoS is returned when a SUBACK grants a topic filter a QoS greater than
+// the one requested [MQTT-3.9.3-2]. The client disconnects.
+type ErrSubackQoS struct {
+	Topic     string
+	Requested QoSLevel
+	Granted   QoSLevel
+}
+
+// Error implements the error interface.
+func (e ErrSubackQoS) Error() string {
+	return "natiu-mqtt: SUBACK granted " + e.Granted.String() + " exceeding requested " + e.Requested.String() + " for topic " + strconv.Quote(e.Topic)
+}
+
+// ErrUnexpectedPacket is returned when the client receives a packet not expected in
+// the current phase of the connection: any packet other than a CONNACK while awaiting
+// the CONNACK [MQTT-3.2.0-1] or a CONNACK once connected. The client disconnects.
+// An ErrUnexpectedPacket received while awaiting the CONNACK matches [ErrExpectedConnack]
+// with [errors.Is].
+type ErrUnexpectedPacket struct {
+	Type PacketType
+	// Connected is set if the packet was received after the CONNACK.
+	Connected bool
+}
+
+// Error implements the error interface.
+func (e ErrUnexpectedPacket) Error() string {
+	if e.Connected {
+		return "natiu-mqtt: unexpected " + e.Type.String() + " while connected"
+	}
+	return "natiu-mqtt: unexpected " + e.Type.String() + " before CONNACK"
+}
+
+// Is reports whether target is ErrExpectedConnack and the packet was received before the CONNACK.
+func (e ErrUnexpectedPacket) Is(target error) bool {
+	return target == ErrExpectedConnack && !e.Connected
+}
+
 // Client is a asynchronous MQTT v3.1.1 client implementation which is
 // safe for concurrent use.
 type Client struct {
@@ -23,6 +97,10 @@ type Client struct {
 
 	txlock sync.Mutex
 	tx     Tx
+
+	retransmitInterval time.Duration
+	maxPublishAttempts int
+	now                func() time.Time
 }
 
 // ClientConfig is used to configure a new Client.
@@ -31,7 +109,52 @@ type ClientConfig struct {
 	Decoder Decoder
 	// OnPub is executed on every PUBLISH message received. Do not call
 	// HandleNext or other client methods from within this function.
+	// A QoS2 PUBLISH is acknowledged with a PUBREC once OnPub returns nil and
+	// is delivered only once: retransmissions received before the server's PUBREL
+	// are acknowledged again without calling OnPub. A QoS1 PUBLISH is acknowledged
+	// with a PUBACK once OnPub returns nil.
 	OnPub func(pubHead Header, varPub VariablesPublish, r io.Reader) error
+	// ReceiveMaximum limits the amount of incoming QoS1 and QoS2 PUBLISH exchanges in flight,
+	// that is delivered to OnPub and not yet concluded by the client's PUBACK or PUBCOMP.
+	// Incoming exchanges are only tracked when set. Once the limit is reached HandleNext writes outstanding acknowledgements before
+	// reading another packet. A server exceeding the limit, i.e. by sending QoS2 PUBLISH
+	// packets without sending their PUBREL, is disconnected with [ErrReceiveMaximum].
+	// Over MQTT 5.0 connections it is advertised to the server as the Receive Maximum
+	// CONNECT property unless already present. If zero there is no limit.
+	ReceiveMaximum uint16
+	// RetransmitInterval is the time waited for a response to a QoS>0 exchange
+	// before retransmitting the last packet sent. If zero a default of 5 seconds is used.
+	RetransmitInterval time.Duration
+	// MaxPendingSubs limits the amount of topic filters awaiting a SUBACK. If a subscribe
+	// would exceed the limit [ErrTooManyPendingSubs] is returned. If zero there is no limit.
+	MaxPendingSubs int
+	// MaxConcurrentSubscribes limits the amount of SUBSCRIBE packets awaiting their SUBACK.
+	// A subscribe attempted once the limit is reached returns [ErrSubscribeInProgress].
+	// Several topic filters may be subscribed to with a single SUBSCRIBE regardless.
+	// If zero only one subscribe may be pending at a time. If negative there is no limit.
+	MaxConcurrentSubscribes int
+	// MaxInflight limits the amount of packet identifiers in use by outgoing exchanges
+	// awaiting completion, that is SUBSCRIBE, UNSUBSCRIBE and QoS1 and QoS2 PUBLISH
+	// packets combined. If an operation would exceed the limit [ErrNoPacketIDs] is returned.
+	// If zero there is no limit other than the amount of packet identifiers.
+	MaxInflight int
+	// OnInflightAvailable is called once for every in-flight slot freed by the server's
+	// acknowledgement of an outgoing exchange: PUBACK, PUBCOMP, SUBACK or UNSUBACK.
+	// A producer that got [ErrNoPacketIDs] may use it to resume without polling.
+	// It is called from within HandleNext, do not call HandleNext from within this function.
+	OnInflightAvailable func()
+	// MaxPublishAttempts enables retransmission of QoS1 PUBLISH packets not acknowledged
+	// within RetransmitInterval, see [Client.RetransmitStalled]. A PUBLISH is abandoned
+	// after being sent MaxPublishAttempts times. If zero QoS1 PUBLISH packets are not retransmitted.
+	MaxPublishAttempts int
+	// OnWarning is called when a packet received is legal but unexpected, such as
+	// a PUBACK referencing a packet identifier that is not in flight or a PINGRESP
+	// received with no PINGREQ outstanding. Warnings do not disconnect the client.
+	// Do not call HandleNext from within this function.
+	OnWarning func(msg string)
+	// Now returns the current time and is used to time retransmissions and ping round trips.
+	// If nil time.Now is used.
+	Now func() time.Time
 	// TODO: add a backoff algorithm callback here so clients can roll their own.
 }
 
@@ -45,14 +168,77 @@ func NewClient(cfg ClientConfig) *Client {
 		}
 	}
 	if cfg.Decoder == nil {
-		cfg.Decoder = DecoderNoAlloc{UserBuffer: make([]byte, 4*1024)}
+		cfg.Decoder = DecoderNoAlloc{UserBuffer: make([]byte, defaultDecoderBufferSize)}
+	}
+	if cfg.RetransmitInterval == 0 {
+		cfg.RetransmitInterval = 5 * time.Second
+	}
+	if cfg.Now == nil {
+		cfg.Now = time.Now
+	}
+	c := &Client{
+		cs: clientState{
+			closeErr:          errYetToConnect,
+			maxPendingSubs:    cfg.MaxPendingSubs,
+			maxConcurrentSubs: cfg.MaxConcurrentSubscribes,
+			maxInflight:       cfg.MaxInflight,
+			receiveMaximum:    cfg.ReceiveMaximum,
+
+			onInflightAvailable: cfg.OnInflightAvailable,
+			now:                 cfg.Now,
+		},
+		retransmitInterval: cfg.RetransmitInterval,
+		maxPublishAttempts: cfg.MaxPublishAttempts,
+		now:                cfg.Now,
 	}
-	c := &Client{cs: clientState{closeErr: errors.New("yet to connect")}}
 	c.rx.RxCallbacks, c.tx.TxCallbacks = c.cs.callbacks(onPub)
+	c.tx.EnforceConnectFirst = true
+	c.rx.OnWarning = cfg.OnWarning
 	c.rx.userDecoder = cfg.Decoder
 	return c
 }
 
+// SessionMemoryEstimate returns an upper bound in bytes on the memory used by a [Client]
+// created with the default decoder over a session with at most maxInflight QoS>0 exchanges
+// in each direction, maxSubs topic filters subscribed or being subscribed, topics of at most
+// maxTopicLen bytes and PUBLISH payloads of at most maxPayloadLen bytes.
+// It is meant for sizing static memory arenas; the estimate is deliberately pessimistic and
+// does not include memory referenced by the user's callbacks or transport.
+func SessionMemoryEstimate(maxInflight, maxSubs, maxTopicLen, maxPayloadLen int) int {
+	const (
+		// Fixed cost of each of the client state's maps: pendingSubs, abandonedSubs,
+		// pendingPubs, pendingRecs, inbound, pubResults and retained.
+		mapBase  = 512
+		numMaps  = 7
+		sliceHdr = int(unsafe.Sizeof([]byte{}))
+		ptrSize  = int(unsafe.Sizeof(uintptr(0)))
+		piSize   = int(unsafe.Sizeof(uint16(0)))
+		// Fixed header, topic length, packet identifier and properties of a PUBLISH.
+		maxPublishHeader = 64
+	)
+	// Allocations may be rounded up to twice the requested size by append and size classes.
+	alloc := func(n int) int { return 2*n + 16 }
+	// Map entries may take up twice the size of their key and value due to load factor and growth.
+	mapEntry := func(kv int) int { return 2*(piSize+kv) + 8 }
+	// Client struct, which includes the packet identifier bitmap, the default decoder's
+	// buffer and Tx's encoding buffer, which holds a whole PUBLISH including its payload.
+	sz := int(unsafe.Sizeof(Client{})) + defaultDecoderBufferSize + alloc(maxPublishHeader+maxTopicLen+maxPayloadLen)
+	sz += numMaps * mapBase
+	// pendingPubs, pubResults and retained copies of outgoing PUBLISH packets.
+	sz += maxInflight * (mapEntry(int(unsafe.Sizeof(PacketType(0)))) +
+		mapEntry(ptrSize) + alloc(int(unsafe.Sizeof(pubResult{}))) +
+		mapEntry(ptrSize) + alloc(int(unsafe.Sizeof(retainedPublish{}))) + alloc(maxTopicLen) + alloc(maxPayloadLen))
+	// pendingRecs and inbound entries of incoming PUBLISH packets and queued acknowledgements.
+	sz += maxInflight * (2*mapEntry(0) + alloc(int(unsafe.Sizeof(identifiedPacket{}))))
+	// pendingSubs and abandonedSubs entries, activeSubs and pending UNSUBSCRIBE topics,
+	// each holding a copy of the topic filter.
+	filter := alloc(maxTopicLen)
+	sz += maxSubs * (mapEntry(int(unsafe.Sizeof(VariablesSubscribe{}))) + mapEntry(0) + alloc(int(unsafe.Sizeof(SubscribeRequest{}))) + filter)
+	sz += maxSubs * (alloc(int(unsafe.Sizeof(activeSub{}))) + filter)
+	sz += maxSubs * (alloc(sliceHdr) + filter)
+	return sz
+}
+
 // HandleNext reads from the wire and decodes MQTT packets.
 // If bytes are read and the decoder fails to read a packet the whole
 // client fails and disconnects.
@@ -60,19 +246,41 @@ func NewClient(cfg ClientConfig) *Client {
 // in the ClientConfig returns an error or if a packet is malformed.
 // If HandleNext returns an error the client will be in a disconnected state.
 func (c *Client) HandleNext() error {
+	if c.cs.inboundFull() {
+		// Write acknowledgements still queued so the server can free its own slots.
+		if err := c.writePendingAcks(); err != nil {
+			return err
+		}
+	}
 	n, err := c.readNextWrapped()
 	if err != nil && n != 0 {
 		if c.IsConnected() {
 			c.cs.OnDisconnect(err)
 			c.txlock.Lock()
 			defer c.txlock.Unlock()
-			c.tx.WriteSimple(PacketDisconnect)
+			c.tx.WriteDisconnect()
 		}
 		return err
 	}
+	if err == nil {
+		err = c.writePendingAcks()
+	}
 	return err
 }
 
+// writePendingAcks writes packets queued by Rx callbacks. These are not written
+// from within the callbacks since Tx may not be locked while Rx is locked.
+func (c *Client) writePendingAcks() error {
+	for _, ack := range c.cs.TakeAcks() {
+		err := c.writeIdentified(ack.packetType, ack.packetIdentifier)
+		if err != nil {
+			return err
+		}
+		c.cs.AckWritten(ack)
+	}
+	return nil
+}
+
 // readNextWrapped is a separate function so mutex locks Rx for minimum amount of time.
 func (c *Client) readNextWrapped() (int, error) {
 	c.rxlock.Lock()
@@ -91,26 +299,111 @@ func (c *Client) StartConnect(rwc io.ReadWriteCloser, vc *VariablesConnect) erro
 	defer c.rxlock.Unlock()
 	c.txlock.Lock()
 	defer c.txlock.Unlock()
-	c.tx.SetTxTransport(rwc)
-	c.rx.SetRxTransport(rwc)
 	if c.cs.IsConnected() {
+		// Checked before setting transports so the established connection is not affected.
 		return errors.New("already connected; disconnect before connecting")
 	}
-	return c.tx.WriteConnect(vc)
+	c.tx.SetTxTransport(rwc)
+	c.rx.SetRxTransport(rwc)
+	c.rx.LastReceivedHeader = Header{}
+	c.rx.ProtocolLevel = vc.ProtocolLevel
+	c.cs.Reset() // Clear state of previous connection attempts.
+	c.cs.SetKeepAlive(vc.KeepAlive)
+	return c.tx.WriteConnect(c.advertiseReceiveMaximum(vc))
+}
+
+// advertiseReceiveMaximum returns vc with the configured receive maximum added as
+// a property over MQTT 5.0 connections. vc is not modified.
+func (c *Client) advertiseReceiveMaximum(vc *VariablesConnect) *VariablesConnect {
+	if vc.ProtocolLevel != ProtocolLevel5 || c.cs.receiveMaximum == 0 {
+		return vc
+	}
+	for _, p := range vc.Properties {
+		if p.ID == PropReceiveMaximum {
+			return vc
+		}
+	}
+	vcopy := *vc
+	vcopy.Properties = append(vc.Properties[:len(vc.Properties):len(vc.Properties)], Property{
+		ID:    PropReceiveMaximum,
+		Value: uint32(c.cs.receiveMaximum),
+	})
+	return &vcopy
 }
 
 // Connect sends a CONNECT packet over the transport and waits for a
 // CONNACK response from the server. The client is connected if the returned error is nil.
+// If rwc implements SetReadDeadline(time.Time) error, as [net.Conn] does, a read pending
+// when ctx ends is interrupted with a past read deadline, which is cleared before returning.
+// The transport's read deadline is not modified otherwise.
+// See [Client.ConnectAck] to obtain the CONNACK.
 func (c *Client) Connect(ctx context.Context, rwc io.ReadWriteCloser, vc *VariablesConnect) error {
+	_, err := c.ConnectAck(ctx, rwc, vc)
+	return err
+}
+
+// ConnectAck performs the CONNECT handshake as [Client.Connect] does and returns the
+// CONNACK received. The first packet received must be the CONNACK [MQTT-3.2.0-1],
+// otherwise the client disconnects with an [ErrUnexpectedPacket] matching [ErrExpectedConnack]
+// and closes the transport. If the server rejects the connection the CONNACK is returned
+// along with its [ConnectReturnCode] as the error.
+// ConnectAck fails if the client is already connected.
+func (c *Client) ConnectAck(ctx context.Context, rwc io.ReadWriteCloser, vc *VariablesConnect) (VariablesConnack, error) {
+	err := c.connect(ctx, rwc, vc)
+	return c.cs.Connack(), err
+}
+
+func (c *Client) connect(ctx context.Context, rwc io.ReadWriteCloser, vc *VariablesConnect) error {
 	err := c.StartConnect(rwc, vc)
 	if err != nil {
 		return err
 	}
+	if deadliner, ok := rwc.(readDeadliner); ok && ctx.Done() != nil {
+		// Without a read deadline a blocking read could outlive ctx. The deadline is only
+		// set, and cleared on return, if ctx ends so that one set by the caller is kept.
+		stop := make(chan struct{})
+		interrupted := make(chan bool, 1)
+		go func() {
+			select {
+			case <-ctx.Done():
+				deadliner.SetReadDeadline(time.Unix(1, 0)) // Unblock pending read.
+				interrupted <- true
+			case <-stop:
+				interrupted <- false
+			}
+		}()
+		defer func() {
+			close(stop)
+			if <-interrupted {
+				deadliner.SetReadDeadline(time.Time{})
+			}
+		}()
+	}
 	backoff := newBackoff()
 	for !c.IsConnected() && ctx.Err() == nil {
 		backoff.Miss()
 		err := c.HandleNext()
 		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil && isTimeout(err) {
+				return ctxErr
+			}
+			// Brokers close the connection after rejecting a CONNECT. The
+			// CONNACK rejection is more meaningful than the transport error.
+			var rc ConnectReturnCode
+			if cerr := c.Err(); errors.As(cerr, &rc) {
+				return cerr
+			}
+			if errors.Is(err, ErrExpectedConnack) {
+				rwc.Close() // Server broke the handshake, the transport is not reused.
+			}
+			return err
+		}
+		if hdr := c.lastReceivedHeader(); hdr != (Header{}) && hdr.Type() != PacketConnack {
+			// Packets with no client callback are not checked on receipt so
+			// the CONNACK is required to be the first packet here instead.
+			err = ErrUnexpectedPacket{Type: hdr.Type()}
+			c.cs.OnDisconnect(err)
+			rwc.Close()
 			return err
 		}
 	}
@@ -120,6 +413,108 @@ func (c *Client) Connect(ctx context.Context, rwc io.ReadWriteCloser, vc *Variab
 	return ctx.Err()
 }
 
+func (c *Client) lastReceivedHeader() Header {
+	c.rxlock.Lock()
+	defer c.rxlock.Unlock()
+	return c.rx.LastReceivedHeader
+}
+
+// SessionPresent returns true if the server indicated in the CONNACK of the current
+// connection that it resumed a session stored for the client's ID, see [VariablesConnack.SessionPresent].
+// If false the server holds no subscriptions of previous connections, so a client
+// connecting with CleanSession unset should subscribe again.
+func (c *Client) SessionPresent() bool {
+	return c.IsConnected() && c.cs.Connack().SessionPresent()
+}
+
+// DialConnect establishes a transport by calling dial and then performs the CONNECT
+// handshake as [Client.Connect] does. The deadline of ctx bounds the whole operation:
+// time spent dialing is taken from the time available to wait for the CONNACK.
+// The transport is closed if the handshake fails.
+func (c *Client) DialConnect(ctx context.Context, dial func(ctx context.Context) (io.ReadWriteCloser, error), vc *VariablesConnect) error {
+	rwc, err := dial(ctx)
+	if err != nil {
+		return err
+	}
+	if err = ctx.Err(); err == nil {
+		err = c.Connect(ctx, rwc, vc)
+	}
+	if err != nil {
+		rwc.Close()
+	}
+	return err
+}
+
+// ReconnectConfig configures [Client.Reconnect].
+type ReconnectConfig struct {
+	// MinWait is the time waited after the first failed attempt. The wait doubles
+	// after every failed attempt up to MaxWait. If zero a default of 1 second is used.
+	MinWait time.Duration
+	// MaxWait is the maximum time waited between attempts. If zero a default of 1 minute is used.
+	MaxWait time.Duration
+	// OnAttempt, if set, is called after every reconnect attempt with the attempt
+	// number starting at 1 and the error of the attempt, which is nil on success.
+	OnAttempt func(attempt int, err error)
+}
+
+// Reconnect re-establishes a lost connection by calling dial and performing the CONNECT
+// handshake with vc as [Client.DialConnect] does, retrying with exponential backoff until it
+// succeeds or until ctx is cancelled. If the server does not resume the session, see
+// [Client.SessionPresent], the subscriptions active before the connection was lost are
+// subscribed to again at their granted QoS. If the session is resumed the subscriptions are
+// kept by the server and restored as active, see [Client.SubscribedTopics].
+// Reconnect does nothing if the client is connected.
+func (c *Client) Reconnect(ctx context.Context, dial func(ctx context.Context) (io.ReadWriteCloser, error), vc *VariablesConnect, cfg ReconnectConfig) error {
+	if c.IsConnected() {
+		return nil
+	}
+	if cfg.MinWait <= 0 {
+		cfg.MinWait = time.Second
+	}
+	if cfg.MaxWait <= 0 {
+		cfg.MaxWait = time.Minute
+	}
+	// Subscriptions are cleared on connecting so they are stored beforehand.
+	var resub VariablesSubscribe
+	c.cs.mu.Lock()
+	subs := append([]activeSub{}, c.cs.activeSubs...)
+	c.cs.mu.Unlock()
+	for _, sub := range subs {
+		resub.TopicFilters = append(resub.TopicFilters, SubscribeRequest{TopicFilter: []byte(sub.topic), QoS: sub.qos})
+	}
+	wait := cfg.MinWait
+	for attempt := 1; ; attempt++ {
+		err := c.DialConnect(ctx, dial, vc)
+		if err == nil && len(subs) > 0 {
+			if c.SessionPresent() {
+				c.cs.RestoreSubs(subs)
+			} else {
+				err = c.Subscribe(ctx, resub)
+				if err != nil && c.IsConnected() {
+					c.Disconnect(err)
+				}
+			}
+		}
+		if cfg.OnAttempt != nil {
+			cfg.OnAttempt(attempt, err)
+		}
+		if err == nil {
+			return nil
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		wait *= 2
+		if wait > cfg.MaxWait {
+			wait = cfg.MaxWait
+		}
+	}
+}
+
 // IsConnected returns true if there still has been no disconnect event or an
 // unrecoverable error encountered during decoding.
 // A Connected client may send and receive MQTT messages.
@@ -137,45 +532,75 @@ func (c *Client) Disconnect(userErr error) error {
 		return errDisconnected
 	}
 	c.cs.OnDisconnect(userErr)
-	err := c.tx.WriteSimple(PacketDisconnect)
-	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+	err := c.tx.WriteDisconnect()
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) {
 		err = nil //if EOF or network closed simply exit.
 	}
 	c.rxlock.Lock()
 	defer c.rxlock.Unlock()
-	c.rx.rxTrp.Close()
-	c.tx.txTrp.Close()
+	c.rx.CloseRx()
+	c.tx.CloseTx()
 	return err
 }
 
-// StartSubscribe begins subscription to argument topics.
+// DisconnectAndClose performs a clean shutdown of the connection: a DISCONNECT packet
+// is written so the server discards the will message and the transport is closed.
+// Future calls to Err return [ErrGracefulDisconnect]. Closing the transport without
+// writing a DISCONNECT causes the server to publish the will message.
+func (c *Client) DisconnectAndClose() error {
+	return c.Disconnect(ErrGracefulDisconnect)
+}
+
+// StartSubscribe begins subscription to argument topics and does not wait for the
+// SUBACK. The PacketIdentifier field of vsub is ignored, a free packet identifier is
+// allocated instead, see [Client.StartSubscribeID]. Only one subscribe may be pending
+// at a time unless MaxConcurrentSubscribes is set in ClientConfig, otherwise
+// [ErrSubscribeInProgress] is returned. Each is completed when the SUBACK with its
+// packet identifier is received.
 func (c *Client) StartSubscribe(vsub VariablesSubscribe) error {
+	_, err := c.StartSubscribeID(vsub)
+	return err
+}
+
+// StartSubscribeID begins subscription to argument topics as [Client.StartSubscribe]
+// does and returns the packet identifier allocated for the SUBSCRIBE.
+func (c *Client) StartSubscribeID(vsub VariablesSubscribe) (uint16, error) {
 	if err := vsub.Validate(); err != nil {
-		return err
+		return 0, err
 	}
 	c.txlock.Lock()
 	defer c.txlock.Unlock()
 	if !c.IsConnected() {
-		return errDisconnected
+		return 0, errDisconnected
 	}
-	if c.AwaitingSuback() {
-		// TODO(soypat): Allow multiple subscriptions to be queued.
-		return errors.New("tried to subscribe while still awaiting suback")
+	pi, err := c.cs.RegisterSubscribe(vsub)
+	if err != nil {
+		return 0, err
+	}
+	vsub.PacketIdentifier = pi
+	err = c.tx.WriteSubscribe(vsub)
+	if err != nil {
+		c.cs.UnregisterSubscribe(pi)
+		return 0, err
 	}
-	c.cs.pendingSubs = vsub.Copy()
-	return c.tx.WriteSubscribe(vsub)
+	return pi, nil
 }
 
 // Subscribe writes a SUBSCRIBE packet over the network and waits for the server
-// to respond with a SUBACK packet or until the context ends.
+// to respond with the matching SUBACK packet or until the context ends. The packet
+// identifier is allocated as described in [Client.StartSubscribe]. If the SUBACK
+// does not correspond to the SUBSCRIBE sent the client disconnects. The server may
+// grant a lower QoS than requested, see [Client.GrantedQoS]. If the context ends
+// first the subscribe is abandoned, releasing its packet identifier, and a SUBACK
+// for it received later is ignored.
 func (c *Client) Subscribe(ctx context.Context, vsub VariablesSubscribe) error {
 	session := c.ConnectedAt()
-	err := c.StartSubscribe(vsub)
+	pi, err := c.StartSubscribeID(vsub)
 	if err != nil {
 		return err
 	}
 	backoff := newBackoff()
-	for c.cs.PendingSublen() != 0 && ctx.Err() == nil {
+	for c.cs.SubscribePending(pi) && ctx.Err() == nil {
 		if c.ConnectedAt() != session {
 			// Prevent waiting on subscribes from previous connection or during disconnection.
 			return errDisconnected
@@ -183,6 +608,47 @@ func (c *Client) Subscribe(ctx context.Context, vsub VariablesSubscribe) error {
 		backoff.Miss()
 		c.HandleNext()
 	}
+	if c.ConnectedAt() != session {
+		// Disconnect, possibly due to a bad SUBACK, discarded the pending subscribe.
+		return errDisconnected
+	}
+	if err = ctx.Err(); err != nil {
+		c.cs.AbandonSubscribe(pi)
+	}
+	return err
+}
+
+// UnsubscribeAll writes an UNSUBSCRIBE packet with all topics the client is
+// subscribed to and waits for the server to respond with an UNSUBACK packet or
+// until the context ends. On UNSUBACK receipt the topics are removed from [Client.SubscribedTopics].
+// If the client has no active subscriptions UnsubscribeAll returns nil without writing a packet.
+func (c *Client) UnsubscribeAll(ctx context.Context) error {
+	session := c.ConnectedAt()
+	c.txlock.Lock()
+	if !c.IsConnected() {
+		c.txlock.Unlock()
+		return errDisconnected
+	}
+	vunsub, err := c.cs.RegisterUnsubscribeAll()
+	if err == nil && len(vunsub.Topics) > 0 {
+		err = c.tx.WriteUnsubscribe(vunsub)
+		if err != nil {
+			c.cs.UnregisterUnsubscribe()
+		}
+	}
+	c.txlock.Unlock()
+	if err != nil || len(vunsub.Topics) == 0 {
+		return err
+	}
+	backoff := newBackoff()
+	for c.cs.AwaitingUnsuback() && ctx.Err() == nil {
+		if c.ConnectedAt() != session {
+			// Prevent waiting on unsubscribes from previous connection or during disconnection.
+			return errDisconnected
+		}
+		backoff.Miss()
+		c.HandleNext()
+	}
 	return ctx.Err()
 }
 
@@ -191,7 +657,25 @@ func (c *Client) Subscribe(ctx context.Context, vsub VariablesSubscribe) error {
 func (c *Client) SubscribedTopics() []string {
 	c.cs.mu.Lock()
 	defer c.cs.mu.Unlock()
-	return append([]string{}, c.cs.activeSubs...)
+	topics := make([]string, len(c.cs.activeSubs))
+	for i, sub := range c.cs.activeSubs {
+		topics[i] = sub.topic
+	}
+	return topics
+}
+
+// GrantedQoS returns the maximum QoS granted by the server in the SUBACK for the
+// subscribed topic filter. The server may grant a lower QoS than requested.
+// ok is false if the client is not subscribed to topicFilter.
+func (c *Client) GrantedQoS(topicFilter string) (qos QoSLevel, ok bool) {
+	c.cs.mu.Lock()
+	defer c.cs.mu.Unlock()
+	for _, sub := range c.cs.activeSubs {
+		if sub.topic == topicFilter {
+			return sub.qos, true
+		}
+	}
+	return 0, false
 }
 
 // PublishPayload sends a PUBLISH packet over the network on the topic defined by
@@ -209,10 +693,232 @@ func (c *Client) PublishPayload(flags PacketFlags, varPub VariablesPublish, payl
 	if !c.IsConnected() {
 		return errDisconnected
 	}
-	return c.tx.WritePublishPayload(newHeader(PacketPublish, flags, uint32(varPub.Size(qos)+len(payload))), varPub, payload)
+	return c.tx.WritePublishPayload(newHeader(PacketPublish, flags, 0), varPub, payload)
+}
+
+// StartPublishQoS1 sends a QoS1 PUBLISH packet over the network and does not wait
+// for the PUBACK response. It returns the packet identifier allocated for the PUBLISH.
+// The packet identifier is freed on PUBACK receipt. If MaxPublishAttempts is set in
+// ClientConfig the PUBLISH is retained for retransmission by [Client.RetransmitStalled].
+func (c *Client) StartPublishQoS1(topic, payload []byte) (uint16, error) {
+	pi, _, err := c.startPublishQoS1(topic, payload, false)
+	return pi, err
+}
+
+func (c *Client) startPublishQoS1(topic, payload []byte, retain bool) (uint16, *pubResult, error) {
+	if len(topic) == 0 {
+		return 0, nil, errEmptyTopic
+	}
+	pi, result, err := c.cs.RegisterPublish(QoS1)
+	if err != nil {
+		return 0, nil, err
+	}
+	if c.maxPublishAttempts > 0 {
+		c.cs.RetainPublish(pi, topic, payload, retain, c.now())
+	}
+	err = c.writePublish(QoS1, VariablesPublish{TopicName: topic, PacketIdentifier: pi}, payload, false, retain)
+	if err != nil {
+		c.cs.ForgetPublish(pi)
+		return 0, nil, err
+	}
+	return pi, result, nil
+}
+
+// PublishQoS1 sends a QoS1 PUBLISH packet over the network and blocks until
+// the PUBACK response is received or until the context ends. If MaxPublishAttempts is
+// set in ClientConfig stalled PUBLISH packets are retransmitted while waiting and
+// [ErrPublishGaveUp] is returned if the PUBLISH is abandoned. An error is returned if
+// the client disconnects before the PUBACK is received.
+func (c *Client) PublishQoS1(ctx context.Context, topic, payload []byte) error {
+	pi, result, err := c.startPublishQoS1(topic, payload, false)
+	if err != nil {
+		return err
+	}
+	defer c.cs.ForgetPublish(pi)
+	return c.awaitPuback(ctx, result)
+}
+
+// awaitPuback handles incoming packets until the QoS1 PUBLISH exchange of result is
+// done or until the context ends. It returns the result's error if the exchange is done.
+func (c *Client) awaitPuback(ctx context.Context, result *pubResult) error {
+	backoff := newBackoff()
+	for ctx.Err() == nil {
+		if done, err := c.cs.PublishResult(result); done {
+			return err
+		}
+		// Abandoned PUBLISH packets are reported through their own result.
+		err := c.RetransmitStalled()
+		if err != nil && err != ErrPublishGaveUp {
+			return err
+		}
+		backoff.Miss()
+		c.HandleNext()
+	}
+	return ctx.Err()
+}
+
+// Publish sends a PUBLISH packet of QoS0 or QoS1 over the network without waiting for
+// the exchange to complete and returns a token to wait on its completion. A QoS0 token
+// is complete once the packet is written. A QoS1 token completes on PUBACK receipt,
+// see [PubToken.Wait]. QoS2 is not supported, use [Client.PublishQoS2] instead.
+func (c *Client) Publish(topic, payload []byte, qos QoSLevel, retain bool) (*PubToken, error) {
+	token := &PubToken{c: c}
+	switch qos {
+	case QoS0:
+		if len(topic) == 0 {
+			return nil, errEmptyTopic
+		}
+		err := c.writePublish(QoS0, VariablesPublish{TopicName: topic}, payload, false, retain)
+		if err != nil {
+			return nil, err
+		}
+	case QoS1:
+		pi, result, err := c.startPublishQoS1(topic, payload, retain)
+		if err != nil {
+			return nil, err
+		}
+		token.packetIdentifier = pi
+		token.result = result
+	default:
+		return nil, errors.New("only QoS0 and QoS1 supported, use PublishQoS2 for QoS2")
+	}
+	return token, nil
+}
+
+// PubToken tracks the completion of a PUBLISH sent with [Client.Publish].
+type PubToken struct {
+	c *Client
+	// result is resolved by the client on PUBACK receipt, abandonment or disconnection.
+	// It is nil for QoS0 PUBLISH packets.
+	result *pubResult
+	// packetIdentifier is zero for QoS0 PUBLISH packets.
+	packetIdentifier uint16
+}
+
+// PacketIdentifier returns the packet identifier allocated for the PUBLISH. It is zero for QoS0.
+func (pt *PubToken) PacketIdentifier() uint16 { return pt.packetIdentifier }
+
+// Done returns true if the PUBLISH exchange is no longer in flight, that is
+// if it is QoS0, its PUBACK was received, it was abandoned or the client disconnected.
+// Done is not affected by the packet identifier being allocated again once freed.
+func (pt *PubToken) Done() bool {
+	if pt.result == nil {
+		return true
+	}
+	done, _ := pt.c.cs.PublishResult(pt.result)
+	return done
+}
+
+// Wait blocks until the PUBACK of a QoS1 PUBLISH is received or until the context ends.
+// Incoming packets are handled while waiting as in [Client.PublishQoS1]. If the context
+// ends the PUBLISH remains in flight and Wait may be called again. [ErrPublishGaveUp] is
+// returned if the PUBLISH was abandoned and an error if the client disconnected before
+// the PUBACK was received. It returns nil immediately for QoS0 PUBLISH packets.
+func (pt *PubToken) Wait(ctx context.Context) error {
+	if pt.result == nil {
+		return nil
+	}
+	return pt.c.awaitPuback(ctx, pt.result)
+}
+
+// RetransmitStalled retransmits with the DUP flag set the QoS1 PUBLISH packets that
+// have been awaiting a PUBACK for longer than RetransmitInterval. PUBLISH packets
+// that were already sent MaxPublishAttempts times are abandoned instead, freeing
+// their packet identifier, and [ErrPublishGaveUp] is returned. It is meant to be
+// called periodically, i.e. on a [time.Ticker]. It does nothing if MaxPublishAttempts
+// is not set in ClientConfig. [Client.PublishQoS1] and [PubToken.Wait] calls waiting on an
+// abandoned PUBLISH return [ErrPublishGaveUp] regardless of which RetransmitStalled call abandoned it.
+func (c *Client) RetransmitStalled() error {
+	if c.maxPublishAttempts <= 0 {
+		return nil
+	}
+	now := c.now()
+	stalled, gaveUp := c.cs.TakeStalled(now.Add(-c.retransmitInterval), now, c.maxPublishAttempts)
+	for _, pub := range stalled {
+		err := c.writePublish(QoS1, VariablesPublish{TopicName: pub.topic, PacketIdentifier: pub.packetIdentifier}, pub.payload, true, pub.retain)
+		if err != nil {
+			return err
+		}
+	}
+	if gaveUp > 0 {
+		return ErrPublishGaveUp
+	}
+	return nil
+}
+
+// PublishQoS2 sends a QoS2 PUBLISH packet over the network and blocks until the
+// four packet exchange (PUBLISH, PUBREC, PUBREL, PUBCOMP) completes or until the context ends.
+// If no response is received within the RetransmitInterval set in ClientConfig
+// the PUBLISH packet is retransmitted with the DUP flag set or the PUBREL packet is retransmitted,
+// depending on the state of the exchange.
+func (c *Client) PublishQoS2(ctx context.Context, topic, payload []byte) error {
+	if len(topic) == 0 {
+		return errEmptyTopic
+	}
+	session := c.ConnectedAt()
+	pi, _, err := c.cs.RegisterPublish(QoS2)
+	if err != nil {
+		return err
+	}
+	defer c.cs.ForgetPublish(pi)
+	varPub := VariablesPublish{TopicName: topic, PacketIdentifier: pi}
+	err = c.writePublish(QoS2, varPub, payload, false, false)
+	if err != nil {
+		return err
+	}
+	lastSent := c.now()
+	backoff := newBackoff()
+	for ctx.Err() == nil {
+		if c.ConnectedAt() != session {
+			// Prevent waiting on publishes from previous connection or during disconnection.
+			return errDisconnected
+		}
+		awaiting := c.cs.PublishAwaiting(pi)
+		if awaiting == 0 {
+			return nil // PUBCOMP received.
+		}
+		if c.now().Sub(lastSent) > c.retransmitInterval {
+			if awaiting == PacketPubrec {
+				err = c.writePublish(QoS2, varPub, payload, true, false)
+			} else {
+				err = c.writeIdentified(PacketPubrel, pi)
+			}
+			if err != nil {
+				return err
+			}
+			lastSent = c.now()
+			backoff.Hit()
+		}
+		backoff.Miss()
+		c.HandleNext()
+	}
+	return ctx.Err()
+}
+
+func (c *Client) writePublish(qos QoSLevel, varPub VariablesPublish, payload []byte, dup, retain bool) error {
+	flags, err := NewPublishFlags(qos, dup, retain)
+	if err != nil {
+		return err
+	}
+	c.txlock.Lock()
+	defer c.txlock.Unlock()
+	if !c.IsConnected() {
+		return errDisconnected
+	}
+	return c.tx.WritePublishPayload(newHeader(PacketPublish, flags, 0), varPub, payload)
+}
+
+func (c *Client) writeIdentified(packetType PacketType, packetIdentifier uint16) error {
+	c.txlock.Lock()
+	defer c.txlock.Unlock()
+	if !c.IsConnected() {
+		return errDisconnected
+	}
+	return c.tx.WriteIdentified(packetType, packetIdentifier)
 }
 
 // Err returns error indicating the cause of client disconnection.
+// Returns nil if the client is connected or has yet to connect.
 func (c *Client) Err() error {
 	return c.cs.Err()
 }
@@ -224,9 +930,10 @@ func (c *Client) StartPing() error {
 	if !c.IsConnected() {
 		return errDisconnected
 	}
-	err := c.tx.WriteSimple(PacketPingreq)
+	sentAt := c.now()
+	err := c.tx.WritePingreq()
 	if err == nil {
-		c.cs.PingSent() // Flag the fact that a ping has been sent successfully.
+		c.cs.PingSent(sentAt) // Flag the fact that a ping has been sent successfully.
 	}
 	return err
 }
@@ -256,6 +963,106 @@ func (c *Client) Ping(ctx context.Context) error {
 	return ctx.Err()
 }
 
+// PingRoundTrip performs a [Client.Ping] and returns the time elapsed between the
+// PINGREQ packet being sent and the PINGRESP packet being received. Packets
+// received while awaiting the PINGRESP are handled as usual.
+func (c *Client) PingRoundTrip(ctx context.Context) (time.Duration, error) {
+	err := c.Ping(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return c.cs.PingRTT(), nil
+}
+
+// KeepAlive returns the keepalive interval sent in the last CONNECT packet. The
+// client should send a packet, i.e. a PINGREQ, at least once every KeepAlive
+// to keep the connection open. Zero means keepalive is disabled.
+func (c *Client) KeepAlive() time.Duration { return c.cs.KeepAlive() }
+
+// KeepAliveLoop writes a PINGREQ packet every half keepalive interval, as returned by
+// [Client.KeepAlive], until ctx ends or the client disconnects. If no packet is received
+// from the server within the keepalive interval the transport is closed and
+// [ErrKeepAliveTimeout] is returned. If keepalive is disabled KeepAliveLoop returns nil immediately.
+// KeepAliveLoop does not read from the transport, HandleNext must be called concurrently
+// for PINGRESP packets to be received. See [Client.KeepAliveLoopConfig] to configure the interval.
+func (c *Client) KeepAliveLoop(ctx context.Context) error {
+	return c.KeepAliveLoopConfig(ctx, KeepAliveConfig{})
+}
+
+// KeepAliveConfig configures [Client.KeepAliveLoopConfig].
+type KeepAliveConfig struct {
+	// Fraction is the interval between PINGREQ packets as a fraction of the keepalive
+	// interval, in the range (0, 1]. If zero a default of 0.5 is used.
+	Fraction float64
+	// Jitter, if set, randomly varies every interval by up to ±10% so that many clients
+	// connecting at once do not ping the server in phase. The jittered interval never
+	// exceeds the keepalive interval.
+	Jitter bool
+}
+
+// keepAliveJitter is the maximum relative variation of the interval between PINGREQ packets.
+const keepAliveJitter = 0.1
+
+// interval returns the time to wait before the next PINGREQ. rng is only used if Jitter is set.
+func (cfg KeepAliveConfig) interval(keepAlive time.Duration, rng *rand.Rand) time.Duration {
+	frac := cfg.Fraction
+	if frac == 0 {
+		frac = 0.5
+	}
+	if cfg.Jitter {
+		frac *= 1 + keepAliveJitter*(2*rng.Float64()-1)
+	}
+	if frac > 1 {
+		frac = 1
+	}
+	return time.Duration(frac * float64(keepAlive))
+}
+
+// KeepAliveLoopConfig works as [Client.KeepAliveLoop] with the interval between
+// PINGREQ packets configured by cfg.
+func (c *Client) KeepAliveLoopConfig(ctx context.Context, cfg KeepAliveConfig) error {
+	if cfg.Fraction < 0 || cfg.Fraction > 1 {
+		return errors.New("keepalive fraction must be in range (0, 1]")
+	}
+	keepAlive := c.KeepAlive()
+	if keepAlive == 0 {
+		return nil
+	}
+	var rng *rand.Rand
+	if cfg.Jitter {
+		// Seeded per loop so that clients started together do not share a sequence.
+		rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	session := c.ConnectedAt()
+	timer := time.NewTimer(cfg.interval(keepAlive, rng))
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			timer.Reset(cfg.interval(keepAlive, rng))
+		}
+		lastRx := c.LastRx()
+		if c.ConnectedAt() != session || lastRx.IsZero() {
+			return errDisconnected
+		}
+		if time.Since(lastRx) > keepAlive {
+			c.txlock.Lock()
+			c.cs.OnDisconnect(ErrKeepAliveTimeout)
+			// Closing also unblocks a concurrent HandleNext on full duplex transports such as net.Conn.
+			c.tx.CloseTx()
+			c.rx.CloseRx()
+			c.txlock.Unlock()
+			return ErrKeepAliveTimeout
+		}
+		err := c.StartPing()
+		if err != nil {
+			return err
+		}
+	}
+}
+
 // AwaitingPingresp checks if a ping sent over the wire had no response received back.
 func (c *Client) AwaitingPingresp() bool { return c.cs.AwaitingPingresp() }
 
@@ -263,6 +1070,12 @@ func (c *Client) AwaitingPingresp() bool { return c.cs.AwaitingPingresp() }
 // client is disconnected ConnectedAt returns the zero-value for time.Time.
 func (c *Client) ConnectedAt() time.Time { return c.cs.ConnectedAt() }
 
+// InboundInflight returns the amount of incoming QoS1 and QoS2 PUBLISH exchanges
+// delivered to OnPub and not yet concluded by the client's PUBACK or PUBCOMP.
+// See ReceiveMaximum in [ClientConfig]. Returns 0 if client is disconnected
+// or ReceiveMaximum is not set, in which case exchanges are not tracked.
+func (c *Client) InboundInflight() int { return c.cs.InboundInflight() }
+
 // AwaitingSuback checks if a subscribe request sent over the wire had no suback received back.
 // Returns false if client is disconnected.
 func (c *Client) AwaitingSuback() bool { return c.cs.AwaitingSuback() }
@@ -276,6 +1089,63 @@ func (c *Client) LastRx() time.Time { return c.cs.LastRx() }
 // If Client is disconnected LastTx returns the zero value of time.Time.
 func (c *Client) LastTx() time.Time { return c.cs.LastTx() }
 
+// Correlator resolves in-flight application requests when a PUBLISH is received
+// on the response topic of the request. It serves request/response patterns over
+// MQTT v3.1.1, which has no native correlation data: the requester registers
+// the response topic with Expect before publishing the request and calls Handle
+// from the OnPub callback passed in the ClientConfig.
+//
+// The zero value is ready for use. Correlator is safe for concurrent use.
+type Correlator struct {
+	mu      sync.Mutex
+	waiters map[string]func(pubHead Header, varPub VariablesPublish, r io.Reader) error
+}
+
+// Expect registers onResponse to be called once on the next PUBLISH received on
+// responseTopic. Only one request may be awaiting a response per topic.
+func (cr *Correlator) Expect(responseTopic []byte, onResponse func(pubHead Header, varPub VariablesPublish, r io.Reader) error) error {
+	if len(responseTopic) == 0 {
+		return errEmptyTopic
+	} else if onResponse == nil {
+		return errors.New("nil response callback")
+	}
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if cr.waiters == nil {
+		cr.waiters = make(map[string]func(Header, VariablesPublish, io.Reader) error)
+	}
+	if _, ok := cr.waiters[string(responseTopic)]; ok {
+		return errors.New("already awaiting response on topic")
+	}
+	cr.waiters[string(responseTopic)] = onResponse
+	return nil
+}
+
+// Cancel stops awaiting a response on responseTopic. It returns true if
+// there was a request awaiting a response.
+func (cr *Correlator) Cancel(responseTopic []byte) bool {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	_, ok := cr.waiters[string(responseTopic)]
+	delete(cr.waiters, string(responseTopic))
+	return ok
+}
+
+// Handle resolves the request awaiting a response on the topic of varPub by
+// calling its callback with the PUBLISH contents. If no request is awaiting
+// a response handled is false and r is not read from.
+func (cr *Correlator) Handle(pubHead Header, varPub VariablesPublish, r io.Reader) (handled bool, err error) {
+	cr.mu.Lock()
+	onResponse, ok := cr.waiters[string(varPub.TopicName)]
+	delete(cr.waiters, string(varPub.TopicName))
+	cr.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	// Callback called outside of lock so it may register a new request.
+	return true, onResponse(pubHead, varPub, r)
+}
+
 func newBackoff() exponentialBackoff {
 	return exponentialBackoff{
 		MaxWait: 500 * time.Millisecond,
@@ -3,6 +3,7 @@ package mqtt
 import (
 	"errors"
 	"io"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -12,14 +13,88 @@ type clientState struct {
 	lastRx      time.Time
 	lastTx      time.Time
 	connectedAt time.Time
-	activeSubs  []string
+	activeSubs  []activeSub
 	// field flag indicates we received a ping request from server and need to reply.
 	pendingPingreq time.Time
 	// field flags we are waiting on a ping response packet from server.
 	pendingPingresp time.Time
+	// keepAlive is the effective keepalive interval in seconds of the connection. Zero means disabled.
+	keepAlive uint16
+	// pingRTT is the round trip time of the last completed ping.
+	pingRTT time.Duration
+	// now returns the time at which a PINGRESP is received to measure pingRTT. If nil time.Now is used.
+	now func() time.Time
 	// closeErr stores the reason for disconnection.
-	closeErr    error
-	pendingSubs VariablesSubscribe
+	closeErr error
+	// connack is the CONNACK received in response to the last CONNECT.
+	connack VariablesConnack
+	// pendingSubs maps packet identifiers of outgoing SUBSCRIBE packets to their contents.
+	pendingSubs map[uint16]VariablesSubscribe
+	// abandonedSubs holds the released packet identifiers of SUBSCRIBE packets whose
+	// SUBACK is no longer waited on. A SUBACK for them is ignored.
+	abandonedSubs map[uint16]struct{}
+	pendingUnsubs VariablesUnsubscribe
+	// ids allocates packet identifiers of outgoing packets.
+	ids PacketIDAllocator
+	// pendingPubs maps packet identifiers of outgoing QoS1 and QoS2 PUBLISH exchanges to the
+	// packet type expected next from the server: PUBACK, PUBREC or PUBCOMP.
+	pendingPubs map[uint16]PacketType
+	// pendingRecs holds packet identifiers of incoming QoS2 PUBLISH packets
+	// acknowledged with a PUBREC and awaiting the server's PUBREL.
+	pendingRecs map[uint16]struct{}
+	// inbound holds packet identifiers of incoming QoS1 and QoS2 PUBLISH packets
+	// delivered and not yet fully acknowledged with a PUBACK or PUBCOMP.
+	// It is only filled when receiveMaximum is set.
+	inbound map[uint16]struct{}
+	// receiveMaximum limits the amount of entries in inbound. Zero means no limit.
+	receiveMaximum uint16
+	// pubResults holds the results of outgoing QoS1 PUBLISH exchanges in flight. Waiters keep
+	// the result so that it outlives the packet identifier, which may be allocated again once freed.
+	pubResults map[uint16]*pubResult
+	// retained holds copies of outgoing QoS1 PUBLISH packets awaiting PUBACK for retransmission.
+	retained map[uint16]*retainedPublish
+	// maxPendingSubs limits the amount of topic filters awaiting SUBACK. Zero means no limit.
+	maxPendingSubs int
+	// maxConcurrentSubs limits the amount of SUBSCRIBE packets awaiting SUBACK.
+	// Zero means one at a time and a negative value means no limit.
+	maxConcurrentSubs int
+	// maxInflight limits the amount of packet identifiers in use by outgoing exchanges. Zero means no limit.
+	maxInflight int
+	// onInflightAvailable, if set, is called once for every in-flight slot freed by an acknowledgement.
+	onInflightAvailable func()
+	// pendingAcks holds packets queued during packet receipt to be written once Rx is unlocked.
+	pendingAcks []identifiedPacket
+}
+
+// activeSub is a topic filter subscribed to and the maximum QoS granted by the server.
+type activeSub struct {
+	topic string
+	qos   QoSLevel
+}
+
+// retainedPublish is an outgoing QoS1 PUBLISH packet kept for retransmission.
+type retainedPublish struct {
+	packetIdentifier uint16
+	topic            []byte
+	payload          []byte
+	retain           bool
+	sentAt           time.Time
+	// attempts is the amount of times the PUBLISH has been sent.
+	attempts int
+}
+
+// pubResult is the result of an outgoing QoS1 PUBLISH exchange. Guarded by clientState's mutex.
+type pubResult struct {
+	done bool
+	// err is nil if the PUBACK was received, [ErrPublishGaveUp] if the PUBLISH was
+	// abandoned after MaxPublishAttempts and errDisconnected if the connection ended first.
+	err error
+}
+
+// identifiedPacket is a PUBACK, PUBREC, PUBREL, PUBCOMP or UNSUBACK packet.
+type identifiedPacket struct {
+	packetType       PacketType
+	packetIdentifier uint16
 }
 
 // onConnect is meant to be called on opening a new connection to delete
@@ -27,12 +102,21 @@ type clientState struct {
 func (cs *clientState) onConnect(t time.Time) {
 	cs.closeErr = nil
 	if cs.activeSubs == nil {
-		cs.activeSubs = make([]string, 2)
+		cs.activeSubs = make([]activeSub, 2)
 	}
 	cs.activeSubs = cs.activeSubs[:0]
 	cs.lastRx = t
 	cs.connectedAt = t
-	cs.pendingSubs = VariablesSubscribe{}
+	cs.ids.Reset()
+	cs.pendingSubs = make(map[uint16]VariablesSubscribe)
+	cs.abandonedSubs = make(map[uint16]struct{})
+	cs.pendingUnsubs = VariablesUnsubscribe{}
+	cs.pendingPubs = make(map[uint16]PacketType)
+	cs.pendingRecs = make(map[uint16]struct{})
+	cs.inbound = make(map[uint16]struct{})
+	cs.pubResults = make(map[uint16]*pubResult)
+	cs.retained = make(map[uint16]*retainedPublish)
+	cs.pendingAcks = cs.pendingAcks[:0]
 }
 
 // onConnect is meant to be called on opening a new connection to delete
@@ -54,81 +138,261 @@ func (cs *clientState) onDisconnect(err error) {
 	cs.lastTx = time.Time{}
 	cs.pendingPingreq = time.Time{}
 	cs.pendingPingresp = time.Time{}
-	cs.pendingSubs = VariablesSubscribe{}
+	cs.ids.Reset()
+	cs.pendingSubs = nil
+	cs.abandonedSubs = nil
+	cs.pendingUnsubs = VariablesUnsubscribe{}
+	cs.pendingPubs = nil
+	cs.pendingRecs = nil
+	cs.inbound = nil
+	for _, result := range cs.pubResults {
+		cs.resolvePublish(result, errDisconnected)
+	}
+	cs.pubResults = nil
+	cs.retained = nil
+	cs.pendingAcks = cs.pendingAcks[:0]
+}
+
+// Reset clears all connection state, returning cs to the never-connected baseline
+// so that it may be reused for a new connection.
+func (cs *clientState) Reset() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.onDisconnect(errYetToConnect)
+	cs.activeSubs = cs.activeSubs[:0]
+	cs.pingRTT = 0
+	cs.keepAlive = 0
+	cs.connack = VariablesConnack{}
+}
+
+// Connack returns the CONNACK received in response to the last CONNECT.
+func (cs *clientState) Connack() VariablesConnack {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.connack
 }
 
 // callbacks returns the Rx and Tx callbacks necessary for a clientState to function automatically.
 // The onPub callback
 func (cs *clientState) callbacks(onPub func(rx *Rx, varPub VariablesPublish, r io.Reader) error) (RxCallbacks, TxCallbacks) {
-	return RxCallbacks{
-			OnConnack: func(r *Rx, vc VariablesConnack) error {
-				connTime := time.Now()
-				cs.mu.Lock()
-				defer cs.mu.Unlock()
-				cs.lastRx = connTime
-				if cs.closeErr == nil {
-					return errors.New("connack received while connected")
+	rxcb := RxCallbacks{
+		OnConnack: func(r *Rx, vc VariablesConnack) error {
+			connTime := time.Now()
+			cs.mu.Lock()
+			defer cs.mu.Unlock()
+			cs.lastRx = connTime
+			// Rx does not call OnRxError on callback errors so state is updated here.
+			if err := cs.checkPhase(PacketConnack); err != nil {
+				return err
+			}
+			cs.connack = vc
+			if !vc.Accepted() {
+				cs.onDisconnect(vc.ReturnCode)
+				return vc.ReturnCode
+			}
+			cs.onConnect(connTime)
+			return nil
+		},
+		OnPub: func(rx *Rx, varPub VariablesPublish, r io.Reader) (err error) {
+			qos := rx.LastReceivedHeader.Flags().QoS()
+			qos2 := qos == QoS2
+			cs.mu.Lock()
+			if err = cs.checkPhase(PacketPublish); err != nil {
+				cs.mu.Unlock()
+				return err
+			}
+			_, redelivery := cs.pendingRecs[varPub.PacketIdentifier]
+			_, inflight := cs.inbound[varPub.PacketIdentifier]
+			if qos != QoS0 && !inflight && cs.receiveMaximum != 0 && len(cs.inbound) >= int(cs.receiveMaximum) {
+				err = ErrReceiveMaximum
+				cs.onDisconnect(err)
+				cs.mu.Unlock()
+				return err
+			}
+			cs.mu.Unlock()
+			if onPub != nil && !(qos2 && redelivery) {
+				err = onPub(rx, varPub, r)
+			} else {
+				// QoS2 PUBLISH awaiting PUBREL was already delivered, only PUBREC is resent.
+				err = rx.exhaustReader(r)
+			}
+			rxTime := time.Now()
+			cs.mu.Lock()
+			defer cs.mu.Unlock()
+			cs.lastRx = rxTime
+			if err != nil || qos == QoS0 || cs.inbound == nil {
+				return err
+			}
+			if cs.receiveMaximum != 0 {
+				// Incoming exchanges are only tracked when limited.
+				cs.inbound[varPub.PacketIdentifier] = struct{}{}
+			}
+			if qos2 {
+				cs.pendingRecs[varPub.PacketIdentifier] = struct{}{}
+				cs.pendingAcks = append(cs.pendingAcks, identifiedPacket{packetType: PacketPubrec, packetIdentifier: varPub.PacketIdentifier})
+			} else {
+				cs.pendingAcks = append(cs.pendingAcks, identifiedPacket{packetType: PacketPuback, packetIdentifier: varPub.PacketIdentifier})
+			}
+			return nil
+		},
+		OnSuback: func(r *Rx, vs VariablesSuback) (err error) {
+			rxTime := time.Now()
+			defer func() {
+				// Notify after unlocking so callback may query client state.
+				if err == nil {
+					cs.inflightAvailable(1)
 				}
-				if vc.ReturnCode != 0 {
-					return vc.ReturnCode
+			}()
+			cs.mu.Lock()
+			defer cs.mu.Unlock()
+			cs.lastRx = rxTime
+			if err = cs.checkPhase(PacketSuback); err != nil {
+				return err
+			}
+			defer func() {
+				if err != nil {
+					cs.onDisconnect(err)
 				}
-				cs.onConnect(connTime)
+			}()
+			pending, ok := cs.pendingSubs[vs.PacketIdentifier]
+			if _, abandoned := cs.abandonedSubs[vs.PacketIdentifier]; !ok && abandoned {
+				delete(cs.abandonedSubs, vs.PacketIdentifier)
 				return nil
-			},
-			OnPub: onPub,
-			OnSuback: func(r *Rx, vs VariablesSuback) error {
-				rxTime := time.Now()
-				cs.mu.Lock()
-				defer cs.mu.Unlock()
-				cs.lastRx = rxTime
-				if len(vs.ReturnCodes) != len(cs.pendingSubs.TopicFilters) {
-					return errors.New("got mismatched number of return codes compared to pending client subscriptions")
+			}
+			if !ok {
+				return errors.New("SUBACK with unknown packet identifier " + strconv.Itoa(int(vs.PacketIdentifier)))
+			}
+			if len(vs.ReturnCodes) != len(pending.TopicFilters) {
+				return errors.New("got mismatched number of return codes compared to pending client subscriptions")
+			}
+			for i, qos := range vs.ReturnCodes {
+				// The server may grant a lower QoS than requested [MQTT-3.9.3-2].
+				if qos != QoSSubfail && qos > pending.TopicFilters[i].QoS {
+					return ErrSubackQoS{Topic: string(pending.TopicFilters[i].TopicFilter), Requested: pending.TopicFilters[i].QoS, Granted: qos}
 				}
-				for i, qos := range vs.ReturnCodes {
-					if qos != QoSSubfail {
-						if qos != cs.pendingSubs.TopicFilters[i].QoS {
-							return errors.New("QoS does not match requested QoS for topic")
-						}
-						cs.activeSubs = append(cs.activeSubs, string(cs.pendingSubs.TopicFilters[i].TopicFilter))
-					}
+			}
+			for i, qos := range vs.ReturnCodes {
+				if qos != QoSSubfail {
+					cs.activeSubs = append(cs.activeSubs, activeSub{topic: string(pending.TopicFilters[i].TopicFilter), qos: qos})
 				}
-				cs.pendingSubs.TopicFilters = cs.pendingSubs.TopicFilters[:0]
-				return nil
-			},
-			OnOther: func(rx *Rx, packetIdentifier uint16) (err error) {
-				tp := rx.LastReceivedHeader.Type()
-				rxTime := time.Now()
-				cs.mu.Lock()
-				defer cs.mu.Unlock()
-				cs.lastRx = rxTime
-				switch tp {
-				case PacketDisconnect:
-					err = errDisconnected
-				case PacketPingreq:
-					cs.pendingPingreq = rxTime
-				case PacketPingresp:
-					cs.pendingPingresp = time.Time{} // got the response, we can unflag.
-				default:
-					println("unexpected packet type: ", tp.String())
-				}
-				if err != nil {
-					cs.onDisconnect(err)
+			}
+			delete(cs.pendingSubs, vs.PacketIdentifier)
+			cs.ids.Free(vs.PacketIdentifier)
+			return nil
+		},
+		OnOther: func(rx *Rx, packetIdentifier uint16) (err error) {
+			tp := rx.LastReceivedHeader.Type()
+			rxTime := time.Now()
+			var warning string
+			var freed int
+			defer func() {
+				// Warn after unlocking so OnWarning may query client state.
+				if warning != "" {
+					rx.warn(warning)
 				}
+				cs.inflightAvailable(freed)
+			}()
+			cs.mu.Lock()
+			defer cs.mu.Unlock()
+			cs.lastRx = rxTime
+			if err = cs.checkPhase(tp); err != nil {
 				return err
-			},
-			OnRxError: func(r *Rx, err error) {
-				cs.onDisconnect(err)
-			},
-		}, TxCallbacks{
-			OnTxError: func(tx *Tx, err error) {
+			}
+			switch tp {
+			case PacketDisconnect:
+				err = errDisconnected
+			case PacketPingreq:
+				cs.pendingPingreq = rxTime
+			case PacketPingresp:
+				if !cs.pendingPingresp.IsZero() {
+					cs.pingRTT = cs.pingrespTime(rxTime).Sub(cs.pendingPingresp)
+				} else {
+					// Unsolicited PINGRESP. Not a protocol violation so connection is kept.
+					warning = "PINGRESP with no outstanding PINGREQ"
+				}
+				cs.pendingPingresp = time.Time{} // got the response, we can unflag.
+			case PacketPubrec:
+				if _, ok := cs.pendingPubs[packetIdentifier]; ok {
+					// PUBREC may be received again if our PUBREL was lost.
+					cs.pendingPubs[packetIdentifier] = PacketPubcomp
+					cs.pendingAcks = append(cs.pendingAcks, identifiedPacket{packetType: PacketPubrel, packetIdentifier: packetIdentifier})
+				}
+			case PacketPuback:
+				if cs.pendingPubs[packetIdentifier] == PacketPuback {
+					delete(cs.pendingPubs, packetIdentifier)
+					delete(cs.retained, packetIdentifier)
+					cs.resolvePublish(cs.pubResults[packetIdentifier], nil)
+					delete(cs.pubResults, packetIdentifier)
+					cs.ids.Free(packetIdentifier)
+					freed++
+				} else {
+					// Duplicate or spurious PUBACK. Not a protocol violation so connection is kept.
+					warning = "PUBACK with unknown packet identifier " + strconv.Itoa(int(packetIdentifier))
+				}
+			case PacketUnsuback:
+				if len(cs.pendingUnsubs.Topics) > 0 && packetIdentifier == cs.pendingUnsubs.PacketIdentifier {
+					cs.onUnsuback()
+					freed++
+				}
+			case PacketPubrel:
+				if _, ok := cs.pendingRecs[packetIdentifier]; !ok {
+					err = ErrUnexpectedPubrel
+					break
+				}
+				delete(cs.pendingRecs, packetIdentifier)
+				cs.pendingAcks = append(cs.pendingAcks, identifiedPacket{packetType: PacketPubcomp, packetIdentifier: packetIdentifier})
+			case PacketPubcomp:
+				if cs.pendingPubs[packetIdentifier] == PacketPubcomp {
+					delete(cs.pendingPubs, packetIdentifier)
+					cs.ids.Free(packetIdentifier)
+					freed++
+				}
+			default:
+				println("unexpected packet type: ", tp.String())
+			}
+			if err != nil {
 				cs.onDisconnect(err)
-			},
-			OnSuccessfulTx: func(tx *Tx) {
-				cs.mu.Lock()
-				defer cs.mu.Unlock()
-				cs.lastTx = time.Now()
-			},
-		}
+			}
+			return err
+		},
+		OnRxError: func(r *Rx, err error) {
+			cs.onDisconnect(err)
+		},
+	}
+	// Acknowledgements are handled alongside PINGREQ, PINGRESP and DISCONNECT.
+	rxcb.OnPuback = rxcb.OnOther
+	rxcb.OnPubrec = rxcb.OnOther
+	rxcb.OnPubrel = rxcb.OnOther
+	rxcb.OnPubcomp = rxcb.OnOther
+	rxcb.OnUnsuback = rxcb.OnOther
+	return rxcb, TxCallbacks{
+		OnTxError: func(tx *Tx, err error) {
+			cs.onDisconnect(err)
+		},
+		OnSuccessfulTx: func(tx *Tx) {
+			cs.mu.Lock()
+			defer cs.mu.Unlock()
+			cs.lastTx = time.Now()
+		},
+	}
+}
+
+// checkPhase disconnects and returns an [ErrUnexpectedPacket] if a packet of type tp is
+// not expected in the current phase of the connection: a packet other than CONNACK while
+// awaiting the CONNACK or a CONNACK while connected. Packets received after the connection
+// ended are discarded with errDisconnected, keeping the reason of disconnection. Called with cs locked.
+func (cs *clientState) checkPhase(tp PacketType) error {
+	connected := cs.closeErr == nil
+	awaitingConnack := cs.closeErr == errYetToConnect
+	if !connected && !awaitingConnack {
+		return errDisconnected
+	}
+	if connected != (tp == PacketConnack) {
+		return nil
+	}
+	err := ErrUnexpectedPacket{Type: tp, Connected: connected}
+	cs.onDisconnect(err)
+	return err
 }
 
 // IsConnected returns true if the client is currently connected.
@@ -142,13 +406,16 @@ func (cs *clientState) IsConnected() bool {
 }
 
 // Err returns the error that caused the MQTT connection to finish.
-// Returns nil if currently connected.
+// Returns nil if currently connected or if never connected.
 func (cs *clientState) Err() error {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
 	if cs.connectedAt.IsZero() != (cs.closeErr != nil) {
 		panic("assertion failed: bug in natiu-mqtt clientState implementation")
 	}
+	if cs.closeErr == errYetToConnect {
+		return nil
+	}
 	return cs.closeErr
 }
 
@@ -156,7 +423,7 @@ func (cs *clientState) Err() error {
 func (cs *clientState) PendingResponse() bool {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
-	return cs.closeErr == nil && (len(cs.pendingSubs.TopicFilters) > 0 || !cs.pendingPingreq.IsZero())
+	return cs.closeErr == nil && (cs.awaitingSuback() || !cs.pendingPingreq.IsZero())
 }
 
 func (cs *clientState) AwaitingPingresp() bool {
@@ -171,20 +438,76 @@ func (cs *clientState) AwaitingSuback() bool {
 	return cs.awaitingSuback()
 }
 func (cs *clientState) awaitingSuback() bool {
-	return len(cs.pendingSubs.TopicFilters) > 0
+	return len(cs.pendingSubs) > 0
+}
+
+// pendingSublen returns the amount of topic filters awaiting SUBACK.
+func (cs *clientState) pendingSublen() (n int) {
+	for _, vsub := range cs.pendingSubs {
+		n += len(vsub.TopicFilters)
+	}
+	return n
 }
 
-func (cs *clientState) RegisterSubscribe(vsub VariablesSubscribe) error {
+// RegisterSubscribe allocates a packet identifier for an outgoing SUBSCRIBE and
+// stores a copy of vsub with the allocated packet identifier until its SUBACK is received.
+func (cs *clientState) RegisterSubscribe(vsub VariablesSubscribe) (uint16, error) {
 	if len(vsub.TopicFilters) == 0 {
-		return errors.New("need at least one topic to subscribe")
+		return 0, errors.New("need at least one topic to subscribe")
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.closeErr != nil {
+		return 0, errDisconnected
+	}
+	if cs.maxPendingSubs > 0 && cs.pendingSublen()+len(vsub.TopicFilters) > cs.maxPendingSubs {
+		return 0, ErrTooManyPendingSubs
+	}
+	maxSubs := cs.maxConcurrentSubs
+	if maxSubs == 0 {
+		maxSubs = 1
 	}
+	if maxSubs > 0 && len(cs.pendingSubs) >= maxSubs {
+		return 0, ErrSubscribeInProgress
+	}
+	pi, err := cs.nextPI()
+	if err != nil {
+		return 0, err
+	}
+	vsub.PacketIdentifier = pi
+	cs.pendingSubs[pi] = vsub.Copy()
+	return pi, nil
+}
+
+// UnregisterSubscribe discards the pending subscription, i.e. if the SUBSCRIBE failed to be sent.
+func (cs *clientState) UnregisterSubscribe(packetIdentifier uint16) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if _, ok := cs.pendingSubs[packetIdentifier]; ok {
+		delete(cs.pendingSubs, packetIdentifier)
+		cs.ids.Free(packetIdentifier)
+	}
+}
+
+// AbandonSubscribe stops waiting on the SUBACK of the pending SUBSCRIBE with the argument
+// packet identifier and releases the packet identifier. A SUBACK for it received before the
+// packet identifier is allocated again is ignored.
+func (cs *clientState) AbandonSubscribe(packetIdentifier uint16) {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
-	if cs.awaitingSuback() {
-		return errors.New("tried to register subscribe while awaiting suback")
+	if _, ok := cs.pendingSubs[packetIdentifier]; ok {
+		delete(cs.pendingSubs, packetIdentifier)
+		cs.ids.Free(packetIdentifier)
+		cs.abandonedSubs[packetIdentifier] = struct{}{}
 	}
-	cs.pendingSubs = vsub.Copy()
-	return nil
+}
+
+// SubscribePending returns true if the SUBSCRIBE with the argument packet identifier awaits its SUBACK.
+func (cs *clientState) SubscribePending(packetIdentifier uint16) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	_, ok := cs.pendingSubs[packetIdentifier]
+	return ok
 }
 func (cs *clientState) LastPingTime() time.Time {
 	cs.mu.Lock()
@@ -192,10 +515,63 @@ func (cs *clientState) LastPingTime() time.Time {
 	return cs.pendingPingresp
 }
 
+// NegotiateKeepAlive clamps the requested keepalive to serverMax as per [ClampKeepAlive]
+// and stores the effective value for timeout enforcement, which is also returned.
+func (cs *clientState) NegotiateKeepAlive(requested, serverMax uint16) uint16 {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.keepAlive = ClampKeepAlive(requested, serverMax)
+	return cs.keepAlive
+}
+
+// SetKeepAlive stores the keepalive in seconds of the connection. Zero means disabled.
+func (cs *clientState) SetKeepAlive(keepAlive uint16) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.keepAlive = keepAlive
+}
+
+// ApplyKeepAlivePolicy applies policy to the keepalive requested by vc as per [KeepAlivePolicy.Apply].
+// If the CONNECT is accepted the effective keepalive is stored for timeout enforcement and vc's
+// KeepAlive field is set to it. The returned code should be sent in the CONNACK.
+func (cs *clientState) ApplyKeepAlivePolicy(vc *VariablesConnect, policy KeepAlivePolicy) ConnectReturnCode {
+	effective, rc := policy.Apply(vc.KeepAlive)
+	if rc != ReturnCodeConnAccepted {
+		return rc
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.keepAlive = effective
+	vc.KeepAlive = effective
+	return rc
+}
+
+// KeepAlive returns the effective keepalive interval of the connection. Zero means disabled.
+func (cs *clientState) KeepAlive() time.Duration {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return time.Duration(cs.keepAlive) * time.Second
+}
+
+// pingrespTime returns the time of receipt of a PINGRESP read at rxTime by the clock
+// used to time the PINGREQ sent.
+func (cs *clientState) pingrespTime(rxTime time.Time) time.Time {
+	if cs.now == nil {
+		return rxTime
+	}
+	return cs.now()
+}
+
+func (cs *clientState) PingRTT() time.Duration {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.pingRTT
+}
+
 func (cs *clientState) PendingSublen() int {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
-	return len(cs.pendingSubs.TopicFilters)
+	return cs.pendingSublen()
 }
 
 func (cs *clientState) ConnectedAt() time.Time {
@@ -210,10 +586,267 @@ func (cs *clientState) LastTx() time.Time {
 	return cs.lastTx
 }
 
-func (cs *clientState) PingSent() {
+func (cs *clientState) PingSent(sentAt time.Time) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.pendingPingresp = sentAt
+}
+
+// RestoreSubs marks subs as active, i.e. when the server resumes the session in which
+// they were subscribed to. Topic filters already active are not duplicated.
+func (cs *clientState) RestoreSubs(subs []activeSub) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for _, sub := range subs {
+		active := false
+		for _, activeSub := range cs.activeSubs {
+			if activeSub.topic == sub.topic {
+				active = true
+				break
+			}
+		}
+		if !active {
+			cs.activeSubs = append(cs.activeSubs, sub)
+		}
+	}
+}
+
+// onUnsuback removes the pending unsubscribe topics from the active subscriptions.
+func (cs *clientState) onUnsuback() {
+	active := cs.activeSubs[:0]
+	for _, sub := range cs.activeSubs {
+		unsubscribed := false
+		for _, coldTopic := range cs.pendingUnsubs.Topics {
+			if sub.topic == string(coldTopic) {
+				unsubscribed = true
+				break
+			}
+		}
+		if !unsubscribed {
+			active = append(active, sub)
+		}
+	}
+	cs.activeSubs = active
+	cs.ids.Free(cs.pendingUnsubs.PacketIdentifier)
+	cs.pendingUnsubs = VariablesUnsubscribe{}
+}
+
+// RegisterUnsubscribeAll registers an unsubscribe from all active subscriptions
+// and returns it. The returned UNSUBSCRIBE has no topics if there are no active subscriptions.
+func (cs *clientState) RegisterUnsubscribeAll() (VariablesUnsubscribe, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.awaitingSuback() || len(cs.pendingUnsubs.Topics) > 0 {
+		return VariablesUnsubscribe{}, ErrUnsubscribeInProgress
+	}
+	if len(cs.activeSubs) == 0 {
+		return VariablesUnsubscribe{}, nil
+	}
+	pi, err := cs.nextPI()
+	if err != nil {
+		return VariablesUnsubscribe{}, err
+	}
+	vunsub := VariablesUnsubscribe{PacketIdentifier: pi}
+	for _, sub := range cs.activeSubs {
+		vunsub.Topics = append(vunsub.Topics, []byte(sub.topic))
+	}
+	cs.pendingUnsubs = vunsub
+	return vunsub, nil
+}
+
+// UnregisterUnsubscribe discards the pending unsubscribe, i.e. if the UNSUBSCRIBE failed to be sent.
+func (cs *clientState) UnregisterUnsubscribe() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if len(cs.pendingUnsubs.Topics) > 0 {
+		cs.ids.Free(cs.pendingUnsubs.PacketIdentifier)
+	}
+	cs.pendingUnsubs = VariablesUnsubscribe{}
+}
+
+func (cs *clientState) AwaitingUnsuback() bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return len(cs.pendingUnsubs.Topics) > 0
+}
+
+// inflightAvailable calls onInflightAvailable once for each of the freed in-flight slots.
+// It must be called with cs.mu unlocked.
+func (cs *clientState) inflightAvailable(freed int) {
+	for i := 0; i < freed && cs.onInflightAvailable != nil; i++ {
+		cs.onInflightAvailable()
+	}
+}
+
+// inflightFull returns true if no more packet identifiers may be allocated, either
+// because all are in use or because the maxInflight limit has been reached.
+func (cs *clientState) inflightFull() bool {
+	n := len(cs.pendingPubs) + len(cs.pendingSubs)
+	if len(cs.pendingUnsubs.Topics) > 0 {
+		n++
+	}
+	return n >= 0xffff || (cs.maxInflight > 0 && n >= cs.maxInflight)
+}
+
+// nextPI returns a non-zero packet identifier not in use by a pending exchange.
+// It returns [ErrNoPacketIDs] if no more packet identifiers may be allocated.
+func (cs *clientState) nextPI() (uint16, error) {
+	if cs.inflightFull() {
+		return 0, ErrNoPacketIDs
+	}
+	pi, err := cs.ids.Next()
+	if err == nil {
+		// SUBACK of an abandoned SUBSCRIBE is now indistinguishable from that of the new exchange.
+		delete(cs.abandonedSubs, pi)
+	}
+	return pi, err
+}
+
+// RegisterPublish allocates a packet identifier for an outgoing QoS1 or QoS2 PUBLISH
+// and starts tracking the exchange. The result of QoS1 exchanges is returned, it is nil for QoS2.
+func (cs *clientState) RegisterPublish(qos QoSLevel) (uint16, *pubResult, error) {
+	var awaiting PacketType
+	switch qos {
+	case QoS1:
+		awaiting = PacketPuback
+	case QoS2:
+		awaiting = PacketPubrec
+	default:
+		return 0, nil, errors.New("only QoS1 and QoS2 PUBLISH exchanges are tracked")
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.closeErr != nil {
+		return 0, nil, errDisconnected
+	}
+	pi, err := cs.nextPI()
+	if err != nil {
+		return 0, nil, err
+	}
+	cs.pendingPubs[pi] = awaiting
+	var result *pubResult
+	if qos == QoS1 {
+		result = &pubResult{}
+		cs.pubResults[pi] = result
+	}
+	return pi, result, nil
+}
+
+// PublishResult returns true and the result of the QoS1 PUBLISH exchange once it is done.
+func (cs *clientState) PublishResult(result *pubResult) (done bool, err error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return result.done, result.err
+}
+
+// resolvePublish marks the exchange of result as done with err. Called with cs locked.
+func (cs *clientState) resolvePublish(result *pubResult, err error) {
+	if result != nil && !result.done {
+		result.done = true
+		result.err = err
+	}
+}
+
+// PublishAwaiting returns the packet type expected next from the server for the
+// PUBLISH exchange with the argument packet identifier or 0 if the exchange is complete.
+func (cs *clientState) PublishAwaiting(packetIdentifier uint16) PacketType {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
-	cs.pendingPingresp = time.Now()
+	return cs.pendingPubs[packetIdentifier]
+}
+
+// ForgetPublish stops tracking the PUBLISH exchange with the argument packet identifier.
+func (cs *clientState) ForgetPublish(packetIdentifier uint16) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if _, ok := cs.pendingPubs[packetIdentifier]; ok {
+		delete(cs.pendingPubs, packetIdentifier)
+		cs.ids.Free(packetIdentifier)
+	}
+	delete(cs.retained, packetIdentifier)
+	delete(cs.pubResults, packetIdentifier)
+}
+
+// RetainPublish stores a copy of the outgoing QoS1 PUBLISH with the argument packet
+// identifier for retransmission until its PUBACK is received.
+func (cs *clientState) RetainPublish(packetIdentifier uint16, topic, payload []byte, retain bool, sentAt time.Time) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.pendingPubs[packetIdentifier] != PacketPuback {
+		return // Exchange already completed or abandoned.
+	}
+	cs.retained[packetIdentifier] = &retainedPublish{
+		packetIdentifier: packetIdentifier,
+		topic:            append([]byte{}, topic...),
+		payload:          append([]byte{}, payload...),
+		retain:           retain,
+		sentAt:           sentAt,
+		attempts:         1,
+	}
+}
+
+// TakeStalled returns the retained PUBLISH packets last sent before deadline and
+// sets their send time to now. PUBLISH packets already sent maxAttempts times are
+// abandoned instead, freeing their packet identifier, and counted in gaveUp.
+func (cs *clientState) TakeStalled(deadline, now time.Time, maxAttempts int) (stalled []retainedPublish, gaveUp int) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for pi, pub := range cs.retained {
+		if !pub.sentAt.Before(deadline) {
+			continue
+		}
+		if pub.attempts >= maxAttempts {
+			delete(cs.retained, pi)
+			delete(cs.pendingPubs, pi)
+			cs.resolvePublish(cs.pubResults[pi], ErrPublishGaveUp)
+			delete(cs.pubResults, pi)
+			cs.ids.Free(pi)
+			gaveUp++
+			continue
+		}
+		pub.attempts++
+		pub.sentAt = now
+		stalled = append(stalled, *pub)
+	}
+	return stalled, gaveUp
+}
+
+// AckWritten is called once ack, taken with TakeAcks, is written. A PUBACK or
+// PUBCOMP concludes an incoming exchange, freeing a slot of the receive maximum.
+func (cs *clientState) AckWritten(ack identifiedPacket) {
+	if ack.packetType != PacketPuback && ack.packetType != PacketPubcomp {
+		return
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	delete(cs.inbound, ack.packetIdentifier)
+}
+
+// InboundInflight returns the amount of incoming QoS1 and QoS2 PUBLISH exchanges
+// not yet concluded by a PUBACK or PUBCOMP.
+func (cs *clientState) InboundInflight() int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return len(cs.inbound)
+}
+
+// inboundFull returns true if the amount of incoming exchanges in flight reached the receive maximum.
+func (cs *clientState) inboundFull() bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.receiveMaximum != 0 && len(cs.inbound) >= int(cs.receiveMaximum)
+}
+
+// TakeAcks returns the queued packets and clears the queue.
+func (cs *clientState) TakeAcks() []identifiedPacket {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if len(cs.pendingAcks) == 0 {
+		return nil
+	}
+	acks := append([]identifiedPacket{}, cs.pendingAcks...)
+	cs.pendingAcks = cs.pendingAcks[:0]
+	return acks
 }
 
 func (cs *clientState) LastRx() time.Time {
@@ -221,3 +854,62 @@ func (cs *clientState) LastRx() time.Time {
 	defer cs.mu.Unlock()
 	return cs.lastRx
 }
+
+// PacketIDAllocator allocates packet identifiers for outgoing PUBLISH, SUBSCRIBE and
+// UNSUBSCRIBE packets. Identifiers are never zero and are unique among those allocated
+// and not yet freed. They are handed out in increasing order, wrapping around after 65535.
+// The zero value is ready for use. PacketIDAllocator is safe for concurrent use.
+type PacketIDAllocator struct {
+	mu sync.Mutex
+	// inUse is a bitmap of allocated packet identifiers.
+	inUse [(1 << 16) / 64]uint64
+	n     int
+	last  uint16
+}
+
+// Next allocates and returns a packet identifier not in use. It returns
+// [ErrNoPacketIDs] if all 65535 packet identifiers are in use.
+func (a *PacketIDAllocator) Next() (uint16, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.n >= 0xffff {
+		return 0, ErrNoPacketIDs
+	}
+	for {
+		a.last++
+		if a.last != 0 && a.inUse[a.last/64]&(1<<(a.last%64)) == 0 {
+			break
+		}
+	}
+	a.inUse[a.last/64] |= 1 << (a.last % 64)
+	a.n++
+	return a.last, nil
+}
+
+// Free releases the packet identifier id so that it may be allocated again.
+// Freeing a packet identifier not in use has no effect.
+func (a *PacketIDAllocator) Free(id uint16) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	bit := uint64(1) << (id % 64)
+	if a.inUse[id/64]&bit != 0 {
+		a.inUse[id/64] &^= bit
+		a.n--
+	}
+}
+
+// InUse returns the amount of packet identifiers allocated and not yet freed.
+func (a *PacketIDAllocator) InUse() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.n
+}
+
+// Reset frees all packet identifiers and restarts allocation from 1.
+func (a *PacketIDAllocator) Reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.inUse = [len(a.inUse)]uint64{}
+	a.n = 0
+	a.last = 0
+}
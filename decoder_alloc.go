@@ -0,0 +1,58 @@
+package mqtt
+
+import "io"
+
+// DecoderAlloc implements the [Decoder] interface by allocating a new byte slice for
+// every string decoded, such as topic names, client IDs and will messages. Unlike with
+// [DecoderNoAlloc] decoded values remain valid after the next packet is read, so they
+// may be retained by callbacks without being copied. The zero value is ready for use.
+//
+// DecoderAlloc is suited to servers that retain topics and client IDs of many clients,
+// at the cost of garbage collector pressure proportional to the packets received.
+// PUBLISH payloads are not decoded and are streamed as with DecoderNoAlloc, though
+// the OnPubBytes callback receives a freshly allocated payload when DecoderAlloc is used.
+type DecoderAlloc struct{}
+
+// DecodeConnect implements [Decoder] interface.
+func (DecoderAlloc) DecodeConnect(r io.Reader) (VariablesConnect, int, error) {
+	return DecoderAlloc{}.decodeConnect(r, 0)
+}
+
+// decodeConnect implements connectDecoder.
+func (DecoderAlloc) decodeConnect(r io.Reader, maxWillSize int) (VariablesConnect, int, error) {
+	vd := varDecoder{alloc: true}
+	return vd.decodeConnect(r, maxWillSize)
+}
+
+// DecodePublish implements [Decoder] interface.
+func (DecoderAlloc) DecodePublish(r io.Reader, qos QoSLevel) (VariablesPublish, int, error) {
+	vd := varDecoder{alloc: true}
+	return vd.decodePublish(r, qos)
+}
+
+// decodePublishV5 implements publishV5Decoder.
+func (DecoderAlloc) decodePublishV5(r io.Reader, qos QoSLevel) (VariablesPublish, int, error) {
+	vd := varDecoder{alloc: true}
+	return vd.decodePublishV5(r, qos)
+}
+
+// DecodeSubscribe implements [Decoder] interface.
+func (DecoderAlloc) DecodeSubscribe(r io.Reader, remainingLen uint32) (VariablesSubscribe, int, error) {
+	vd := varDecoder{alloc: true}
+	return vd.decodeSubscribe(r, remainingLen)
+}
+
+// DecodeUnsubscribe implements [Decoder] interface.
+func (DecoderAlloc) DecodeUnsubscribe(r io.Reader, remainingLength uint32) (VariablesUnsubscribe, int, error) {
+	return DecoderAlloc{}.decodeUnsubscribe(r, remainingLength, 0)
+}
+
+// decodeUnsubscribe implements unsubscribeDecoder.
+func (DecoderAlloc) decodeUnsubscribe(r io.Reader, remainingLength uint32, maxTopics int) (varUnsub VariablesUnsubscribe, n int, err error) {
+	vd := varDecoder{alloc: true}
+	n, err = vd.decodeUnsubscribeInto(r, remainingLength, maxTopics, &varUnsub)
+	if err != nil {
+		return VariablesUnsubscribe{}, n, err
+	}
+	return varUnsub, n, nil
+}
@@ -12,19 +12,59 @@ import (
 // Decode Calls that receive strings invalidate strings decoded in previous calls.
 // Needless to say, this implementation is NOT safe for concurrent use.
 // Calls that allocate strings or bytes are contained in the [Decoder] interface.
+//
+// PUBLISH payloads are not decoded into the UserBuffer, only the topic name is, so
+// payloads larger than the UserBuffer are still received by streaming them through
+// the OnPub callback's reader. Only a topic name that does not fit fails with [ErrUserBufferFull].
 type DecoderNoAlloc struct {
 	UserBuffer []byte
 }
 
 // DecodeConnect implements [Decoder] interface.
 func (d DecoderNoAlloc) DecodeConnect(r io.Reader) (varConn VariablesConnect, n int, err error) {
-	payloadDst := d.UserBuffer
+	return d.decodeConnect(r, 0)
+}
+
+// decodeConnect implements connectDecoder.
+func (d DecoderNoAlloc) decodeConnect(r io.Reader, maxWillSize int) (varConn VariablesConnect, n int, err error) {
+	vd := varDecoder{buf: d.UserBuffer}
+	return vd.decodeConnect(r, maxWillSize)
+}
+
+// connectDecoder is implemented by decoders that can reject a CONNECT packet with
+// a will message longer than maxWillSize, if non-zero, with errWillTooLarge before it is read.
+type connectDecoder interface {
+	decodeConnect(r io.Reader, maxWillSize int) (VariablesConnect, int, error)
+}
+
+// unsubscribeDecoder is implemented by decoders that can reject an UNSUBSCRIBE packet
+// with more than maxTopics topics, if non-zero, with errManyTopics before the excess is read.
+type unsubscribeDecoder interface {
+	decodeUnsubscribe(r io.Reader, remainingLength uint32, maxTopics int) (VariablesUnsubscribe, int, error)
+}
+
+// publishV5Decoder is implemented by decoders that can decode the variable header
+// of MQTT 5.0 PUBLISH packets. The topic name may be empty if a topic alias is present.
+type publishV5Decoder interface {
+	decodePublishV5(r io.Reader, qos QoSLevel) (VariablesPublish, int, error)
+}
+
+// varDecoder decodes the variable headers of MQTT packets for [DecoderNoAlloc] and
+// [DecoderAlloc]. Decoded strings are stored in consecutive regions of buf or,
+// if alloc is set, in freshly allocated slices.
+type varDecoder struct {
+	buf   []byte
+	alloc bool
+}
+
+// decodeConnect decodes a CONNECT packet. If maxWillSize is non-zero a will message
+// longer than maxWillSize is rejected with errWillTooLarge before it is read.
+func (vd *varDecoder) decodeConnect(r io.Reader, maxWillSize int) (varConn VariablesConnect, n int, err error) {
 	var ngot int
-	varConn.Protocol, n, err = decodeMQTTString(r, payloadDst)
+	varConn.Protocol, n, err = vd.decodeString(r, 0, nil)
 	if err != nil {
 		return VariablesConnect{}, n, err
 	}
-	payloadDst = payloadDst[len(varConn.Protocol):]
 	varConn.ProtocolLevel, err = decodeByte(r)
 	if err != nil {
 		return VariablesConnect{}, n, err
@@ -53,38 +93,55 @@ func (d DecoderNoAlloc) DecodeConnect(r io.Reader) (varConn VariablesConnect, n
 	if err != nil {
 		return VariablesConnect{}, n, err
 	}
-	varConn.ClientID, ngot, err = decodeMQTTString(r, payloadDst)
+	if varConn.ProtocolLevel == ProtocolLevel5 {
+		varConn.Properties, ngot, err = vd.decodeConnectProperties(r)
+		n += ngot
+		if err != nil {
+			return VariablesConnect{}, n, err
+		}
+	}
+	varConn.ClientID, ngot, err = vd.decodeBytes(r, 0, nil)
 	if err != nil {
 		return VariablesConnect{}, n, err
 	}
 	n += ngot
-	payloadDst = payloadDst[len(varConn.ClientID):]
 
 	if willFlag {
-		varConn.WillTopic, ngot, err = decodeMQTTString(r, payloadDst)
+		if varConn.ProtocolLevel == ProtocolLevel5 {
+			// Will properties are skipped.
+			var willPropLen uint32
+			willPropLen, ngot, err = decodeRemainingLength(r)
+			n += ngot
+			if err != nil {
+				return VariablesConnect{}, n, err
+			}
+			nskip, err := io.CopyN(io.Discard, r, int64(willPropLen))
+			n += int(nskip)
+			if err != nil {
+				return VariablesConnect{}, n, err
+			}
+		}
+		varConn.WillTopic, ngot, err = vd.decodeString(r, 0, nil)
 		n += ngot
 		if err != nil {
 			return VariablesConnect{}, n, err
 		}
-		payloadDst = payloadDst[len(varConn.WillTopic):]
-		varConn.WillMessage, ngot, err = decodeMQTTString(r, payloadDst)
+		varConn.WillMessage, ngot, err = vd.decodeBytes(r, maxWillSize, errWillTooLarge)
 		n += ngot
 		if err != nil {
 			return VariablesConnect{}, n, err
 		}
-		payloadDst = payloadDst[len(varConn.WillMessage):]
 	}
 
 	if userNameFlag {
 		// Username and password.
-		varConn.Username, ngot, err = decodeMQTTString(r, payloadDst)
+		varConn.Username, ngot, err = vd.decodeString(r, 0, nil)
 		n += ngot
 		if err != nil {
 			return VariablesConnect{}, n, err
 		}
 		if passwordFlag {
-			payloadDst = payloadDst[len(varConn.Username):]
-			varConn.Password, ngot, err = decodeMQTTString(r, payloadDst)
+			varConn.Password, ngot, err = vd.decodeString(r, 0, nil)
 			n += ngot
 			if err != nil {
 				return VariablesConnect{}, n, err
@@ -94,9 +151,125 @@ func (d DecoderNoAlloc) DecodeConnect(r io.Reader) (varConn VariablesConnect, n
 	return varConn, n, nil
 }
 
+// ParseConnect parses the CONNECT packet contents following the fixed header in buf,
+// as generated by [VariablesConnect.AppendTo]. buf must hold exactly the contents
+// of one CONNECT packet. The strings of the returned VariablesConnect
+// do not reference buf's memory.
+func ParseConnect(buf []byte) (VariablesConnect, error) {
+	r := bytes.NewReader(buf)
+	vc, _, err := DecoderNoAlloc{UserBuffer: make([]byte, len(buf))}.DecodeConnect(r)
+	if err = unmarshalEnd(r, err); err != nil {
+		return VariablesConnect{}, err
+	}
+	return vc, nil
+}
+
+// DecodeConnectHead decodes the CONNECT packet contents in buf, which start
+// after the fixed header, up to and including the credentials so that a server
+// may authenticate a client before processing the rest of the packet. The will topic
+// and message, if present, are skipped over without being parsed. The returned
+// byte slices point to buf's memory and flags are the CONNECT flags.
+// n is the amount of bytes of buf consumed.
+func DecodeConnectHead(buf []byte) (clientID, username, password []byte, flags byte, n int, err error) {
+	_, n, err = sliceMQTTString(buf) // Protocol name.
+	if err != nil {
+		return nil, nil, nil, 0, n, err
+	}
+	if len(buf) < n+4 {
+		return nil, nil, nil, 0, n, io.ErrUnexpectedEOF
+	}
+	level := buf[n]
+	flags = buf[n+1]
+	n += 4 // Protocol level, flags and keepalive.
+	isV5 := level == ProtocolLevel5
+	if isV5 {
+		ngot, err := skipProperties(buf[n:])
+		n += ngot
+		if err != nil {
+			return nil, nil, nil, 0, n, err
+		}
+	}
+	if flags&1 != 0 { // [MQTT-3.1.2-3].
+		return nil, nil, nil, 0, n, errors.New("reserved bit set in CONNECT flag")
+	}
+	userNameFlag := flags&(1<<7) != 0
+	passwordFlag := flags&(1<<6) != 0
+	willFlag := flags&(1<<2) != 0
+	if passwordFlag && !userNameFlag {
+		return nil, nil, nil, 0, n, errors.New("username flag must be set to use password flag")
+	}
+	clientID, ngot, err := sliceMQTTString(buf[n:])
+	n += ngot
+	if err != nil {
+		return nil, nil, nil, 0, n, err
+	}
+	if willFlag {
+		if isV5 {
+			ngot, err = skipProperties(buf[n:])
+			n += ngot
+			if err != nil {
+				return nil, nil, nil, 0, n, err
+			}
+		}
+		// Skip will topic and will message.
+		for i := 0; i < 2; i++ {
+			_, ngot, err = sliceMQTTString(buf[n:])
+			n += ngot
+			if err != nil {
+				return nil, nil, nil, 0, n, err
+			}
+		}
+	}
+	if userNameFlag {
+		username, ngot, err = sliceMQTTString(buf[n:])
+		n += ngot
+		if err != nil {
+			return nil, nil, nil, 0, n, err
+		}
+	}
+	if passwordFlag {
+		password, ngot, err = sliceMQTTString(buf[n:])
+		n += ngot
+		if err != nil {
+			return nil, nil, nil, 0, n, err
+		}
+	}
+	return clientID, username, password, flags, n, nil
+}
+
+// skipProperties returns the length of the MQTT 5.0 property block at the start of buf.
+func skipProperties(buf []byte) (int, error) {
+	propLen, n, err := decodeRemainingLength(bytes.NewReader(buf))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	n += int(propLen)
+	if err == nil && n > len(buf) {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// sliceMQTTString returns the MQTT string at the start of buf without copying it.
+func sliceMQTTString(buf []byte) ([]byte, int, error) {
+	if len(buf) < 2 {
+		return nil, len(buf), io.ErrUnexpectedEOF
+	}
+	end := 2 + (int(buf[0])<<8 | int(buf[1]))
+	if end > len(buf) {
+		return nil, len(buf), io.ErrUnexpectedEOF
+	}
+	return buf[2:end], end, nil
+}
+
 // DecodePublish implements [Decoder] interface.
 func (d DecoderNoAlloc) DecodePublish(r io.Reader, qos QoSLevel) (_ VariablesPublish, n int, err error) {
-	topic, n, err := decodeMQTTString(r, d.UserBuffer)
+	vd := varDecoder{buf: d.UserBuffer}
+	return vd.decodePublish(r, qos)
+}
+
+func (vd *varDecoder) decodePublish(r io.Reader, qos QoSLevel) (_ VariablesPublish, n int, err error) {
+	topic, n, err := vd.decodeString(r, 0, nil)
 	if err != nil {
 		return VariablesPublish{}, n, err
 	}
@@ -113,17 +286,48 @@ func (d DecoderNoAlloc) DecodePublish(r io.Reader, qos QoSLevel) (_ VariablesPub
 	return VariablesPublish{TopicName: topic, PacketIdentifier: PI}, n, nil
 }
 
+// decodePublishV5 implements publishV5Decoder.
+func (d DecoderNoAlloc) decodePublishV5(r io.Reader, qos QoSLevel) (VariablesPublish, int, error) {
+	vd := varDecoder{buf: d.UserBuffer}
+	return vd.decodePublishV5(r, qos)
+}
+
+func (vd *varDecoder) decodePublishV5(r io.Reader, qos QoSLevel) (vp VariablesPublish, n int, err error) {
+	// Topic name may be empty if a topic alias is present.
+	vp.TopicName, n, err = vd.decodeBytes(r, 0, nil)
+	if err != nil {
+		return VariablesPublish{}, n, err
+	}
+	var ngot int
+	if qos == 1 || qos == 2 {
+		vp.PacketIdentifier, ngot, err = decodeUint16(r)
+		n += ngot
+		if err != nil {
+			return VariablesPublish{}, n, err
+		}
+	}
+	vp.TopicAlias, ngot, err = decodePublishProperties(r)
+	n += ngot
+	if err != nil {
+		return VariablesPublish{}, n, err
+	}
+	return vp, n, nil
+}
+
 // DecodeSubscribe implements [Decoder] interface.
 func (d DecoderNoAlloc) DecodeSubscribe(r io.Reader, remainingLen uint32) (varSub VariablesSubscribe, n int, err error) {
-	payloadDst := d.UserBuffer
+	vd := varDecoder{buf: d.UserBuffer}
+	return vd.decodeSubscribe(r, remainingLen)
+}
+
+func (vd *varDecoder) decodeSubscribe(r io.Reader, remainingLen uint32) (varSub VariablesSubscribe, n int, err error) {
 	varSub.PacketIdentifier, n, err = decodeUint16(r)
 	if err != nil {
 		return VariablesSubscribe{}, n, err
 	}
 	for n < int(remainingLen) {
-		hotTopic, ngot, err := decodeMQTTString(r, payloadDst)
+		hotTopic, ngot, err := vd.decodeString(r, 0, nil)
 		n += ngot
-		payloadDst = payloadDst[ngot:] //Advance buffer pointer to not overwrite.
 		if err != nil {
 			return VariablesSubscribe{}, n, err
 		}
@@ -138,22 +342,47 @@ func (d DecoderNoAlloc) DecodeSubscribe(r io.Reader, remainingLen uint32) (varSu
 }
 
 // DecodeUnsubscribe implements [Decoder] interface.
-func (d DecoderNoAlloc) DecodeUnsubscribe(r io.Reader, remainingLength uint32) (varUnsub VariablesUnsubscribe, n int, err error) {
-	payloadDst := d.UserBuffer
-	varUnsub.PacketIdentifier, n, err = decodeUint16(r)
+func (d DecoderNoAlloc) DecodeUnsubscribe(r io.Reader, remainingLength uint32) (VariablesUnsubscribe, int, error) {
+	return d.decodeUnsubscribe(r, remainingLength, 0)
+}
+
+// decodeUnsubscribe implements unsubscribeDecoder.
+func (d DecoderNoAlloc) decodeUnsubscribe(r io.Reader, remainingLength uint32, maxTopics int) (varUnsub VariablesUnsubscribe, n int, err error) {
+	n, err = d.decodeUnsubscribeInto(r, remainingLength, maxTopics, &varUnsub)
 	if err != nil {
 		return VariablesUnsubscribe{}, n, err
 	}
+	return varUnsub, n, nil
+}
+
+// decodeUnsubscribeInto decodes an UNSUBSCRIBE packet into varUnsub reusing the capacity of its Topics.
+// If maxTopics is non-zero errManyTopics is returned before decoding a topic past the limit.
+func (d DecoderNoAlloc) decodeUnsubscribeInto(r io.Reader, remainingLength uint32, maxTopics int, varUnsub *VariablesUnsubscribe) (n int, err error) {
+	vd := varDecoder{buf: d.UserBuffer}
+	return vd.decodeUnsubscribeInto(r, remainingLength, maxTopics, varUnsub)
+}
+
+func (vd *varDecoder) decodeUnsubscribeInto(r io.Reader, remainingLength uint32, maxTopics int, varUnsub *VariablesUnsubscribe) (n int, err error) {
+	varUnsub.Topics = varUnsub.Topics[:0]
+	varUnsub.PacketIdentifier, n, err = decodeUint16(r)
+	if err != nil {
+		return n, err
+	}
 	for n < int(remainingLength) {
-		coldTopic, ngot, err := decodeMQTTString(r, payloadDst)
+		if maxTopics > 0 && len(varUnsub.Topics) == maxTopics {
+			return n, errManyTopics
+		}
+		coldTopic, ngot, err := vd.decodeString(r, 0, nil)
 		n += ngot
-		payloadDst = payloadDst[ngot:] // Advance buffer pointer to not overwrite.
 		if err != nil {
-			return VariablesUnsubscribe{}, n, err
+			return n, err
 		}
 		varUnsub.Topics = append(varUnsub.Topics, coldTopic)
 	}
-	return varUnsub, n, nil
+	if len(varUnsub.Topics) == 0 { // [MQTT-3.10.3-2].
+		return n, errNoTopics
+	}
+	return n, nil
 }
 
 // decodeConnack decodes a connack packet. It is the responsibility of the caller to handle a non-zero [ConnectReturnCode].
@@ -199,68 +428,105 @@ func decodeRemainingLength(r io.Reader) (value uint32, n int, err error) {
 		n++
 		value += uint32(encodedByte&127) * multiplier
 		if encodedByte&128 == 0 {
+			if encodedByte == 0 && i > 0 {
+				// Value could have been encoded with fewer bytes.
+				return 0, n, errOverlongRemainingLen
+			}
 			return value, n, nil
 		}
 		multiplier *= 128
 
 	}
-	return 0, n, errors.New("malformed remaining length")
+	return 0, n, errLongRemainingLen
 }
 
-func readFull(src io.Reader, dst []byte) (int, error) {
-	n, err := src.Read(dst)
-	if err == nil && n != len(dst) {
-		var buffer [256]byte
-		// TODO(soypat): Avoid heavy heap allocation by implementing lightweight algorithm here.
-		i64, err := io.CopyBuffer(bytes.NewBuffer(dst[n:]), src, buffer[:])
-		i := int(i64)
-		if err != nil && errors.Is(err, io.EOF) && i == len(dst[n:]) {
-			err = nil
-		}
-		return n + i, err
+var (
+	errOverlongRemainingLen = wrapErr(ErrBadRemainingLen, "overlong encoding")
+	errLongRemainingLen     = wrapErr(ErrBadRemainingLen, "encoding exceeds 4 bytes")
+)
+
+// readFull reads exactly len(dst) bytes from src. Bytes returned by src alongside
+// an error are consumed before the error is considered, so an error returned
+// together with the last bytes of dst is not reported.
+func readFull(src io.Reader, dst []byte) (n int, err error) {
+	for n < len(dst) && err == nil {
+		var ngot int
+		ngot, err = src.Read(dst[n:])
+		n += ngot
+	}
+	if n == len(dst) {
+		err = nil
 	}
 	return n, err
 }
 
-// decodeMQTT unmarshals a string from r into buffer's start. The unmarshalled
-// string can be at most len(buffer). buffer must be at least of length 2.
-// decodeMQTTString only returns a non-nil string on a successful decode.
-func decodeMQTTString(r io.Reader, buffer []byte) ([]byte, int, error) {
-	if len(buffer) < 2 {
-		return nil, 0, ErrUserBufferFull
-	}
+// decodeString decodes a non-empty MQTT string from r. If maxLen is non-zero a string longer
+// than maxLen is rejected with errTooLong before it is read.
+// decodeString only returns a non-nil string on a successful decode.
+func (vd *varDecoder) decodeString(r io.Reader, maxLen int, errTooLong error) ([]byte, int, error) {
+	return vd.decodeField(r, maxLen, errTooLong, false)
+}
+
+// decodeBytes decodes an MQTT string or binary data from r as decodeString does
+// except that it may be zero length, i.e. the client identifier [MQTT-3.1.3-6].
+func (vd *varDecoder) decodeBytes(r io.Reader, maxLen int, errTooLong error) ([]byte, int, error) {
+	return vd.decodeField(r, maxLen, errTooLong, true)
+}
+
+func (vd *varDecoder) decodeField(r io.Reader, maxLen int, errTooLong error, allowEmpty bool) ([]byte, int, error) {
 	stringLength, n, err := decodeUint16(r)
 	if err != nil {
 		return nil, n, err
 	}
-	if stringLength == 0 {
-		return nil, n, errors.New("zero length MQTT string")
+	if stringLength == 0 && !allowEmpty {
+		return nil, n, errZeroLengthString
+	}
+	if maxLen > 0 && int(stringLength) > maxLen {
+		return nil, n, errTooLong
 	}
-	if stringLength > uint16(len(buffer)) {
-		return nil, n, ErrUserBufferFull // errors.New("buffer too small for string of length " + strconv.FormatUint(uint64(stringLength), 10))
+	var str []byte
+	if vd.alloc {
+		str = make([]byte, stringLength)
+	} else if int(stringLength) > len(vd.buf) {
+		return nil, n, ErrUserBufferFull
+	} else {
+		// Capacity is limited so appending to a string does not overwrite the next.
+		str = vd.buf[:stringLength:stringLength]
+		vd.buf = vd.buf[stringLength:]
 	}
-	ngot, err := readFull(r, buffer[:stringLength])
+	ngot, err := readFull(r, str)
 	n += ngot
-	if err != nil && errors.Is(err, io.EOF) && uint16(ngot) == stringLength {
-		err = nil // MQTT string was read successfully albeit with an EOF right at the end.
+	if err != nil {
+		return nil, n, err
 	}
-	return buffer[:stringLength], n, err
+	return str, n, nil
 }
 
+// decodeByte reads a single byte from r. If r implements [io.ByteReader], such as
+// a [bufio.Reader], it is used so that the byte read does not escape to the heap.
 func decodeByte(r io.Reader) (value byte, err error) {
-	var vbuf [1]byte
-	n, err := r.Read(vbuf[:])
-	if err != nil && errors.Is(err, io.EOF) && n == 1 {
-		err = nil // Byte was read successfully albeit with an EOF.
+	if br, ok := r.(io.ByteReader); ok {
+		return br.ReadByte()
 	}
+	var vbuf [1]byte
+	_, err = readFull(r, vbuf[:])
 	return vbuf[0], err
 }
 
 func decodeUint16(r io.Reader) (value uint16, n int, err error) {
+	if br, ok := r.(io.ByteReader); ok {
+		var msb, lsb byte
+		msb, err = br.ReadByte()
+		if err != nil {
+			return 0, 0, err
+		}
+		lsb, err = br.ReadByte()
+		if err != nil {
+			return 0, 1, err
+		}
+		return uint16(msb)<<8 | uint16(lsb), 2, nil
+	}
 	var vbuf [2]byte
 	n, err = readFull(r, vbuf[:])
-	if err != nil && errors.Is(err, io.EOF) && n == 2 {
-		err = nil // integer was read successfully albeit with an EOF.
-	}
 	return uint16(vbuf[0])<<8 | uint16(vbuf[1]), n, err
 }
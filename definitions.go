@@ -12,6 +12,8 @@ const (
 	DefaultProtocolLevel = 4
 	// Accepted protocol as per MQTT v3.1.1. This goes in the CONNECT variable header.
 	DefaultProtocol = "MQTT"
+	// Protocol level of MQTT v5.0. CONNECT packets of this level carry properties.
+	ProtocolLevel5 = 5
 	// Size on wire after being encoded.
 	maxRemainingLengthSize = 4
 	// Max value Remaining Length can take 0xfff_ffff. When encoded over the wire this value yields 0xffff_ff7f.
@@ -16,7 +16,7 @@ func (h Header) Encode(w io.Writer) (n int, err error) {
 	}
 	var headerBuf [5]byte
 	n = h.Put(headerBuf[:])
-	return writeFull(w, headerBuf[:n])
+	return writeSmall(w, headerBuf[:n])
 }
 
 func (h Header) Put(buf []byte) int {
@@ -26,18 +26,24 @@ func (h Header) Put(buf []byte) int {
 }
 
 func encodeMQTTString(w io.Writer, s []byte) (int, error) {
-	length := len(s)
-	if length == 0 {
+	if len(s) == 0 {
 		return 0, errors.New("cannot encode MQTT string of length 0")
 	}
-	if length > math.MaxUint16 {
-		return 0, errors.New("cannot encode MQTT string of length > MaxUint16 or length 0")
+	return encodeMQTTBytes(w, s)
+}
+
+// encodeMQTTBytes encodes s as an MQTT string or binary data. Unlike encodeMQTTString
+// s may be zero length. It is used for fields that may be empty, such as the client
+// identifier [MQTT-3.1.3-6] and the will message.
+func encodeMQTTBytes(w io.Writer, s []byte) (int, error) {
+	if len(s) > math.MaxUint16 {
+		return 0, errors.New("cannot encode MQTT string of length > MaxUint16")
 	}
 	n, err := encodeUint16(w, uint16(len(s)))
 	if err != nil {
 		return n, err
 	}
-	n2, err := writeFull(w, s)
+	n2, err := WriteFull(w, s)
 	n += n2
 	if err != nil {
 		return n, err
@@ -76,31 +82,46 @@ func encodeConnect(w io.Writer, varConn *VariablesConnect) (n int, err error) {
 	var varHeaderBuf [10]byte
 	// Set protocol name 'MQTT' and protocol level 4.
 	n += copy(varHeaderBuf[:], "\x00\x04MQTT\x04") // writes 7 bytes.
+	isV5 := varConn.ProtocolLevel == ProtocolLevel5
+	if isV5 {
+		varHeaderBuf[n-1] = ProtocolLevel5
+	}
 	varHeaderBuf[n] = varConn.Flags()
 	varHeaderBuf[n+1] = byte(varConn.KeepAlive >> 8) // MSB
 	varHeaderBuf[n+2] = byte(varConn.KeepAlive)      // LSB
-	// n+=3 // We've written 10 bytes exactly if all went well up to here.
-	n, err = w.Write(varHeaderBuf[:])
-	if err == nil && n != 10 {
-		return n, errors.New("single write did not complete for encoding, use larger underlying buffer")
-	}
+	n, err = writeSmall(w, varHeaderBuf[:])
 	if err != nil {
 		return n, err
 	}
+	if isV5 {
+		// MQTT 5.0 properties follow the keepalive.
+		ngot, err := encodeConnectProperties(w, varConn.Properties)
+		n += ngot
+		if err != nil {
+			return n, err
+		}
+	}
 	// Begin Encoding payload contents. First field is ClientID.
-	ngot, err := encodeMQTTString(w, varConn.ClientID)
+	ngot, err := encodeMQTTBytes(w, varConn.ClientID)
 	n += ngot
 	if err != nil {
 		return n, err
 	}
 
 	if varConn.WillFlag() {
+		if isV5 {
+			ngot, err = encodeByte(w, 0) // Will properties are not supported.
+			n += ngot
+			if err != nil {
+				return n, err
+			}
+		}
 		ngot, err = encodeMQTTString(w, varConn.WillTopic)
 		n += ngot
 		if err != nil {
 			return n, err
 		}
-		ngot, err = encodeMQTTString(w, varConn.WillMessage)
+		ngot, err = encodeMQTTBytes(w, varConn.WillMessage)
 		n += ngot
 		if err != nil {
 			return n, err
@@ -129,12 +150,17 @@ func encodeConnack(w io.Writer, varConn VariablesConnack) (int, error) {
 	var buf [2]byte
 	buf[0] = varConn.AckFlags
 	buf[1] = byte(varConn.ReturnCode)
-	return writeFull(w, buf[:])
+	return writeSmall(w, buf[:])
 }
 
 // encodePublish encodes PUBLISH packet variable header. Does not encode fixed header or user payload.
-func encodePublish(w io.Writer, qos QoSLevel, varPub VariablesPublish) (n int, err error) {
-	n, err = encodeMQTTString(w, varPub.TopicName)
+// If v5 is set the MQTT 5.0 properties are encoded and the topic name may be empty if a topic alias is set.
+func encodePublish(w io.Writer, qos QoSLevel, varPub VariablesPublish, v5 bool) (n int, err error) {
+	if v5 && varPub.TopicAlias != 0 {
+		n, err = encodeMQTTBytes(w, varPub.TopicName)
+	} else {
+		n, err = encodeMQTTString(w, varPub.TopicName)
+	}
 	if err != nil {
 		return n, err
 	}
@@ -145,19 +171,26 @@ func encodePublish(w io.Writer, qos QoSLevel, varPub VariablesPublish) (n int, e
 			return n, err
 		}
 	}
+	if v5 {
+		ngot, err := encodePublishProperties(w, varPub)
+		n += ngot
+		if err != nil {
+			return n, err
+		}
+	}
 	return n, err
 }
 
 func encodeByte(w io.Writer, value byte) (n int, err error) {
 	var vbuf [1]byte
 	vbuf[0] = value
-	return w.Write(vbuf[:])
+	return writeSmall(w, vbuf[:])
 }
 
 func encodeUint16(w io.Writer, value uint16) (n int, err error) {
 	var vbuf [2]byte
 	binary.BigEndian.PutUint16(vbuf[:], value)
-	return writeFull(w, vbuf[:])
+	return writeSmall(w, vbuf[:])
 }
 
 func encodeSubscribe(w io.Writer, varSub VariablesSubscribe) (n int, err error) {
@@ -168,15 +201,13 @@ func encodeSubscribe(w io.Writer, varSub VariablesSubscribe) (n int, err error)
 	if err != nil {
 		return n, err
 	}
-	var vbuf [1]byte
 	for _, hotTopic := range varSub.TopicFilters {
 		ngot, err := encodeMQTTString(w, hotTopic.TopicFilter)
 		n += ngot
 		if err != nil {
 			return n, err
 		}
-		vbuf[0] = byte(hotTopic.QoS & 0b11)
-		ngot, err = w.Write(vbuf[:1])
+		ngot, err = encodeByte(w, byte(hotTopic.QoS&0b11))
 		n += ngot
 		if err != nil {
 			return n, err
@@ -185,6 +216,42 @@ func encodeSubscribe(w io.Writer, varSub VariablesSubscribe) (n int, err error)
 	return n, nil
 }
 
+// EncodeSubscribe encodes a complete SUBSCRIBE packet, fixed header included, into dst
+// and returns the number of bytes written. The result is byte-for-byte identical
+// to what [Tx.WriteSubscribe] writes to its transport. If dst is too small to fit
+// the packet [io.ErrShortBuffer] is returned.
+func EncodeSubscribe(dst []byte, varSub VariablesSubscribe) (int, error) {
+	h := newHeader(PacketSubscribe, PacketFlagsPubrelSubUnsub, uint32(varSub.Size()))
+	if len(dst) < h.Size()+int(h.RemainingLength) {
+		return 0, io.ErrShortBuffer
+	}
+	// Buffer capacity is enough to hold the whole packet so dst is never reallocated.
+	buf := bytes.NewBuffer(dst[:0])
+	_, err := h.Encode(buf)
+	if err != nil {
+		return 0, err
+	}
+	_, err = encodeSubscribe(buf, varSub)
+	if err != nil {
+		return 0, err
+	}
+	return buf.Len(), nil
+}
+
+// AppendTo appends the CONNECT packet contents following the fixed header to dst, byte-for-byte
+// identical to what [Tx.WriteConnect] writes, and returns the extended buffer. The protocol name
+// is always encoded as "MQTT" and the protocol level as 4 unless ProtocolLevel is [ProtocolLevel5].
+// The result may be parsed back with [ParseConnect]. If vc cannot be encoded, such as when
+// a string exceeds 65535 bytes or a property is unknown, dst is returned unchanged.
+func (vc *VariablesConnect) AppendTo(dst []byte) []byte {
+	buf := bytes.NewBuffer(dst)
+	_, err := encodeConnect(buf, vc)
+	if err != nil {
+		return dst
+	}
+	return buf.Bytes()
+}
+
 func encodeSuback(w io.Writer, varSuback VariablesSuback) (n int, err error) {
 	n, err = encodeUint16(w, varSuback.PacketIdentifier)
 	if err != nil {
@@ -223,18 +290,45 @@ func encodeUnsubscribe(w io.Writer, varUnsub VariablesUnsubscribe) (n int, err e
 
 // Pings and DISCONNECT do not have variable headers so no encoders here.
 
-func writeFull(dst io.Writer, src []byte) (int, error) {
-	// dataPtr := 0
-	n, err := dst.Write(src)
-	if err == nil && n != len(src) {
-		// TODO(soypat): Avoid heavy heap allocation by implementing lightweight algorithm here.
-		var buffer [256]byte
-		i, err := io.CopyBuffer(dst, bytes.NewBuffer(src[n:]), buffer[:])
-		return n + int(i), err
+// WriteFull writes all of p to w. Unlike a single call to w.Write it does not
+// return a nil error unless all of p was written, even if w accepts only part of p
+// per call. If w makes no progress and returns no error [io.ErrShortWrite] is returned.
+func WriteFull(w io.Writer, p []byte) (n int, err error) {
+	for n < len(p) && err == nil {
+		var ngot int
+		ngot, err = w.Write(p[n:])
+		n += ngot
+		if ngot == 0 && err == nil {
+			err = io.ErrShortWrite
+		}
 	}
 	return n, err
 }
 
+// maxWriteSmall is the maximum length of the slice passed to writeSmall.
+const maxWriteSmall = 10
+
+// writeSmall writes up to maxWriteSmall bytes of src to dst without causing src
+// to escape to the heap. This keeps encoding allocation free for writers that
+// implement io.ByteWriter, such as the bytes.Buffer used by Tx.
+func writeSmall(dst io.Writer, src []byte) (int, error) {
+	if bw, ok := dst.(io.ByteWriter); ok {
+		for i, c := range src {
+			if err := bw.WriteByte(c); err != nil {
+				return i, err
+			}
+		}
+		return len(src), nil
+	}
+	// Copy so that only this buffer escapes and only when this path is taken.
+	var buf [maxWriteSmall]byte
+	n := copy(buf[:], src)
+	if n != len(src) {
+		panic("writeSmall: slice too large. " + bugReportLink)
+	}
+	return WriteFull(dst, buf[:n])
+}
+
 // bool to uint8
 //
 //go:inline
@@ -0,0 +1,161 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"unicode/utf8"
+)
+
+// The Variables types implement [encoding.BinaryMarshaler] and [encoding.BinaryUnmarshaler].
+// The marshaled form is the packet contents following the fixed header as sent on the wire,
+// so the length of the marshaled data is the remaining length of the packet. Unmarshaling
+// validates the data as [Rx] does on packet receipt and byte slices of the result do not
+// reference the argument data's memory.
+
+// MarshalBinary implements [encoding.BinaryMarshaler]. See [VariablesConnect.AppendTo].
+func (vc *VariablesConnect) MarshalBinary() ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, vc.Size()))
+	_, err := encodeConnect(buf, vc)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary implements [encoding.BinaryUnmarshaler]. See [ParseConnect].
+func (vc *VariablesConnect) UnmarshalBinary(data []byte) error {
+	parsed, err := ParseConnect(data)
+	if err != nil {
+		return err
+	}
+	*vc = parsed
+	return nil
+}
+
+// MarshalBinary implements [encoding.BinaryMarshaler]. The packet identifier is only
+// encoded if non-zero, as is the case for QoS1 and QoS2 PUBLISH packets. The payload is not included.
+func (vp VariablesPublish) MarshalBinary() ([]byte, error) {
+	qos := QoS0
+	if vp.PacketIdentifier != 0 {
+		qos = QoS1
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, vp.Size(qos)))
+	_, err := encodePublish(buf, qos, vp, false)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary implements [encoding.BinaryUnmarshaler]. The packet identifier is
+// decoded if data holds two bytes following the topic name.
+func (vp *VariablesPublish) UnmarshalBinary(data []byte) error {
+	qos := QoS0
+	if len(data) >= 2 && len(data) == int(binary.BigEndian.Uint16(data))+4 {
+		qos = QoS1
+	}
+	r := bytes.NewReader(data)
+	parsed, _, err := DecoderNoAlloc{UserBuffer: make([]byte, len(data))}.DecodePublish(r, qos)
+	if err = unmarshalEnd(r, err); err != nil {
+		return err
+	}
+	if !utf8.Valid(parsed.TopicName) {
+		return errTopicNotUTF8
+	}
+	*vp = parsed
+	return nil
+}
+
+// MarshalBinary implements [encoding.BinaryMarshaler].
+func (vs VariablesSubscribe) MarshalBinary() ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, vs.Size()))
+	_, err := encodeSubscribe(buf, vs)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary implements [encoding.BinaryUnmarshaler].
+func (vs *VariablesSubscribe) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	parsed, _, err := DecoderNoAlloc{UserBuffer: make([]byte, len(data))}.DecodeSubscribe(r, uint32(len(data)))
+	if err = unmarshalEnd(r, err); err != nil {
+		return err
+	}
+	for _, hotTopic := range parsed.TopicFilters {
+		if !utf8.Valid(hotTopic.TopicFilter) {
+			return errTopicNotUTF8
+		}
+	}
+	*vs = parsed
+	return nil
+}
+
+// MarshalBinary implements [encoding.BinaryMarshaler].
+func (vs VariablesSuback) MarshalBinary() ([]byte, error) {
+	if err := vs.Validate(); err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, vs.Size()))
+	_, err := encodeSuback(buf, vs)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary implements [encoding.BinaryUnmarshaler].
+func (vs *VariablesSuback) UnmarshalBinary(data []byte) error {
+	if len(data) < 2 {
+		return ErrBadRemainingLen
+	}
+	r := bytes.NewReader(data)
+	parsed, _, err := decodeSuback(r, uint32(len(data)))
+	if err = unmarshalEnd(r, err); err != nil {
+		return err
+	}
+	*vs = parsed
+	return nil
+}
+
+// MarshalBinary implements [encoding.BinaryMarshaler].
+func (vu VariablesUnsubscribe) MarshalBinary() ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, vu.Size()))
+	_, err := encodeUnsubscribe(buf, vu)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary implements [encoding.BinaryUnmarshaler].
+func (vu *VariablesUnsubscribe) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	parsed, _, err := DecoderNoAlloc{UserBuffer: make([]byte, len(data))}.DecodeUnsubscribe(r, uint32(len(data)))
+	if err = unmarshalEnd(r, err); err != nil {
+		return err
+	}
+	for _, coldTopic := range parsed.Topics {
+		if !utf8.Valid(coldTopic) {
+			return errTopicNotUTF8
+		}
+	}
+	*vu = parsed
+	return nil
+}
+
+// unmarshalEnd returns the error of decoding packet contents from r, which must
+// have been completely consumed.
+func unmarshalEnd(r *bytes.Reader, err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	} else if err == nil && r.Len() != 0 {
+		return errTrailingBytes
+	}
+	return err
+}
+
+var errTrailingBytes = errors.New("trailing bytes after packet contents")
@@ -1,6 +1,7 @@
 package mqtt
 
 import (
+	"bytes"
 	"errors"
 	"io"
 	"strconv"
@@ -27,17 +28,43 @@ type Decoder interface {
 const bugReportLink = "Please report bugs at https://github.com/soypat/natiu-mqtt/issues/new "
 
 var (
-	errQoS0NoDup  = errors.New("DUP must be 0 for all QoS0 [MQTT-3.3.1-2]")
-	errEmptyTopic = errors.New("empty topic")
-	errGotZeroPI  = errors.New("packet identifier must be nonzero for packet type")
+	errQoS0NoDup    = errors.New("DUP must be 0 for all QoS0 [MQTT-3.3.1-2]")
+	errEmptyTopic   = errors.New("empty topic")
+	errGotZeroPI    = errors.New("packet identifier must be nonzero for packet type")
+	errNoTopics     = errors.New("payload must contain at least one topic")
+	errManyTopics   = errors.New("too many topics")
+	errWillTooLarge = errors.New("will message too large")
+	errPayloadLarge = errors.New("payload too large")
+	// errZeroLengthString is returned when decoding a zero length string for a field
+	// that may not be empty, such as a topic name or topic filter [MQTT-4.7.3-1].
+	errZeroLengthString = errors.New("zero length MQTT string")
 
 	// natiu-mqtt depends on user provided buffers for string and byte slice allocation.
 	// If a buffer is too small for the incoming strings or for marshalling a subscription topic
 	// then the implementation should return this error.
 	ErrUserBufferFull = errors.New("natiu-mqtt: user buffer full")
 	// ErrBadRemainingLen is passed to Rx's OnRxError after decoding a header with a
-	// remaining length that does not conform to MQTT v3.1.1 packet specifications.
+	// remaining length that does not conform to MQTT v3.1.1 packet specifications
+	// or that is not a valid variable length integer.
 	ErrBadRemainingLen = errors.New("natiu-mqtt: MQTT v3.1.1 bad remaining length")
+	// ErrForbiddenPacketType is returned when decoding a fixed header with the reserved packet type 0 or 15.
+	ErrForbiddenPacketType = errors.New("natiu-mqtt: forbidden packet type")
+	// ErrBadUTF8 is returned when a topic is not a valid UTF-8 encoded string [MQTT-1.5.3-1].
+	ErrBadUTF8 = errors.New("natiu-mqtt: malformed UTF-8 string")
+	// ErrConnectFirst is returned by Tx when a packet other than CONNECT is written
+	// before a CONNECT and Tx's EnforceConnectFirst field is set.
+	ErrConnectFirst = errors.New("natiu-mqtt: CONNECT must be the first packet written")
+	// ErrIdle is returned by [Rx.ReadNextPacketTimeout] when no packet is received within the timeout.
+	ErrIdle = errors.New("natiu-mqtt: idle")
+	// ErrBadConnackFlags is returned when decoding a CONNACK packet with any of
+	// the reserved Ack flags bits 7-1 set [MQTT-3.2.2.1].
+	ErrBadConnackFlags = errors.New("natiu-mqtt: CONNACK Ack flag bits 7-1 must be set to 0")
+	// ErrConnackSessionPresent is returned by [NewConnack] when session present is set
+	// along with a non-zero return code [MQTT-3.2.2-4].
+	ErrConnackSessionPresent = errors.New("natiu-mqtt: CONNACK session present must be 0 for non-zero return code")
+	// ErrTopicAliasMaximum is returned when a PUBLISH topic alias exceeds the
+	// Topic Alias Maximum of the receiver, see [Rx] and [Tx] TopicAliasMaximum.
+	ErrTopicAliasMaximum = errors.New("natiu-mqtt: topic alias exceeds Topic Alias Maximum")
 )
 
 // Header represents the bytes preceding the payload in an MQTT packet.
@@ -52,21 +79,36 @@ type Header struct {
 
 // Size returns the size of the header as encoded over the wire. If the remaining
 // length is invalid Size returns 0.
-func (h Header) Size() (sz int) {
-	rl := h.RemainingLength
+func (h Header) Size() int { return FixedHeaderSize(h.RemainingLength) }
+
+// FixedHeaderSize returns the size of an encoded fixed header with the argument
+// remaining length. This is the first byte plus the 1 to 4 bytes of the encoded
+// remaining length. If the remaining length is invalid FixedHeaderSize returns 0.
+func FixedHeaderSize(remainingLength uint32) int {
+	width := RemainingLengthEncodedWidth(remainingLength)
+	if width == 0 {
+		return 0
+	}
+	return 1 + width
+}
+
+// RemainingLengthEncodedWidth returns the amount of bytes (1 to 4) used by the
+// minimal encoding of the argument remaining length. If the remaining length
+// exceeds the maximum allowed by MQTT RemainingLengthEncodedWidth returns 0.
+func RemainingLengthEncodedWidth(remainingLength uint32) (width int) {
 	switch {
-	case rl <= 0x7F:
-		sz = 2
-	case rl <= 0xff7f:
-		sz = 3
-	case rl <= 0xffff_7f:
-		sz = 4
-	case rl < maxRemainingLengthValue:
-		sz = 5
+	case remainingLength <= 0x7f:
+		width = 1
+	case remainingLength <= 0x3fff:
+		width = 2
+	case remainingLength <= 0x1f_ffff:
+		width = 3
+	case remainingLength <= maxRemainingLengthValue:
+		width = 4
 	default:
-		// sz = 0 // Not needed since sz's default value is zero.
+		// width = 0 // Not needed since width's default value is zero.
 	}
-	return sz
+	return width
 }
 
 // HasPacketIdentifier returns true if the MQTT packet has a 2 octet packet identifier number.
@@ -98,19 +140,61 @@ func (pf PacketFlags) Retain() bool { return pf&1 != 0 }
 // If the DUP flag is set to 0, it indicates that this is the first occasion that the Client or Server has attempted to send this MQTT PUBLISH Packet.
 func (pf PacketFlags) Dup() bool { return pf&(1<<3) != 0 }
 
-// String returns a pretty string representation of pf. Allocates memory.
+// String returns a pretty string representation of pf decoded as PUBLISH flags
+// as [PacketFlags.PublishString] does, i.e. "QoS1,DUP,RETAIN". pf does not carry its packet type,
+// use [PacketFlags.StringForType] to format flags of other packet types. Allocates memory.
 func (pf PacketFlags) String() string {
 	if pf > 15 {
 		return "invalid packet flags"
 	}
-	s := pf.QoS().String()
+	return pf.PublishString()
+}
+
+// StringForType returns a pretty string representation of pf as the flags of
+// a packet of type tp. PUBLISH flags are formatted as [PacketFlags.String] does.
+// Flags of other packet types are reserved and formatted as the raw nibble, i.e. "0b0010".
+func (pf PacketFlags) StringForType(tp PacketType) string {
+	if tp == PacketPublish {
+		return pf.String()
+	}
+	if pf > 15 {
+		return "invalid packet flags"
+	}
+	var buf [6]byte
+	return string(pf.appendNibble(buf[:0]))
+}
+
+// appendNibble appends the 4 flag bits of pf to dst in binary, i.e. "0b0010".
+func (pf PacketFlags) appendNibble(dst []byte) []byte {
+	dst = append(dst, "0b"...)
+	for bit := 3; bit >= 0; bit-- {
+		dst = append(dst, '0'+byte(pf>>bit)&1)
+	}
+	return dst
+}
+
+// PublishString returns the PUBLISH flags of pf formatted for logging, i.e. "QoS1,DUP,RETAIN".
+// The reserved QoS value of 3 is formatted as "QoS?".
+func (pf PacketFlags) PublishString() string {
+	var buf [16]byte
+	return string(pf.appendPublish(buf[:0]))
+}
+
+// appendPublish appends the PublishString representation of pf to dst.
+func (pf PacketFlags) appendPublish(dst []byte) []byte {
+	dst = append(dst, "QoS"...)
+	if qos := pf.QoS(); qos <= QoS2 {
+		dst = append(dst, '0'+byte(qos))
+	} else {
+		dst = append(dst, '?')
+	}
 	if pf.Dup() {
-		s += "/DUP"
+		dst = append(dst, ",DUP"...)
 	}
 	if pf.Retain() {
-		s += "/RET"
+		dst = append(dst, ",RETAIN"...)
 	}
-	return s
+	return dst
 }
 
 // NewPublishFlags returns PUBLISH packet flags and an error if the flags were
@@ -125,6 +209,26 @@ func NewPublishFlags(qos QoSLevel, dup, retain bool) (PacketFlags, error) {
 	return PacketFlags(b2u8(retain) | (b2u8(dup) << 3) | uint8(qos<<1)), nil
 }
 
+// PublishOptions is a bitfield of PUBLISH packet options other than QoS.
+type PublishOptions uint8
+
+const (
+	// PublishDup sets the DUP flag. See [PacketFlags.Dup].
+	PublishDup PublishOptions = 1 << iota
+	// PublishRetain sets the RETAIN flag. See [PacketFlags.Retain].
+	PublishRetain
+)
+
+// PublishFlagsFromOptions returns PUBLISH packet flags and an error if the flags
+// were to create a malformed packet according to MQTT specification. It is equivalent
+// to [NewPublishFlags] with the DUP and RETAIN bits taken from opts.
+func PublishFlagsFromOptions(qos QoSLevel, opts PublishOptions) (PacketFlags, error) {
+	if opts&^(PublishDup|PublishRetain) != 0 {
+		return 0, errors.New("invalid publish options")
+	}
+	return NewPublishFlags(qos, opts&PublishDup != 0, opts&PublishRetain != 0)
+}
+
 // NewHeader creates a new Header for a packetType and returns an error if invalid
 // arguments are passed in. It will set expected reserved flags for non-PUBLISH packets.
 func NewHeader(packetType PacketType, packetFlags PacketFlags, remainingLen uint32) (Header, error) {
@@ -183,15 +287,60 @@ func (h Header) Flags() PacketFlags { return PacketFlags(h.firstByte & 0b1111) }
 // Type returns the packet type with no validation.
 func (h Header) Type() PacketType { return PacketType(h.firstByte >> 4) }
 
+// QoS returns the QoS level of a PUBLISH packet. QoS is meaningless for other
+// packet types, for which QoS0 is returned.
+func (h Header) QoS() QoSLevel {
+	if h.Type() != PacketPublish {
+		return QoS0
+	}
+	return h.Flags().QoS()
+}
+
+// IsRetain returns true if h is the header of a PUBLISH packet with the RETAIN flag set.
+func (h Header) IsRetain() bool { return h.Type() == PacketPublish && h.Flags().Retain() }
+
+// IsDup returns true if h is the header of a PUBLISH packet with the DUP flag set.
+func (h Header) IsDup() bool { return h.Type() == PacketPublish && h.Flags().Dup() }
+
 // String returns a pretty-string representation of h. Allocates memory.
 func (h Header) String() string {
-	return h.Type().String() + " " + h.Flags().String() + " remlen: 0x" + strconv.FormatUint(uint64(h.RemainingLength), 16)
+	return h.Type().String() + " " + h.Flags().StringForType(h.Type()) + " remlen: 0x" + strconv.FormatUint(uint64(h.RemainingLength), 16)
+}
+
+// MarshalText implements [encoding.TextMarshaler]. It returns a stable key=value
+// representation of the header meant for structured logging, unlike String's. PUBLISH
+// headers show their decoded flags while other packet types show their reserved flag bits:
+//
+//	type=PUBLISH qos=1 dup=false retain=true remlen=42
+//	type=PUBREL flags=0b0010 remlen=2
+func (h Header) MarshalText() ([]byte, error) {
+	return h.appendText(make([]byte, 0, 64)), nil
+}
+
+// appendText appends the representation returned by MarshalText to dst.
+func (h Header) appendText(dst []byte) []byte {
+	dst = append(dst, "type="...)
+	dst = append(dst, h.Type().String()...)
+	flags := h.Flags()
+	if h.Type() == PacketPublish {
+		dst = append(dst, " qos="...)
+		dst = strconv.AppendUint(dst, uint64(flags.QoS()), 10)
+		dst = append(dst, " dup="...)
+		dst = strconv.AppendBool(dst, flags.Dup())
+		dst = append(dst, " retain="...)
+		dst = strconv.AppendBool(dst, flags.Retain())
+	} else {
+		dst = append(dst, " flags="...)
+		dst = flags.appendNibble(dst)
+	}
+	dst = append(dst, " remlen="...)
+	return strconv.AppendUint(dst, uint64(h.RemainingLength), 10)
 }
 
 // PacketType lists in definitions.go
 
 func (p PacketType) validateFlags(flag4bits PacketFlags) error {
-	onlyBit1Set := flag4bits&^(1<<1) == 0
+	onlyBit1Set := flag4bits == PacketFlagsPubrelSubUnsub
 	isControlPacket := p == PacketPubrel || p == PacketSubscribe || p == PacketUnsubscribe
 	if p == PacketPublish || (onlyBit1Set && isControlPacket) || (!isControlPacket && flag4bits == 0) {
 		return nil
@@ -273,6 +422,20 @@ func (qos QoSLevel) String() (s string) {
 	return s
 }
 
+// wrappedError adds detail to a sentinel error while still matching it with [errors.Is].
+type wrappedError struct {
+	msg string
+	err error
+}
+
+// wrapErr returns an error with message "<sentinel message>: <detail>" that unwraps to sentinel.
+func wrapErr(sentinel error, detail string) error {
+	return &wrappedError{msg: sentinel.Error() + ": " + detail, err: sentinel}
+}
+
+func (e *wrappedError) Error() string { return e.msg }
+func (e *wrappedError) Unwrap() error { return e.err }
+
 // Packet specific functions
 
 // VariablesConnect all strings in the variable header must be UTF-8 encoded
@@ -285,7 +448,9 @@ type VariablesConnect struct {
 	Protocol []byte
 	Username []byte
 	// For password to be used username must also be set. See [MQTT-3.1.2-22].
-	Password    []byte
+	Password []byte
+	// WillTopic and WillMessage are the Will Message the server publishes on unexpected
+	// disconnection of the client. A non-empty WillTopic sets the will flag, see [VariablesConnect.SetWill].
 	WillTopic   []byte
 	WillMessage []byte
 	// KeepAlive is a interval measured in seconds. it is the maximum time interval that is
@@ -299,6 +464,31 @@ type VariablesConnect struct {
 	CleanSession bool
 	// These two bits specify the QoS level to be used when publishing the Will Message.
 	WillQoS QoSLevel
+	// Properties are the MQTT 5.0 CONNECT properties. They are only encoded and
+	// decoded when ProtocolLevel is [ProtocolLevel5].
+	Properties []Property
+}
+
+// Equal returns true if vc and other have equal fields, including will flags,
+// credentials and properties. Nil and empty byte slices are considered equal.
+func (vc *VariablesConnect) Equal(other *VariablesConnect) bool {
+	if vc.KeepAlive != other.KeepAlive || vc.ProtocolLevel != other.ProtocolLevel ||
+		vc.WillRetain != other.WillRetain || vc.CleanSession != other.CleanSession ||
+		vc.WillQoS != other.WillQoS || len(vc.Properties) != len(other.Properties) {
+		return false
+	}
+	if !bytes.Equal(vc.ClientID, other.ClientID) || !bytes.Equal(vc.Protocol, other.Protocol) ||
+		!bytes.Equal(vc.Username, other.Username) || !bytes.Equal(vc.Password, other.Password) ||
+		!bytes.Equal(vc.WillTopic, other.WillTopic) || !bytes.Equal(vc.WillMessage, other.WillMessage) {
+		return false
+	}
+	for i, p := range vc.Properties {
+		q := other.Properties[i]
+		if p.ID != q.ID || p.Value != q.Value || !bytes.Equal(p.Data, q.Data) || !bytes.Equal(p.UserValue, q.UserValue) {
+			return false
+		}
+	}
+	return true
 }
 
 // Size returns size-on-wire of the CONNECT variable header generated by vs.
@@ -312,9 +502,21 @@ func (vc *VariablesConnect) Size() (sz int) {
 		sz += len(vc.WillTopic) + len(vc.WillMessage) + 4
 	}
 	sz += len(vc.ClientID) + len(vc.Protocol) + 4
+	if vc.ProtocolLevel == ProtocolLevel5 {
+		sz += propertyBlockSize(vc.Properties)
+		if vc.WillFlag() {
+			sz++ // Empty will properties.
+		}
+	}
 	return sz + 1 + 2 + 1 // Add Connect flags (1), Protocol level (1) and keepalive (2).
 }
 
+// sizeV5 returns size-on-wire of the PUBLISH variable header generated by vp including
+// its MQTT 5.0 properties.
+func (vp VariablesPublish) sizeV5(qos QoSLevel) int {
+	return vp.Size(qos) + publishPropertiesSize(vp)
+}
+
 // StringsLen returns length of all strings in variable header before being encoded.
 // StringsLen is useful to know how much of the user's buffer was consumed during decoding.
 func (vc *VariablesConnect) StringsLen() (n int) {
@@ -324,6 +526,11 @@ func (vc *VariablesConnect) StringsLen() (n int) {
 	if vc.WillFlag() {
 		n += len(vc.WillTopic) + len(vc.WillMessage)
 	}
+	if vc.ProtocolLevel == ProtocolLevel5 {
+		for _, p := range vc.Properties {
+			n += len(p.Data) + len(p.UserValue)
+		}
+	}
 	return len(vc.ClientID) + len(vc.Protocol) + len(vc.Username)
 }
 
@@ -332,13 +539,33 @@ func (vc *VariablesConnect) Flags() byte {
 	willFlag := vc.WillFlag()
 	hasUsername := len(vc.Username) != 0
 	return b2u8(hasUsername)<<7 | b2u8(hasUsername && len(vc.Password) != 0)<<6 | // See  [MQTT-3.1.2-22].
-		b2u8(vc.WillRetain)<<5 | byte(vc.WillQoS&0b11)<<3 |
+		// Will QoS and Will Retain must be zero without a will [MQTT-3.1.2-13] [MQTT-3.1.2-15].
+		b2u8(willFlag && vc.WillRetain)<<5 | byte(vc.WillQoS&0b11)*b2u8(willFlag)<<3 |
 		b2u8(willFlag)<<2 | b2u8(vc.CleanSession)<<1
 }
 
 // WillFlag returns true if CONNECT packet will have a will topic and a will message, which means setting Will Flag bit to 1.
+// The will flag is set if WillTopic is non-empty. The will message may be empty.
 func (vc *VariablesConnect) WillFlag() bool {
-	return len(vc.WillTopic) != 0 && len(vc.WillMessage) != 0
+	return len(vc.WillTopic) != 0
+}
+
+// SetWill sets the Will Message published by the server with the given QoS and retain flag
+// when the network connection is closed without a DISCONNECT packet. The will topic must
+// be a valid topic name, it is validated when the CONNECT packet is written by [Tx.WriteConnect].
+// The Will Message is not part of the session state so CleanSession does not affect it:
+// the server discards it once published or on receipt of a DISCONNECT packet and it
+// must be set on every CONNECT, including those resuming a session.
+func (vc *VariablesConnect) SetWill(topic, message []byte, qos QoSLevel, retain bool) {
+	vc.WillTopic = topic
+	vc.WillMessage = message
+	vc.WillQoS = qos
+	vc.WillRetain = retain
+}
+
+// ClearWill zeroes the Will Message fields so that no will is sent with the CONNECT packet.
+func (vc *VariablesConnect) ClearWill() {
+	vc.SetWill(nil, nil, QoS0, false)
 }
 
 // VarConnack TODO
@@ -351,6 +578,11 @@ type VariablesPublish struct {
 	TopicName []byte
 	// Only present (non-zero) in QoS level 1 or 2.
 	PacketIdentifier uint16
+	// TopicAlias is the MQTT 5.0 Topic Alias property, only encoded and decoded over
+	// connections with protocol level [ProtocolLevel5]. Zero means no alias. A PUBLISH
+	// with a topic name and an alias maps the alias to the topic name for the rest of the connection.
+	// A PUBLISH with an empty topic name and a previously mapped alias is sent to the alias' topic.
+	TopicAlias uint16
 }
 
 func (vp VariablesPublish) Validate() error {
@@ -375,6 +607,20 @@ func (vp VariablesPublish) Size(qos QoSLevel) int {
 // StringsLen is useful to know how much of the user's buffer was consumed during decoding.
 func (vp VariablesPublish) StringsLen() int { return len(vp.TopicName) }
 
+// AckResponse returns the packet type and identifier a receiver responds with to a PUBLISH
+// of vp's variables received with the argument QoS: a PUBACK for QoS1 and a PUBREC for QoS2,
+// which starts the QoS2 exchange concluded by the receiver's PUBCOMP in response to the sender's PUBREL.
+// QoS0 PUBLISH packets are not responded to, in which case a zero packet type is returned.
+func (vp VariablesPublish) AckResponse(qos QoSLevel) (PacketType, uint16) {
+	switch qos {
+	case QoS1:
+		return PacketPuback, vp.PacketIdentifier
+	case QoS2:
+		return PacketPubrec, vp.PacketIdentifier
+	}
+	return 0, 0
+}
+
 // VariablesSubscribe represents the variable header of a SUBSCRIBE packet.
 // It encodes the topic filters requested by a Client and the desired QoS for each topic.
 type VariablesSubscribe struct {
@@ -390,6 +636,10 @@ func (vs VariablesSubscribe) Size() (sz int) {
 	return sz + 2 // Add packet ID.
 }
 
+// NumFilters returns the amount of topic filters in vs. It is the amount
+// of return codes expected in the corresponding SUBACK.
+func (vs VariablesSubscribe) NumFilters() int { return len(vs.TopicFilters) }
+
 // StringsLen returns length of all strings in variable header before being encoded.
 // StringsLen is useful to know how much of the user's buffer was consumed during decoding.
 func (vs VariablesSubscribe) StringsLen() (n int) {
@@ -463,6 +713,20 @@ type VariablesConnack struct {
 	ReturnCode ConnectReturnCode
 }
 
+// NewConnack returns CONNACK variables with the return code and the session present
+// flag set in AckFlags. It returns [ErrConnackSessionPresent] if sessionPresent is
+// set for a return code other than [ReturnCodeConnAccepted] and [ErrUnknownConnackCode]
+// if code is not defined by MQTT v3.1.1. See [VariablesConnack.SessionPresent].
+func NewConnack(code ConnectReturnCode, sessionPresent bool) (VariablesConnack, error) {
+	if code >= minInvalidReturnCode {
+		return VariablesConnack{}, ErrUnknownConnackCode{Code: byte(code)}
+	}
+	if sessionPresent && code != ReturnCodeConnAccepted {
+		return VariablesConnack{}, ErrConnackSessionPresent
+	}
+	return VariablesConnack{AckFlags: b2u8(sessionPresent), ReturnCode: code}, nil
+}
+
 // String returns a pretty-string representation of CONNACK variable header.
 func (vc VariablesConnack) String() string {
 	sp := vc.SessionPresent()
@@ -481,6 +745,9 @@ func (vc VariablesConnack) String() string {
 // Size returns size-on-wire of the CONNACK variable header generated by vs.
 func (vc VariablesConnack) Size() (sz int) { return 1 + 1 }
 
+// Accepted returns true if the CONNACK return code indicates the server accepted the connection.
+func (vc VariablesConnack) Accepted() bool { return vc.ReturnCode == ReturnCodeConnAccepted }
+
 // SessionPresent returns true if the SP bit is set in the CONNACK Ack flags. This bit indicates whether
 // the ClientID already has a session on the server.
 //   - If server accepts a connection with CleanSession set to 1 the server MUST set SP to 0 (false).
@@ -495,11 +762,62 @@ func (vc VariablesConnack) SessionPresent() bool { return vc.AckFlags&1 != 0 }
 // validate provides early validation of CONNACK variables.
 func (vc VariablesConnack) validate() error {
 	if vc.AckFlags&^1 != 0 {
-		return errors.New("CONNACK Ack flag bits 7-1 must be set to 0")
+		return ErrBadConnackFlags
+	}
+	if vc.ReturnCode >= minInvalidReturnCode {
+		return ErrUnknownConnackCode{Code: byte(vc.ReturnCode)}
 	}
 	return nil
 }
 
+// ErrUnknownConnackCode is returned when decoding a CONNACK packet with a return
+// code outside of the range defined by MQTT v3.1.1. Code is the raw return code byte.
+type ErrUnknownConnackCode struct {
+	Code byte
+}
+
+// Error implements the error interface.
+func (e ErrUnknownConnackCode) Error() string {
+	return "natiu-mqtt: unknown CONNACK return code " + strconv.Itoa(int(e.Code))
+}
+
+// ErrUnacceptableProtocolLevel is returned by [Rx] when a CONNECT packet received has
+// a protocol level not listed in AcceptedProtocolLevels. It matches
+// [ReturnCodeUnnaceptableProtocol] with errors.Is so a server may respond with a CONNACK
+// carrying the return code before closing the connection [MQTT-3.1.2-2].
+type ErrUnacceptableProtocolLevel struct {
+	Level byte
+}
+
+// Error implements the error interface.
+func (e ErrUnacceptableProtocolLevel) Error() string {
+	return "natiu-mqtt: unacceptable CONNECT protocol level " + strconv.Itoa(int(e.Level))
+}
+
+// Is returns true if target is [ReturnCodeUnnaceptableProtocol].
+func (e ErrUnacceptableProtocolLevel) Is(target error) bool {
+	return target == ReturnCodeUnnaceptableProtocol
+}
+
+// ReturnCode returns the CONNACK return code a server should respond with.
+func (e ErrUnacceptableProtocolLevel) ReturnCode() ConnectReturnCode {
+	return ReturnCodeUnnaceptableProtocol
+}
+
+// ErrBadSubscribeOptions is returned by [Rx] in strict mode when a SUBSCRIBE packet's
+// topic filter is followed by an options byte not valid in MQTT v3.1.1, that is with
+// any of the reserved bits 2-7 set, i.e. MQTT v5 subscription options, or a QoS of 3.
+// Options is the raw options byte and Topic the topic filter it follows.
+type ErrBadSubscribeOptions struct {
+	Topic   string
+	Options byte
+}
+
+// Error implements the error interface.
+func (e ErrBadSubscribeOptions) Error() string {
+	return "natiu-mqtt: bad SUBSCRIBE options " + strconv.Itoa(int(e.Options)) + " for topic filter " + strconv.Quote(e.Topic)
+}
+
 // ConnectReturnCode defined in definitions.go
 
 // String returns a pretty-string representation of rc indicating if
@@ -540,7 +858,7 @@ func DecodeHeader(transp io.Reader) (Header, int, error) {
 	}
 	packetType := PacketType(firstByte >> 4)
 	if packetType == 0 || packetType > PacketDisconnect {
-		return Header{}, n, errors.New("invalid packet type")
+		return Header{}, n, ErrForbiddenPacketType
 	}
 	packetFlags := PacketFlags(firstByte & 0b1111)
 	if err := packetType.validateFlags(packetFlags); err != nil {
@@ -554,6 +872,19 @@ func DecodeHeader(transp io.Reader) (Header, int, error) {
 	return hdr, n, nil
 }
 
+// PeekIsMQTT reports whether firstByte could legally begin an MQTT v3.1.1 packet, that is
+// whether it holds a valid packet type and flags. It lets a server accepting connections on
+// a port shared with other protocols reject traffic such as HTTP requests or TLS handshakes
+// after reading a single byte. The first packet of a connection must also be a CONNECT,
+// which servers may check with PacketType(firstByte>>4) == PacketConnect.
+func PeekIsMQTT(firstByte byte) bool {
+	packetType := PacketType(firstByte >> 4)
+	if packetType == 0 || packetType > PacketDisconnect {
+		return false
+	}
+	return Header{firstByte: firstByte}.Validate() == nil
+}
+
 // mqttStringSize returns the size on wire occupied
 // by an *OPTIONAL* MQTT encoded string. If string is zero length returns 0.
 func mqttStringSize(b []byte) int {
@@ -564,6 +895,49 @@ func mqttStringSize(b []byte) int {
 	return 0
 }
 
+// ClampKeepAlive returns the keepalive in seconds a server with a maximum
+// keepalive of serverMax should enforce for a CONNECT requesting a keepalive of requested.
+// A requested keepalive of 0 disables the keepalive mechanism and is returned as is since
+// MQTT v3.1.1 servers may not override it, see the Min field of [KeepAlivePolicy] to forbid it.
+// A serverMax of 0 means the server imposes no maximum.
+func ClampKeepAlive(requested, serverMax uint16) uint16 {
+	if serverMax != 0 && requested > serverMax {
+		return serverMax
+	}
+	return requested
+}
+
+// KeepAlivePolicy is a server side policy on the keepalive requested by clients in CONNECT.
+// It prevents clients from requesting keepalives so short they generate excessive PINGREQ traffic
+// or so long (or disabled) that dead connections go undetected.
+type KeepAlivePolicy struct {
+	// Min is the minimum keepalive in seconds accepted. Zero means no minimum.
+	// A non-zero Min also forbids clients from disabling the keepalive mechanism.
+	Min uint16
+	// Max is the maximum keepalive in seconds accepted. Zero means no maximum. See [ClampKeepAlive].
+	// Max does not apply to a disabled keepalive, which is kept as is unless Min is non-zero.
+	Max uint16
+	// RejectCode, if non-zero, is the CONNACK return code with which a CONNECT
+	// requesting a keepalive outside of policy is rejected. If zero the requested
+	// keepalive is clamped to the policy's bounds.
+	RejectCode ConnectReturnCode
+}
+
+// Apply returns the effective keepalive in seconds for a CONNECT requesting a keepalive of requested.
+// If the requested keepalive is outside of policy and RejectCode is set then the requested keepalive
+// is returned unmodified along with RejectCode, which should be sent in the CONNACK.
+// Otherwise the returned code is [ReturnCodeConnAccepted].
+func (kp KeepAlivePolicy) Apply(requested uint16) (uint16, ConnectReturnCode) {
+	effective := ClampKeepAlive(requested, kp.Max)
+	if effective < kp.Min {
+		effective = kp.Min
+	}
+	if effective != requested && kp.RejectCode != ReturnCodeConnAccepted {
+		return requested, kp.RejectCode
+	}
+	return effective, ReturnCodeConnAccepted
+}
+
 // SetDefaultMQTT sets required fields, like the ClientID, Protocol and Protocol level fields.
 // If KeepAlive is zero, is set to 60 (one minute). If Protocol field is not set to "MQTT" then memory is allocated for it.
 // Clean session is also set to true.
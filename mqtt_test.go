@@ -3,11 +3,18 @@ package mqtt
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding"
 	"errors"
 	"fmt"
 	"io"
 	"math"
+	"math/rand"
 	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -101,28 +108,28 @@ func (rxtx *RxTx) ShallowCopy() *RxTx {
 
 // SetTransport sets the rxtx's reader and writer.
 func (rxtx *RxTx) SetTransport(transport io.ReadWriteCloser) {
-	rxtx.rxTrp = transport
-	rxtx.txTrp = transport
+	rxtx.SetRxTransport(transport)
+	rxtx.SetTxTransport(transport)
 }
 
 func FuzzRxTxReadNextPacket(f *testing.F) {
 	const maxSize = 1500
 	testCases := [][]byte{
-		// Typical connect packet.
-		[]byte("\x10\x1e\x00\x04MQTT\x04\xec\x00<\x00\x020w\x00\x02Bw\x00\x02Aw\x00\x02Cw\x00\x02Dw"),
-		// Typical connack
+		// Connack missing its packet type.
 		[]byte("\x02\x01\x04"),
-		// A Publish packet
-		[]byte(";\x8e\x01\x00&now-for-something-completely-different\xff\xffertytgbhjjhundsaip;vf[oniw[aondmiksfvoWDNFOEWOPndsafr;poulikujyhtgbfrvdcsxzaesxt dfcgvfhbg kjnlkm/'."),
-		// A subscribe packet.
-		[]byte("\x824\xff\xff\x00\tfavorites\x02\x00\tthe-clash\x02\x00\x0falways-watching\x02\x00\x05k-pop\x02"),
-		// Unsubscribe packet
-		[]byte("\xa2$\xff\xff\x00\x06topic1\x00\x06topic2\x00\x06topic3\x00\bsemperfi"),
-		// Suback packet.
-		[]byte("\x90\b\xff\xff\x00\x01\x00\x02\x80\x01"),
-		// Pubrel packet.
-		[]byte("b\x02\f\xa0"),
+		// Pingreq with overlong remaining length encoding.
+		[]byte("\xc0\x80\x00"),
+		// QoS acknowledgement packets with wrong flags.
+		[]byte("\x42\x02\x00\x01"),
+		[]byte("\x52\x02\x00\x01"),
+		[]byte("\x60\x02\x00\x01"),
+		[]byte("\x72\x02\x00\x01"),
+		// Unsubscribe with no topics.
+		[]byte("\xa2\x02\x00\x01"),
+		// Unsubscribe with a zero-length topic.
+		[]byte("\xa2\x0a\x00\x01\x00\x01a\x00\x00\x00\x01b"),
 	}
+	testCases = append(testCases, validPackets...)
 	testCases = append(testCases, fuzzCorpus...)
 	for _, tc := range testCases {
 		f.Add(tc) // Provide seed corpus.
@@ -133,7 +140,7 @@ func FuzzRxTxReadNextPacket(f *testing.F) {
 			return
 		}
 		buf := newLoopbackTransport()
-		_, err := writeFull(buf, a)
+		_, err := WriteFull(buf, a)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -171,7 +178,7 @@ func TestHeaderLoopback(t *testing.T) {
 		}
 		flagsGot := h.Flags()
 		if header.tp == PacketPublish && flagsGot != header.flags {
-			t.Error("publish flag mismatch", flagsGot, header.flags)
+			t.Errorf("publish flag mismatch: got %s, expected %s", flagsGot, header.flags)
 		}
 		typeGot := h.Type()
 		if typeGot != header.tp {
@@ -180,6 +187,95 @@ func TestHeaderLoopback(t *testing.T) {
 	}
 }
 
+func TestRxTxHalfClose(t *testing.T) {
+	var rx Rx
+	var tx Tx
+	if rx.CloseRx() == nil || tx.CloseTx() == nil {
+		t.Error("expected error closing nil transport")
+	}
+	// Shared transport: closing either direction affects both.
+	shared := &testTransport{&bytes.Buffer{}}
+	rx.SetRxTransport(shared)
+	tx.SetTxTransport(shared)
+	if err := rx.CloseRx(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rx.ReadNextPacket(); err != io.ErrClosedPipe {
+		t.Errorf("read after CloseRx: got %v, expected %v", err, io.ErrClosedPipe)
+	}
+	if err := tx.WritePingreq(); err != io.ErrClosedPipe {
+		t.Errorf("write over shared transport after CloseRx: got %v, expected %v", err, io.ErrClosedPipe)
+	}
+	// Distinct transports close independently.
+	var rxBuf, txBuf bytes.Buffer
+	rx.SetRxTransport(&testTransport{&rxBuf})
+	tx.SetTxTransport(&testTransport{&txBuf})
+	if err := tx.CloseTx(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.WritePingreq(); err != io.ErrClosedPipe {
+		t.Errorf("write after CloseTx: got %v, expected %v", err, io.ErrClosedPipe)
+	}
+	rxBuf.WriteString("\xc0\x00") // PINGREQ.
+	if _, err := rx.ReadNextPacket(); err != nil {
+		t.Errorf("read after closing distinct Tx transport: %v", err)
+	}
+	// Close errors are returned.
+	errClose := errors.New("close failed")
+	rx.SetRxTransport(closeErrTransport{errClose})
+	if err := rx.CloseRx(); err != errClose {
+		t.Errorf("got %v, expected %v", err, errClose)
+	}
+}
+
+func TestRxTxSharedClose(t *testing.T) {
+	pipe := func() (net.Conn, net.Conn) { return net.Pipe() }
+	tcp := func() (net.Conn, net.Conn) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Skip(err)
+		}
+		defer l.Close()
+		c1, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c2, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c1, c2
+	}
+	for name, newConns := range map[string]func() (net.Conn, net.Conn){"pipe": pipe, "tcp": tcp} {
+		for _, closeRx := range []bool{true, false} {
+			conn, other := newConns()
+			defer other.Close()
+			var rx Rx
+			var tx Tx
+			rx.SetRxTransport(conn)
+			tx.SetTxTransport(conn)
+			if closeRx {
+				rx.CloseRx()
+			} else {
+				tx.CloseTx()
+			}
+			if _, err := rx.ReadNextPacket(); err != io.ErrClosedPipe {
+				t.Errorf("%s closeRx=%v: read got %v, expected %v", name, closeRx, err, io.ErrClosedPipe)
+			}
+			if err := tx.WritePingreq(); err != io.ErrClosedPipe {
+				t.Errorf("%s closeRx=%v: write got %v, expected %v", name, closeRx, err, io.ErrClosedPipe)
+			}
+		}
+	}
+}
+
+// closeErrTransport returns err on Close.
+type closeErrTransport struct{ err error }
+
+func (closeErrTransport) Read([]byte) (int, error)  { return 0, io.EOF }
+func (closeErrTransport) Write([]byte) (int, error) { return 0, io.EOF }
+func (t closeErrTransport) Close() error            { return t.err }
+
 func TestRxTxBadPacketRxErrors(t *testing.T) {
 	rxtx, err := NewRxTx(&testTransport{}, DecoderNoAlloc{UserBuffer: make([]byte, 1500)})
 	if err != nil {
@@ -188,20 +284,25 @@ func TestRxTxBadPacketRxErrors(t *testing.T) {
 	for _, test := range []struct {
 		reason string
 		rx     []byte
+		// expect is the error expected with errors.Is. If nil any error is accepted.
+		expect error
 	}{
-		{"no contents", []byte("")},
-		{"EOF during fixed header", []byte("\x01")},
-		{"forbidden packet type 0", []byte("\x00\x00")},
-		{"forbidden packet type 15", []byte("\xf0\x00")},
-		{"missing CONNECT var header and bad remaining length", []byte("\x10\x0a")},
-		{"missing CONNECT var header", []byte("\x10\x00")},
-		{"missing CONNACK var header", []byte("\x20\x00")},
-		{"missing PUBLISH var header", []byte("\x30\x00")},
-		{"missing PUBACK var header", []byte("\x40\x00")},
-		{"missing SUBSCRIBE var header", []byte("\x80\x00")},
-		{"missing SUBACK var header", []byte("\x90\x00")},
-		{"missing UNSUBSCRIBE var header", []byte("\xa0\x00")},
-		{"missing UNSUBACK var header", []byte("\xb0\x00")},
+		{"no contents", []byte(""), io.EOF},
+		{"EOF during fixed header", []byte("\x01"), io.ErrUnexpectedEOF},
+		{"forbidden packet type 0", []byte("\x00\x00"), ErrForbiddenPacketType},
+		{"forbidden packet type 15", []byte("\xf0\x00"), ErrForbiddenPacketType},
+		{"overlong remaining length", []byte("\xc0\x80\x00"), ErrBadRemainingLen},
+		{"remaining length exceeds 4 bytes", []byte("\xc0\xff\xff\xff\xff\x01"), ErrBadRemainingLen},
+		{"missing CONNECT var header and bad remaining length", []byte("\x10\x0a"), io.ErrUnexpectedEOF},
+		{"missing CONNECT var header", []byte("\x10\x00"), io.ErrUnexpectedEOF},
+		{"missing CONNACK var header", []byte("\x20\x00"), ErrBadRemainingLen},
+		{"missing PUBLISH var header", []byte("\x30\x00"), io.ErrUnexpectedEOF},
+		{"PUBLISH topic not UTF-8", []byte("\x30\x04\x00\x02a\xff"), ErrBadUTF8},
+		{"missing PUBACK var header", []byte("\x40\x00"), ErrBadRemainingLen},
+		{"missing SUBSCRIBE var header", []byte("\x80\x00"), nil},
+		{"missing SUBACK var header", []byte("\x90\x00"), ErrBadRemainingLen},
+		{"missing UNSUBSCRIBE var header", []byte("\xa0\x00"), nil},
+		{"missing UNSUBACK var header", []byte("\xb0\x00"), ErrBadRemainingLen},
 	} {
 		buf := newLoopbackTransport()
 		rxtx.SetTransport(buf)
@@ -212,6 +313,26 @@ func TestRxTxBadPacketRxErrors(t *testing.T) {
 		_, err = rxtx.ReadNextPacket()
 		if err == nil {
 			t.Error("expected error for case:", test.reason)
+		} else if test.expect != nil && !errors.Is(err, test.expect) {
+			t.Errorf("%s: got error %q, expected %q", test.reason, err, test.expect)
+		}
+	}
+}
+
+func TestDecodeQoSAckFlags(t *testing.T) {
+	for _, packetType := range []PacketType{PacketPuback, PacketPubrec, PacketPubrel, PacketPubcomp} {
+		expectFlags := PacketFlags(0)
+		if packetType == PacketPubrel {
+			expectFlags = PacketFlagsPubrelSubUnsub
+		}
+		for flags := PacketFlags(0); flags < 16; flags++ {
+			packet := []byte{byte(packetType)<<4 | byte(flags), 2, 0, 1}
+			_, _, err := DecodeHeader(bytes.NewReader(packet))
+			if flags == expectFlags && err != nil {
+				t.Errorf("%s with flags %04b: unexpected error %v", packetType, flags, err)
+			} else if flags != expectFlags && err == nil {
+				t.Errorf("%s with flags %04b: expected error", packetType, flags)
+			}
 		}
 	}
 }
@@ -249,6 +370,75 @@ func TestHasPacketIdentifer(t *testing.T) {
 	}
 }
 
+func TestHeaderPublishFlags(t *testing.T) {
+	for _, test := range []struct {
+		h           Header
+		qos         QoSLevel
+		retain, dup bool
+	}{
+		{h: newHeader(PacketPublish, 0, 0), qos: QoS0},
+		{h: newHeader(PacketPublish, 0b0011, 0), qos: QoS1, retain: true},
+		{h: newHeader(PacketPublish, 0b1100, 0), qos: QoS2, dup: true},
+		{h: newHeader(PacketPublish, 0b1011, 0), qos: QoS1, retain: true, dup: true},
+		// Flag bits of other packet types are not PUBLISH flags.
+		{h: newHeader(PacketPubrel, PacketFlagsPubrelSubUnsub, 0), qos: QoS0},
+		{h: newHeader(PacketSubscribe, PacketFlagsPubrelSubUnsub, 0), qos: QoS0},
+		{h: newHeader(PacketConnect, 0, 0), qos: QoS0},
+	} {
+		if got := test.h.QoS(); got != test.qos {
+			t.Errorf("%s: got QoS %v, expected %v", test.h, got, test.qos)
+		}
+		if got := test.h.IsRetain(); got != test.retain {
+			t.Errorf("%s: got retain %v, expected %v", test.h, got, test.retain)
+		}
+		if got := test.h.IsDup(); got != test.dup {
+			t.Errorf("%s: got dup %v, expected %v", test.h, got, test.dup)
+		}
+	}
+}
+
+func TestVariablesConnectSetWill(t *testing.T) {
+	var connect VariablesConnect
+	connect.SetDefaultMQTT([]byte("salamanca"))
+	connect.SetWill([]byte("last/words"), nil, QoS1, true)
+	const willBits = 1<<5 | byte(QoS1)<<3 | 1<<2
+	if !connect.WillFlag() || connect.Flags()&willBits != willBits {
+		t.Errorf("will with empty message not reflected in flags %08b", connect.Flags())
+	}
+	var buf bytes.Buffer
+	rxtx, err := NewRxTx(&testTransport{&buf}, DecoderNoAlloc{make([]byte, 1500)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got VariablesConnect
+	rxtx.RxCallbacks.OnConnect = func(_ *Rx, vc *VariablesConnect) error {
+		got = *vc
+		return nil
+	}
+	if err = rxtx.WriteConnect(&connect); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = rxtx.ReadNextPacket(); err != nil {
+		t.Fatal(err)
+	}
+	varEqual(t, &connect, &got)
+
+	connect.ClearWill()
+	if connect.WillFlag() || connect.Flags()&willBits != 0 {
+		t.Errorf("cleared will reflected in flags %08b", connect.Flags())
+	}
+	// Will QoS and retain are not encoded without a will topic.
+	connect.WillQoS, connect.WillRetain = QoS2, true
+	if flags := connect.Flags(); flags&(1<<5|0b11<<3|1<<2) != 0 {
+		t.Errorf("will QoS and retain without will reflected in flags %08b", flags)
+	}
+	connect.WillQoS, connect.WillRetain = QoS0, false
+	connect.SetWill([]byte("last/+"), []byte("bye"), QoS0, false)
+	if err = rxtx.WriteConnect(&connect); !errors.Is(err, errTopicNameWildcard) {
+		t.Errorf("got %v, expected %v for wildcard will topic", err, errTopicNameWildcard)
+	}
+}
+
 func TestVariablesConnectFlags(t *testing.T) {
 	getFlags := func(flag byte) (username, password, willRetain, willFlag, cleanSession, reserved bool, qos QoSLevel) {
 		return flag&(1<<7) != 0, flag&(1<<6) != 0, flag&(1<<5) != 0, flag&(1<<2) != 0, flag&(1<<1) != 0, flag&1 != 0, QoSLevel(flag>>3) & 0b11
@@ -286,8 +476,8 @@ func TestVariablesConnectFlags(t *testing.T) {
 	connect.Password = []byte("123")
 	connect.CleanSession = false
 	usr, pwd, wR, wF, cs, forbidden, qos = getFlags(connect.Flags())
-	if qos != QoS2 {
-		t.Error("QoS0 default, got ", qos.String())
+	if qos != QoS0 {
+		t.Error("will QoS encoded without will [MQTT-3.1.2-13], got ", qos.String())
 	}
 	if !usr {
 		t.Error("username flag not ok")
@@ -309,6 +499,51 @@ func TestVariablesConnectFlags(t *testing.T) {
 	}
 }
 
+func TestPeekIsMQTT(t *testing.T) {
+	for _, test := range []struct {
+		desc      string
+		firstByte byte
+		expect    bool
+	}{
+		{desc: "CONNECT", firstByte: 0x10, expect: true},
+		{desc: "PUBLISH QoS1 retain", firstByte: 0x33, expect: true},
+		{desc: "PUBREL", firstByte: 0x62, expect: true},
+		{desc: "DISCONNECT", firstByte: 0xe0, expect: true},
+		{desc: "HTTP GET", firstByte: 'G'},
+		{desc: "TLS handshake", firstByte: 0x16},
+		{desc: "reserved type 0", firstByte: 0x00},
+		{desc: "reserved type 15", firstByte: 0xf0},
+		{desc: "PUBLISH QoS3", firstByte: 0x36},
+	} {
+		got := PeekIsMQTT(test.firstByte)
+		if got != test.expect {
+			t.Errorf("%s (%#x): got %v, expected %v", test.desc, test.firstByte, got, test.expect)
+		}
+	}
+}
+
+func TestHeaderMarshalText(t *testing.T) {
+	publishFlags, _ := NewPublishFlags(QoS1, false, true)
+	for _, test := range []struct {
+		hdr    Header
+		expect string
+	}{
+		{hdr: newHeader(PacketPublish, publishFlags, 42), expect: "type=PUBLISH qos=1 dup=false retain=true remlen=42"},
+		{hdr: newHeader(PacketPubrel, PacketFlagsPubrelSubUnsub, 2), expect: "type=PUBREL flags=0b0010 remlen=2"},
+		{hdr: newHeader(PacketPingreq, 0, 0), expect: "type=PINGREQ flags=0b0000 remlen=0"},
+		{hdr: newHeader(PacketConnect, 0, 300), expect: "type=CONNECT flags=0b0000 remlen=300"},
+	} {
+		var m encoding.TextMarshaler = test.hdr
+		got, err := m.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != test.expect {
+			t.Errorf("got %q, expected %q", got, test.expect)
+		}
+	}
+}
+
 func TestHeaderSize(t *testing.T) {
 	for _, test := range []struct {
 		h      Header
@@ -329,6 +564,47 @@ func TestHeaderSize(t *testing.T) {
 	}
 }
 
+func TestFixedHeaderSize(t *testing.T) {
+	var b bytes.Buffer
+	for _, remlen := range []uint32{
+		0, 0x7f, 0x80, 0x3fff, 0x4000, 0x1f_ffff, 0x20_0000, maxRemainingLengthValue, maxRemainingLengthValue + 1,
+	} {
+		hdr := newHeader(PacketPublish, 0, remlen)
+		got := FixedHeaderSize(remlen)
+		if got != hdr.Size() {
+			t.Errorf("remlen %#x: FixedHeaderSize=%d, Header.Size=%d", remlen, got, hdr.Size())
+		}
+		b.Reset()
+		n, err := hdr.Encode(&b)
+		if err != nil {
+			n = 0 // Invalid remaining length.
+		}
+		if got != n {
+			t.Errorf("remlen %#x: FixedHeaderSize=%d, encoded %d bytes", remlen, got, n)
+		}
+	}
+}
+
+func TestRemainingLengthEncodedWidth(t *testing.T) {
+	var buf [4]byte
+	for _, remlen := range []uint32{0, 0x7f, 0x80, 0x3fff, 0x4000, 0x1f_ffff, 0x20_0000, maxRemainingLengthValue} {
+		got := RemainingLengthEncodedWidth(remlen)
+		if n := encodeRemainingLength(remlen, buf[:]); got != n {
+			t.Errorf("remlen %#x: RemainingLengthEncodedWidth=%d, encoded %d bytes", remlen, got, n)
+		}
+	}
+	if RemainingLengthEncodedWidth(maxRemainingLengthValue+1) != 0 {
+		t.Error("expected 0 width for invalid remaining length")
+	}
+	// Overlong encodings are forbidden.
+	for _, overlong := range []string{"\x80\x00", "\xff\x80\x00", "\x80\x80\x00", "\x80\x80\x80\x00"} {
+		_, _, err := DecodeHeader(bytes.NewReader([]byte("\xc0" + overlong)))
+		if err == nil {
+			t.Errorf("expected error decoding overlong remaining length %q", overlong)
+		}
+	}
+}
+
 func TestHeaderEncodeDecodeLoopback(t *testing.T) {
 	var b bytes.Buffer
 	for _, test := range []struct {
@@ -371,6 +647,44 @@ func TestHeaderEncodeDecodeLoopback(t *testing.T) {
 	}
 }
 
+func TestVariablesConnectEqual(t *testing.T) {
+	newVarConn := func() *VariablesConnect {
+		var vc VariablesConnect
+		vc.SetDefaultMQTT([]byte("salamanca"))
+		vc.Username = []byte("user")
+		vc.Password = []byte("pass")
+		vc.WillTopic = []byte("will")
+		vc.WillMessage = []byte("bye")
+		vc.WillQoS = QoS1
+		return &vc
+	}
+	a := newVarConn()
+	if !a.Equal(newVarConn()) {
+		t.Fatal("expected equal CONNECT variables")
+	}
+	for name, modify := range map[string]func(*VariablesConnect){
+		"will retain":   func(vc *VariablesConnect) { vc.WillRetain = true },
+		"will QoS":      func(vc *VariablesConnect) { vc.WillQoS = QoS2 },
+		"will topic":    func(vc *VariablesConnect) { vc.WillTopic = []byte("other") },
+		"will message":  func(vc *VariablesConnect) { vc.WillMessage = nil },
+		"clean session": func(vc *VariablesConnect) { vc.CleanSession = !vc.CleanSession },
+		"keepalive":     func(vc *VariablesConnect) { vc.KeepAlive++ },
+		"client id":     func(vc *VariablesConnect) { vc.ClientID = []byte("other") },
+		"username":      func(vc *VariablesConnect) { vc.Username = []byte("other") },
+		"password":      func(vc *VariablesConnect) { vc.Password = []byte("other") },
+		"protocol":      func(vc *VariablesConnect) { vc.ProtocolLevel = ProtocolLevel5 },
+		"properties": func(vc *VariablesConnect) {
+			vc.Properties = []Property{{ID: PropReceiveMaximum, Value: 10}}
+		},
+	} {
+		b := newVarConn()
+		modify(b)
+		if a.Equal(b) || b.Equal(a) {
+			t.Errorf("%s difference not detected", name)
+		}
+	}
+}
+
 func TestVariablesConnectSize(t *testing.T) {
 	var varConn VariablesConnect
 	varConn.SetDefaultMQTT([]byte("salamanca"))
@@ -390,421 +704,4569 @@ func TestVariablesConnectSize(t *testing.T) {
 	}
 }
 
-func TestRxTxLoopback(t *testing.T) {
-	// This test starts with a long running
-	buf := newLoopbackTransport()
-	rxtx, err := NewRxTx(buf, DecoderNoAlloc{make([]byte, 1500)})
-	if err != nil {
-		t.Fatal(err)
+func TestVariablesConnackAccepted(t *testing.T) {
+	for code := ReturnCodeConnAccepted; code <= ReturnCodeUnauthorized; code++ {
+		vc := VariablesConnack{ReturnCode: code}
+		if got, expect := vc.Accepted(), code == ReturnCodeConnAccepted; got != expect {
+			t.Errorf("%s: Accepted()=%v, want %v", code, got, expect)
+		}
 	}
-	rxtx.SetTransport(buf)
-	//
-	// Send CONNECT packet over wire.
-	//
-	{
-		var varConn VariablesConnect
-		varConn.SetDefaultMQTT([]byte("0w"))
-		varConn.WillQoS = QoS1
-		varConn.WillRetain = true
-		varConn.WillMessage = []byte("Aw")
-		varConn.WillTopic = []byte("Bw")
-		varConn.Username = []byte("Cw")
-		varConn.Password = []byte("Dw")
-		remlen := uint32(varConn.Size())
-		expectHeader := newHeader(PacketConnect, 0, remlen)
-		err = rxtx.WriteConnect(&varConn)
-		if err != nil {
-			t.Fatal(err)
+}
+
+func TestPublishAckResponse(t *testing.T) {
+	vp := VariablesPublish{TopicName: []byte("a"), PacketIdentifier: 42}
+	for _, test := range []struct {
+		qos        QoSLevel
+		expectType PacketType
+		expectPI   uint16
+	}{
+		{qos: QoS0},
+		{qos: QoS1, expectType: PacketPuback, expectPI: 42},
+		{qos: QoS2, expectType: PacketPubrec, expectPI: 42},
+	} {
+		gotType, gotPI := vp.AckResponse(test.qos)
+		if gotType != test.expectType || gotPI != test.expectPI {
+			t.Errorf("%s: got %s %d, expected %s %d", test.qos, gotType, gotPI, test.expectType, test.expectPI)
 		}
-		// We now prepare to receive CONNECT packet on other side.
-		callbackExecuted := false
-		rxtx.RxCallbacks.OnConnect = func(rt *Rx, vc *VariablesConnect) error {
-			if rt.LastReceivedHeader != expectHeader {
-				t.Errorf("rxtx header mismatch, expect:%v, rxed:%v", expectHeader.String(), rt.LastReceivedHeader.String())
+	}
+}
+
+func TestPublishFlagsFromOptions(t *testing.T) {
+	for qos := QoS0; qos <= QoS2+1; qos++ {
+		for _, dup := range []bool{false, true} {
+			for _, retain := range []bool{false, true} {
+				var opts PublishOptions
+				if dup {
+					opts |= PublishDup
+				}
+				if retain {
+					opts |= PublishRetain
+				}
+				expect, expectErr := NewPublishFlags(qos, dup, retain)
+				got, err := PublishFlagsFromOptions(qos, opts)
+				if got != expect || (err == nil) != (expectErr == nil) {
+					t.Errorf("qos=%d dup=%v retain=%v: got %v,%v; NewPublishFlags got %v,%v", qos, dup, retain, got, err, expect, expectErr)
+				}
 			}
-			varEqual(t, &varConn, vc)
-			callbackExecuted = true
-			return nil
-		}
-		// Read packet that is on the "wire"
-		n, err := rxtx.ReadNextPacket()
-		if err != nil {
-			t.Fatal(err)
 		}
-		expectSize := expectHeader.Size() + varConn.Size()
-		if n != expectSize {
-			t.Errorf("read %v bytes, expected to read %v bytes", n, expectSize)
+	}
+	_, err := PublishFlagsFromOptions(QoS0, 1<<7)
+	if err == nil {
+		t.Error("expected error for invalid options")
+	}
+}
+
+func TestPacketFlagsPublishString(t *testing.T) {
+	for _, test := range []struct {
+		flags  PacketFlags
+		expect string
+	}{
+		{flags: 0, expect: "QoS0"},
+		{flags: 0b0010, expect: "QoS1"},
+		{flags: 0b1011, expect: "QoS1,DUP,RETAIN"},
+		{flags: 0b0101, expect: "QoS2,RETAIN"},
+		{flags: 0b1100, expect: "QoS2,DUP"},
+		{flags: 0b0110, expect: "QoS?"}, // Malformed QoS3.
+		{flags: 0b1111, expect: "QoS?,DUP,RETAIN"},
+	} {
+		if got := test.flags.PublishString(); got != test.expect {
+			t.Errorf("flags %#04b: got %q, expected %q", test.flags, got, test.expect)
 		}
-		if !callbackExecuted {
-			t.Error("OnConnect callback not executed")
+	}
+}
+
+func TestPacketFlagsStringForType(t *testing.T) {
+	for _, test := range []struct {
+		tp     PacketType
+		flags  PacketFlags
+		expect string
+	}{
+		{tp: PacketPublish, flags: 0, expect: "QoS0"},
+		{tp: PacketPublish, flags: 0b1011, expect: "QoS1,DUP,RETAIN"},
+		{tp: PacketPublish, flags: 0b0100, expect: "QoS2"},
+		{tp: PacketPubrel, flags: PacketFlagsPubrelSubUnsub, expect: "0b0010"},
+		{tp: PacketSubscribe, flags: PacketFlagsPubrelSubUnsub, expect: "0b0010"},
+		{tp: PacketPingreq, flags: 0, expect: "0b0000"},
+		{tp: PacketConnect, flags: 0b1001, expect: "0b1001"}, // Malformed reserved flags.
+		{tp: PacketConnack, flags: 16, expect: "invalid packet flags"},
+	} {
+		if got := test.flags.StringForType(test.tp); got != test.expect {
+			t.Errorf("%s flags %#04b: got %q, expected %q", test.tp, test.flags, got, test.expect)
 		}
 	}
-	if t.Failed() {
-		return // fix first clause before continuing.
+	if got := newHeader(PacketPubrel, PacketFlagsPubrelSubUnsub, 2).String(); got != "PUBREL 0b0010 remlen: 0x2" {
+		t.Errorf("got header string %q", got)
 	}
-	buf.rw.Reset()
-	//
-	// Send CONNACK packet over wire.
-	//
-	{
-		varConnck := VariablesConnack{
-			AckFlags:   1,                      // SP set
-			ReturnCode: ReturnCodeConnAccepted, // Accepted since SP set.
+}
+
+func TestNewConnack(t *testing.T) {
+	for _, test := range []struct {
+		code           ConnectReturnCode
+		sessionPresent bool
+		expectFlags    uint8
+		expectErr      error
+	}{
+		{code: ReturnCodeConnAccepted, sessionPresent: false, expectFlags: 0},
+		{code: ReturnCodeConnAccepted, sessionPresent: true, expectFlags: 1},
+		{code: ReturnCodeUnauthorized, sessionPresent: false, expectFlags: 0},
+		{code: ReturnCodeUnnaceptableProtocol, sessionPresent: true, expectErr: ErrConnackSessionPresent},
+		{code: minInvalidReturnCode, sessionPresent: false, expectErr: ErrUnknownConnackCode{Code: byte(minInvalidReturnCode)}},
+	} {
+		vc, err := NewConnack(test.code, test.sessionPresent)
+		if err != test.expectErr {
+			t.Errorf("%s sp=%v: got error %v, expected %v", test.code, test.sessionPresent, err, test.expectErr)
+			continue
 		}
-		err = rxtx.WriteConnack(varConnck)
 		if err != nil {
-			t.Fatal(err)
+			continue
 		}
-		expectHeader := newHeader(PacketConnack, 0, uint32(varConnck.Size()))
-		callbackExecuted := false
-		rxtx.RxCallbacks.OnConnack = func(rt *Rx, vc VariablesConnack) error {
-			if rt.LastReceivedHeader != expectHeader {
-				t.Errorf("rxtx header mismatch, expect:%v, rxed:%v", expectHeader.String(), rt.LastReceivedHeader.String())
-			}
-			varEqual(t, varConnck, vc)
-			callbackExecuted = true
-			return nil
+		if vc.AckFlags != test.expectFlags || vc.ReturnCode != test.code || vc.SessionPresent() != test.sessionPresent {
+			t.Errorf("%s sp=%v: got %+v", test.code, test.sessionPresent, vc)
 		}
+		if err = vc.validate(); err != nil {
+			t.Error(err)
+		}
+	}
+}
 
-		n, err := rxtx.ReadNextPacket()
-		if err != nil {
-			t.Fatal(err)
+func TestDecodeConnackUnknownCode(t *testing.T) {
+	buf := newLoopbackTransport()
+	rxtx, err := NewRxTx(buf, DecoderNoAlloc{make([]byte, 1500)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rxtx.RxCallbacks.OnRxError = func(*Rx, error) {}
+	buf.Write([]byte("\x20\x02\x00\x07"))
+	_, err = rxtx.ReadNextPacket()
+	var unknownCode ErrUnknownConnackCode
+	if !errors.As(err, &unknownCode) {
+		t.Fatalf("expected ErrUnknownConnackCode, got %v", err)
+	}
+	if unknownCode.Code != 7 {
+		t.Errorf("got code %d, expected 7", unknownCode.Code)
+	}
+}
+
+func TestRxAcceptedProtocolLevels(t *testing.T) {
+	var vc VariablesConnect
+	vc.SetDefaultMQTT([]byte("salamanca"))
+	var buf bytes.Buffer
+	var tx Tx
+	tx.SetTxTransport(&testTransport{&buf})
+	if err := tx.WriteConnect(&vc); err != nil {
+		t.Fatal(err)
+	}
+	v4 := append([]byte{}, buf.Bytes()...)
+	v3 := append([]byte{}, v4...)
+	v3[8] = 3 // Protocol level byte following "MQTT" protocol name.
+	for _, test := range []struct {
+		accepted     []byte
+		packet       []byte
+		expectAccept bool
+	}{
+		{accepted: nil, packet: v4, expectAccept: true},
+		{accepted: nil, packet: v3, expectAccept: false},
+		{accepted: []byte{ProtocolLevel5}, packet: v4, expectAccept: false},
+		{accepted: []byte{3, DefaultProtocolLevel}, packet: v3, expectAccept: true},
+	} {
+		// OnRxError is not set so the transport would be closed on decoding errors.
+		conn := &testTransport{bytes.NewBuffer(append(append([]byte{}, test.packet...), 0xc0, 0x00))}
+		var rx Rx
+		rx.AcceptedProtocolLevels = test.accepted
+		rx.SetRxTransport(conn)
+		rx.userDecoder = DecoderNoAlloc{UserBuffer: make([]byte, 64)}
+		connected := false
+		rx.RxCallbacks.OnConnect = func(*Rx, *VariablesConnect) error {
+			connected = true
+			return nil
 		}
-		expectSize := expectHeader.Size() + varConnck.Size()
-		if n != expectSize {
-			t.Errorf("read %v bytes, expected to read %v bytes", n, expectSize)
+		n, err := rx.ReadNextPacket()
+		if connected != test.expectAccept {
+			t.Errorf("accepted %v, level %d: got OnConnect called %v, err %v", test.accepted, test.packet[8], connected, err)
 		}
-		if !callbackExecuted {
-			t.Error("OnConnack callback not executed")
+		if test.expectAccept {
+			continue
 		}
-	}
-
-	//
-	// Send PUBLISH QoS1 packet over wire.
-	//
-	{
-		const pubQos = QoS1
-		publishPayload := []byte("PL")
-		varPublish := VariablesPublish{
-			TopicName:        []byte("TOP"),
-			PacketIdentifier: math.MaxUint16,
+		var levelErr ErrUnacceptableProtocolLevel
+		if !errors.As(err, &levelErr) || levelErr.Level != test.packet[8] || !errors.Is(err, ReturnCodeUnnaceptableProtocol) {
+			t.Errorf("accepted %v, level %d: got error %v", test.accepted, test.packet[8], err)
 		}
-		pubflags, err := NewPublishFlags(pubQos, true, true)
-		if err != nil {
-			t.Fatal(err)
+		// Rejected CONNECT is read completely so the response may be written and the stream stays in sync.
+		if n != len(test.packet) {
+			t.Errorf("got %d bytes read, expected %d", n, len(test.packet))
 		}
-		expectedRemainingLen := uint32(varPublish.Size(pubQos) + len(publishPayload))
-		publishHeader := newHeader(PacketPublish, pubflags, expectedRemainingLen)
-		err = rxtx.WritePublishPayload(publishHeader, varPublish, publishPayload)
-		if err != nil {
-			t.Fatal(err)
+		if _, err = rx.ReadNextPacket(); err != nil || rx.LastReceivedHeader.Type() != PacketPingreq {
+			t.Errorf("expected PINGREQ after rejected CONNECT, got %v, err %v", rx.LastReceivedHeader, err)
 		}
-		callbackExecuted := false
-		rxtx.RxCallbacks.OnPub = func(rt *Rx, vp VariablesPublish, r io.Reader) error {
-			b, err := io.ReadAll(r)
-			if err != nil {
-				t.Fatal(err)
-			}
-			if !bytes.Equal(b, publishPayload) {
-				t.Error("got different payloads!")
-			}
-			if rt.LastReceivedHeader != publishHeader {
-				t.Errorf("rxtx header mismatch, txed:%v, rxed:%v", publishHeader.String(), rt.LastReceivedHeader.String())
-			}
-			if vp.Size(pubQos) != varPublish.Size(pubQos) {
-				t.Errorf("mismatch between publish variable sizes")
-			}
-			varEqual(t, varPublish, vp)
-			callbackExecuted = true
-			return nil
-		}
-
-		n, err := rxtx.ReadNextPacket()
-		if err != nil {
-			t.Fatal(err)
+		// Transport is left open for the server to respond.
+		var tx Tx
+		tx.SetTxTransport(conn)
+		if err = tx.WriteConnack(VariablesConnack{ReturnCode: levelErr.ReturnCode()}); err != nil {
+			t.Errorf("writing CONNACK after rejected CONNECT: %v", err)
 		}
+	}
+}
 
-		if n != int(expectedRemainingLen) {
-			t.Errorf("read %v bytes, expected to read %v bytes", n, expectedRemainingLen)
-		}
-		if !callbackExecuted {
-			t.Error("OnPub callback not executed")
-		}
+func TestRxOnWarning(t *testing.T) {
+	buf := newLoopbackTransport()
+	rxtx, err := NewRxTx(buf, DecoderNoAlloc{make([]byte, 1500)})
+	if err != nil {
+		t.Fatal(err)
 	}
-	//
-	// Send PUBLISH QoS0 packet over wire.
-	//
-	{
-		const pubQos = QoS0
-		publishPayload := []byte("\xa6\x32")
-		varPublish := VariablesPublish{
-			TopicName:        []byte("pressure"),
-			PacketIdentifier: 0, // No packet ID for QoS0.
-		}
-		pubflags, err := NewPublishFlags(pubQos, false, false)
-		if err != nil {
-			t.Fatal(err)
-		}
-		expectedRemainingLen := uint32(varPublish.Size(pubQos) + len(publishPayload))
-		publishHeader := newHeader(PacketPublish, pubflags, expectedRemainingLen)
-		err = rxtx.WritePublishPayload(publishHeader, varPublish, publishPayload)
+	var warnings []string
+	rxtx.Rx.OnWarning = func(msg string) {
+		warnings = append(warnings, msg)
+	}
+	connected := false
+	rxtx.RxCallbacks.OnConnect = func(_ *Rx, _ *VariablesConnect) error {
+		connected = true
+		return nil
+	}
+	var varConn VariablesConnect
+	varConn.SetDefaultMQTT(nil)
+	varConn.CleanSession = false
+	err = rxtx.WriteConnect(&varConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = rxtx.ReadNextPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !connected {
+		t.Error("OnConnect callback not executed")
+	}
+	if len(warnings) != 1 {
+		t.Errorf("expected 1 warning, got %q", warnings)
+	}
+}
+
+func TestRxReadWithEOF(t *testing.T) {
+	// Transports may return the last bytes of the stream alongside io.EOF.
+	for _, packet := range validPackets {
+		decoded, err := DecodeAll(packet)
 		if err != nil {
 			t.Fatal(err)
 		}
-		callbackExecuted := false
-		rxtx.RxCallbacks.OnPub = func(rt *Rx, vp VariablesPublish, r io.Reader) error {
-			b, err := io.ReadAll(r)
-			if err != nil {
-				t.Fatal(err)
-			}
-			if !bytes.Equal(b, publishPayload) {
-				t.Error("got different payloads!")
+		for _, chunk := range []int{1, 2, len(packet)} {
+			var rx Rx
+			rx.userDecoder = DecoderNoAlloc{UserBuffer: make([]byte, 1500)}
+			rx.SetRxTransport(&eofTransport{data: packet, chunk: chunk})
+			var payload []byte
+			rx.RxCallbacks.OnPub = func(_ *Rx, _ VariablesPublish, r io.Reader) (err error) {
+				payload, err = io.ReadAll(r)
+				return err
 			}
-			if rt.LastReceivedHeader != publishHeader {
-				t.Errorf("rxtx header mismatch, txed:%v, rxed:%v", publishHeader.String(), rt.LastReceivedHeader.String())
+			rx.RxCallbacks.OnConnack = func(*Rx, VariablesConnack) error { return nil }
+			n, err := rx.ReadNextPacket()
+			expectN := len(packet) - len(payload) // PUBLISH payload not counted.
+			if err != nil {
+				t.Errorf("packet %q read in chunks of %d: %v", packet, chunk, err)
+			} else if n != expectN {
+				t.Errorf("packet %q read in chunks of %d: read %d bytes, expected %d", packet, chunk, n, expectN)
 			}
-			if vp.Size(pubQos) != varPublish.Size(pubQos) {
-				t.Errorf("mismatch between publish variable sizes")
+			if !bytes.Equal(payload, decoded[0].Payload) {
+				t.Errorf("got payload %q, expected %q", payload, decoded[0].Payload)
 			}
-			varEqual(t, varPublish, vp)
-			callbackExecuted = true
-			return nil
 		}
+	}
+}
 
-		n, err := rxtx.ReadNextPacket()
+// eofTransport returns data in chunks of at most chunk bytes
+// and returns io.EOF alongside the last chunk.
+type eofTransport struct {
+	data  []byte
+	chunk int
+}
+
+func (e *eofTransport) Read(p []byte) (int, error) {
+	if len(e.data) == 0 {
+		return 0, io.EOF
+	}
+	if len(p) > e.chunk {
+		p = p[:e.chunk]
+	}
+	n := copy(p, e.data)
+	e.data = e.data[n:]
+	if len(e.data) == 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (e *eofTransport) Close() error { return nil }
+
+func TestPacketStats(t *testing.T) {
+	buf := newLoopbackTransport()
+	rxtx, err := NewRxTx(buf, DecoderNoAlloc{make([]byte, 1500)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rxStats, txStats PacketStats
+	rxtx.RxStats = &rxStats
+	rxtx.TxStats = &txStats
+	flags, _ := NewPublishFlags(QoS0, false, false)
+	varPub := VariablesPublish{TopicName: []byte("sz")}
+	overhead := 2 + varPub.Size(QoS0) // Fixed header for small packets + topic.
+	var expect [5]uint64
+	for _, payloadLen := range []int{0, 63 - overhead, 64 - overhead, 255, 1000, 1024, 16*1024 - 3 - overhead, 16 * 1024, 40000} {
+		err = rxtx.WritePublishPayload(newHeader(PacketPublish, flags, 0), varPub, make([]byte, payloadLen))
 		if err != nil {
 			t.Fatal(err)
 		}
-
-		if n != int(expectedRemainingLen) {
-			t.Errorf("read %v bytes, expected to read %v bytes", n, expectedRemainingLen)
+		_, err = rxtx.ReadNextPacket()
+		if err != nil {
+			t.Fatal(err)
 		}
-		if !callbackExecuted {
-			t.Error("OnPub callback not executed")
+		size := FixedHeaderSize(uint32(overhead-2+payloadLen)) + overhead - 2 + payloadLen
+		switch {
+		case size < 64:
+			expect[0]++
+		case size < 256:
+			expect[1]++
+		case size < 1024:
+			expect[2]++
+		case size < 16*1024:
+			expect[3]++
+		default:
+			expect[4]++
 		}
 	}
-
-	//
-	// Send PUBLISH packet over wire and ignore packet.
-	//
-	{
-		const pubQos = QoS1
-		publishPayload := []byte("ertytgbhjjhundsaip;vf[oniw[aondmiksfvoWDNFOEWOPndsafr;poulikujyhtgbfrvdcsxzaesxt dfcgvfhbg kjnlkm/'.")
-		varPublish := VariablesPublish{
-			TopicName:        []byte("now-for-something-completely-different"),
-			PacketIdentifier: math.MaxUint16,
+	if expect != [5]uint64{2, 1, 2, 2, 2} {
+		t.Fatalf("bad test sizes, bucket distribution %v", expect)
+	}
+	for _, stats := range []*PacketStats{&rxStats, &txStats} {
+		if stats.Histogram[PacketPublish] != expect {
+			t.Errorf("got histogram %v, expected %v", stats.Histogram[PacketPublish], expect)
 		}
-		pubflags, err := NewPublishFlags(pubQos, true, true)
+		if stats.Count[PacketPublish] != 9 {
+			t.Errorf("got %d publishes, expected 9", stats.Count[PacketPublish])
+		}
+	}
+}
+
+func TestPacketRing(t *testing.T) {
+	const ringSize = 3
+	buf := newLoopbackTransport()
+	rxtx, err := NewRxTx(buf, DecoderNoAlloc{make([]byte, 1500)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rxtx.RxRing = NewPacketRing(ringSize)
+	rxtx.TxRing = NewPacketRing(ringSize)
+	flags, _ := NewPublishFlags(QoS0, false, false)
+	varPub := VariablesPublish{TopicName: []byte("ring")}
+	var expect []Header
+	for payloadLen := 1; payloadLen <= 5; payloadLen++ {
+		// Distinct payload lengths so headers can be told apart.
+		err = rxtx.WritePublishPayload(newHeader(PacketPublish, flags, 0), varPub, make([]byte, payloadLen))
 		if err != nil {
 			t.Fatal(err)
 		}
-
-		publishHeader := newHeader(PacketPublish, pubflags, uint32(varPublish.Size(pubQos)+len(publishPayload)))
-		err = rxtx.WritePublishPayload(publishHeader, varPublish, publishPayload)
+		_, err = rxtx.ReadNextPacket()
 		if err != nil {
 			t.Fatal(err)
 		}
-		rxtx.RxCallbacks.OnPub = nil
+		expect = append(expect, rxtx.LastReceivedHeader)
+	}
+	expect = expect[len(expect)-ringSize:]
+	dst := make([]Header, 0, ringSize)
+	for _, ring := range []*PacketRing{rxtx.RxRing, rxtx.TxRing} {
+		got := ring.RecentPackets(dst)
+		if len(got) != ringSize {
+			t.Fatalf("got %d headers, expected %d", len(got), ringSize)
+		}
+		for i := range got {
+			if got[i] != expect[i] {
+				t.Errorf("header %d: got %v, expected %v", i, got[i], expect[i])
+			}
+		}
+	}
+	allocs := testing.AllocsPerRun(10, func() {
+		rxtx.TxRing.Record(expect[0])
+		dst = rxtx.TxRing.RecentPackets(dst[:0])
+	})
+	if allocs != 0 {
+		t.Errorf("got %v allocations, expected none", allocs)
+	}
+	rxtx.RxRing.Reset()
+	if got := rxtx.RxRing.RecentPackets(nil); len(got) != 0 {
+		t.Errorf("got %d headers after reset", len(got))
+	}
+}
 
-		n, err := rxtx.ReadNextPacket()
+func TestTxWriteSimpleWrappers(t *testing.T) {
+	for _, test := range []struct {
+		write  func(*Tx) error
+		expect PacketType
+	}{
+		{write: (*Tx).WriteDisconnect, expect: PacketDisconnect},
+		{write: (*Tx).WritePingreq, expect: PacketPingreq},
+		{write: (*Tx).WritePingresp, expect: PacketPingresp},
+	} {
+		var buf bytes.Buffer
+		var tx Tx
+		if test.write(&tx) == nil {
+			t.Errorf("%s: expected nil transport error", test.expect)
+		}
+		tx.SetTxTransport(&testTransport{&buf})
+		err := test.write(&tx)
 		if err != nil {
 			t.Fatal(err)
 		}
-		expectSize := publishHeader.Size() + varPublish.Size(pubQos)
-		if n != expectSize {
-			t.Errorf("read %v bytes, expected to read %v bytes", n, expectSize)
+		expect := []byte{byte(test.expect) << 4, 0}
+		if !bytes.Equal(buf.Bytes(), expect) {
+			t.Errorf("%s: got %q, expected %q", test.expect, buf.Bytes(), expect)
 		}
+	}
+}
 
+func TestTxEnforceConnectFirst(t *testing.T) {
+	var buf bytes.Buffer
+	var tx Tx
+	tx.EnforceConnectFirst = true
+	tx.SetTxTransport(&testTransport{&buf})
+	flags, _ := NewPublishFlags(QoS0, false, false)
+	publish := func() error {
+		return tx.WritePublishPayload(newHeader(PacketPublish, flags, 0), VariablesPublish{TopicName: []byte("a")}, []byte("early"))
 	}
+	if err := publish(); err != ErrConnectFirst {
+		t.Fatalf("got %v, expected %v", err, ErrConnectFirst)
+	}
+	if err := tx.WritePingreq(); err != ErrConnectFirst {
+		t.Fatalf("got %v, expected %v", err, ErrConnectFirst)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("packets written before CONNECT: %q", buf.Bytes())
+	}
+	var varConn VariablesConnect
+	varConn.SetDefaultMQTT([]byte("salamanca"))
+	err := tx.WriteConnect(&varConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = publish(); err != nil {
+		t.Fatal(err)
+	}
+	// A new transport is a new connection.
+	tx.SetTxTransport(&testTransport{&buf})
+	if err = publish(); err != ErrConnectFirst {
+		t.Errorf("new transport: got %v, expected %v", err, ErrConnectFirst)
+	}
+}
 
-	//
-	// Send SUBSCRIBE packet over wire.
-	//
-	{
+func TestTxSubscribeSizeCheck(t *testing.T) {
+	var buf bytes.Buffer
+	var tx Tx
+	tx.SetTxTransport(&testTransport{&buf})
+	tx.SkipTopicValidation = true
+	// Enough maximum length topic filters to exceed the maximum remaining length.
+	filter := bytes.Repeat([]byte("a"), math.MaxUint16)
+	n := maxRemainingLengthValue/(len(filter)+2) + 1
+	vsub := VariablesSubscribe{PacketIdentifier: 1, TopicFilters: make([]SubscribeRequest, n)}
+	vunsub := VariablesUnsubscribe{PacketIdentifier: 1, Topics: make([][]byte, n)}
+	for i := 0; i < n; i++ {
+		vsub.TopicFilters[i] = SubscribeRequest{TopicFilter: filter}
+		vunsub.Topics[i] = filter
+	}
+	if err := tx.WriteSubscribe(vsub); err != ErrBadRemainingLen {
+		t.Errorf("SUBSCRIBE: got %v, expected %v", err, ErrBadRemainingLen)
+	}
+	if err := tx.WriteUnsubscribe(vunsub); err != ErrBadRemainingLen {
+		t.Errorf("UNSUBSCRIBE: got %v, expected %v", err, ErrBadRemainingLen)
+	}
+	if err := tx.WriteSubscribe(VariablesSubscribe{PacketIdentifier: 1}); err != errNoTopics {
+		t.Errorf("empty SUBSCRIBE: got %v, expected %v", err, errNoTopics)
+	}
+	if err := tx.WriteUnsubscribe(VariablesUnsubscribe{PacketIdentifier: 1}); err != errNoTopics {
+		t.Errorf("empty UNSUBSCRIBE: got %v, expected %v", err, errNoTopics)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("wrote %d bytes of rejected packets", buf.Len())
+	}
+}
 
-		varsub := VariablesSubscribe{
-			PacketIdentifier: math.MaxUint16,
-			TopicFilters: []SubscribeRequest{
-				{TopicFilter: []byte("favorites"), QoS: QoS2},
-				{TopicFilter: []byte("the-clash"), QoS: QoS2},
-				{TopicFilter: []byte("always-watching"), QoS: QoS2},
-				{TopicFilter: []byte("k-pop"), QoS: QoS2},
-			},
+func TestTxWriteAcks(t *testing.T) {
+	var buf bytes.Buffer
+	var tx Tx
+	tx.SetTxTransport(&testTransport{&buf})
+	ids := []uint16{1, 0xff, 0x1234, 2}
+	for _, packetType := range []PacketType{PacketPuback, PacketPubrec, PacketPubrel, PacketPubcomp, PacketUnsuback} {
+		buf.Reset()
+		err := tx.WriteAcks(packetType, ids)
+		if err != nil {
+			t.Fatal(err)
 		}
-		err = rxtx.WriteSubscribe(varsub)
+		packets, err := DecodeAll(buf.Bytes())
 		if err != nil {
 			t.Fatal(err)
 		}
-
-		expectHeader := newHeader(PacketSubscribe, PacketFlagsPubrelSubUnsub, uint32(varsub.Size()))
-		callbackExecuted := false
-		rxtx.RxCallbacks.OnSub = func(rt *Rx, vs VariablesSubscribe) error {
-			if rt.LastReceivedHeader != expectHeader {
-				t.Errorf("rxtx header mismatch, expect:%v, rxed:%v", expectHeader.String(), rt.LastReceivedHeader.String())
+		if len(packets) != len(ids) {
+			t.Fatalf("%s: decoded %d packets, expected %d", packetType, len(packets), len(ids))
+		}
+		for i, packet := range packets {
+			if packet.Header.Type() != packetType || packet.PacketIdentifier != ids[i] {
+				t.Errorf("%s: packet %d decoded as %s with PI %d", packetType, i, packet.Header.Type(), packet.PacketIdentifier)
 			}
-			varEqual(t, varsub, vs)
-			callbackExecuted = true
-			return nil
 		}
+	}
+	if tx.WriteAcks(PacketPublish, ids) == nil {
+		t.Error("expected error for non-ack packet type")
+	}
+	if tx.WriteAcks(PacketPuback, []uint16{1, 0}) == nil {
+		t.Error("expected error for zero packet identifier")
+	}
+}
 
-		n, err := rxtx.ReadNextPacket()
-		if err != nil {
-			t.Fatal(err)
+func TestEncodeSubscribe(t *testing.T) {
+	const golden = "\x82\x1a\x00\x0a\x00\x05a/b/c\x00\x00\x03d/#\x01\x00\x07sensors\x02"
+	vs := VariablesSubscribe{
+		PacketIdentifier: 10,
+		TopicFilters: []SubscribeRequest{
+			{TopicFilter: []byte("a/b/c"), QoS: QoS0},
+			{TopicFilter: []byte("d/#"), QoS: QoS1},
+			{TopicFilter: []byte("sensors"), QoS: QoS2},
+		},
+	}
+	var buf bytes.Buffer
+	var tx Tx
+	tx.SetTxTransport(&testTransport{&buf})
+	err := tx.WriteSubscribe(vs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := make([]byte, 64)
+	n, err := EncodeSubscribe(dst, vs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dst[:n], buf.Bytes()) {
+		t.Errorf("EncodeSubscribe %q differs from WriteSubscribe %q", dst[:n], buf.Bytes())
+	}
+	if string(dst[:n]) != golden {
+		t.Errorf("got %q, expected golden %q", dst[:n], golden)
+	}
+	_, err = EncodeSubscribe(dst[:n-1], vs)
+	if !errors.Is(err, io.ErrShortBuffer) {
+		t.Errorf("expected short buffer error, got %v", err)
+	}
+	// Decoded SUBSCRIBE must report the same amount of filters for sizing the SUBACK.
+	pkts, err := DecodeAll([]byte(golden))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pkts[0].Subscribe.NumFilters(); got != vs.NumFilters() || got != 3 {
+		t.Errorf("decoded %d filters, expected %d", got, vs.NumFilters())
+	}
+}
+
+func TestRxTxPacketHooks(t *testing.T) {
+	rxtx, err := NewRxTx(newLoopbackTransport(), DecoderNoAlloc{make([]byte, 1500)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written, read []string
+	var callbacks int
+	rxtx.OnPacketWrite = func(hdr Header, n int) {
+		written = append(written, fmt.Sprintf("%s %d", hdr, n))
+		if hdr.Type() == PacketPuback {
+			// Tx must not be locked during the hook.
+			if err := rxtx.WritePingreq(); err != nil {
+				t.Error(err)
+			}
 		}
-		expectSize := expectHeader.Size() + varsub.Size()
-		if n != expectSize {
-			t.Errorf("read %v bytes, expected to read %v bytes", n, expectSize)
+	}
+	rxtx.OnPacketRead = func(hdr Header, n int) {
+		read = append(read, fmt.Sprintf("%s %d", hdr, n))
+	}
+	rxtx.RxCallbacks.OnOther = func(rx *Rx, packetIdentifier uint16) error {
+		callbacks++
+		if len(read) != callbacks {
+			t.Error("OnPacketRead not called before callback")
 		}
-		if !callbackExecuted {
-			t.Error("OnSub callback not executed")
+		return nil
+	}
+	rxtx.RxCallbacks.OnPuback = rxtx.RxCallbacks.OnOther
+	err = rxtx.WriteAcks(PacketPuback, []uint16{1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		_, err = rxtx.ReadNextPacket()
+		if err != nil {
+			t.Fatal(err)
 		}
 	}
+	ack := newHeader(PacketPuback, 0, 2).String() + " 4"
+	ping := newHeader(PacketPingreq, 0, 0).String() + " 2"
+	expectWritten := strings.Join([]string{ack, ping, ack, ping}, ",")
+	expectRead := strings.Join([]string{ack, ack, ping, ping}, ",")
+	if got := strings.Join(written, ","); got != expectWritten {
+		t.Errorf("got written %q, expected %q", got, expectWritten)
+	}
+	if got := strings.Join(read, ","); got != expectRead {
+		t.Errorf("got read %q, expected %q", got, expectRead)
+	}
+}
 
-	//
-	// Send UNSUBSCRIBE packet over wire.
-	//
-	{
-		callbackExecuted := false
-		varunsub := VariablesUnsubscribe{
-			PacketIdentifier: math.MaxUint16,
-			Topics:           bytes.Fields([]byte("topic1 topic2 topic3 semperfi")),
-		}
-		err = rxtx.WriteUnsubscribe(varunsub)
+func TestRxTxTrace(t *testing.T) {
+	rxtx, err := NewRxTx(newLoopbackTransport(), DecoderNoAlloc{make([]byte, 1500)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var trace bytes.Buffer
+	rxtx.RxTrace = &trace
+	rxtx.TxTrace = &trace
+	flags, _ := NewPublishFlags(QoS1, false, false)
+	varPub := VariablesPublish{TopicName: []byte("foo/bar"), PacketIdentifier: 42}
+	err = rxtx.WritePublishPayload(newHeader(PacketPublish, flags, 0), varPub, make([]byte, 128))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rxtx.WriteIdentified(PacketPuback, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		_, err = rxtx.ReadNextPacket()
 		if err != nil {
 			t.Fatal(err)
 		}
-		expectHeader := newHeader(PacketUnsubscribe, PacketFlagsPubrelSubUnsub, uint32(varunsub.Size()))
-		rxtx.RxCallbacks.OnUnsub = func(rt *Rx, vu VariablesUnsubscribe) error {
+	}
+	flags, _ = NewPublishFlags(QoS2, true, true)
+	err = rxtx.WritePublishPayload(newHeader(PacketPublish, flags, 0), varPub, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = rxtx.ReadNextPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const expect = "> PUBLISH qos=1 id=42 topic=foo/bar len=128\n" +
+		"> PUBACK id=42\n" +
+		"< PUBLISH qos=1 id=42 topic=foo/bar len=128\n" +
+		"< PUBACK id=42\n" +
+		"> PUBLISH qos=2 id=42 dup=1 retain=1 topic=foo/bar len=0\n" +
+		"< PUBLISH qos=2 id=42 dup=1 retain=1 topic=foo/bar len=0\n"
+	if trace.String() != expect {
+		t.Errorf("got trace:\n%s\nexpected:\n%s", trace.String(), expect)
+	}
+}
+
+func TestTxWriteSubackFor(t *testing.T) {
+	var buf bytes.Buffer
+	var tx Tx
+	tx.SetTxTransport(&testTransport{&buf})
+	vs := VariablesSubscribe{
+		PacketIdentifier: 7,
+		TopicFilters: []SubscribeRequest{
+			{TopicFilter: []byte("a"), QoS: QoS1},
+			{TopicFilter: []byte("b"), QoS: QoS2},
+			{TopicFilter: []byte("secret"), QoS: QoS1},
+		},
+	}
+	err := tx.WriteSubackFor(vs, []QoSLevel{QoS1, QoS1, QoSSubfail})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const expect = "\x90\x05\x00\x07\x01\x01\x80"
+	if buf.String() != expect {
+		t.Errorf("got SUBACK %q, expected %q", buf.String(), expect)
+	}
+	if tx.WriteSubackFor(vs, []QoSLevel{QoS1, QoS1}) == nil {
+		t.Error("expected error for mismatched granted QoS count")
+	}
+	if tx.WriteSubackFor(vs, []QoSLevel{QoS2, QoS1, QoS1}) == nil {
+		t.Error("expected error for granted QoS exceeding requested")
+	}
+}
+
+func TestTxPublishRemainingLength(t *testing.T) {
+	var buf bytes.Buffer
+	var tx Tx
+	tx.SetTxTransport(&testTransport{&buf})
+	flags, _ := NewPublishFlags(QoS1, false, false)
+	varPub := VariablesPublish{TopicName: []byte("a/b"), PacketIdentifier: 1}
+	payload := []byte("payload")
+	rl := uint32(varPub.Size(QoS1) + len(payload))
+	err := tx.WritePublishPayload(newHeader(PacketPublish, flags, rl+1), varPub, payload)
+	if err == nil {
+		t.Fatal("expected error for mismatched remaining length")
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("malformed packet written: %q", buf.Bytes())
+	}
+	err = tx.ForwardPayload(newHeader(PacketPublish, flags, rl-1), varPub, bytes.NewReader(payload), len(payload))
+	if err == nil || buf.Len() != 0 {
+		t.Fatalf("expected forwarded mismatched remaining length to be rejected, got %v", err)
+	}
+	for _, hdrRL := range []uint32{rl, 0} {
+		buf.Reset()
+		err = tx.WritePublishPayload(newHeader(PacketPublish, flags, hdrRL), varPub, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len() != 2+int(rl) {
+			t.Errorf("remaining length %d: got packet of %d bytes, expected %d", hdrRL, buf.Len(), 2+rl)
+		}
+	}
+}
+
+func TestTxClearRetained(t *testing.T) {
+	var buf bytes.Buffer
+	var tx Tx
+	tx.SetTxTransport(&testTransport{&buf})
+	err := tx.ClearRetained([]byte("sensors/temp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkts, err := DecodeAll(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkts) != 1 {
+		t.Fatalf("got %d packets, expected 1", len(pkts))
+	}
+	h := pkts[0].Header
+	if h.Type() != PacketPublish || !h.IsRetain() || h.IsDup() || h.QoS() != QoS0 {
+		t.Errorf("expected QoS0 retained PUBLISH, got %s", h)
+	}
+	if string(pkts[0].Publish.TopicName) != "sensors/temp" || len(pkts[0].Payload) != 0 {
+		t.Errorf("got topic %q with payload %q", pkts[0].Publish.TopicName, pkts[0].Payload)
+	}
+}
+
+func TestTxForwardPayload(t *testing.T) {
+	payload := make([]byte, 64*1024)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	flags, _ := NewPublishFlags(QoS1, false, true)
+	varPub := VariablesPublish{TopicName: []byte("big/data"), PacketIdentifier: 3}
+	var src, expect bytes.Buffer
+	var srcTx Tx
+	srcTx.SetTxTransport(&testTransport{&src})
+	err := srcTx.WritePublishPayload(newHeader(PacketPublish, flags, 0), varPub, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect.Write(src.Bytes())
+
+	var dst bytes.Buffer
+	var dstTx Tx
+	dstTx.SetTxTransport(&testTransport{&dst})
+	var rx Rx
+	rx.SetRxTransport(&testTransport{&src})
+	rx.userDecoder = DecoderNoAlloc{UserBuffer: make([]byte, 64)}
+	rx.RxCallbacks.OnPub = func(rx *Rx, vp VariablesPublish, r io.Reader) error {
+		payloadLen := int(rx.LastReceivedHeader.RemainingLength) - vp.Size(rx.LastReceivedHeader.Flags().QoS())
+		return dstTx.ForwardPayload(rx.LastReceivedHeader, vp, r, payloadLen)
+	}
+	_, err = rx.ReadNextPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dst.Bytes(), expect.Bytes()) {
+		t.Error("forwarded PUBLISH differs from original")
+	}
+	err = dstTx.ForwardPayload(newHeader(PacketPublish, flags, 0), varPub, bytes.NewReader(payload[:10]), 11)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("got %v for short payload, expected %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func BenchmarkForwardPayload(b *testing.B) {
+	const payloadLen = 1 << 20
+	flags, _ := NewPublishFlags(QoS0, false, false)
+	varPub := VariablesPublish{TopicName: []byte("big/data")}
+	var packet bytes.Buffer
+	var tx Tx
+	tx.SetTxTransport(&testTransport{&packet})
+	err := tx.WritePublishPayload(newHeader(PacketPublish, flags, 0), varPub, make([]byte, payloadLen))
+	if err != nil {
+		b.Fatal(err)
+	}
+	src := bytes.NewReader(packet.Bytes())
+	var rx Rx
+	rx.SetRxTransport(io.NopCloser(src))
+	rx.userDecoder = DecoderNoAlloc{UserBuffer: make([]byte, 64)}
+	var dstTx Tx
+	dstTx.SetTxTransport(discardTransport{})
+	rx.RxCallbacks.OnPub = func(rx *Rx, vp VariablesPublish, r io.Reader) error {
+		return dstTx.ForwardPayload(rx.LastReceivedHeader, vp, r, payloadLen)
+	}
+	b.SetBytes(int64(packet.Len()))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		src.Seek(0, io.SeekStart)
+		_, err = rx.ReadNextPacket()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Benchmarks of encoding with Tx and decoding with Rx and DecoderNoAlloc of representative packets.
+// Bytes per second reported are of the whole packet.
+
+func BenchmarkEncodeConnect(b *testing.B)   { benchmarkEncode(b, benchWriteConnect) }
+func BenchmarkDecodeConnect(b *testing.B)   { benchmarkDecode(b, benchWriteConnect) }
+func BenchmarkEncodePublish(b *testing.B)   { benchmarkEncode(b, benchWritePublish) }
+func BenchmarkDecodePublish(b *testing.B)   { benchmarkDecode(b, benchWritePublish) }
+func BenchmarkEncodeSubscribe(b *testing.B) { benchmarkEncode(b, benchWriteSubscribe) }
+func BenchmarkDecodeSubscribe(b *testing.B) { benchmarkDecode(b, benchWriteSubscribe) }
+func BenchmarkEncodeSuback(b *testing.B)    { benchmarkEncode(b, benchWriteSuback) }
+func BenchmarkDecodeSuback(b *testing.B)    { benchmarkDecode(b, benchWriteSuback) }
+
+// Packets are declared once so that allocations reported are those of encoding and decoding.
+var (
+	benchConnect = VariablesConnect{
+		ClientID:      []byte("salamanca"),
+		Protocol:      []byte(DefaultProtocol),
+		ProtocolLevel: DefaultProtocolLevel,
+		KeepAlive:     60,
+		CleanSession:  true,
+		Username:      []byte("inigo"),
+		Password:      []byte("montoya"),
+		WillTopic:     []byte("last/words"),
+		WillMessage:   []byte("prepare to die"),
+	}
+	benchPublishFlags, _ = NewPublishFlags(QoS1, false, false)
+	benchPublish         = VariablesPublish{TopicName: []byte("sensors/temperature/livingroom"), PacketIdentifier: 42}
+	benchPayload         = bytes.Repeat([]byte("natiu"), 256/5)
+	benchSubscribe       = VariablesSubscribe{
+		PacketIdentifier: 42,
+		TopicFilters: []SubscribeRequest{
+			{TopicFilter: []byte("sensors/+/livingroom"), QoS: QoS1},
+			{TopicFilter: []byte("sensors/temperature/#"), QoS: QoS0},
+			{TopicFilter: []byte("alarms/#"), QoS: QoS2},
+			{TopicFilter: []byte("$SYS/broker/uptime"), QoS: QoS0},
+		},
+	}
+	benchSuback = VariablesSuback{PacketIdentifier: 42, ReturnCodes: []QoSLevel{QoS1, QoS0, QoS2, QoSSubfail}}
+)
+
+func benchWriteConnect(tx *Tx) error { return tx.WriteConnect(&benchConnect) }
+
+func benchWritePublish(tx *Tx) error {
+	return tx.WritePublishPayload(newHeader(PacketPublish, benchPublishFlags, 0), benchPublish, benchPayload)
+}
+
+func benchWriteSubscribe(tx *Tx) error { return tx.WriteSubscribe(benchSubscribe) }
+
+func benchWriteSuback(tx *Tx) error { return tx.WriteSuback(benchSuback) }
+
+func benchmarkEncode(b *testing.B, write func(*Tx) error) {
+	var packet bytes.Buffer
+	var tx Tx
+	tx.SetTxTransport(&testTransport{&packet})
+	if err := write(&tx); err != nil {
+		b.Fatal(err)
+	}
+	tx.SetTxTransport(discardTransport{})
+	b.SetBytes(int64(packet.Len()))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := write(&tx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkDecode(b *testing.B, write func(*Tx) error) {
+	var packet bytes.Buffer
+	var tx Tx
+	tx.SetTxTransport(&testTransport{&packet})
+	if err := write(&tx); err != nil {
+		b.Fatal(err)
+	}
+	src := bytes.NewReader(packet.Bytes())
+	var rx Rx
+	rx.SetRxTransport(io.NopCloser(src))
+	rx.userDecoder = DecoderNoAlloc{UserBuffer: make([]byte, 256)}
+	rx.ScratchBuf = make([]byte, 512) // PUBLISH payloads are discarded.
+	b.SetBytes(int64(packet.Len()))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		src.Seek(0, io.SeekStart)
+		if _, err := rx.ReadNextPacket(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// discardTransport discards all data written to it. It implements io.ReaderFrom
+// like most network transports.
+type discardTransport struct{}
+
+func (discardTransport) Write(p []byte) (int, error)         { return len(p), nil }
+func (discardTransport) ReadFrom(r io.Reader) (int64, error) { return io.Copy(io.Discard, r) }
+func (discardTransport) Close() error                        { return nil }
+
+func TestVariablesConnectAppendTo(t *testing.T) {
+	var varConn VariablesConnect
+	varConn.SetDefaultMQTT([]byte("salamanca"))
+	varConn.Username = []byte("inigo")
+	varConn.Password = []byte("montoya")
+	varConn.KeepAlive = 60
+	varConn.SetWill([]byte("last/words"), []byte("prepare to die"), QoS1, true)
+	var encoded bytes.Buffer
+	_, err := encodeConnect(&encoded, &varConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := []byte("prefix")
+	got := varConn.AppendTo(prefix)
+	if !bytes.Equal(got[:len(prefix)], prefix) || !bytes.Equal(got[len(prefix):], encoded.Bytes()) {
+		t.Fatalf("AppendTo mismatch:\n%q\n%q", got[len(prefix):], encoded.Bytes())
+	}
+	parsed, err := ParseConnect(got[len(prefix):])
+	if err != nil {
+		t.Fatal(err)
+	}
+	varEqual(t, &varConn, &parsed)
+	_, err = ParseConnect(got[len(prefix) : len(got)-1])
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("got %v for truncated CONNECT, expected %v", err, io.ErrUnexpectedEOF)
+	}
+	_, err = ParseConnect(append(got[len(prefix):], 0))
+	if err == nil {
+		t.Error("expected error for trailing bytes")
+	}
+}
+
+func TestVariablesMarshalBinary(t *testing.T) {
+	var varConn VariablesConnect
+	varConn.SetDefaultMQTT([]byte("salamanca"))
+	varConn.SetWill([]byte("last/words"), []byte("prepare to die"), QoS1, false)
+	for _, test := range []struct {
+		v    encoding.BinaryMarshaler
+		into encoding.BinaryUnmarshaler
+	}{
+		{v: &varConn, into: &VariablesConnect{}},
+		{v: VariablesPublish{TopicName: []byte("a/b")}, into: &VariablesPublish{}},
+		{v: VariablesPublish{TopicName: []byte("a/b"), PacketIdentifier: 42}, into: &VariablesPublish{}},
+		{v: VariablesSubscribe{PacketIdentifier: 1, TopicFilters: []SubscribeRequest{{TopicFilter: []byte("a/+"), QoS: QoS1}, {TopicFilter: []byte("#")}}}, into: &VariablesSubscribe{}},
+		{v: VariablesSuback{PacketIdentifier: 2, ReturnCodes: []QoSLevel{QoS1, QoSSubfail}}, into: &VariablesSuback{}},
+		{v: VariablesUnsubscribe{PacketIdentifier: 3, Topics: [][]byte{[]byte("a/+"), []byte("b")}}, into: &VariablesUnsubscribe{}},
+	} {
+		data, err := test.v.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%T: %v", test.v, err)
+		}
+		err = test.into.UnmarshalBinary(data)
+		if err != nil {
+			t.Fatalf("%T: %v", test.v, err)
+		}
+		var got any
+		switch into := test.into.(type) {
+		case *VariablesConnect:
+			got = into
+		case *VariablesPublish:
+			got = *into
+		case *VariablesSubscribe:
+			got = *into
+		case *VariablesSuback:
+			got = *into
+		case *VariablesUnsubscribe:
+			got = *into
+		}
+		varEqual(t, test.v, got)
+		truncated := data[:len(data)-1]
+		if _, ok := test.v.(VariablesSuback); ok {
+			truncated = data[:1] // Any amount of return codes is valid.
+		}
+		if test.into.UnmarshalBinary(truncated) == nil {
+			t.Errorf("%T: expected error unmarshaling truncated data", test.v)
+		}
+	}
+	_, err := VariablesSuback{PacketIdentifier: 1, ReturnCodes: []QoSLevel{4}}.MarshalBinary()
+	if err == nil {
+		t.Error("expected error marshaling invalid SUBACK return code")
+	}
+	var vp VariablesPublish
+	err = vp.UnmarshalBinary([]byte("\x00\x02a\xff"))
+	if !errors.Is(err, ErrBadUTF8) {
+		t.Errorf("got %v, expected %v", err, ErrBadUTF8)
+	}
+}
+
+func TestDecodeConnectHead(t *testing.T) {
+	for _, withWill := range []bool{false, true} {
+		var varConn VariablesConnect
+		varConn.SetDefaultMQTT([]byte("salamanca"))
+		varConn.Username = []byte("inigo")
+		varConn.Password = []byte("montoya")
+		if withWill {
+			varConn.WillTopic = []byte("last/words")
+			varConn.WillMessage = []byte("prepare to die")
+		}
+		var buf bytes.Buffer
+		var tx Tx
+		tx.SetTxTransport(&testTransport{&buf})
+		err := tx.WriteConnect(&varConn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdr, hdrLen, err := DecodeHeader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet := buf.Bytes()[hdrLen:]
+		clientID, username, password, flags, n, err := DecodeConnectHead(packet)
+		if err != nil {
+			t.Fatalf("will=%v: %v", withWill, err)
+		}
+		if string(clientID) != "salamanca" || string(username) != "inigo" || string(password) != "montoya" {
+			t.Errorf("will=%v: got client ID %q, username %q, password %q", withWill, clientID, username, password)
+		}
+		if flags != varConn.Flags() {
+			t.Errorf("will=%v: got flags %#x, expected %#x", withWill, flags, varConn.Flags())
+		}
+		if n != int(hdr.RemainingLength) {
+			t.Errorf("will=%v: consumed %d bytes, expected %d", withWill, n, hdr.RemainingLength)
+		}
+		_, _, _, _, _, err = DecodeConnectHead(packet[:len(packet)-1])
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("will=%v: got %v for truncated CONNECT, expected %v", withWill, err, io.ErrUnexpectedEOF)
+		}
+	}
+}
+
+func TestRxPublishLargerThanUserBuffer(t *testing.T) {
+	const bufSize = 16
+	buf := newLoopbackTransport()
+	rxtx, err := NewRxTx(buf, DecoderNoAlloc{make([]byte, bufSize)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotTopic, gotPayload string
+	rxtx.RxCallbacks.OnPub = func(_ *Rx, vp VariablesPublish, r io.Reader) error {
+		gotTopic = string(vp.TopicName)
+		b, err := io.ReadAll(r)
+		gotPayload = string(b)
+		return err
+	}
+	flags, _ := NewPublishFlags(QoS0, false, false)
+	payload := strings.Repeat("streamed", 4*bufSize)
+	err = rxtx.WritePublishPayload(newHeader(PacketPublish, flags, 0), VariablesPublish{TopicName: []byte("small")}, []byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = rxtx.ReadNextPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotTopic != "small" || gotPayload != payload {
+		t.Errorf("got topic %q and %d byte payload, expected %q and %d bytes", gotTopic, len(gotPayload), "small", len(payload))
+	}
+
+	// Topic name that does not fit in buffer fails.
+	err = rxtx.WritePublishPayload(newHeader(PacketPublish, flags, 0), VariablesPublish{TopicName: []byte(strings.Repeat("t", bufSize+1))}, []byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = rxtx.ReadNextPacket()
+	if !errors.Is(err, ErrUserBufferFull) {
+		t.Errorf("got %v for topic larger than buffer, expected %v", err, ErrUserBufferFull)
+	}
+}
+
+func TestRxOnUnhandled(t *testing.T) {
+	rxtx, err := NewRxTx(newLoopbackTransport(), DecoderNoAlloc{make([]byte, 1500)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unhandled []Header
+	rxtx.RxCallbacks.OnUnhandled = func(rx *Rx, hdr Header) error {
+		unhandled = append(unhandled, hdr)
+		return nil
+	}
+	flags, _ := NewPublishFlags(QoS1, false, false)
+	varPub := VariablesPublish{TopicName: []byte("a/b"), PacketIdentifier: 1}
+	pubHeader := newHeader(PacketPublish, flags, uint32(varPub.Size(QoS1)+len("unheard")))
+	if err = rxtx.WritePublishPayload(pubHeader, varPub, []byte("unheard")); err != nil {
+		t.Fatal(err)
+	}
+	if err = rxtx.WritePingreq(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err = rxtx.ReadNextPacket(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(unhandled) != 2 || unhandled[0] != pubHeader || unhandled[1].Type() != PacketPingreq {
+		t.Errorf("got unhandled %v, expected %v and PINGREQ", unhandled, pubHeader)
+	}
+	// Packets with a callback set are not unhandled.
+	rxtx.RxCallbacks.OnOther = func(*Rx, uint16) error { return nil }
+	if err = rxtx.WritePingreq(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = rxtx.ReadNextPacket(); err != nil || len(unhandled) != 2 {
+		t.Errorf("got error %v and %d unhandled packets, expected 2", err, len(unhandled))
+	}
+	// Errors are handled as other callback errors.
+	errUnhandled := errors.New("unhandled")
+	rxtx.RxCallbacks.OnUnhandled = func(*Rx, Header) error { return errUnhandled }
+	if err = rxtx.WritePublishPayload(pubHeader, varPub, []byte("unheard")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = rxtx.ReadNextPacket(); err != errUnhandled {
+		t.Errorf("got %v, expected %v", err, errUnhandled)
+	}
+}
+
+func TestRxOnPubBytes(t *testing.T) {
+	userBuf := make([]byte, 32)
+	buf := newLoopbackTransport()
+	rxtx, err := NewRxTx(buf, DecoderNoAlloc{userBuf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotTopic, gotPayload []byte
+	rxtx.RxCallbacks.OnPubBytes = func(_ *Rx, vp VariablesPublish, payload []byte) error {
+		gotTopic, gotPayload = vp.TopicName, payload
+		return nil
+	}
+	flags, _ := NewPublishFlags(QoS1, false, false)
+	const topic, payload = "bytes", "zero copy payload"
+	err = rxtx.WritePublishPayload(newHeader(PacketPublish, flags, 0), VariablesPublish{TopicName: []byte(topic), PacketIdentifier: 1}, []byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = rxtx.ReadNextPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(gotTopic) != topic || string(gotPayload) != payload {
+		t.Fatalf("got topic %q and payload %q, expected %q and %q", gotTopic, gotPayload, topic, payload)
+	}
+	if &gotPayload[0] != &userBuf[len(topic)] {
+		t.Error("payload does not point to decoder's user buffer following topic")
+	}
+
+	// Payload does not fit in user buffer.
+	err = rxtx.WritePublishPayload(newHeader(PacketPublish, flags, 0), VariablesPublish{TopicName: []byte(topic), PacketIdentifier: 2}, []byte(strings.Repeat("x", len(userBuf))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = rxtx.ReadNextPacket()
+	if !errors.Is(err, ErrUserBufferFull) {
+		t.Errorf("got error %v for payload exceeding user buffer, expected %v", err, ErrUserBufferFull)
+	}
+}
+
+func TestRxBufferPool(t *testing.T) {
+	pool := &countingPool{}
+	buf := newLoopbackTransport()
+	rxtx, err := NewRxTx(buf, DecoderNoAlloc{make([]byte, 1500)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rxtx.BufferPool = pool
+	var got []string
+	rxtx.RxCallbacks.OnPubPayload = func(_ *Rx, _ VariablesPublish, payload []byte) error {
+		got = append(got, string(payload))
+		pool.Put(payload)
+		return nil
+	}
+	flags, _ := NewPublishFlags(QoS0, false, false)
+	payloads := []string{"first", "second", "a payload larger than the pooled buffers"}
+	for _, payload := range payloads {
+		err = rxtx.WritePublishPayload(newHeader(PacketPublish, flags, 0), VariablesPublish{TopicName: []byte("pool")}, []byte(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = rxtx.ReadNextPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(got) != len(payloads) {
+		t.Fatalf("got %d payloads, expected %d", len(got), len(payloads))
+	}
+	for i := range payloads {
+		if got[i] != payloads[i] {
+			t.Errorf("payload %d: got %q, expected %q", i, got[i], payloads[i])
+		}
+	}
+	// Small buffer obtained for the large payload is returned too.
+	if pool.gets != 3 || pool.puts != 4 || pool.allocs != 1 {
+		t.Errorf("got %d gets, %d puts and %d pool allocations", pool.gets, pool.puts, pool.allocs)
+	}
+}
+
+func TestRxMaxPayloadSize(t *testing.T) {
+	flags, _ := NewPublishFlags(QoS0, false, false)
+	for _, onPubPayload := range []bool{true, false} {
+		pool := &countingPool{}
+		buf := newLoopbackTransport()
+		rxtx, err := NewRxTx(buf, DecoderAlloc{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rxtx.MaxPayloadSize = 8
+		rxtx.BufferPool = pool
+		var got []string
+		if onPubPayload {
+			rxtx.RxCallbacks.OnPubPayload = func(_ *Rx, _ VariablesPublish, payload []byte) error {
+				got = append(got, string(payload))
+				return nil
+			}
+		} else {
+			rxtx.RxCallbacks.OnPubBytes = func(_ *Rx, _ VariablesPublish, payload []byte) error {
+				got = append(got, string(payload))
+				return nil
+			}
+		}
+		for _, payload := range []string{"8 bytes!", "nine byte"} {
+			err = rxtx.WritePublishPayload(newHeader(PacketPublish, flags, 0), VariablesPublish{TopicName: []byte("max")}, []byte(payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err = rxtx.ReadNextPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = rxtx.ReadNextPacket()
+		if err != errPayloadLarge {
+			t.Errorf("OnPubPayload=%v: got error %v, expected %v", onPubPayload, err, errPayloadLarge)
+		}
+		if len(got) != 1 || got[0] != "8 bytes!" {
+			t.Errorf("OnPubPayload=%v: got payloads %q", onPubPayload, got)
+		}
+		if onPubPayload && pool.gets != 1 {
+			t.Errorf("got %d buffers from pool, expected none for payload exceeding limit", pool.gets-1)
+		}
+	}
+}
+
+// countingPool is a BufferPool that counts its use.
+type countingPool struct {
+	free       [][]byte
+	gets, puts int
+	allocs     int
+}
+
+func (p *countingPool) Get() []byte {
+	p.gets++
+	if len(p.free) == 0 {
+		p.allocs++
+		return make([]byte, 16)
+	}
+	buf := p.free[len(p.free)-1]
+	p.free = p.free[:len(p.free)-1]
+	return buf
+}
+
+func (p *countingPool) Put(buf []byte) {
+	p.puts++
+	p.free = append(p.free, buf)
+}
+
+func TestRxPublishPayloadBounded(t *testing.T) {
+	// PUBLISH declaring a 10 byte payload of which only 4 are written before transport ends.
+	truncated := []byte("\x30\x0f\x00\x03a/bdata")
+	var rx Rx
+	rx.SetRxTransport(io.NopCloser(bytes.NewReader(truncated)))
+	rx.userDecoder = DecoderNoAlloc{UserBuffer: make([]byte, 64)}
+	rx.RxCallbacks.OnRxError = func(*Rx, error) {}
+	var got []byte
+	rx.RxCallbacks.OnPub = func(_ *Rx, _ VariablesPublish, r io.Reader) (err error) {
+		got, err = io.ReadAll(r)
+		return err
+	}
+	_, err := rx.ReadNextPacket()
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("got %v, expected %v", err, io.ErrUnexpectedEOF)
+	}
+	if string(got) != "data" {
+		t.Errorf("got payload %q", got)
+	}
+
+	// Payload reader does not spill into next packet.
+	stream := []byte("\x30\x09\x00\x03a/bdata\xc0\x00")
+	rx.SetRxTransport(io.NopCloser(bytes.NewReader(stream)))
+	_, err = rx.ReadNextPacket()
+	if err != nil || string(got) != "data" {
+		t.Fatalf("got payload %q, err %v", got, err)
+	}
+	_, err = rx.ReadNextPacket()
+	if err != nil || rx.LastReceivedHeader.Type() != PacketPingreq {
+		t.Errorf("got %s after PUBLISH, err %v", rx.LastReceivedHeader.Type(), err)
+	}
+
+	// Remaining length smaller than variable header.
+	rx.SetRxTransport(io.NopCloser(bytes.NewReader([]byte("\x32\x05\x00\x03a/b\x00\x01"))))
+	_, err = rx.ReadNextPacket()
+	if err != ErrBadRemainingLen {
+		t.Errorf("got %v, expected %v", err, ErrBadRemainingLen)
+	}
+}
+
+func TestRxCallbackErrorNotRxError(t *testing.T) {
+	var rxErrs []error
+	var closed int
+	newRx := func(packet string) *Rx {
+		rx := &Rx{}
+		rx.SetRxTransport(&closeCounter{Reader: strings.NewReader(packet), closed: &closed})
+		rx.RxCallbacks.OnRxError = func(_ *Rx, err error) { rxErrs = append(rxErrs, err) }
+		rx.RxCallbacks.OnConnack = func(_ *Rx, vc VariablesConnack) error {
+			if !vc.Accepted() {
+				return vc.ReturnCode
+			}
+			return nil
+		}
+		return rx
+	}
+	// Callback error closes transport without calling OnRxError.
+	_, err := newRx("\x20\x02\x00\x05").ReadNextPacket()
+	if err != ReturnCodeUnauthorized {
+		t.Errorf("got %v, expected %v", err, ReturnCodeUnauthorized)
+	}
+	if len(rxErrs) != 0 || closed != 1 {
+		t.Errorf("callback error: got OnRxError calls %v and %d closes, expected none and 1", rxErrs, closed)
+	}
+	// Decode errors are still reported to OnRxError which is responsible for closing.
+	closed = 0
+	_, err = newRx("\x20\x03\x00\x00\x00").ReadNextPacket()
+	if err != ErrBadRemainingLen {
+		t.Errorf("got %v, expected %v", err, ErrBadRemainingLen)
+	}
+	if len(rxErrs) != 1 || rxErrs[0] != err || closed != 0 {
+		t.Errorf("decode error: got OnRxError calls %v and %d closes, expected 1 and none", rxErrs, closed)
+	}
+}
+
+type closeCounter struct {
+	io.Reader
+	closed *int
+}
+
+func (c *closeCounter) Close() error {
+	*c.closed++
+	return nil
+}
+
+func TestTxWriteZeroAllocs(t *testing.T) {
+	var tx Tx
+	tx.SetTxTransport(discardTransport{})
+	var varConn VariablesConnect
+	varConn.SetDefaultMQTT([]byte("salamanca"))
+	varConn.Username = []byte("inigo")
+	varConn.Password = []byte("montoya")
+	varConn.WillTopic = []byte("last/words")
+	varConn.WillMessage = []byte("prepare to die")
+	varSub := VariablesSubscribe{
+		PacketIdentifier: 1,
+		TopicFilters: []SubscribeRequest{
+			{TopicFilter: []byte("a/b"), QoS: QoS1},
+			{TopicFilter: []byte("c/#"), QoS: QoS0},
+		},
+	}
+	// Tx buffer grows on first use.
+	if tx.WriteConnect(&varConn) != nil || tx.WriteSubscribe(varSub) != nil {
+		t.Fatal("write failed")
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		tx.WriteConnect(&varConn)
+	})
+	if allocs != 0 {
+		t.Errorf("WriteConnect allocated %v times per run", allocs)
+	}
+	allocs = testing.AllocsPerRun(100, func() {
+		tx.WriteSubscribe(varSub)
+	})
+	if allocs != 0 {
+		t.Errorf("WriteSubscribe allocated %v times per run", allocs)
+	}
+}
+
+func TestRxStrictSubscribeOptions(t *testing.T) {
+	// SUBSCRIBE with topic filter "a" and options byte 0x14, that is QoS0 with
+	// MQTT v5 retain handling bits set.
+	const packet = "\x82\x06\x00\x01\x00\x01a\x14"
+	for _, strict := range []bool{false, true} {
+		var rx Rx
+		rx.SetRxTransport(io.NopCloser(strings.NewReader(packet)))
+		rx.userDecoder = DecoderNoAlloc{UserBuffer: make([]byte, 1500)}
+		rx.Strict = strict
+		rx.RxCallbacks.OnRxError = func(*Rx, error) {}
+		subscribed := false
+		rx.RxCallbacks.OnSub = func(*Rx, VariablesSubscribe) error {
+			subscribed = true
+			return nil
+		}
+		_, err := rx.ReadNextPacket()
+		if !strict {
+			if err != nil || !subscribed {
+				t.Errorf("lenient: got error %v, subscribed=%v", err, subscribed)
+			}
+			continue
+		}
+		var optErr ErrBadSubscribeOptions
+		if !errors.As(err, &optErr) || optErr.Options != 0x14 || optErr.Topic != "a" {
+			t.Errorf("strict: got error %v, expected %v", err, ErrBadSubscribeOptions{Topic: "a", Options: 0x14})
+		}
+		if subscribed {
+			t.Error("strict: OnSub called for SUBSCRIBE with reserved option bits")
+		}
+	}
+}
+
+func TestRxMaxWillSize(t *testing.T) {
+	var varConn VariablesConnect
+	varConn.SetDefaultMQTT([]byte("salamanca"))
+	varConn.SetWill([]byte("last/words"), bytes.Repeat([]byte("a"), 100), QoS0, false)
+	var buf bytes.Buffer
+	var tx Tx
+	tx.SetTxTransport(&testTransport{&buf})
+	if err := tx.WriteConnect(&varConn); err != nil {
+		t.Fatal(err)
+	}
+	packet := buf.String()
+	for _, test := range []struct {
+		desc      string
+		maxWill   int
+		expectErr error
+	}{
+		{desc: "over limit", maxWill: 99, expectErr: errWillTooLarge},
+		{desc: "at limit", maxWill: 100},
+		{desc: "no limit"},
+	} {
+		var rx Rx
+		rx.SetRxTransport(io.NopCloser(strings.NewReader(packet)))
+		rx.userDecoder = DecoderNoAlloc{UserBuffer: make([]byte, 1500)}
+		rx.MaxWillSize = test.maxWill
+		rx.RxCallbacks.OnRxError = func(*Rx, error) {}
+		n, err := rx.ReadNextPacket()
+		if err != test.expectErr {
+			t.Errorf("%s: got error %v, expected %v", test.desc, err, test.expectErr)
+		}
+		if err != nil && n > len(packet)-100 {
+			t.Errorf("%s: read %d bytes of will message before rejecting", test.desc, n-(len(packet)-100))
+		}
+	}
+}
+
+func TestRxUnsubscribeTopics(t *testing.T) {
+	for _, test := range []struct {
+		desc      string
+		packet    string
+		maxTopics int
+		expectErr error
+	}{
+		{desc: "no topics", packet: "\xa2\x02\x00\x01", expectErr: errNoTopics},
+		{desc: "zero-length topic", packet: "\xa2\x0a\x00\x01\x00\x01a\x00\x00\x00\x01b", expectErr: errZeroLengthString},
+		{desc: "over limit", packet: "\xa2\x08\x00\x01\x00\x01a\x00\x01b", maxTopics: 1, expectErr: errManyTopics},
+		{desc: "at limit", packet: "\xa2\x08\x00\x01\x00\x01a\x00\x01b", maxTopics: 2},
+		{desc: "no limit", packet: "\xa2\x08\x00\x01\x00\x01a\x00\x01b"},
+	} {
+		for _, decoder := range []string{"noalloc", "alloc", "reuse"} {
+			var rx Rx
+			rx.SetRxTransport(io.NopCloser(strings.NewReader(test.packet)))
+			switch decoder {
+			case "alloc":
+				rx.userDecoder = DecoderAlloc{}
+			case "reuse":
+				rx.SetReuseUnsubscribe(&VariablesUnsubscribe{})
+				fallthrough
+			default:
+				rx.userDecoder = DecoderNoAlloc{UserBuffer: make([]byte, 64)}
+			}
+			rx.MaxUnsubscribeTopics = test.maxTopics
+			rx.RxCallbacks.OnRxError = func(*Rx, error) {}
+			n, err := rx.ReadNextPacket()
+			if err != test.expectErr {
+				t.Errorf("%s %s: got error %v, expected %v", decoder, test.desc, err, test.expectErr)
+			}
+			if err == errManyTopics && n >= len(test.packet) {
+				t.Errorf("%s %s: topics past the limit were decoded", decoder, test.desc)
+			}
+		}
+	}
+}
+
+func TestRxReuseUnsubscribe(t *testing.T) {
+	const packet = "\xa2\x08\x00\x01\x00\x01a\x00\x01b"
+	r := strings.NewReader(packet)
+	var rx Rx
+	// Transport implements io.ByteReader so integer fields are read without allocating.
+	rx.SetRxTransport(byteReaderTransport{r})
+	rx.userDecoder = DecoderNoAlloc{UserBuffer: make([]byte, 64)}
+	var reused VariablesUnsubscribe
+	rx.SetReuseUnsubscribe(&reused)
+	var got VariablesUnsubscribe
+	rx.RxCallbacks.OnUnsub = func(_ *Rx, vu VariablesUnsubscribe) error {
+		got = vu
+		return nil
+	}
+	readNext := func() {
+		r.Reset(packet)
+		if _, err := rx.ReadNextPacket(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readNext() // Grow Topics capacity.
+	varEqual(t, VariablesUnsubscribe{PacketIdentifier: 1, Topics: [][]byte{[]byte("a"), []byte("b")}}, got)
+	if &got.Topics[0] != &reused.Topics[0] {
+		t.Error("callback topics do not alias reused VariablesUnsubscribe")
+	}
+	allocs := testing.AllocsPerRun(100, readNext)
+	if allocs != 0 {
+		t.Errorf("UNSUBSCRIBE decode allocated %v times per run", allocs)
+	}
+}
+
+type byteReaderTransport struct {
+	*strings.Reader
+}
+
+func (byteReaderTransport) Close() error { return nil }
+
+func TestConnectProperties(t *testing.T) {
+	props := []Property{
+		{ID: PropSessionExpiryInterval, Value: 0x01020304},
+		{ID: PropReceiveMaximum, Value: 20},
+		{ID: PropRequestProblemInfo, Value: 1},
+		{ID: PropAuthenticationMethod, Data: []byte("SCRAM-SHA-1")},
+		{ID: PropUserProperty, Data: []byte("region"), UserValue: []byte("eu")},
+	}
+	encode := func(vc *VariablesConnect) []byte {
+		t.Helper()
+		var buf bytes.Buffer
+		var tx Tx
+		tx.SetTxTransport(&testTransport{&buf})
+		if err := tx.WriteConnect(vc); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	// MQTT v3.1.1 encoding ignores properties.
+	var v4 VariablesConnect
+	v4.SetDefaultMQTT([]byte("salamanca"))
+	withoutProps := encode(&v4)
+	v4.Properties = props
+	if !bytes.Equal(encode(&v4), withoutProps) {
+		t.Error("properties changed MQTT v3.1.1 CONNECT encoding")
+	}
+
+	for _, withWill := range []bool{false, true} {
+		v5 := v4
+		v5.ProtocolLevel = ProtocolLevel5
+		if withWill {
+			v5.WillTopic = []byte("last/words")
+			v5.WillMessage = []byte("bye")
+		}
+		packet := encode(&v5)
+		if packet[8] != ProtocolLevel5 {
+			t.Errorf("will=%v: got protocol level %d", withWill, packet[8])
+		}
+		// DecodeAll checks Size against encoded length.
+		packets, err := DecodeAll(packet)
+		if err != nil {
+			t.Fatalf("will=%v: %v", withWill, err)
+		}
+		got := packets[0].Connect
+		if len(got.Properties) != len(props) {
+			t.Fatalf("will=%v: got %d properties, expected %d", withWill, len(got.Properties), len(props))
+		}
+		for i, p := range got.Properties {
+			expect := props[i]
+			if p.ID != expect.ID || p.Value != expect.Value || string(p.Data) != string(expect.Data) || string(p.UserValue) != string(expect.UserValue) {
+				t.Errorf("will=%v: property %d got %+v, expected %+v", withWill, i, p, expect)
+			}
+		}
+		if string(got.ClientID) != "salamanca" || string(got.WillMessage) != string(v5.WillMessage) {
+			t.Errorf("will=%v: got client ID %q and will message %q", withWill, got.ClientID, got.WillMessage)
+		}
+		clientID, _, _, _, _, err := DecodeConnectHead(packet[2:])
+		if err != nil || string(clientID) != "salamanca" {
+			t.Errorf("will=%v: DecodeConnectHead got client ID %q, err %v", withWill, clientID, err)
+		}
+	}
+
+	// Unknown CONNECT property is reported through OnRxError.
+	v5 := v4
+	v5.ProtocolLevel = ProtocolLevel5
+	v5.Properties = []Property{{ID: PropReceiveMaximum, Value: 1}}
+	packet := encode(&v5)
+	packet[13] = 0x23 // Topic Alias, not valid in CONNECT.
+	var rx Rx
+	rx.SetRxTransport(io.NopCloser(bytes.NewReader(packet)))
+	rx.userDecoder = DecoderNoAlloc{UserBuffer: make([]byte, 64)}
+	var rxErr error
+	rx.RxCallbacks.OnRxError = func(_ *Rx, err error) { rxErr = err }
+	_, err := rx.ReadNextPacket()
+	if err == nil || rxErr != err || !strings.Contains(err.Error(), "property identifier 0x23") {
+		t.Errorf("got error %v and OnRxError %v, expected unknown property error", err, rxErr)
+	}
+}
+
+func TestRxTxConcurrentReadWrite(t *testing.T) {
+	// Run with the race detector: go test -race -run TestRxTxConcurrentReadWrite
+	const packets = 100
+	c1, c2 := net.Pipe()
+	a, err := NewRxTx(c1, DecoderNoAlloc{make([]byte, 1500)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewRxTx(c2, DecoderNoAlloc{make([]byte, 1500)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pubs, pings int
+	a.RxCallbacks.OnPub = func(rx *Rx, _ VariablesPublish, r io.Reader) error {
+		pubs++
+		_, err := io.Copy(io.Discard, r)
+		return err
+	}
+	b.RxCallbacks.OnOther = func(rx *Rx, _ uint16) error {
+		if rx.LastReceivedHeader.Type() == PacketPingreq {
+			pings++
+		}
+		return nil
+	}
+	a.RxStats, a.TxStats = new(PacketStats), new(PacketStats)
+	readUntilClosed := func(rxtx *RxTx) {
+		for {
+			if _, err := rxtx.ReadNextPacket(); err != nil {
+				return
+			}
+		}
+	}
+	var readers, writers sync.WaitGroup
+	readers.Add(2)
+	go func() { defer readers.Done(); readUntilClosed(a) }()
+	go func() { defer readers.Done(); readUntilClosed(b) }()
+	writers.Add(2)
+	go func() {
+		defer writers.Done()
+		for i := 0; i < packets; i++ {
+			if err := a.WritePingreq(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer writers.Done()
+		flags, _ := NewPublishFlags(QoS0, false, false)
+		for i := 0; i < packets; i++ {
+			if err := b.WritePublishPayload(newHeader(PacketPublish, flags, 0), VariablesPublish{TopicName: []byte("a/b")}, []byte("payload")); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	writers.Wait()
+	// Closing from the writing side unblocks the readers, whose error handling closes the transport again.
+	a.CloseTx()
+	b.CloseTx()
+	readers.Wait()
+	if pubs != packets || pings != packets {
+		t.Errorf("got %d PUBLISH and %d PINGREQ packets, expected %d of each", pubs, pings, packets)
+	}
+	if a.RxStats.Count[PacketPublish] != packets || a.TxStats.Count[PacketPingreq] != packets {
+		t.Error("bad packet statistics")
+	}
+}
+
+func TestTxConcurrentWrites(t *testing.T) {
+	const writes = 100
+	var buf bytes.Buffer
+	var tx Tx
+	tx.SetTxTransport(&shortWriter{w: yieldWriter{&buf}, max: 3})
+	flags, _ := NewPublishFlags(QoS0, false, false)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < writes; i++ {
+			if err := tx.WritePublishPayload(newHeader(PacketPublish, flags, 0), VariablesPublish{TopicName: []byte("a/b")}, []byte("payload")); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < writes; i++ {
+			if err := tx.WritePingreq(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	packets, err := DecodeAll(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packets) != 2*writes {
+		t.Errorf("decoded %d packets, expected %d", len(packets), 2*writes)
+	}
+}
+
+// yieldWriter yields the processor before every write to interleave concurrent writers.
+type yieldWriter struct {
+	w io.Writer
+}
+
+func (yw yieldWriter) Write(p []byte) (int, error) {
+	runtime.Gosched()
+	return yw.w.Write(p)
+}
+
+func TestTxShortWrites(t *testing.T) {
+	var buf bytes.Buffer
+	var tx Tx
+	tx.SetTxTransport(&shortWriter{w: &buf, max: 3})
+	var varConn VariablesConnect
+	varConn.SetDefaultMQTT([]byte("salamanca"))
+	flags, _ := NewPublishFlags(QoS1, false, false)
+	varSub := VariablesSubscribe{PacketIdentifier: 1, TopicFilters: []SubscribeRequest{{TopicFilter: []byte("a/b")}}}
+	writes := []func() error{
+		func() error { return tx.WriteConnect(&varConn) },
+		func() error { return tx.WriteConnack(VariablesConnack{}) },
+		func() error {
+			return tx.WritePublishPayload(newHeader(PacketPublish, flags, 0), VariablesPublish{TopicName: []byte("a/b"), PacketIdentifier: 1}, []byte("payload"))
+		},
+		func() error { return tx.WriteSubscribe(varSub) },
+		func() error {
+			return tx.WriteSuback(VariablesSuback{PacketIdentifier: 1, ReturnCodes: []QoSLevel{QoS0}})
+		},
+		func() error {
+			return tx.WriteUnsubscribe(VariablesUnsubscribe{PacketIdentifier: 1, Topics: [][]byte{[]byte("a/b")}})
+		},
+		func() error { return tx.WriteIdentified(PacketPuback, 1) },
+		func() error { return tx.WriteAcks(PacketPubcomp, []uint16{1, 2}) },
+		func() error { return tx.WriteSimple(PacketPingreq) },
+	}
+	for i, write := range writes {
+		if err := write(); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+	}
+	packets, err := DecodeAll(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packets) != len(writes)+1 {
+		t.Errorf("decoded %d packets, expected %d", len(packets), len(writes)+1)
+	}
+
+	n, err := WriteFull(&shortWriter{w: io.Discard, max: 0}, []byte("abc"))
+	if n != 0 || err != io.ErrShortWrite {
+		t.Errorf("got n=%d err=%v for stalled writer, expected %v", n, err, io.ErrShortWrite)
+	}
+}
+
+// shortWriter accepts at most max bytes per call to Write.
+type shortWriter struct {
+	w   io.Writer
+	max int
+}
+
+func (sw *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > sw.max {
+		p = p[:sw.max]
+	}
+	return sw.w.Write(p)
+}
+
+func (sw *shortWriter) Close() error { return nil }
+
+func TestPacketWriteTo(t *testing.T) {
+	var stream bytes.Buffer
+	var tx Tx
+	tx.SetTxTransport(&testTransport{&stream})
+	var varConn VariablesConnect
+	varConn.SetDefaultMQTT([]byte("salamanca"))
+	varConn.WillTopic = []byte("last/words")
+	varConn.WillMessage = []byte("prepare to die")
+	flags, _ := NewPublishFlags(QoS1, true, true)
+	writes := []error{
+		tx.WriteConnect(&varConn),
+		tx.WritePublishPayload(newHeader(PacketPublish, flags, 0), VariablesPublish{TopicName: []byte("a/b"), PacketIdentifier: 7}, []byte("fan out")),
+		tx.WriteSubscribe(VariablesSubscribe{PacketIdentifier: 8, TopicFilters: []SubscribeRequest{{TopicFilter: []byte("a/#"), QoS: QoS1}}}),
+		tx.WriteSuback(VariablesSuback{PacketIdentifier: 8, ReturnCodes: []QoSLevel{QoS1}}),
+		tx.WriteIdentified(PacketPubrel, 7),
+		tx.WritePingreq(),
+	}
+	for i, err := range writes {
+		if err != nil {
+			t.Fatal(i, err)
+		}
+	}
+	packets, err := DecodeAll(stream.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Decoded packets written back are identical to the original stream.
+	var got bytes.Buffer
+	var total int64
+	for i := range packets {
+		n, err := packets[i].WriteTo(&got)
+		if err != nil {
+			t.Fatalf("packet %d %s: %v", i, packets[i].Header, err)
+		}
+		total += n
+	}
+	if !bytes.Equal(got.Bytes(), stream.Bytes()) || total != int64(stream.Len()) {
+		t.Errorf("got %d bytes %q, expected %q", total, got.Bytes(), stream.Bytes())
+	}
+	// Serialized once, written many times.
+	var pub bytes.Buffer
+	packets[1].WriteTo(&pub)
+	var dst1, dst2 bytes.Buffer
+	pub.WriteTo(io.MultiWriter(&dst1, &dst2))
+	if dst1.String() != dst2.String() || !strings.Contains(dst1.String(), "fan out") {
+		t.Errorf("fan out got %q and %q", dst1.Bytes(), dst2.Bytes())
+	}
+	invalid := Packet{Header: newHeader(PacketPublish, flags, 0)}
+	if _, err = invalid.WriteTo(&got); err == nil {
+		t.Error("expected error writing PUBLISH with empty topic")
+	}
+}
+
+func TestDecodeAll(t *testing.T) {
+	stream := bytes.Join(validPackets, nil)
+	packets, err := DecodeAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packets) != len(validPackets) {
+		t.Fatalf("decoded %d packets, expected %d", len(packets), len(validPackets))
+	}
+	for i, packet := range validPackets {
+		if packets[i].Header.Type() != PacketType(packet[0]>>4) {
+			t.Errorf("packet %d: got type %s, expected %s", i, packets[i].Header.Type(), PacketType(packet[0]>>4))
+		}
+	}
+	if string(packets[3].Subscribe.TopicFilters[1].TopicFilter) != "the-clash" {
+		t.Errorf("got topic filter %q", packets[3].Subscribe.TopicFilters[1].TopicFilter)
+	}
+	if packets[6].PacketIdentifier != 0x0ca0 {
+		t.Errorf("got PUBREL packet identifier %#x", packets[6].PacketIdentifier)
+	}
+	if !bytes.HasPrefix(packets[2].Payload, []byte("ertytgbh")) {
+		t.Errorf("got PUBLISH payload %q", packets[2].Payload)
+	}
+
+	// Malformed PUBACK (bad remaining length) in middle of stream.
+	badOffset := len(validPackets[0]) + len(validPackets[1])
+	malformed := bytes.Join([][]byte{validPackets[0], validPackets[1], []byte("\x40\x03\x00\x01\x00"), validPackets[7]}, nil)
+	packets, err = DecodeAll(malformed)
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) {
+		t.Fatalf("expected DecodeError, got %v", err)
+	}
+	if decodeErr.Offset != badOffset {
+		t.Errorf("got offset %d, expected %d", decodeErr.Offset, badOffset)
+	}
+	if len(packets) != 2 {
+		t.Errorf("expected 2 packets decoded before error, got %d", len(packets))
+	}
+}
+
+func TestRxReadNextPacketTimeout(t *testing.T) {
+	conn, remote := net.Pipe()
+	defer conn.Close()
+	defer remote.Close()
+	var rx Rx
+	rx.userDecoder = DecoderNoAlloc{UserBuffer: make([]byte, 1500)}
+	rx.SetRxTransport(conn)
+	var gotPing bool
+	rx.RxCallbacks.OnOther = func(rx *Rx, _ uint16) error {
+		gotPing = rx.LastReceivedHeader.Type() == PacketPingreq
+		return nil
+	}
+	rx.RxCallbacks.OnRxError = func(_ *Rx, err error) {
+		t.Error("unexpected rx error:", err)
+	}
+	n, err := rx.ReadNextPacketTimeout(10 * time.Millisecond)
+	if err != ErrIdle || n != 0 {
+		t.Fatalf("got %d, %v; expected 0, ErrIdle", n, err)
+	}
+	go remote.Write([]byte{byte(PacketPingreq) << 4, 0})
+	_, err = rx.ReadNextPacketTimeout(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gotPing {
+		t.Error("PINGREQ not received after idle period")
+	}
+
+	// Deadline is cleared on errors other than a timeout before any byte is read.
+	trp := &deadlineTransport{ReadWriteCloser: &testTransport{&bytes.Buffer{}}}
+	rx.SetRxTransport(trp)
+	rx.RxCallbacks.OnRxError = func(*Rx, error) {}
+	n, err = rx.ReadNextPacketTimeout(time.Second)
+	if err == nil || err == ErrIdle || n != 0 {
+		t.Fatalf("got %d, %v; expected 0 and transport error", n, err)
+	}
+	if !trp.deadline.IsZero() {
+		t.Error("read deadline not cleared after error:", trp.deadline)
+	}
+}
+
+func TestRxReadNextPacketContext(t *testing.T) {
+	conn, remote := net.Pipe()
+	defer conn.Close()
+	defer remote.Close()
+	var rx Rx
+	rx.userDecoder = DecoderNoAlloc{UserBuffer: make([]byte, 1500)}
+	rx.SetRxTransport(conn)
+	var gotPing bool
+	rx.RxCallbacks.OnOther = func(rx *Rx, _ uint16) error {
+		gotPing = rx.LastReceivedHeader.Type() == PacketPingreq
+		return nil
+	}
+	rx.RxCallbacks.OnRxError = func(_ *Rx, err error) {
+		t.Error("unexpected rx error:", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	n, err := rx.ReadNextPacketContext(ctx)
+	if err != context.Canceled || n != 0 {
+		t.Fatalf("got %d, %v; expected 0, %v", n, err, context.Canceled)
+	}
+	n, err = rx.ReadNextPacketContext(ctx)
+	if err != context.Canceled || n != 0 {
+		t.Fatalf("cancelled context: got %d, %v; expected 0, %v", n, err, context.Canceled)
+	}
+	// Transport is usable after cancellation.
+	go remote.Write([]byte{byte(PacketPingreq) << 4, 0})
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = rx.ReadNextPacketContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gotPing {
+		t.Error("PINGREQ not received after cancellation")
+	}
+}
+
+func TestRxIdentifiedCallbacks(t *testing.T) {
+	var buf bytes.Buffer
+	var tx Tx
+	tx.SetTxTransport(&testTransport{&buf})
+	types := []PacketType{PacketPuback, PacketPubrec, PacketPubrel, PacketPubcomp, PacketUnsuback, PacketPingresp}
+	for i, packetType := range types {
+		if packetType == PacketPingresp {
+			if err := tx.WritePingresp(); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := tx.WriteIdentified(packetType, uint16(i+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var rx Rx
+	rx.SetRxTransport(&testTransport{&buf})
+	var got []PacketType
+	var gotPI []uint16
+	record := func(packetType PacketType) func(*Rx, uint16) error {
+		return func(_ *Rx, pi uint16) error {
+			got = append(got, packetType)
+			gotPI = append(gotPI, pi)
+			return nil
+		}
+	}
+	rx.RxCallbacks.OnPuback = record(PacketPuback)
+	rx.RxCallbacks.OnPubrec = record(PacketPubrec)
+	rx.RxCallbacks.OnPubrel = record(PacketPubrel)
+	rx.RxCallbacks.OnPubcomp = record(PacketPubcomp)
+	// PINGRESP goes to OnOther. UNSUBACK has no callback set so it must not.
+	rx.RxCallbacks.OnOther = record(PacketPingresp)
+	rx.RxCallbacks.OnUnhandled = func(_ *Rx, hdr Header) error {
+		got = append(got, hdr.Type())
+		gotPI = append(gotPI, 0)
+		return nil
+	}
+	for range types {
+		if _, err := rx.ReadNextPacket(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := []PacketType{PacketPuback, PacketPubrec, PacketPubrel, PacketPubcomp, PacketUnsuback, PacketPingresp}
+	expectPI := []uint16{1, 2, 3, 4, 0, 0}
+	if len(got) != len(expect) {
+		t.Fatalf("got %d callbacks, expected %d", len(got), len(expect))
+	}
+	for i := range expect {
+		if got[i] != expect[i] || gotPI[i] != expectPI[i] {
+			t.Errorf("packet %d: got callback %s with id %d, expected %s with id %d", i, got[i], gotPI[i], expect[i], expectPI[i])
+		}
+	}
+}
+
+func TestRxResyncOnError(t *testing.T) {
+	for _, resync := range []bool{false, true} {
+		var buf bytes.Buffer
+		var tx Tx
+		tx.SetTxTransport(&testTransport{&buf})
+		buf.WriteByte(0) // Garbage.
+		if err := tx.WriteIdentified(PacketPuback, 7); err != nil {
+			t.Fatal(err)
+		}
+		// PUBACK with bad remaining length followed by PINGRESP.
+		buf.WriteString("\x40\x03\x00\x01\x00")
+		if err := tx.WritePingresp(); err != nil {
+			t.Fatal(err)
+		}
+		trp := &testTransport{&buf}
+		var rx Rx
+		rx.ResyncOnError = resync
+		rx.SetRxTransport(trp)
+		var gotPI uint16
+		rx.RxCallbacks.OnPuback = func(_ *Rx, pi uint16) error {
+			gotPI = pi
+			return nil
+		}
+		_, err := rx.ReadNextPacket()
+		if !resync {
+			if err == nil || trp.rw != nil {
+				t.Fatalf("expected error and closed transport, got error %v", err)
+			}
+			continue
+		}
+		if err != nil || gotPI != 7 {
+			t.Fatalf("got error %v and packet identifier %d; expected resync to PUBACK with id 7", err, gotPI)
+		}
+		_, err = rx.ReadNextPacket()
+		if err != ErrBadRemainingLen || trp.rw == nil {
+			t.Fatalf("got error %v; expected %v and open transport", err, ErrBadRemainingLen)
+		}
+		_, err = rx.ReadNextPacket()
+		if err != nil || rx.LastReceivedHeader.Type() != PacketPingresp {
+			t.Fatalf("got error %v and packet %s; expected resync to PINGRESP", err, rx.LastReceivedHeader.Type())
+		}
+	}
+}
+
+func TestRxResyncTransportError(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("\x40\x02\x00") // PUBACK truncated by end of transport.
+	trp := &testTransport{&buf}
+	var rx Rx
+	rx.ResyncOnError = true
+	rx.SetRxTransport(trp)
+	var rxErr error
+	rx.RxCallbacks.OnRxError = func(_ *Rx, err error) { rxErr = err }
+	rx.RxCallbacks.OnOther = func(*Rx, uint16) error {
+		t.Error("OnOther called for truncated packet")
+		return nil
+	}
+	_, err := rx.ReadNextPacket()
+	if err == nil || rxErr != err {
+		t.Fatalf("got error %v and OnRxError %v; expected transport error passed to OnRxError", err, rxErr)
+	}
+	if !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		t.Errorf("got error %v; expected end of transport", err)
+	}
+}
+
+func TestRxReadUpTo(t *testing.T) {
+	var buf bytes.Buffer
+	var tx Tx
+	tx.SetTxTransport(&testTransport{&buf})
+	for i := 0; i < 5; i++ {
+		if err := tx.WritePingreq(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var rx Rx
+	rx.SetRxTransport(&testTransport{&buf})
+	dispatched := 0
+	rx.RxCallbacks.OnOther = func(*Rx, uint16) error {
+		dispatched++
+		return nil
+	}
+	for _, expect := range []int{2, 2} {
+		dispatched = 0
+		n, err := rx.ReadUpTo(2)
+		if err != nil || n != expect || dispatched != expect {
+			t.Fatalf("got %d packets read, %d dispatched and error %v; expected %d", n, dispatched, err, expect)
+		}
+	}
+	// Transport runs dry before limit.
+	n, err := rx.ReadUpTo(2)
+	if n != 1 || err != io.EOF {
+		t.Errorf("got %d packets read and error %v; expected 1 and EOF", n, err)
+	}
+}
+
+func TestRxTopicValidator(t *testing.T) {
+	errBadPrefix := errors.New("topic must start with v1/")
+	pubFlags, _ := NewPublishFlags(QoS0, false, false)
+	for _, test := range []struct {
+		topic     string
+		expectErr error
+	}{
+		{topic: "v1/thing"},
+		{topic: "other/thing", expectErr: errBadPrefix},
+	} {
+		for _, packetType := range []PacketType{PacketPublish, PacketSubscribe} {
+			buf := newLoopbackTransport()
+			rxtx, err := NewRxTx(buf, DecoderNoAlloc{make([]byte, 1500)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			rxtx.RxCallbacks.OnRxError = func(*Rx, error) {}
+			rxtx.TopicValidator = func(topic []byte) error {
+				if !bytes.HasPrefix(topic, []byte("v1/")) {
+					return errBadPrefix
+				}
+				return nil
+			}
+			topic := []byte(test.topic)
+			if packetType == PacketPublish {
+				err = rxtx.WritePublishPayload(newHeader(PacketPublish, pubFlags, 0), VariablesPublish{TopicName: topic}, []byte("data"))
+			} else {
+				err = rxtx.WriteSubscribe(VariablesSubscribe{PacketIdentifier: 1, TopicFilters: []SubscribeRequest{{TopicFilter: topic}}})
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = rxtx.ReadNextPacket()
+			if err != test.expectErr {
+				t.Errorf("%s %s: got error %v, expected %v", packetType, test.topic, err, test.expectErr)
+			}
+		}
+	}
+}
+
+func TestValidateTopic(t *testing.T) {
+	for _, test := range []struct {
+		topic     string
+		nameErr   error
+		filterErr error
+	}{
+		{topic: "sensors/temp"},
+		{topic: "/"},
+		{topic: "sensors/#", nameErr: errTopicNameWildcard},
+		{topic: "#", nameErr: errTopicNameWildcard},
+		{topic: "+/temp/+", nameErr: errTopicNameWildcard},
+		{topic: "sensors/+/temp", nameErr: errTopicNameWildcard},
+		{topic: "", nameErr: errEmptyTopic, filterErr: errEmptyTopic},
+		{topic: "a\x00b", nameErr: errTopicNull, filterErr: errTopicNull},
+		{topic: "a/\xff", nameErr: errTopicNotUTF8, filterErr: errTopicNotUTF8},
+		{topic: "sensors/#/temp", nameErr: errTopicNameWildcard, filterErr: errTopicHashLast},
+		{topic: "sensors#", nameErr: errTopicNameWildcard, filterErr: errTopicHashLast},
+		{topic: "sensors+/temp", nameErr: errTopicNameWildcard, filterErr: errTopicPlusLevel},
+		{topic: "sensors/+temp", nameErr: errTopicNameWildcard, filterErr: errTopicPlusLevel},
+	} {
+		if err := ValidateTopicName([]byte(test.topic)); err != test.nameErr {
+			t.Errorf("ValidateTopicName(%q): got %v, expected %v", test.topic, err, test.nameErr)
+		}
+		if err := ValidateTopicFilter([]byte(test.topic)); err != test.filterErr {
+			t.Errorf("ValidateTopicFilter(%q): got %v, expected %v", test.topic, err, test.filterErr)
+		}
+	}
+	var buf bytes.Buffer
+	var tx Tx
+	tx.SetTxTransport(&testTransport{&buf})
+	flags, _ := NewPublishFlags(QoS0, false, false)
+	err := tx.WritePublishPayload(newHeader(PacketPublish, flags, 0), VariablesPublish{TopicName: []byte("sensors/#")}, nil)
+	if err != errTopicNameWildcard {
+		t.Errorf("expected wildcard error publishing to filter, got %v", err)
+	}
+	err = tx.WriteUnsubscribe(VariablesUnsubscribe{PacketIdentifier: 1, Topics: [][]byte{[]byte("a/#/b")}})
+	if err != errTopicHashLast {
+		t.Errorf("expected '#' error unsubscribing, got %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("invalid packets written to transport: %q", buf.Bytes())
+	}
+	tx.SkipTopicValidation = true
+	err = tx.WritePublishPayload(newHeader(PacketPublish, flags, 0), VariablesPublish{TopicName: []byte("sensors/#")}, nil)
+	if err != nil || buf.Len() == 0 {
+		t.Errorf("expected publish with validation skipped to be written, got %v", err)
+	}
+}
+
+func TestTopicAliasV5(t *testing.T) {
+	rxtx, err := NewRxTx(newLoopbackTransport(), DecoderNoAlloc{make([]byte, 1500)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rxtx.Tx.ProtocolLevel = ProtocolLevel5
+	rxtx.Rx.ProtocolLevel = ProtocolLevel5
+	rxtx.Tx.TopicAliasMaximum = 10
+	rxtx.Rx.TopicAliasMaximum = 10
+	type received struct {
+		topic   string
+		alias   uint16
+		payload string
+	}
+	var got []received
+	rxtx.RxCallbacks.OnPub = func(rx *Rx, vp VariablesPublish, r io.Reader) error {
+		b, err := io.ReadAll(r)
+		got = append(got, received{topic: string(vp.TopicName), alias: vp.TopicAlias, payload: string(b)})
+		return err
+	}
+	flags, _ := NewPublishFlags(QoS1, false, false)
+	h := newHeader(PacketPublish, flags, 0)
+	// Alias is not mapped until a PUBLISH with its topic name is written.
+	err = rxtx.WritePublishPayload(h, VariablesPublish{PacketIdentifier: 1, TopicAlias: 3}, nil)
+	if err == nil {
+		t.Error("expected error writing unmapped topic alias")
+	}
+	err = rxtx.WritePublishPayload(h, VariablesPublish{TopicName: []byte("a/b"), PacketIdentifier: 1, TopicAlias: 11}, nil)
+	if err != ErrTopicAliasMaximum {
+		t.Errorf("got %v, expected %v", err, ErrTopicAliasMaximum)
+	}
+	err = rxtx.WritePublishPayload(h, VariablesPublish{TopicName: []byte("a/b"), PacketIdentifier: 1, TopicAlias: 3}, []byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rxtx.WritePublishPayload(h, VariablesPublish{PacketIdentifier: 2, TopicAlias: 3}, []byte("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		_, err = rxtx.ReadNextPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := []received{{"a/b", 3, "first"}, {"a/b", 3, "second"}}
+	if len(got) != len(expect) || got[0] != expect[0] || got[1] != expect[1] {
+		t.Errorf("got %v, expected %v", got, expect)
+	}
+
+	// Receiver rejects aliases exceeding its Topic Alias Maximum.
+	rxtx.Rx.TopicAliasMaximum = 2
+	rxtx.RxCallbacks.OnRxError = func(*Rx, error) {}
+	err = rxtx.WritePublishPayload(h, VariablesPublish{PacketIdentifier: 3, TopicAlias: 3}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = rxtx.ReadNextPacket()
+	if err != ErrTopicAliasMaximum {
+		t.Errorf("got %v, expected %v", err, ErrTopicAliasMaximum)
+	}
+
+	// Properties other than the topic alias are skipped: content type, user property and subscription identifier.
+	const props = "\x03\x00\x01x" + "\x26\x00\x01k\x00\x01v" + "\x0b\x05" + "\x23\x00\x01"
+	rx := Rx{ProtocolLevel: ProtocolLevel5, TopicAliasMaximum: 1}
+	rx.SetRxTransport(io.NopCloser(strings.NewReader("\x30\x15\x00\x01t\x10" + props + "p")))
+	rx.userDecoder = DecoderNoAlloc{make([]byte, 16)}
+	rx.RxCallbacks.OnPub = rxtx.RxCallbacks.OnPub
+	got = got[:0]
+	_, err = rx.ReadNextPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0] != (received{"t", 1, "p"}) {
+		t.Errorf("got %v, expected topic t with alias 1 and payload p", got)
+	}
+}
+
+func TestDecoderAlloc(t *testing.T) {
+	buf := newLoopbackTransport()
+	rxtx, err := NewRxTx(buf, DecoderAlloc{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var varConn VariablesConnect
+	varConn.SetDefaultMQTT([]byte("0w"))
+	varConn.SetWill([]byte("Bw"), []byte("Aw"), QoS1, true)
+	varConn.Username = []byte("Cw")
+	varConn.Password = []byte("Dw")
+	varSub := VariablesSubscribe{PacketIdentifier: 1, TopicFilters: []SubscribeRequest{{TopicFilter: []byte("sub/a"), QoS: QoS1}, {TopicFilter: []byte("sub/b")}}}
+	varUnsub := VariablesUnsubscribe{PacketIdentifier: 2, Topics: [][]byte{[]byte("unsub/a"), []byte("unsub/b")}}
+	varPub := VariablesPublish{TopicName: []byte("pub"), PacketIdentifier: 3}
+	pubFlags, _ := NewPublishFlags(QoS1, false, false)
+
+	// Values are retained across reads without copying.
+	var (
+		gotConn  *VariablesConnect
+		gotSub   VariablesSubscribe
+		gotUnsub VariablesUnsubscribe
+		gotPub   VariablesPublish
+	)
+	rxtx.RxCallbacks.OnConnect = func(_ *Rx, vc *VariablesConnect) error { gotConn = vc; return nil }
+	rxtx.RxCallbacks.OnSub = func(_ *Rx, vs VariablesSubscribe) error { gotSub = vs; return nil }
+	rxtx.RxCallbacks.OnUnsub = func(_ *Rx, vu VariablesUnsubscribe) error { gotUnsub = vu; return nil }
+	rxtx.RxCallbacks.OnPub = func(_ *Rx, vp VariablesPublish, r io.Reader) error {
+		gotPub = vp
+		_, err := io.Copy(io.Discard, r)
+		return err
+	}
+	for _, write := range []func() error{
+		func() error { return rxtx.WriteConnect(&varConn) },
+		func() error { return rxtx.WriteSubscribe(varSub) },
+		func() error { return rxtx.WriteUnsubscribe(varUnsub) },
+		func() error {
+			return rxtx.WritePublishPayload(newHeader(PacketPublish, pubFlags, 0), varPub, []byte("payload"))
+		},
+	} {
+		if err = write(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = rxtx.ReadNextPacket(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if gotConn == nil {
+		t.Fatal("OnConnect not called")
+	}
+	varEqual(t, &varConn, gotConn)
+	varEqual(t, varSub, gotSub)
+	varEqual(t, varUnsub, gotUnsub)
+	varEqual(t, varPub, gotPub)
+}
+
+func TestRxTxLoopback(t *testing.T) {
+	// This test starts with a long running
+	buf := newLoopbackTransport()
+	rxtx, err := NewRxTx(buf, DecoderNoAlloc{make([]byte, 1500)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rxtx.SetTransport(buf)
+	//
+	// Send CONNECT packet over wire.
+	//
+	{
+		var varConn VariablesConnect
+		varConn.SetDefaultMQTT([]byte("0w"))
+		varConn.WillQoS = QoS1
+		varConn.WillRetain = true
+		varConn.WillMessage = []byte("Aw")
+		varConn.WillTopic = []byte("Bw")
+		varConn.Username = []byte("Cw")
+		varConn.Password = []byte("Dw")
+		remlen := uint32(varConn.Size())
+		expectHeader := newHeader(PacketConnect, 0, remlen)
+		err = rxtx.WriteConnect(&varConn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// We now prepare to receive CONNECT packet on other side.
+		callbackExecuted := false
+		rxtx.RxCallbacks.OnConnect = func(rt *Rx, vc *VariablesConnect) error {
+			if rt.LastReceivedHeader != expectHeader {
+				t.Errorf("rxtx header mismatch, expect:%v, rxed:%v", expectHeader.String(), rt.LastReceivedHeader.String())
+			}
+			varEqual(t, &varConn, vc)
+			callbackExecuted = true
+			return nil
+		}
+		// Read packet that is on the "wire"
+		n, err := rxtx.ReadNextPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectSize := expectHeader.Size() + varConn.Size()
+		if n != expectSize {
+			t.Errorf("read %v bytes, expected to read %v bytes", n, expectSize)
+		}
+		if !callbackExecuted {
+			t.Error("OnConnect callback not executed")
+		}
+	}
+	if t.Failed() {
+		return // fix first clause before continuing.
+	}
+	buf.rw.Reset()
+	//
+	// Send CONNACK packet over wire.
+	//
+	{
+		varConnck := VariablesConnack{
+			AckFlags:   1,                      // SP set
+			ReturnCode: ReturnCodeConnAccepted, // Accepted since SP set.
+		}
+		err = rxtx.WriteConnack(varConnck)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectHeader := newHeader(PacketConnack, 0, uint32(varConnck.Size()))
+		callbackExecuted := false
+		rxtx.RxCallbacks.OnConnack = func(rt *Rx, vc VariablesConnack) error {
+			if rt.LastReceivedHeader != expectHeader {
+				t.Errorf("rxtx header mismatch, expect:%v, rxed:%v", expectHeader.String(), rt.LastReceivedHeader.String())
+			}
+			varEqual(t, varConnck, vc)
+			callbackExecuted = true
+			return nil
+		}
+
+		n, err := rxtx.ReadNextPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectSize := expectHeader.Size() + varConnck.Size()
+		if n != expectSize {
+			t.Errorf("read %v bytes, expected to read %v bytes", n, expectSize)
+		}
+		if !callbackExecuted {
+			t.Error("OnConnack callback not executed")
+		}
+	}
+
+	//
+	// Send PUBLISH QoS1 packet over wire.
+	//
+	{
+		const pubQos = QoS1
+		publishPayload := []byte("PL")
+		varPublish := VariablesPublish{
+			TopicName:        []byte("TOP"),
+			PacketIdentifier: math.MaxUint16,
+		}
+		pubflags, err := NewPublishFlags(pubQos, true, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedRemainingLen := uint32(varPublish.Size(pubQos) + len(publishPayload))
+		publishHeader := newHeader(PacketPublish, pubflags, expectedRemainingLen)
+		err = rxtx.WritePublishPayload(publishHeader, varPublish, publishPayload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		callbackExecuted := false
+		rxtx.RxCallbacks.OnPub = func(rt *Rx, vp VariablesPublish, r io.Reader) error {
+			b, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, publishPayload) {
+				t.Error("got different payloads!")
+			}
+			if rt.LastReceivedHeader != publishHeader {
+				t.Errorf("rxtx header mismatch, txed:%v, rxed:%v", publishHeader.String(), rt.LastReceivedHeader.String())
+			}
+			if vp.Size(pubQos) != varPublish.Size(pubQos) {
+				t.Errorf("mismatch between publish variable sizes")
+			}
+			varEqual(t, varPublish, vp)
+			callbackExecuted = true
+			return nil
+		}
+
+		n, err := rxtx.ReadNextPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != int(expectedRemainingLen) {
+			t.Errorf("read %v bytes, expected to read %v bytes", n, expectedRemainingLen)
+		}
+		if !callbackExecuted {
+			t.Error("OnPub callback not executed")
+		}
+	}
+	//
+	// Send PUBLISH QoS0 packet over wire.
+	//
+	{
+		const pubQos = QoS0
+		publishPayload := []byte("\xa6\x32")
+		varPublish := VariablesPublish{
+			TopicName:        []byte("pressure"),
+			PacketIdentifier: 0, // No packet ID for QoS0.
+		}
+		pubflags, err := NewPublishFlags(pubQos, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedRemainingLen := uint32(varPublish.Size(pubQos) + len(publishPayload))
+		publishHeader := newHeader(PacketPublish, pubflags, expectedRemainingLen)
+		err = rxtx.WritePublishPayload(publishHeader, varPublish, publishPayload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		callbackExecuted := false
+		rxtx.RxCallbacks.OnPub = func(rt *Rx, vp VariablesPublish, r io.Reader) error {
+			b, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, publishPayload) {
+				t.Error("got different payloads!")
+			}
+			if rt.LastReceivedHeader != publishHeader {
+				t.Errorf("rxtx header mismatch, txed:%v, rxed:%v", publishHeader.String(), rt.LastReceivedHeader.String())
+			}
+			if vp.Size(pubQos) != varPublish.Size(pubQos) {
+				t.Errorf("mismatch between publish variable sizes")
+			}
+			varEqual(t, varPublish, vp)
+			callbackExecuted = true
+			return nil
+		}
+
+		n, err := rxtx.ReadNextPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != int(expectedRemainingLen) {
+			t.Errorf("read %v bytes, expected to read %v bytes", n, expectedRemainingLen)
+		}
+		if !callbackExecuted {
+			t.Error("OnPub callback not executed")
+		}
+	}
+
+	//
+	// Send PUBLISH packet over wire and ignore packet.
+	//
+	{
+		const pubQos = QoS1
+		publishPayload := []byte("ertytgbhjjhundsaip;vf[oniw[aondmiksfvoWDNFOEWOPndsafr;poulikujyhtgbfrvdcsxzaesxt dfcgvfhbg kjnlkm/'.")
+		varPublish := VariablesPublish{
+			TopicName:        []byte("now-for-something-completely-different"),
+			PacketIdentifier: math.MaxUint16,
+		}
+		pubflags, err := NewPublishFlags(pubQos, true, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		publishHeader := newHeader(PacketPublish, pubflags, uint32(varPublish.Size(pubQos)+len(publishPayload)))
+		err = rxtx.WritePublishPayload(publishHeader, varPublish, publishPayload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rxtx.RxCallbacks.OnPub = nil
+
+		n, err := rxtx.ReadNextPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectSize := publishHeader.Size() + varPublish.Size(pubQos)
+		if n != expectSize {
+			t.Errorf("read %v bytes, expected to read %v bytes", n, expectSize)
+		}
+
+	}
+
+	//
+	// Send SUBSCRIBE packet over wire.
+	//
+	{
+
+		varsub := VariablesSubscribe{
+			PacketIdentifier: math.MaxUint16,
+			TopicFilters: []SubscribeRequest{
+				{TopicFilter: []byte("favorites"), QoS: QoS2},
+				{TopicFilter: []byte("the-clash"), QoS: QoS2},
+				{TopicFilter: []byte("always-watching"), QoS: QoS2},
+				{TopicFilter: []byte("k-pop"), QoS: QoS2},
+			},
+		}
+		err = rxtx.WriteSubscribe(varsub)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectHeader := newHeader(PacketSubscribe, PacketFlagsPubrelSubUnsub, uint32(varsub.Size()))
+		callbackExecuted := false
+		rxtx.RxCallbacks.OnSub = func(rt *Rx, vs VariablesSubscribe) error {
+			if rt.LastReceivedHeader != expectHeader {
+				t.Errorf("rxtx header mismatch, expect:%v, rxed:%v", expectHeader.String(), rt.LastReceivedHeader.String())
+			}
+			varEqual(t, varsub, vs)
+			callbackExecuted = true
+			return nil
+		}
+
+		n, err := rxtx.ReadNextPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectSize := expectHeader.Size() + varsub.Size()
+		if n != expectSize {
+			t.Errorf("read %v bytes, expected to read %v bytes", n, expectSize)
+		}
+		if !callbackExecuted {
+			t.Error("OnSub callback not executed")
+		}
+	}
+
+	//
+	// Send UNSUBSCRIBE packet over wire.
+	//
+	{
+		callbackExecuted := false
+		varunsub := VariablesUnsubscribe{
+			PacketIdentifier: math.MaxUint16,
+			Topics:           bytes.Fields([]byte("topic1 topic2 topic3 semperfi")),
+		}
+		err = rxtx.WriteUnsubscribe(varunsub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectHeader := newHeader(PacketUnsubscribe, PacketFlagsPubrelSubUnsub, uint32(varunsub.Size()))
+		rxtx.RxCallbacks.OnUnsub = func(rt *Rx, vu VariablesUnsubscribe) error {
+			if rt.LastReceivedHeader != expectHeader {
+				t.Errorf("rxtx header mismatch, expect:%v, rxed:%v", expectHeader.String(), rt.LastReceivedHeader.String())
+			}
+			varEqual(t, varunsub, vu)
+			callbackExecuted = true
+			return nil
+		}
+
+		n, err := rxtx.ReadNextPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectSize := expectHeader.Size() + varunsub.Size()
+		if n != expectSize {
+			t.Errorf("read %v bytes, expected to read %v bytes", n, expectSize)
+		}
+		if !callbackExecuted {
+			t.Error("OnUnsub callback not executed")
+		}
+	}
+
+	//
+	// Send SUBACK packet over wire.
+	//
+	{
+		callbackExecuted := false
+		varSuback := VariablesSuback{
+			PacketIdentifier: math.MaxUint16,
+			ReturnCodes:      []QoSLevel{QoS0, QoS1, QoS0, QoS2, QoSSubfail, QoS1},
+		}
+		err = rxtx.WriteSuback(varSuback)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectHeader := newHeader(PacketSuback, 0, uint32(varSuback.Size()))
+		rxtx.RxCallbacks.OnSuback = func(rt *Rx, vu VariablesSuback) error {
+			if rt.LastReceivedHeader != expectHeader {
+				t.Errorf("rxtx header mismatch, expect:%v, rxed:%v", expectHeader.String(), rt.LastReceivedHeader.String())
+			}
+			varEqual(t, varSuback, vu)
+			callbackExecuted = true
+			return nil
+		}
+
+		n, err := rxtx.ReadNextPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectSize := expectHeader.Size() + varSuback.Size()
+		if n != expectSize {
+			t.Errorf("read %v bytes, expected to read %v bytes", n, expectSize)
+		}
+		if !callbackExecuted {
+			t.Error("OnSuback callback not executed")
+		}
+	}
+
+	//
+	// Send PUBREL packet over wire.
+	//
+	{
+		callbackExecuted := false
+		txPI := uint16(3232)
+		expectHeader := newHeader(PacketPubrel, PacketFlagsPubrelSubUnsub, 2)
+		err = rxtx.WriteIdentified(PacketPubrel, txPI)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rxtx.RxCallbacks.OnPubrel = func(rt *Rx, gotPI uint16) error {
+			if rt.LastReceivedHeader != expectHeader {
+				t.Errorf("rxtx header mismatch, expect:%v, rxed:%v", expectHeader.String(), rt.LastReceivedHeader.String())
+			}
+			if gotPI != txPI {
+				t.Error("mismatch of packet identifiers", gotPI, txPI)
+			}
+			callbackExecuted = true
+			return nil
+		}
+
+		n, err := rxtx.ReadNextPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectSize := expectHeader.Size() + 2
+		if n != expectSize {
+			t.Errorf("read %v bytes, expected to read %v bytes", n, expectSize)
+		}
+		if !callbackExecuted {
+			t.Error("OnPubrel callback not executed")
+		}
+	}
+
+	//
+	// Send PINGREQ packet over wire.
+	//
+	{
+		callbackExecuted := false
+		expectHeader := newHeader(PacketPingreq, 0, 0)
+		err = rxtx.WriteSimple(PacketPingreq)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rxtx.RxCallbacks.OnOther = func(rt *Rx, gotPI uint16) error {
 			if rt.LastReceivedHeader != expectHeader {
 				t.Errorf("rxtx header mismatch, expect:%v, rxed:%v", expectHeader.String(), rt.LastReceivedHeader.String())
 			}
-			varEqual(t, varunsub, vu)
-			callbackExecuted = true
+			if gotPI != 0 {
+				t.Error("mismatch of packet identifiers", gotPI, 0)
+			}
+			callbackExecuted = true
+			return nil
+		}
+
+		n, err := rxtx.ReadNextPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectSize := expectHeader.Size()
+		if n != expectSize {
+			t.Errorf("read %v bytes, expected to read %v bytes", n, expectSize)
+		}
+		if !callbackExecuted {
+			t.Error("OnOther callback not executed")
+		}
+	}
+	err = rxtx.CloseRx() // closes both.
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCorrelator(t *testing.T) {
+	broker := newTestBroker(t)
+	// Broker responds to requests on req/<name> with a publish on resp/<name>.
+	broker.rx.RxCallbacks.OnPub = func(rx *Rx, vp VariablesPublish, r io.Reader) error {
+		payload, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		name := bytes.TrimPrefix(vp.TopicName, []byte("req/"))
+		resp := VariablesPublish{TopicName: append([]byte("resp/"), name...)}
+		flags, _ := NewPublishFlags(QoS0, false, false)
+		h := newHeader(PacketPublish, flags, uint32(resp.Size(QoS0)+len(payload)))
+		return broker.tx.WritePublishPayload(h, resp, payload)
+	}
+	var cr Correlator
+	client := newConnectedClient(t, broker, ClientConfig{
+		OnPub: func(pubHead Header, varPub VariablesPublish, r io.Reader) error {
+			handled, err := cr.Handle(pubHead, varPub, r)
+			if !handled {
+				t.Error("unexpected publish on topic", string(varPub.TopicName))
+			}
+			return err
+		},
+	})
+	var gotX []byte
+	err := cr.Expect([]byte("resp/X"), func(_ Header, _ VariablesPublish, r io.Reader) (err error) {
+		gotX, err = io.ReadAll(r)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cr.Expect([]byte("resp/Y"), func(Header, VariablesPublish, io.Reader) error {
+		t.Error("resp/Y waiter resolved by response to req/X")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cr.Expect([]byte("resp/X"), func(Header, VariablesPublish, io.Reader) error { return nil }) == nil {
+		t.Error("expected error registering two requests on same response topic")
+	}
+
+	flags, _ := NewPublishFlags(QoS0, false, false)
+	err = client.PublishPayload(flags, VariablesPublish{TopicName: []byte("req/X"), PacketIdentifier: 1}, []byte("token-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.HandleNext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(gotX) != "token-1" {
+		t.Errorf("got response %q, expected %q", gotX, "token-1")
+	}
+	if cr.Cancel([]byte("resp/X")) {
+		t.Error("resp/X waiter should have been removed after being resolved")
+	}
+	if !cr.Cancel([]byte("resp/Y")) {
+		t.Error("resp/Y waiter should still be awaiting response")
+	}
+}
+
+func TestClientPublishQoS1Disconnect(t *testing.T) {
+	broker := newTestBroker(t)
+	broker.rx.RxCallbacks.OnPub = func(_ *Rx, _ VariablesPublish, r io.Reader) error {
+		_, err := io.Copy(io.Discard, r)
+		if err != nil {
+			return err
+		}
+		// SUBACK for a SUBSCRIBE never sent disconnects the client instead of a PUBACK.
+		return broker.tx.WriteSuback(VariablesSuback{PacketIdentifier: 1234, ReturnCodes: []QoSLevel{QoS0}})
+	}
+	client := newConnectedClient(t, broker, ClientConfig{})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := client.PublishQoS1(ctx, []byte("a"), []byte("at least once"))
+	if err == nil || ctx.Err() != nil {
+		t.Fatalf("got error %v after disconnect, expected disconnection error", err)
+	}
+	if client.IsConnected() {
+		t.Error("expected client to disconnect on bad SUBACK")
+	}
+}
+
+func TestClientPublishToken(t *testing.T) {
+	broker := newTestBroker(t)
+	var gotFlags []PacketFlags
+	broker.rx.RxCallbacks.OnPub = func(rx *Rx, _ VariablesPublish, r io.Reader) error {
+		gotFlags = append(gotFlags, rx.LastReceivedHeader.Flags()) // Withhold PUBACK.
+		_, err := io.Copy(io.Discard, r)
+		return err
+	}
+	client := newConnectedClient(t, broker, ClientConfig{})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	token, err := client.Publish([]byte("a"), []byte("at most once"), QoS0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !token.Done() || token.PacketIdentifier() != 0 || token.Wait(ctx) != nil {
+		t.Error("QoS0 token not complete after write")
+	}
+
+	token, err = client.Publish([]byte("a"), []byte("at least once"), QoS1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Done() || token.PacketIdentifier() == 0 {
+		t.Fatal("QoS1 token complete before PUBACK")
+	}
+	err = broker.tx.WriteIdentified(PacketPuback, token.PacketIdentifier())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = token.Wait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !token.Done() {
+		t.Error("QoS1 token not complete after PUBACK")
+	}
+	if len(gotFlags) != 2 || gotFlags[0].QoS() != QoS0 || gotFlags[0].Retain() ||
+		gotFlags[1].QoS() != QoS1 || !gotFlags[1].Retain() {
+		t.Errorf("broker got unexpected PUBLISH flags %v", gotFlags)
+	}
+
+	_, err = client.Publish([]byte("a"), []byte("exactly once"), QoS2, false)
+	if err == nil {
+		t.Error("expected error publishing QoS2")
+	}
+}
+
+func TestClientPublishTokenDisconnect(t *testing.T) {
+	withholdPuback := func(_ *Rx, _ VariablesPublish, r io.Reader) error {
+		_, err := io.Copy(io.Discard, r)
+		return err
+	}
+	broker := newTestBroker(t)
+	broker.rx.RxCallbacks.OnPub = withholdPuback
+	client := newConnectedClient(t, broker, ClientConfig{})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	abandoned, err := client.Publish([]byte("a"), []byte("lost"), QoS1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Disconnect(errors.New("bye"))
+	if !abandoned.Done() {
+		t.Error("expected token to be done after disconnect")
+	}
+	if err = abandoned.Wait(ctx); err == nil {
+		t.Error("expected error waiting on token of PUBLISH not acknowledged before disconnect")
+	}
+
+	// Packet identifier of the abandoned PUBLISH is allocated again on the next connection.
+	broker2 := newTestBroker(t)
+	broker2.rx.RxCallbacks.OnPub = withholdPuback
+	var varConn VariablesConnect
+	varConn.SetDefaultMQTT([]byte("salamanca"))
+	if err = client.Connect(ctx, broker2, &varConn); err != nil {
+		t.Fatal(err)
+	}
+	token, err := client.Publish([]byte("a"), []byte("found"), QoS1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.PacketIdentifier() != abandoned.PacketIdentifier() {
+		t.Fatalf("got packet identifier %d, expected reuse of %d", token.PacketIdentifier(), abandoned.PacketIdentifier())
+	}
+	if token.Done() || !abandoned.Done() {
+		t.Error("token completion must not depend on packet identifier reuse")
+	}
+	if err = broker2.tx.WriteIdentified(PacketPuback, token.PacketIdentifier()); err != nil {
+		t.Fatal(err)
+	}
+	if err = token.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err = abandoned.Wait(ctx); err == nil {
+		t.Error("PUBACK for reused packet identifier completed abandoned token")
+	}
+}
+
+func TestClientPublishQoS2(t *testing.T) {
+	for _, test := range []struct {
+		desc        string
+		dropPubrecs int
+	}{
+		{desc: "happy path"},
+		{desc: "PUBREC lost", dropPubrecs: 1},
+	} {
+		broker := newTestBroker(t)
+		dropPubrecs := test.dropPubrecs
+		var gotDups []bool
+		var gotPubrel bool
+		broker.rx.RxCallbacks.OnPub = func(rx *Rx, varPub VariablesPublish, r io.Reader) error {
+			payload, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			flags := rx.LastReceivedHeader.Flags()
+			if flags.QoS() != QoS2 || string(payload) != "hello" {
+				t.Errorf("%s: unexpected PUBLISH %s with payload %q", test.desc, flags, payload)
+			}
+			gotDups = append(gotDups, flags.Dup())
+			if dropPubrecs > 0 {
+				dropPubrecs--
+				return nil
+			}
+			return broker.tx.WriteIdentified(PacketPubrec, varPub.PacketIdentifier)
+		}
+		broker.rx.RxCallbacks.OnPubrel = func(rx *Rx, packetIdentifier uint16) error {
+			if rx.LastReceivedHeader.Type() != PacketPubrel {
+				t.Errorf("%s: unexpected packet %s", test.desc, rx.LastReceivedHeader.Type())
+				return nil
+			}
+			gotPubrel = true
+			return broker.tx.WriteIdentified(PacketPubcomp, packetIdentifier)
+		}
+		client := newConnectedClient(t, broker, ClientConfig{RetransmitInterval: 20 * time.Millisecond})
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err := client.PublishQoS2(ctx, []byte("exactly/once"), []byte("hello"))
+		cancel()
+		if err != nil {
+			t.Fatalf("%s: %v", test.desc, err)
+		}
+		if !gotPubrel {
+			t.Errorf("%s: PUBREL not received by broker", test.desc)
+		}
+		if len(gotDups) != 1+test.dropPubrecs {
+			t.Fatalf("%s: got %d PUBLISH packets, want %d", test.desc, len(gotDups), 1+test.dropPubrecs)
+		}
+		for i, dup := range gotDups {
+			if dup != (i > 0) {
+				t.Errorf("%s: PUBLISH #%d got DUP=%v", test.desc, i, dup)
+			}
+		}
+	}
+}
+
+func TestClientReceiveMaximum(t *testing.T) {
+	broker := newTestBroker(t)
+	var gotAcks []identifiedPacket
+	broker.rx.RxCallbacks.OnOther = func(rx *Rx, packetIdentifier uint16) error {
+		gotAcks = append(gotAcks, identifiedPacket{packetType: rx.LastReceivedHeader.Type(), packetIdentifier: packetIdentifier})
+		return nil
+	}
+	onAcks(&broker.rx.RxCallbacks, broker.rx.RxCallbacks.OnOther)
+	client := newConnectedClient(t, broker, ClientConfig{ReceiveMaximum: 2, OnPub: func(_ Header, _ VariablesPublish, r io.Reader) error {
+		_, err := io.ReadAll(r)
+		return err
+	}})
+	publish := func(qos QoSLevel, packetIdentifier uint16) error {
+		flags, _ := NewPublishFlags(qos, false, false)
+		err := broker.tx.WritePublishPayload(newHeader(PacketPublish, flags, 0), VariablesPublish{TopicName: []byte("a"), PacketIdentifier: packetIdentifier}, []byte("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client.HandleNext()
+	}
+	for _, test := range []struct {
+		qos            QoSLevel
+		pi             uint16
+		expectInflight int
+	}{
+		{qos: QoS2, pi: 1, expectInflight: 1}, // Awaiting PUBREL.
+		{qos: QoS1, pi: 2, expectInflight: 1}, // Concluded by PUBACK.
+		{qos: QoS0, pi: 0, expectInflight: 1},
+		{qos: QoS2, pi: 3, expectInflight: 2},
+	} {
+		if err := publish(test.qos, test.pi); err != nil {
+			t.Fatal(err)
+		}
+		if got := client.InboundInflight(); got != test.expectInflight {
+			t.Fatalf("after QoS%d PUBLISH %d: got %d inbound in flight, expected %d", test.qos, test.pi, got, test.expectInflight)
+		}
+	}
+	expect := []identifiedPacket{{PacketPubrec, 1}, {PacketPuback, 2}, {PacketPubrec, 3}}
+	if len(gotAcks) != len(expect) {
+		t.Fatalf("got acks %v, expected %v", gotAcks, expect)
+	}
+	for i := range expect {
+		if gotAcks[i] != expect[i] {
+			t.Errorf("ack %d: got %v, expected %v", i, gotAcks[i], expect[i])
+		}
+	}
+	// Retransmissions of exchanges in flight do not count against the limit.
+	dupFlags, _ := NewPublishFlags(QoS2, false, true)
+	err := broker.tx.WritePublishPayload(newHeader(PacketPublish, dupFlags, 0), VariablesPublish{TopicName: []byte("a"), PacketIdentifier: 3}, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.HandleNext(); err != nil {
+		t.Fatal(err)
+	}
+	if err = publish(QoS1, 4); !errors.Is(err, ErrReceiveMaximum) {
+		t.Fatalf("got error %v, expected %v", err, ErrReceiveMaximum)
+	}
+	if client.IsConnected() || client.InboundInflight() != 0 {
+		t.Fatal("expected client to disconnect after server exceeded receive maximum")
+	}
+
+	// Receive maximum is advertised over MQTT 5.0.
+	var vc VariablesConnect
+	vc.SetDefaultMQTT([]byte("salamanca"))
+	if got := client.advertiseReceiveMaximum(&vc); got != &vc {
+		t.Error("expected MQTT 3.1.1 CONNECT to be unmodified")
+	}
+	vc.ProtocolLevel = ProtocolLevel5
+	got := client.advertiseReceiveMaximum(&vc)
+	if len(vc.Properties) != 0 || len(got.Properties) != 1 || got.Properties[0].ID != PropReceiveMaximum || got.Properties[0].Value != 2 {
+		t.Errorf("got properties %v, expected receive maximum of 2 added to copy", got.Properties)
+	}
+
+	// Without a receive maximum incoming exchanges are not tracked but are still acknowledged.
+	broker = newTestBroker(t)
+	gotAcks = gotAcks[:0]
+	broker.rx.RxCallbacks.OnOther = func(rx *Rx, packetIdentifier uint16) error {
+		gotAcks = append(gotAcks, identifiedPacket{packetType: rx.LastReceivedHeader.Type(), packetIdentifier: packetIdentifier})
+		return nil
+	}
+	onAcks(&broker.rx.RxCallbacks, broker.rx.RxCallbacks.OnOther)
+	client = newConnectedClient(t, broker, ClientConfig{OnPub: func(_ Header, _ VariablesPublish, r io.Reader) error {
+		_, err := io.ReadAll(r)
+		return err
+	}})
+	for pi := uint16(1); pi <= 3; pi++ {
+		if err = publish(QoS1, pi); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = publish(QoS2, 4); err != nil {
+		t.Fatal(err)
+	}
+	if client.InboundInflight() != 0 || len(client.cs.inbound) != 0 {
+		t.Error("expected incoming exchanges not to be tracked without receive maximum")
+	}
+	expectAcks := []identifiedPacket{{PacketPuback, 1}, {PacketPuback, 2}, {PacketPuback, 3}, {PacketPubrec, 4}}
+	if len(gotAcks) != len(expectAcks) {
+		t.Fatalf("got acks %v, expected %v", gotAcks, expectAcks)
+	}
+	for i := range expectAcks {
+		if gotAcks[i] != expectAcks[i] {
+			t.Errorf("got acks %v, expected %v", gotAcks, expectAcks)
+			break
+		}
+	}
+}
+
+func TestClientReceiveQoS2(t *testing.T) {
+	broker := newTestBroker(t)
+	var gotAcks []identifiedPacket
+	broker.rx.RxCallbacks.OnOther = func(rx *Rx, packetIdentifier uint16) error {
+		gotAcks = append(gotAcks, identifiedPacket{packetType: rx.LastReceivedHeader.Type(), packetIdentifier: packetIdentifier})
+		return nil
+	}
+	onAcks(&broker.rx.RxCallbacks, broker.rx.RxCallbacks.OnOther)
+	var (
+		gotPub     []byte
+		deliveries int
+	)
+	client := newConnectedClient(t, broker, ClientConfig{OnPub: func(_ Header, _ VariablesPublish, r io.Reader) (err error) {
+		deliveries++
+		gotPub, err = io.ReadAll(r)
+		return err
+	}})
+	flags, _ := NewPublishFlags(QoS2, false, false)
+	err := broker.tx.WritePublishPayload(newHeader(PacketPublish, flags, 0), VariablesPublish{TopicName: []byte("a"), PacketIdentifier: 7}, []byte("exactly once"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.HandleNext(); err != nil {
+		t.Fatal(err)
+	}
+	// Retransmission before PUBREL is acknowledged but not redelivered.
+	dupFlags, _ := NewPublishFlags(QoS2, false, true)
+	err = broker.tx.WritePublishPayload(newHeader(PacketPublish, dupFlags, 0), VariablesPublish{TopicName: []byte("a"), PacketIdentifier: 7}, []byte("exactly once"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.HandleNext(); err != nil {
+		t.Fatal(err)
+	}
+	err = broker.tx.WriteIdentified(PacketPubrel, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.HandleNext(); err != nil {
+		t.Fatal(err)
+	}
+	expect := []identifiedPacket{{PacketPubrec, 7}, {PacketPubrec, 7}, {PacketPubcomp, 7}}
+	if deliveries != 1 || string(gotPub) != "exactly once" || len(gotAcks) != len(expect) {
+		t.Fatalf("got %d deliveries of payload %q and acks %v, expected acks %v", deliveries, gotPub, gotAcks, expect)
+	}
+	for i := range expect {
+		if gotAcks[i] != expect[i] {
+			t.Errorf("ack %d: got %v, expected %v", i, gotAcks[i], expect[i])
+		}
+	}
+
+	// PUBREL must follow a PUBREC for the same packet identifier.
+	err = broker.tx.WriteIdentified(PacketPubrel, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.HandleNext()
+	if !errors.Is(err, ErrUnexpectedPubrel) || client.IsConnected() {
+		t.Errorf("got %v, expected orphan PUBREL to disconnect with %v", err, ErrUnexpectedPubrel)
+	}
+}
+
+func TestClientPingRoundTrip(t *testing.T) {
+	const delay = 10 * time.Millisecond
+	clock := time.Unix(1000, 0)
+	broker := newTestBroker(t)
+	broker.rx.RxCallbacks.OnOther = func(rx *Rx, _ uint16) error {
+		if rx.LastReceivedHeader.Type() != PacketPingreq {
+			t.Error("unexpected packet", rx.LastReceivedHeader.Type())
+			return nil
+		}
+		// Interleave a PUBLISH before the PINGRESP.
+		flags, _ := NewPublishFlags(QoS0, false, false)
+		err := broker.tx.WritePublishPayload(newHeader(PacketPublish, flags, 0), VariablesPublish{TopicName: []byte("news")}, []byte("extra"))
+		if err != nil {
+			return err
+		}
+		clock = clock.Add(delay)
+		return broker.tx.WriteSimple(PacketPingresp)
+	}
+	var gotPub []byte
+	client := newConnectedClient(t, broker, ClientConfig{
+		OnPub: func(_ Header, _ VariablesPublish, r io.Reader) (err error) {
+			gotPub, err = io.ReadAll(r)
+			return err
+		},
+		Now: func() time.Time { return clock },
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	rtt, err := client.PingRoundTrip(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtt != delay {
+		t.Errorf("got RTT %s, expected %s", rtt, delay)
+	}
+	if string(gotPub) != "extra" {
+		t.Errorf("interleaved PUBLISH not dispatched, got %q", gotPub)
+	}
+}
+
+func TestClientSubscribeInProgress(t *testing.T) {
+	broker := newTestBroker(t)
+	var pending VariablesSubscribe
+	broker.rx.RxCallbacks.OnSub = func(_ *Rx, vs VariablesSubscribe) error {
+		pending = vs.Copy() // Withhold SUBACK.
+		return nil
+	}
+	client := newConnectedClient(t, broker, ClientConfig{})
+	// Topic filters batched in a single SUBSCRIBE are one operation.
+	vsub := VariablesSubscribe{TopicFilters: []SubscribeRequest{{TopicFilter: []byte("a"), QoS: QoS1}, {TopicFilter: []byte("b"), QoS: QoS1}}}
+	err := client.StartSubscribe(vsub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.StartSubscribe(VariablesSubscribe{TopicFilters: []SubscribeRequest{{TopicFilter: []byte("c"), QoS: QoS1}}})
+	if err != ErrSubscribeInProgress {
+		t.Fatalf("got %v, expected %v", err, ErrSubscribeInProgress)
+	}
+	err = broker.tx.WriteSubackFor(pending, []QoSLevel{QoS1, QoS1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.HandleNext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.StartSubscribe(VariablesSubscribe{TopicFilters: []SubscribeRequest{{TopicFilter: []byte("c"), QoS: QoS1}}})
+	if err != nil {
+		t.Fatal("subscribe after SUBACK:", err)
+	}
+
+	// No limit.
+	broker = newTestBroker(t)
+	broker.rx.RxCallbacks.OnSub = func(*Rx, VariablesSubscribe) error { return nil }
+	client = newConnectedClient(t, broker, ClientConfig{MaxConcurrentSubscribes: -1})
+	for i := 0; i < 8; i++ {
+		err = client.StartSubscribe(VariablesSubscribe{TopicFilters: []SubscribeRequest{{TopicFilter: []byte{'a' + byte(i)}, QoS: QoS1}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestClientConcurrentSubscribes(t *testing.T) {
+	broker := newTestBroker(t)
+	var pending []VariablesSubscribe
+	broker.rx.RxCallbacks.OnSub = func(_ *Rx, vs VariablesSubscribe) error {
+		pending = append(pending, vs.Copy()) // Withhold SUBACK.
+		return nil
+	}
+	client := newConnectedClient(t, broker, ClientConfig{MaxConcurrentSubscribes: 2})
+	for _, topic := range []string{"first", "second"} {
+		// User provided packet identifiers are ignored.
+		err := client.StartSubscribe(VariablesSubscribe{PacketIdentifier: 1, TopicFilters: []SubscribeRequest{{TopicFilter: []byte(topic), QoS: QoS1}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(pending) != 2 || pending[0].PacketIdentifier == pending[1].PacketIdentifier || pending[0].PacketIdentifier == 0 {
+		t.Fatalf("expected two SUBSCRIBE with distinct packet identifiers, got %v", pending)
+	}
+	err := client.StartSubscribe(VariablesSubscribe{TopicFilters: []SubscribeRequest{{TopicFilter: []byte("third"), QoS: QoS1}}})
+	if err != ErrSubscribeInProgress {
+		t.Fatalf("got %v, expected %v once limit is reached", err, ErrSubscribeInProgress)
+	}
+	// SUBACKs answered out of order are matched by packet identifier.
+	for i := len(pending) - 1; i >= 0; i-- {
+		err := broker.tx.WriteSubackFor(pending[i], []QoSLevel{QoS1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = client.HandleNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if client.AwaitingSuback() {
+		t.Error("client still awaiting SUBACK")
+	}
+	if got := client.SubscribedTopics(); len(got) != 2 || got[0] != "second" || got[1] != "first" {
+		t.Errorf("got subscribed topics %v", got)
+	}
+
+	// SUBACK return codes not corresponding to the SUBSCRIBE disconnect the client.
+	err = client.StartSubscribe(VariablesSubscribe{TopicFilters: []SubscribeRequest{{TopicFilter: []byte("third"), QoS: QoS1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = broker.tx.WriteSuback(VariablesSuback{PacketIdentifier: pending[2].PacketIdentifier, ReturnCodes: []QoSLevel{QoS1, QoS1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.HandleNext() == nil || client.IsConnected() {
+		t.Error("expected mismatched SUBACK to disconnect client")
+	}
+}
+
+func TestClientSubscribeAbandon(t *testing.T) {
+	broker := newTestBroker(t)
+	var pending []VariablesSubscribe
+	broker.rx.RxCallbacks.OnSub = func(_ *Rx, vs VariablesSubscribe) error {
+		pending = append(pending, vs.Copy()) // Withhold SUBACK.
+		return nil
+	}
+	client := newConnectedClient(t, broker, ClientConfig{MaxInflight: 1})
+	vsub := VariablesSubscribe{TopicFilters: []SubscribeRequest{{TopicFilter: []byte("a"), QoS: QoS1}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := client.Subscribe(ctx, vsub)
+	if err != context.Canceled {
+		t.Fatalf("got %v, expected %v", err, context.Canceled)
+	}
+	if len(pending) != 1 {
+		t.Fatalf("expected SUBSCRIBE to be sent, got %v", pending)
+	}
+	if client.AwaitingSuback() {
+		t.Error("client still awaiting SUBACK of abandoned subscribe")
+	}
+	// SUBACK of abandoned subscribe is ignored.
+	err = broker.tx.WriteSubackFor(pending[0], []QoSLevel{QoS1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.HandleNext()
+	if err != nil || !client.IsConnected() {
+		t.Fatalf("expected late SUBACK to be ignored, got %v", err)
+	}
+	if got := client.SubscribedTopics(); len(got) != 0 {
+		t.Errorf("abandoned subscribe added topics %v", got)
+	}
+	// The packet identifier was released.
+	pi, err := client.StartSubscribeID(vsub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = broker.tx.WriteSuback(VariablesSuback{PacketIdentifier: pi, ReturnCodes: []QoSLevel{QoS1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.HandleNext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := client.SubscribedTopics(); len(got) != 1 || got[0] != "a" {
+		t.Errorf("got subscribed topics %v", got)
+	}
+}
+
+func TestClientGrantedQoS(t *testing.T) {
+	broker := newTestBroker(t)
+	var pending []VariablesSubscribe
+	broker.rx.RxCallbacks.OnSub = func(_ *Rx, vs VariablesSubscribe) error {
+		pending = append(pending, vs.Copy()) // Withhold SUBACK.
+		return nil
+	}
+	client := newConnectedClient(t, broker, ClientConfig{})
+	subscribe := func(granted ...QoSLevel) error {
+		t.Helper()
+		vsub := VariablesSubscribe{TopicFilters: []SubscribeRequest{{TopicFilter: []byte("a"), QoS: QoS1}, {TopicFilter: []byte("b"), QoS: QoS1}}}
+		err := client.StartSubscribe(vsub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vs := pending[len(pending)-1]
+		err = broker.tx.WriteSuback(VariablesSuback{PacketIdentifier: vs.PacketIdentifier, ReturnCodes: granted})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client.HandleNext()
+	}
+	// Downgraded QoS is accepted and failed subscriptions are not active.
+	err := subscribe(QoS0, QoSSubfail)
+	if err != nil || !client.IsConnected() {
+		t.Fatal("expected downgraded SUBACK to be accepted, got", err)
+	}
+	if qos, ok := client.GrantedQoS("a"); !ok || qos != QoS0 {
+		t.Errorf("got granted QoS %v (subscribed=%v), expected QoS0", qos, ok)
+	}
+	if _, ok := client.GrantedQoS("b"); ok {
+		t.Error("failed subscription reported as active")
+	}
+	// Upgraded QoS disconnects the client.
+	err = subscribe(QoS1, QoS2)
+	if err == nil || client.IsConnected() {
+		t.Error("expected SUBACK granting more than requested QoS to disconnect client")
+	}
+	var qosErr ErrSubackQoS
+	if !errors.As(err, &qosErr) || qosErr != (ErrSubackQoS{Topic: "b", Requested: QoS1, Granted: QoS2}) {
+		t.Errorf("got error %v, expected %v", err, ErrSubackQoS{Topic: "b", Requested: QoS1, Granted: QoS2})
+	}
+}
+
+func TestNegotiateKeepAlive(t *testing.T) {
+	const serverMax = 120
+	for _, test := range []struct {
+		requested, serverMax, expect uint16
+	}{
+		{requested: 0, serverMax: 0, expect: 0},         // Keepalive disabled.
+		{requested: 0, serverMax: serverMax, expect: 0}, // Servers may not override disabled keepalive.
+		{requested: 60, serverMax: serverMax, expect: 60},
+		{requested: 600, serverMax: serverMax, expect: serverMax},
+		{requested: 600, serverMax: 0, expect: 600},
+	} {
+		buf := newLoopbackTransport()
+		rxtx, err := NewRxTx(buf, DecoderNoAlloc{make([]byte, 1500)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var cs clientState
+		var got uint16
+		rxtx.RxCallbacks.OnConnect = func(_ *Rx, vc *VariablesConnect) error {
+			got = cs.NegotiateKeepAlive(vc.KeepAlive, test.serverMax)
+			if vc.KeepAlive != test.requested {
+				t.Errorf("requested=%d max=%d: CONNECT modified to %d", test.requested, test.serverMax, vc.KeepAlive)
+			}
+			return nil
+		}
+		var varConn VariablesConnect
+		varConn.SetDefaultMQTT([]byte("salamanca"))
+		varConn.KeepAlive = test.requested
+		err = rxtx.WriteConnect(&varConn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = rxtx.ReadNextPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.expect || cs.KeepAlive() != time.Duration(test.expect)*time.Second {
+			t.Errorf("requested=%d max=%d: got %d (stored %s), expected %d", test.requested, test.serverMax, got, cs.KeepAlive(), test.expect)
+		}
+	}
+}
+
+func TestKeepAlivePolicy(t *testing.T) {
+	const min, max = 10, 120
+	for _, test := range []struct {
+		requested, expect uint16
+		rejectCode        ConnectReturnCode
+		expectCode        ConnectReturnCode
+		maxOnly           bool // Policy with no minimum.
+	}{
+		{requested: 1, expect: min},              // Abusive client clamped up.
+		{requested: 0, expect: min},              // Disabled keepalive not allowed with a minimum.
+		{requested: 0, expect: 0, maxOnly: true}, // Disabled keepalive kept without a minimum.
+		{requested: 600, expect: max, maxOnly: true},
+		{requested: 0, rejectCode: ReturnCodeUnauthorized, expectCode: ReturnCodeUnauthorized},
+		{requested: 60, expect: 60},
+		{requested: 600, expect: max},
+		{requested: 1, rejectCode: ReturnCodeUnauthorized, expectCode: ReturnCodeUnauthorized},
+		{requested: 600, rejectCode: ReturnCodeUnauthorized, expectCode: ReturnCodeUnauthorized},
+		{requested: 60, rejectCode: ReturnCodeUnauthorized, expect: 60},
+	} {
+		buf := newLoopbackTransport()
+		rxtx, err := NewRxTx(buf, DecoderNoAlloc{make([]byte, 1500)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		policy := KeepAlivePolicy{Min: min, Max: max, RejectCode: test.rejectCode}
+		if test.maxOnly {
+			policy.Min = 0
+		}
+		var cs clientState
+		var gotCode ConnectReturnCode
+		var gotKeepAlive uint16
+		rxtx.RxCallbacks.OnConnect = func(_ *Rx, vc *VariablesConnect) error {
+			gotCode = cs.ApplyKeepAlivePolicy(vc, policy)
+			gotKeepAlive = vc.KeepAlive
+			return nil
+		}
+		var varConn VariablesConnect
+		varConn.SetDefaultMQTT([]byte("salamanca"))
+		varConn.KeepAlive = test.requested
+		err = rxtx.WriteConnect(&varConn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = rxtx.ReadNextPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gotCode != test.expectCode {
+			t.Errorf("requested=%d: got code %q, expected %q", test.requested, gotCode.String(), test.expectCode.String())
+		}
+		if test.expectCode != ReturnCodeConnAccepted {
+			if gotKeepAlive != test.requested || cs.KeepAlive() != 0 {
+				t.Errorf("requested=%d: rejected CONNECT modified keepalive to %d (stored %s)", test.requested, gotKeepAlive, cs.KeepAlive())
+			}
+			continue
+		}
+		if gotKeepAlive != test.expect || cs.KeepAlive() != time.Duration(test.expect)*time.Second {
+			t.Errorf("requested=%d: got %d (stored %s), expected %d", test.requested, gotKeepAlive, cs.KeepAlive(), test.expect)
+		}
+	}
+}
+
+func TestClientKeepAlive(t *testing.T) {
+	for _, keepAlive := range []uint16{0, 1, 60, 0xffff} {
+		broker := newTestBroker(t)
+		client := NewClient(ClientConfig{})
+		var varConn VariablesConnect
+		varConn.SetDefaultMQTT([]byte("salamanca"))
+		varConn.KeepAlive = keepAlive
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err := client.Connect(ctx, broker, &varConn)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := time.Duration(keepAlive) * time.Second
+		if client.KeepAlive() != expect {
+			t.Errorf("got keepalive %s, expected %s", client.KeepAlive(), expect)
+		}
+	}
+}
+
+func TestClientKeepAliveLoop(t *testing.T) {
+	if err := NewClient(ClientConfig{}).KeepAliveLoop(context.Background()); err != nil {
+		t.Fatalf("disabled keepalive: got %v, expected nil", err)
+	}
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	var (
+		respond atomic.Bool
+		srvRx   Rx
+		srvTx   Tx
+	)
+	respond.Store(true)
+	srvRx.SetRxTransport(serverConn)
+	srvRx.userDecoder = DecoderNoAlloc{UserBuffer: make([]byte, 1500)}
+	srvTx.SetTxTransport(serverConn)
+	srvRx.RxCallbacks = RxCallbacks{
+		OnConnect: func(*Rx, *VariablesConnect) error {
+			return srvTx.WriteConnack(VariablesConnack{ReturnCode: ReturnCodeConnAccepted})
+		},
+		OnOther: func(rx *Rx, _ uint16) error {
+			if rx.LastReceivedHeader.Type() == PacketPingreq && respond.Load() {
+				return srvTx.WriteSimple(PacketPingresp)
+			}
 			return nil
+		},
+		OnRxError: func(*Rx, error) {},
+	}
+	go func() {
+		for {
+			if _, err := srvRx.ReadNextPacket(); err != nil {
+				return
+			}
+		}
+	}()
+	client := NewClient(ClientConfig{})
+	var varConn VariablesConnect
+	varConn.SetDefaultMQTT([]byte("salamanca"))
+	varConn.KeepAlive = 1
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := client.Connect(ctx, clientConn, &varConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for client.HandleNext() == nil {
+		}
+	}()
+
+	// Server answering pings keeps the connection alive past the keepalive interval.
+	ctx, cancel = context.WithTimeout(context.Background(), 1300*time.Millisecond)
+	defer cancel()
+	err = client.KeepAliveLoop(ctx)
+	if err != context.DeadlineExceeded || !client.IsConnected() {
+		t.Fatalf("got %v, expected keepalive loop to end by context with client connected", err)
+	}
+
+	// Unresponsive server is detected within the keepalive window.
+	respond.Store(false)
+	ctx, cancel = context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err = client.KeepAliveLoop(ctx)
+	if err != ErrKeepAliveTimeout {
+		t.Fatalf("got %v, expected %v", err, ErrKeepAliveTimeout)
+	}
+	if client.IsConnected() || client.Err() != ErrKeepAliveTimeout {
+		t.Errorf("expected client disconnected with keepalive timeout, got %v", client.Err())
+	}
+	if client.rx.transportErr() != io.ErrClosedPipe || client.tx.transportErr() != io.ErrClosedPipe {
+		t.Error("expected Rx and Tx closed after keepalive timeout")
+	}
+}
+
+func TestKeepAliveConfigInterval(t *testing.T) {
+	const keepAlive = 10 * time.Second
+	rng := rand.New(rand.NewSource(1))
+	if got := (KeepAliveConfig{}).interval(keepAlive, nil); got != keepAlive/2 {
+		t.Errorf("default interval: got %v, expected %v", got, keepAlive/2)
+	}
+	var minGot, maxGot time.Duration = keepAlive, 0
+	for i := 0; i < 1000; i++ {
+		got := KeepAliveConfig{Jitter: true}.interval(keepAlive, rng)
+		if got < minGot {
+			minGot = got
+		}
+		if got > maxGot {
+			maxGot = got
+		}
+		// Jitter never exceeds the keepalive interval.
+		if got := (KeepAliveConfig{Fraction: 1, Jitter: true}).interval(keepAlive, rng); got > keepAlive {
+			t.Fatalf("jittered interval %v exceeds keepalive %v", got, keepAlive)
+		}
+	}
+	if minGot < 4500*time.Millisecond || maxGot > 5500*time.Millisecond || maxGot-minGot < time.Second/2 {
+		t.Errorf("jittered intervals in [%v, %v], expected spread over [4.5s, 5.5s]", minGot, maxGot)
+	}
+	err := NewClient(ClientConfig{}).KeepAliveLoopConfig(context.Background(), KeepAliveConfig{Fraction: 1.5})
+	if err == nil {
+		t.Error("expected error for fraction greater than 1")
+	}
+}
+
+func TestPacketIDAllocator(t *testing.T) {
+	var a PacketIDAllocator
+	first, _ := a.Next()
+	second, _ := a.Next()
+	if first != 1 || second != 2 {
+		t.Fatalf("got %d, %d; expected 1, 2", first, second)
+	}
+	a.Free(first)
+	a.Free(first) // No effect.
+	if a.InUse() != 1 {
+		t.Fatalf("got %d in use, expected 1", a.InUse())
+	}
+	// Exhaust all identifiers. Allocation wraps around skipping 0 and 2 which is in use.
+	seen := map[uint16]bool{second: true}
+	for i := 0; i < 0xffff-1; i++ {
+		id, err := a.Next()
+		if err != nil {
+			t.Fatalf("allocation %d: %v", i, err)
+		}
+		if id == 0 || seen[id] {
+			t.Fatalf("allocation %d: got invalid or repeated identifier %d", i, id)
+		}
+		seen[id] = true
+	}
+	if _, err := a.Next(); err != ErrNoPacketIDs {
+		t.Fatalf("got %v, expected %v", err, ErrNoPacketIDs)
+	}
+	a.Free(1234)
+	if id, err := a.Next(); err != nil || id != 1234 {
+		t.Errorf("got %d, %v; expected freed identifier 1234", id, err)
+	}
+
+	// Concurrent allocations return distinct identifiers.
+	a.Reset()
+	const goroutines, perGoroutine = 8, 1000
+	ids := make(chan uint16, goroutines*perGoroutine)
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perGoroutine; i++ {
+				id, err := a.Next()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				ids <- id
+			}
+		}()
+	}
+	wg.Wait()
+	close(ids)
+	unique := make(map[uint16]bool)
+	for id := range ids {
+		unique[id] = true
+	}
+	if len(unique) != goroutines*perGoroutine {
+		t.Errorf("got %d distinct identifiers, expected %d", len(unique), goroutines*perGoroutine)
+	}
+}
+
+func TestClientStateReset(t *testing.T) {
+	broker := newTestBroker(t)
+	broker.rx.RxCallbacks.OnSub = func(_ *Rx, vs VariablesSubscribe) error {
+		return broker.tx.WriteSuback(VariablesSuback{PacketIdentifier: vs.PacketIdentifier, ReturnCodes: []QoSLevel{QoS0}})
+	}
+	client := newConnectedClient(t, broker, ClientConfig{})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := client.Subscribe(ctx, VariablesSubscribe{PacketIdentifier: 1, TopicFilters: []SubscribeRequest{{TopicFilter: []byte("a")}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = client.cs.RegisterPublish(QoS2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.StartPing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.cs.Reset()
+	cs := &client.cs
+	if cs.IsConnected() {
+		t.Error("connected after Reset")
+	}
+	if cs.Err() != nil {
+		t.Errorf("got Err %v after Reset", cs.Err())
+	}
+	if len(cs.activeSubs) != 0 || len(cs.pendingSubs) != 0 || len(cs.pendingPubs) != 0 || len(cs.pendingAcks) != 0 {
+		t.Error("subscriptions or in-flight exchanges remain after Reset")
+	}
+	if !cs.ConnectedAt().IsZero() || !cs.LastRx().IsZero() || !cs.LastTx().IsZero() || cs.AwaitingPingresp() {
+		t.Error("timestamps remain after Reset")
+	}
+}
+
+func TestClientConnectAck(t *testing.T) {
+	broker := newTestBroker(t)
+	broker.rx.RxCallbacks.OnConnect = func(*Rx, *VariablesConnect) error {
+		return broker.tx.WriteConnack(VariablesConnack{AckFlags: 1, ReturnCode: ReturnCodeConnAccepted})
+	}
+	client := NewClient(ClientConfig{})
+	var varConn VariablesConnect
+	varConn.SetDefaultMQTT([]byte("salamanca"))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	connack, err := client.ConnectAck(ctx, broker, &varConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connack.AckFlags != 1 || !connack.Accepted() {
+		t.Errorf("got %s, expected accepted CONNACK with session present", connack.String())
+	}
+	if client.ConnectedAt().IsZero() {
+		t.Error("connection time not set")
+	}
+	// Connecting an established connection is rejected without affecting it.
+	broker.rx.RxCallbacks.OnOther = func(*Rx, uint16) error { return broker.tx.WritePingresp() }
+	_, err = client.ConnectAck(ctx, &testTransport{&bytes.Buffer{}}, &varConn)
+	if err == nil {
+		t.Error("expected error connecting while connected")
+	}
+	if err = client.Ping(ctx); err != nil {
+		t.Errorf("established connection affected: %v", err)
+	}
+
+	// First packet received is not a CONNACK.
+	broker = newTestBroker(t)
+	broker.rx.RxCallbacks.OnConnect = func(*Rx, *VariablesConnect) error {
+		return broker.tx.WritePingresp()
+	}
+	client = NewClient(ClientConfig{})
+	_, err = client.ConnectAck(ctx, broker, &varConn)
+	if !errors.Is(err, ErrExpectedConnack) || !errors.Is(client.Err(), ErrExpectedConnack) {
+		t.Errorf("got error %v (client.Err %v), expected %v", err, client.Err(), ErrExpectedConnack)
+	}
+	if !broker.closed {
+		t.Error("expected transport to be closed after server broke handshake")
+	}
+	// Packets without a client callback are checked once received.
+	broker = newTestBroker(t)
+	broker.rx.RxCallbacks.OnConnect = func(*Rx, *VariablesConnect) error {
+		return broker.tx.WriteSubscribe(VariablesSubscribe{PacketIdentifier: 1, TopicFilters: []SubscribeRequest{{TopicFilter: []byte("a")}}})
+	}
+	client = NewClient(ClientConfig{})
+	_, err = client.ConnectAck(ctx, broker, &varConn)
+	if !errors.Is(err, ErrExpectedConnack) || !broker.closed {
+		t.Errorf("got error %v and closed transport %v, expected %v and closed transport", err, broker.closed, ErrExpectedConnack)
+	}
+}
+
+func TestClientUnexpectedPacket(t *testing.T) {
+	flags, _ := NewPublishFlags(QoS0, false, false)
+	pubHeader := newHeader(PacketPublish, flags, 0)
+	varPub := VariablesPublish{TopicName: []byte("a")}
+	var deliveries int
+	cfg := ClientConfig{OnPub: func(_ Header, _ VariablesPublish, r io.Reader) error {
+		deliveries++
+		_, err := io.ReadAll(r)
+		return err
+	}}
+	// PUBLISH before CONNACK is rejected without being delivered.
+	broker := newTestBroker(t)
+	broker.rx.RxCallbacks.OnConnect = func(*Rx, *VariablesConnect) error {
+		return broker.tx.WritePublishPayload(pubHeader, varPub, []byte("early"))
+	}
+	client := NewClient(cfg)
+	var varConn VariablesConnect
+	varConn.SetDefaultMQTT([]byte("salamanca"))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := client.Connect(ctx, broker, &varConn)
+	expect := ErrUnexpectedPacket{Type: PacketPublish}
+	if err != expect || !errors.Is(err, ErrExpectedConnack) || client.Err() != expect {
+		t.Errorf("got error %v (client.Err %v), expected %v", err, client.Err(), expect)
+	}
+	if deliveries != 0 {
+		t.Error("PUBLISH received before CONNACK was delivered")
+	}
+	if !broker.closed {
+		t.Error("expected transport to be closed after PUBLISH before CONNACK")
+	}
+
+	// PUBLISH after CONNACK is delivered, a second CONNACK is rejected.
+	broker = newTestBroker(t)
+	client = newConnectedClient(t, broker, cfg)
+	err = broker.tx.WritePublishPayload(pubHeader, varPub, []byte("on time"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.HandleNext(); err != nil {
+		t.Fatal(err)
+	}
+	if deliveries != 1 {
+		t.Errorf("got %d deliveries, expected 1", deliveries)
+	}
+	err = broker.tx.WriteConnack(VariablesConnack{ReturnCode: ReturnCodeConnAccepted})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.HandleNext()
+	expect = ErrUnexpectedPacket{Type: PacketConnack, Connected: true}
+	if err != expect || errors.Is(err, ErrExpectedConnack) || client.IsConnected() {
+		t.Errorf("got error %v (connected %v), expected %v", err, client.IsConnected(), expect)
+	}
+
+	// Packets received after disconnecting are discarded and do not replace the close reason.
+	rxcb, _ := client.cs.callbacks(nil)
+	var rx Rx
+	rx.LastReceivedHeader = newHeader(PacketPingresp, 0, 0)
+	if err = rxcb.OnOther(&rx, 0); err != errDisconnected {
+		t.Errorf("got error %v for PINGRESP after disconnect, expected %v", err, errDisconnected)
+	}
+	if err = rxcb.OnConnack(&rx, VariablesConnack{ReturnCode: ReturnCodeConnAccepted}); err != errDisconnected {
+		t.Errorf("got error %v for CONNACK after disconnect, expected %v", err, errDisconnected)
+	}
+	if client.Err() != expect || client.IsConnected() {
+		t.Errorf("close reason replaced with %v", client.Err())
+	}
+}
+
+func TestClientSessionPresent(t *testing.T) {
+	for _, ackFlags := range []uint8{0, 1} {
+		broker := newTestBroker(t)
+		broker.rx.RxCallbacks.OnConnect = func(*Rx, *VariablesConnect) error {
+			return broker.tx.WriteConnack(VariablesConnack{AckFlags: ackFlags, ReturnCode: ReturnCodeConnAccepted})
+		}
+		client := newConnectedClient(t, broker, ClientConfig{})
+		if client.SessionPresent() != (ackFlags == 1) {
+			t.Errorf("ack flags %d: got session present %v", ackFlags, client.SessionPresent())
+		}
+	}
+	// Reserved Ack flags bits set.
+	var rx Rx
+	rx.SetRxTransport(io.NopCloser(strings.NewReader("\x20\x02\x02\x00")))
+	rx.RxCallbacks.OnRxError = func(*Rx, error) {}
+	_, err := rx.ReadNextPacket()
+	if err != ErrBadConnackFlags {
+		t.Errorf("got %v, expected %v", err, ErrBadConnackFlags)
+	}
+}
+
+func TestClientDisconnectAndClose(t *testing.T) {
+	broker := newTestBroker(t)
+	gotDisconnect := false
+	broker.rx.RxCallbacks.OnOther = func(rx *Rx, _ uint16) error {
+		gotDisconnect = rx.LastReceivedHeader.Type() == PacketDisconnect
+		return nil
+	}
+	client := newConnectedClient(t, broker, ClientConfig{})
+	err := client.DisconnectAndClose()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gotDisconnect {
+		t.Error("DISCONNECT not received by broker")
+	}
+	if !broker.closed {
+		t.Error("transport not closed")
+	}
+	if client.IsConnected() || client.Err() != ErrGracefulDisconnect {
+		t.Errorf("got client.Err %v, expected %v", client.Err(), ErrGracefulDisconnect)
+	}
+	if client.rx.transportErr() != io.ErrClosedPipe || client.tx.transportErr() != io.ErrClosedPipe {
+		t.Error("expected Rx and Tx closed after disconnect")
+	}
+}
+
+func TestClientConnectRejected(t *testing.T) {
+	broker := newTestBroker(t)
+	broker.rx.RxCallbacks.OnConnect = func(*Rx, *VariablesConnect) error {
+		err := broker.tx.WriteConnack(VariablesConnack{ReturnCode: ReturnCodeUnauthorized})
+		broker.Close() // Broker closes connection after rejecting.
+		return err
+	}
+	client := NewClient(ClientConfig{})
+	var varConn VariablesConnect
+	varConn.SetDefaultMQTT([]byte("salamanca"))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := client.Connect(ctx, broker, &varConn)
+	if err != ReturnCodeUnauthorized {
+		t.Fatalf("got error %v, expected %v", err, ReturnCodeUnauthorized)
+	}
+	if client.Err() != ReturnCodeUnauthorized {
+		t.Errorf("got client.Err %v, expected %v", client.Err(), ReturnCodeUnauthorized)
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	newBroker := func(sessionPresent bool, gotSubs *[]string) *testBroker {
+		broker := newTestBroker(t)
+		broker.rx.RxCallbacks.OnConnect = func(*Rx, *VariablesConnect) error {
+			var ackFlags uint8
+			if sessionPresent {
+				ackFlags = 1
+			}
+			return broker.tx.WriteConnack(VariablesConnack{AckFlags: ackFlags, ReturnCode: ReturnCodeConnAccepted})
+		}
+		broker.rx.RxCallbacks.OnSub = func(_ *Rx, vs VariablesSubscribe) error {
+			var granted []QoSLevel
+			for _, sub := range vs.TopicFilters {
+				*gotSubs = append(*gotSubs, string(sub.TopicFilter)+":"+sub.QoS.String())
+				granted = append(granted, sub.QoS)
+			}
+			return broker.tx.WriteSuback(VariablesSuback{PacketIdentifier: vs.PacketIdentifier, ReturnCodes: granted})
+		}
+		return broker
+	}
+	for _, sessionPresent := range []bool{false, true} {
+		var gotSubs []string
+		client := newConnectedClient(t, newBroker(false, &gotSubs), ClientConfig{})
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err := client.Subscribe(ctx, VariablesSubscribe{TopicFilters: []SubscribeRequest{{TopicFilter: []byte("a"), QoS: QoS1}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Disconnect(errors.New("connection lost"))
+
+		gotSubs = gotSubs[:0]
+		var attempts []error
+		dials := 0
+		dial := func(context.Context) (io.ReadWriteCloser, error) {
+			dials++
+			if dials == 1 {
+				return nil, errors.New("network unreachable")
+			}
+			return newBroker(sessionPresent, &gotSubs), nil
+		}
+		var varConn VariablesConnect
+		varConn.SetDefaultMQTT([]byte("salamanca"))
+		err = client.Reconnect(ctx, dial, &varConn, ReconnectConfig{
+			MinWait:   time.Millisecond,
+			OnAttempt: func(_ int, err error) { attempts = append(attempts, err) },
+		})
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(attempts) != 2 || attempts[0] == nil || attempts[1] != nil {
+			t.Errorf("session present=%v: got attempt results %v", sessionPresent, attempts)
+		}
+		if sessionPresent && len(gotSubs) != 0 {
+			t.Errorf("resumed session resubscribed to %v", gotSubs)
+		} else if !sessionPresent && (len(gotSubs) != 1 || gotSubs[0] != "a:"+QoS1.String()) {
+			t.Errorf("got resubscriptions %v, expected a at QoS1", gotSubs)
+		}
+		if qos, ok := client.GrantedQoS("a"); len(client.SubscribedTopics()) != 1 || !ok || qos != QoS1 || !client.IsConnected() {
+			t.Errorf("session present=%v: got subscribed topics %v after reconnect", sessionPresent, client.SubscribedTopics())
 		}
+		if !sessionPresent {
+			continue
+		}
+		// Subscriptions restored from the resumed session are subscribed to again without a session.
+		client.Disconnect(errors.New("connection lost"))
+		ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+		err = client.Reconnect(ctx, func(context.Context) (io.ReadWriteCloser, error) {
+			return newBroker(false, &gotSubs), nil
+		}, &varConn, ReconnectConfig{})
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(gotSubs) != 1 || gotSubs[0] != "a:"+QoS1.String() {
+			t.Errorf("got resubscriptions %v after resumed session was lost, expected a at QoS1", gotSubs)
+		}
+	}
+	// Cancelled context stops reconnecting.
+	client := NewClient(ClientConfig{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var varConn VariablesConnect
+	varConn.SetDefaultMQTT([]byte("salamanca"))
+	err := client.Reconnect(ctx, func(context.Context) (io.ReadWriteCloser, error) {
+		return nil, errors.New("network unreachable")
+	}, &varConn, ReconnectConfig{})
+	if err != context.Canceled {
+		t.Errorf("got %v, expected %v", err, context.Canceled)
+	}
+}
+
+func TestClientDialConnectBudget(t *testing.T) {
+	const (
+		budget   = 200 * time.Millisecond
+		dialTime = 150 * time.Millisecond
+	)
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	go io.Copy(io.Discard, serverConn) // Broker that never responds with CONNACK.
+	dial := func(ctx context.Context) (io.ReadWriteCloser, error) {
+		time.Sleep(dialTime) // Slow dial consumes most of the budget.
+		return clientConn, nil
+	}
+	client := NewClient(ClientConfig{})
+	var varConn VariablesConnect
+	varConn.SetDefaultMQTT([]byte("salamanca"))
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), budget)
+	defer cancel()
+	err := client.DialConnect(ctx, dial, &varConn)
+	elapsed := time.Since(start)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v, expected deadline exceeded", err)
+	}
+	if elapsed < budget {
+		t.Errorf("CONNACK wait did not get remaining budget, handshake took %v with budget %v", elapsed, budget)
+	}
+	if client.IsConnected() {
+		t.Error("client connected without CONNACK")
+	}
+
+	// Read deadline set by caller is kept after a successful handshake.
+	clientConn, serverConn = net.Pipe()
+	defer serverConn.Close()
+	go func() {
+		var rx Rx
+		rx.SetRxTransport(serverConn)
+		rx.userDecoder = DecoderNoAlloc{UserBuffer: make([]byte, 1500)}
+		rx.RxCallbacks.OnConnect = func(*Rx, *VariablesConnect) error {
+			_, err := serverConn.Write([]byte("\x20\x02\x00\x00")) // CONNACK.
+			return err
+		}
+		rx.ReadNextPacket()
+	}()
+	userDeadline := time.Now().Add(budget)
+	clientConn.SetReadDeadline(userDeadline)
+	client = NewClient(ClientConfig{})
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = client.Connect(ctx, clientConn, &varConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := clientConn
+	guard := time.AfterFunc(time.Second, func() { conn.Close() }) // Unblock read if deadline was cleared.
+	defer guard.Stop()
+	_, err = clientConn.Read(make([]byte, 1))
+	if !isTimeout(err) || time.Now().Before(userDeadline) {
+		t.Errorf("caller's read deadline not kept, got %v", err)
+	}
+}
+
+func TestDialTLS(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	serverName := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Record server name and abort handshake, no certificate is needed.
+		tls.Server(conn, &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName <- hello.ServerName
+			return nil, errors.New("abort handshake")
+		}}).Handshake()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = DialTLS(ctx, net.JoinHostPort("localhost", port), nil)
+	if err == nil {
+		t.Fatal("expected aborted handshake error")
+	}
+	if got := <-serverName; got != "localhost" {
+		t.Errorf("got server name %q, expected server name from address", got)
+	}
+
+	// Server accepting the connection but never completing the handshake.
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = DialTLS(ctx, ln.Addr().String(), &tls.Config{ServerName: "broker"})
+	if err == nil || time.Since(start) > time.Second {
+		t.Errorf("expected handshake to be cancelled with context, got %v after %v", err, time.Since(start))
+	}
+}
+
+func TestClientMaxPendingSubs(t *testing.T) {
+	broker := newTestBroker(t)
+	var pending VariablesSubscribe
+	broker.rx.RxCallbacks.OnSub = func(_ *Rx, vs VariablesSubscribe) error {
+		pending = vs.Copy() // Withhold SUBACK.
+		return nil
+	}
+	client := newConnectedClient(t, broker, ClientConfig{MaxPendingSubs: 2})
+	newSub := func(pi uint16, topics ...string) VariablesSubscribe {
+		vs := VariablesSubscribe{PacketIdentifier: pi}
+		for _, topic := range topics {
+			vs.TopicFilters = append(vs.TopicFilters, SubscribeRequest{TopicFilter: []byte(topic)})
+		}
+		return vs
+	}
+	err := client.StartSubscribe(newSub(1, "a", "b", "c"))
+	if err != ErrTooManyPendingSubs {
+		t.Fatalf("got %v, expected %v", err, ErrTooManyPendingSubs)
+	}
+	err = client.StartSubscribe(newSub(1, "a", "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.StartSubscribe(newSub(2, "c"))
+	if err != ErrTooManyPendingSubs {
+		t.Fatalf("got %v, expected %v", err, ErrTooManyPendingSubs)
+	}
+	// Complete subscribe to free capacity.
+	err = broker.tx.WriteSuback(VariablesSuback{PacketIdentifier: pending.PacketIdentifier, ReturnCodes: []QoSLevel{QoS0, QoS0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.HandleNext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.StartSubscribe(newSub(2, "c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
 
-		n, err := rxtx.ReadNextPacket()
-		if err != nil {
-			t.Fatal(err)
+func TestSessionMemoryEstimate(t *testing.T) {
+	const maxTopicLen = 64
+	for _, test := range []struct {
+		maxInflight, maxSubs, maxPayloadLen int
+	}{
+		{maxInflight: 16, maxSubs: 16, maxPayloadLen: 2048},
+		{maxInflight: 0, maxSubs: 0, maxPayloadLen: 1 << 20}, // Only QoS0 publishes.
+	} {
+		broker := newTestBroker(t)
+		broker.fromClient.Grow(test.maxPayloadLen + 1024)
+		broker.toClient.Grow(1024)
+		discard := make([]byte, 1024)
+		broker.rx.RxCallbacks.OnPub = func(_ *Rx, _ VariablesPublish, r io.Reader) error {
+			// Withhold PUBACK. Payload is read into a preallocated buffer so broker does not allocate.
+			for {
+				_, err := r.Read(discard)
+				if err == io.EOF {
+					return nil
+				} else if err != nil {
+					return err
+				}
+			}
 		}
-		expectSize := expectHeader.Size() + varunsub.Size()
-		if n != expectSize {
-			t.Errorf("read %v bytes, expected to read %v bytes", n, expectSize)
+		broker.rx.RxCallbacks.OnSub = func(_ *Rx, vs VariablesSubscribe) error {
+			return broker.tx.WriteSubackFor(vs, []QoSLevel{QoS1})
 		}
-		if !callbackExecuted {
-			t.Error("OnUnsub callback not executed")
+		topic := func(i int) []byte {
+			b := bytes.Repeat([]byte{'a'}, maxTopicLen)
+			b[0] = 'a' + byte(i)
+			return b
 		}
-	}
+		payload := make([]byte, test.maxPayloadLen)
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
 
-	//
-	// Send SUBACK packet over wire.
-	//
-	{
-		callbackExecuted := false
-		varSuback := VariablesSuback{
-			PacketIdentifier: math.MaxUint16,
-			ReturnCodes:      []QoSLevel{QoS0, QoS1, QoS0, QoS2, QoSSubfail, QoS1},
-		}
-		err = rxtx.WriteSuback(varSuback)
-		if err != nil {
-			t.Fatal(err)
+		client := newConnectedClient(t, broker, ClientConfig{MaxPublishAttempts: 3}) // Retain PUBLISH copies.
+		for i := 0; i < test.maxSubs; i++ {
+			vsub := VariablesSubscribe{TopicFilters: []SubscribeRequest{{TopicFilter: topic(i), QoS: QoS1}}}
+			if err := client.StartSubscribe(vsub); err != nil {
+				t.Fatal(err)
+			}
+			if err := client.HandleNext(); err != nil {
+				t.Fatal(err)
+			}
 		}
-		expectHeader := newHeader(PacketSuback, 0, uint32(varSuback.Size()))
-		rxtx.RxCallbacks.OnSuback = func(rt *Rx, vu VariablesSuback) error {
-			if rt.LastReceivedHeader != expectHeader {
-				t.Errorf("rxtx header mismatch, expect:%v, rxed:%v", expectHeader.String(), rt.LastReceivedHeader.String())
+		for i := 0; i < test.maxInflight; i++ {
+			if _, err := client.StartPublishQoS1(topic(i), payload); err != nil {
+				t.Fatal(err)
 			}
-			varEqual(t, varSuback, vu)
-			callbackExecuted = true
-			return nil
 		}
-
-		n, err := rxtx.ReadNextPacket()
-		if err != nil {
+		// Max size QoS0 PUBLISH is encoded whole in the Tx buffer.
+		if _, err := client.Publish(topic(0), payload, QoS0, false); err != nil {
 			t.Fatal(err)
 		}
-		expectSize := expectHeader.Size() + varSuback.Size()
-		if n != expectSize {
-			t.Errorf("read %v bytes, expected to read %v bytes", n, expectSize)
+		if len(client.SubscribedTopics()) != test.maxSubs {
+			t.Fatal("subscriptions not active")
 		}
-		if !callbackExecuted {
-			t.Error("OnSuback callback not executed")
+
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		runtime.KeepAlive(client)
+		runtime.KeepAlive(broker)
+		runtime.KeepAlive(payload)
+		used := int(after.HeapAlloc) - int(before.HeapAlloc)
+		estimate := SessionMemoryEstimate(test.maxInflight, test.maxSubs, maxTopicLen, test.maxPayloadLen)
+		if used > estimate {
+			t.Errorf("%+v: session used %d bytes, more than estimate of %d bytes", test, used, estimate)
 		}
 	}
+}
 
-	//
-	// Send PUBREL packet over wire.
-	//
-	{
-		callbackExecuted := false
-		txPI := uint16(3232)
-		expectHeader := newHeader(PacketPubrel, PacketFlagsPubrelSubUnsub, 2)
-		err = rxtx.WriteIdentified(PacketPubrel, txPI)
+func TestClientMaxInflight(t *testing.T) {
+	broker := newTestBroker(t)
+	var pubPIs []uint16
+	broker.rx.RxCallbacks.OnPub = func(_ *Rx, vp VariablesPublish, r io.Reader) error {
+		pubPIs = append(pubPIs, vp.PacketIdentifier) // Withhold PUBACK.
+		_, err := io.Copy(io.Discard, r)
+		return err
+	}
+	broker.rx.RxCallbacks.OnSub = func(*Rx, VariablesSubscribe) error { return nil } // Withhold SUBACK.
+	client := newConnectedClient(t, broker, ClientConfig{MaxInflight: 3})
+	handleNext := func() {
+		t.Helper()
+		if err := client.HandleNext(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vsub := VariablesSubscribe{TopicFilters: []SubscribeRequest{{TopicFilter: []byte("a"), QoS: QoS1}}}
+	subPI, err := client.StartSubscribeID(vsub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		_, err = client.StartPublishQoS1([]byte("b"), []byte("payload"))
 		if err != nil {
 			t.Fatal(err)
 		}
+	}
+	if len(pubPIs) != 2 || pubPIs[0] == pubPIs[1] || pubPIs[0] == subPI || pubPIs[1] == subPI {
+		t.Fatalf("bad packet identifiers allocated: %v", pubPIs)
+	}
+	_, err = client.StartPublishQoS1([]byte("b"), []byte("payload"))
+	if err != ErrNoPacketIDs {
+		t.Fatalf("got %v, expected %v", err, ErrNoPacketIDs)
+	}
 
-		rxtx.RxCallbacks.OnOther = func(rt *Rx, gotPI uint16) error {
-			if rt.LastReceivedHeader != expectHeader {
-				t.Errorf("rxtx header mismatch, expect:%v, rxed:%v", expectHeader.String(), rt.LastReceivedHeader.String())
-			}
-			if gotPI != txPI {
-				t.Error("mismatch of packet identifiers", gotPI, txPI)
+	// Completing a publish frees a packet identifier.
+	err = broker.tx.WriteIdentified(PacketPuback, pubPIs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	handleNext()
+	_, err = client.StartPublishQoS1([]byte("b"), []byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.StartPublishQoS1([]byte("b"), []byte("payload"))
+	if err != ErrNoPacketIDs {
+		t.Fatalf("got %v, expected %v", err, ErrNoPacketIDs)
+	}
+
+	// Completing the subscribe frees a packet identifier.
+	err = broker.tx.WriteSuback(VariablesSuback{PacketIdentifier: subPI, ReturnCodes: []QoSLevel{QoS1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handleNext()
+	_, err = client.StartPublishQoS1([]byte("b"), []byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.StartSubscribe(VariablesSubscribe{TopicFilters: []SubscribeRequest{{TopicFilter: []byte("c")}}})
+	if err != ErrNoPacketIDs {
+		t.Fatalf("got %v, expected %v", err, ErrNoPacketIDs)
+	}
+}
+
+func TestClientOnInflightAvailable(t *testing.T) {
+	const maxInflight = 2
+	broker := newTestBroker(t)
+	var pubPIs []uint16
+	broker.rx.RxCallbacks.OnPub = func(_ *Rx, vp VariablesPublish, r io.Reader) error {
+		pubPIs = append(pubPIs, vp.PacketIdentifier) // Withhold PUBACK.
+		_, err := io.Copy(io.Discard, r)
+		return err
+	}
+	available := 0
+	var client *Client
+	client = newConnectedClient(t, broker, ClientConfig{
+		MaxInflight: maxInflight,
+		OnInflightAvailable: func() {
+			available++
+			// Client state may be queried from within the callback.
+			if !client.IsConnected() {
+				t.Error("client disconnected")
 			}
-			callbackExecuted = true
-			return nil
+		},
+	})
+	for i := 0; i < maxInflight; i++ {
+		_, err := client.StartPublishQoS1([]byte("b"), []byte("payload"))
+		if err != nil {
+			t.Fatal(err)
 		}
-
-		n, err := rxtx.ReadNextPacket()
+	}
+	_, err := client.StartPublishQoS1([]byte("b"), []byte("payload"))
+	if err != ErrNoPacketIDs {
+		t.Fatalf("got %v, expected %v", err, ErrNoPacketIDs)
+	}
+	for i, pi := range pubPIs {
+		err = broker.tx.WriteIdentified(PacketPuback, pi)
 		if err != nil {
 			t.Fatal(err)
 		}
-		expectSize := expectHeader.Size() + 2
-		if n != expectSize {
-			t.Errorf("read %v bytes, expected to read %v bytes", n, expectSize)
+		err = client.HandleNext()
+		if err != nil {
+			t.Fatal(err)
 		}
-		if !callbackExecuted {
-			t.Error("OnOther callback not executed")
+		if available != i+1 {
+			t.Fatalf("got %d calls after %d completed publishes", available, i+1)
 		}
 	}
+	// A duplicate PUBACK frees no slot.
+	err = broker.tx.WriteIdentified(PacketPuback, pubPIs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.HandleNext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if available != maxInflight {
+		t.Errorf("got %d calls after duplicate PUBACK, expected %d", available, maxInflight)
+	}
+}
 
-	//
-	// Send PINGREQ packet over wire.
-	//
-	{
-		callbackExecuted := false
-		expectHeader := newHeader(PacketPingreq, 0, 0)
-		err = rxtx.WriteSimple(PacketPingreq)
+func TestClientRetransmitStalled(t *testing.T) {
+	const (
+		interval    = time.Minute
+		maxAttempts = 3
+	)
+	broker := newTestBroker(t)
+	var gotDups []bool
+	broker.rx.RxCallbacks.OnPub = func(rx *Rx, _ VariablesPublish, r io.Reader) error {
+		gotDups = append(gotDups, rx.LastReceivedHeader.Flags().Dup()) // Never PUBACK.
+		_, err := io.Copy(io.Discard, r)
+		return err
+	}
+	now := time.Unix(1000, 0)
+	client := newConnectedClient(t, broker, ClientConfig{
+		RetransmitInterval: interval,
+		MaxPublishAttempts: maxAttempts,
+		MaxInflight:        1,
+		Now:                func() time.Time { return now },
+	})
+	pi, err := client.StartPublishQoS1([]byte("at/least/once"), []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Not stalled yet.
+	err = client.RetransmitStalled()
+	if err != nil || len(gotDups) != 1 {
+		t.Fatalf("got %v and %d PUBLISH packets before interval elapsed", err, len(gotDups))
+	}
+	for i := 1; i < maxAttempts; i++ {
+		now = now.Add(interval + time.Second)
+		err = client.RetransmitStalled()
 		if err != nil {
 			t.Fatal(err)
 		}
+		if len(gotDups) != i+1 || !gotDups[i] {
+			t.Fatalf("retransmit %d: got PUBLISH DUP flags %v", i, gotDups)
+		}
+	}
+	now = now.Add(interval + time.Second)
+	err = client.RetransmitStalled()
+	if err != ErrPublishGaveUp {
+		t.Fatalf("got %v, expected %v", err, ErrPublishGaveUp)
+	}
+	if len(gotDups) != maxAttempts {
+		t.Errorf("got %d PUBLISH packets, expected %d", len(gotDups), maxAttempts)
+	}
+	if client.cs.PublishAwaiting(pi) != 0 {
+		t.Error("abandoned PUBLISH still in-flight")
+	}
+	// Packet identifier is freed after giving up.
+	_, err = client.StartPublishQoS1([]byte("at/least/once"), []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
 
-		rxtx.RxCallbacks.OnOther = func(rt *Rx, gotPI uint16) error {
-			if rt.LastReceivedHeader != expectHeader {
-				t.Errorf("rxtx header mismatch, expect:%v, rxed:%v", expectHeader.String(), rt.LastReceivedHeader.String())
-			}
-			if gotPI != 0 {
-				t.Error("mismatch of packet identifiers", gotPI, 0)
+func TestClientPublishGaveUpConcurrent(t *testing.T) {
+	const interval = time.Minute
+	broker := newTestBroker(t)
+	broker.rx.RxCallbacks.OnPub = func(_ *Rx, _ VariablesPublish, r io.Reader) error {
+		_, err := io.Copy(io.Discard, r) // Never PUBACK.
+		return err
+	}
+	var (
+		mu  sync.Mutex
+		now = time.Unix(1000, 0)
+	)
+	client := newConnectedClient(t, broker, ClientConfig{
+		RetransmitInterval: interval,
+		MaxPublishAttempts: 1,
+		Now: func() time.Time {
+			mu.Lock()
+			defer mu.Unlock()
+			return now
+		},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- client.PublishQoS1(ctx, []byte("a"), []byte("abandoned"))
+	}()
+	// The PUBLISH may be abandoned by either RetransmitStalled caller.
+	for {
+		select {
+		case err := <-done:
+			if err != ErrPublishGaveUp {
+				t.Fatalf("got %v, expected %v", err, ErrPublishGaveUp)
 			}
-			callbackExecuted = true
-			return nil
+			return
+		default:
+			mu.Lock()
+			now = now.Add(2 * interval)
+			mu.Unlock()
+			client.RetransmitStalled()
+			runtime.Gosched()
 		}
+	}
+}
 
-		n, err := rxtx.ReadNextPacket()
+func TestClientUnknownPuback(t *testing.T) {
+	broker := newTestBroker(t)
+	broker.rx.RxCallbacks.OnPub = func(_ *Rx, vp VariablesPublish, r io.Reader) error {
+		_, err := io.Copy(io.Discard, r)
 		if err != nil {
-			t.Fatal(err)
+			return err
 		}
-		expectSize := expectHeader.Size()
-		if n != expectSize {
-			t.Errorf("read %v bytes, expected to read %v bytes", n, expectSize)
+		return broker.tx.WriteIdentified(PacketPuback, vp.PacketIdentifier)
+	}
+	var warnings []string
+	var client *Client
+	client = newConnectedClient(t, broker, ClientConfig{
+		OnWarning: func(msg string) {
+			if !client.IsConnected() {
+				t.Error("client disconnected on warning")
+			}
+			warnings = append(warnings, msg)
+		},
+	})
+	err := broker.tx.WriteIdentified(PacketPuback, 1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.HandleNext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "1234") {
+		t.Fatalf("got warnings %q, expected one for unknown PUBACK", warnings)
+	}
+	if !client.IsConnected() {
+		t.Fatal("client disconnected after unknown PUBACK")
+	}
+	// Acknowledged publishes do not warn.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = client.PublishQoS1(ctx, []byte("a"), []byte("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 {
+		t.Errorf("got unexpected warnings %q", warnings[1:])
+	}
+}
+
+func TestClientUnsolicitedPingresp(t *testing.T) {
+	broker := newTestBroker(t)
+	broker.rx.RxCallbacks.OnOther = func(rx *Rx, _ uint16) error {
+		return broker.tx.WritePingresp()
+	}
+	var warnings []string
+	client := newConnectedClient(t, broker, ClientConfig{
+		OnWarning: func(msg string) { warnings = append(warnings, msg) },
+	})
+	err := broker.tx.WritePingresp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.HandleNext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "PINGRESP") {
+		t.Fatalf("got warnings %q, expected one for unsolicited PINGRESP", warnings)
+	}
+	if !client.IsConnected() {
+		t.Fatal("client disconnected after unsolicited PINGRESP")
+	}
+	// Solicited PINGRESP does not warn.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = client.PingRoundTrip(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 {
+		t.Errorf("got unexpected warnings %q", warnings[1:])
+	}
+}
+
+func TestClientUnsubscribeAll(t *testing.T) {
+	broker := newTestBroker(t)
+	broker.rx.RxCallbacks.OnSub = func(_ *Rx, vs VariablesSubscribe) error {
+		suback := VariablesSuback{PacketIdentifier: vs.PacketIdentifier}
+		for _, hotTopic := range vs.TopicFilters {
+			suback.ReturnCodes = append(suback.ReturnCodes, hotTopic.QoS)
 		}
-		if !callbackExecuted {
-			t.Error("OnOther callback not executed")
+		return broker.tx.WriteSuback(suback)
+	}
+	var gotUnsub []string
+	broker.rx.RxCallbacks.OnUnsub = func(_ *Rx, vu VariablesUnsubscribe) error {
+		for _, coldTopic := range vu.Topics {
+			gotUnsub = append(gotUnsub, string(coldTopic))
 		}
+		return broker.tx.WriteIdentified(PacketUnsuback, vu.PacketIdentifier)
 	}
-	err = rxtx.CloseRx() // closes both.
+	client := newConnectedClient(t, broker, ClientConfig{})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	topics := []string{"a", "b/c", "d/#"}
+	for i, topic := range topics {
+		err := client.Subscribe(ctx, VariablesSubscribe{
+			PacketIdentifier: uint16(i + 1),
+			TopicFilters:     []SubscribeRequest{{TopicFilter: []byte(topic), QoS: QoS0}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(client.SubscribedTopics()) != len(topics) {
+		t.Fatalf("expected %d subscribed topics, got %q", len(topics), client.SubscribedTopics())
+	}
+	err := client.UnsubscribeAll(ctx)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	if fmt.Sprint(gotUnsub) != fmt.Sprint(topics) {
+		t.Errorf("broker got UNSUBSCRIBE for %q, expected %q", gotUnsub, topics)
+	}
+	if active := client.SubscribedTopics(); len(active) != 0 {
+		t.Errorf("expected no subscribed topics after UNSUBACK, got %q", active)
 	}
 }
 
@@ -837,42 +5299,99 @@ func (t *testTransport) Write(p []byte) (int, error) {
 	return t.rw.Write(p)
 }
 
+// deadlineTransport records the read deadline set on it.
+type deadlineTransport struct {
+	io.ReadWriteCloser
+	deadline time.Time
+}
+
+func (d *deadlineTransport) SetReadDeadline(t time.Time) error {
+	d.deadline = t
+	return nil
+}
+
+// onAcks sets the callbacks of all packets acknowledged by packet identifier to f.
+func onAcks(cb *RxCallbacks, f func(*Rx, uint16) error) {
+	cb.OnPuback = f
+	cb.OnPubrec = f
+	cb.OnPubrel = f
+	cb.OnPubcomp = f
+	cb.OnUnsuback = f
+}
+
+// newTestBroker returns a synchronous in-memory broker which is the transport
+// of a Client under test. Packets written by the client are decoded immediately
+// by the broker's Rx and packets written by the broker's Tx are buffered until
+// read by the client. By default the broker accepts CONNECT packets.
+func newTestBroker(t *testing.T) *testBroker {
+	b := &testBroker{}
+	b.rx.SetRxTransport(&testTransport{&b.fromClient})
+	b.rx.userDecoder = DecoderNoAlloc{UserBuffer: make([]byte, 1500)}
+	b.tx.SetTxTransport(&testTransport{&b.toClient})
+	b.rx.RxCallbacks.OnConnect = func(_ *Rx, _ *VariablesConnect) error {
+		return b.tx.WriteConnack(VariablesConnack{ReturnCode: ReturnCodeConnAccepted})
+	}
+	b.rx.RxCallbacks.OnRxError = func(_ *Rx, err error) {
+		t.Error("broker rx error:", err)
+	}
+	return b
+}
+
+type testBroker struct {
+	rx         Rx
+	tx         Tx
+	toClient   bytes.Buffer
+	fromClient bytes.Buffer
+	closed     bool
+}
+
+func (b *testBroker) Read(p []byte) (int, error) {
+	if b.closed && b.toClient.Len() == 0 {
+		return 0, io.ErrClosedPipe
+	}
+	return b.toClient.Read(p)
+}
+
+func (b *testBroker) Write(p []byte) (int, error) {
+	if b.closed {
+		return 0, io.ErrClosedPipe
+	}
+	n, _ := b.fromClient.Write(p)
+	for b.fromClient.Len() > 0 {
+		_, err := b.rx.ReadNextPacket()
+		if err != nil {
+			break
+		}
+	}
+	return n, nil
+}
+
+func (b *testBroker) Close() error {
+	b.closed = true
+	return nil
+}
+
+// newConnectedClient returns a client connected to b.
+func newConnectedClient(t *testing.T, b *testBroker, cfg ClientConfig) *Client {
+	c := NewClient(cfg)
+	var varConn VariablesConnect
+	varConn.SetDefaultMQTT([]byte("salamanca"))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := c.Connect(ctx, b, &varConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
 // varEqual errors test if a's fields not equal to b. Takes as argument all VariablesPACKET structs.
 // Expects pointer to VariablesConnect.
 func varEqual(t *testing.T, a, b any) {
 	switch va := a.(type) {
 	case *VariablesConnect:
-		// Make name distinct to va to catch bugs easier.
-		veebee := b.(*VariablesConnect)
-		if va.CleanSession != veebee.CleanSession {
-			t.Error("clean session mismatch")
-		}
-		if va.ProtocolLevel != veebee.ProtocolLevel {
-			t.Error("protocol level mismatch")
-		}
-		if va.KeepAlive != veebee.KeepAlive {
-			t.Error("willQoS mismatch")
-		}
-		if va.WillQoS != veebee.WillQoS {
-			t.Error("willQoS mismatch")
-		}
-		if !bytes.Equal(va.ClientID, veebee.ClientID) {
-			t.Error("client id mismatch")
-		}
-		if !bytes.Equal(va.Protocol, veebee.Protocol) {
-			t.Error("protocol mismatch")
-		}
-		if !bytes.Equal(va.Password, veebee.Password) {
-			t.Error("password mismatch")
-		}
-		if !bytes.Equal(va.Username, veebee.Username) {
-			t.Error("username mismatch")
-		}
-		if !bytes.Equal(va.WillMessage, veebee.WillMessage) {
-			t.Error("will message mismatch")
-		}
-		if !bytes.Equal(va.WillTopic, veebee.WillTopic) {
-			t.Error("will topic mismatch")
+		if vb := b.(*VariablesConnect); !va.Equal(vb) {
+			t.Errorf("CONNECT not equal:\n%+v\n%+v", va, vb)
 		}
 
 	case VariablesConnack:
@@ -934,6 +5453,27 @@ func varEqual(t *testing.T, a, b any) {
 	}
 }
 
+// validPackets are well formed packets, one of each kind, used as fuzz seeds and
+// as input to decoding tests. Indices are relied upon by TestDecodeAll.
+var validPackets = [][]byte{
+	// Typical connect packet.
+	[]byte("\x10\x1e\x00\x04MQTT\x04\xec\x00<\x00\x020w\x00\x02Bw\x00\x02Aw\x00\x02Cw\x00\x02Dw"),
+	// Typical connack.
+	[]byte("\x20\x02\x01\x04"),
+	// A Publish packet.
+	[]byte(";\x8e\x01\x00&now-for-something-completely-different\xff\xffertytgbhjjhundsaip;vf[oniw[aondmiksfvoWDNFOEWOPndsafr;poulikujyhtgbfrvdcsxzaesxt dfcgvfhbg kjnlkm/'."),
+	// A subscribe packet.
+	[]byte("\x824\xff\xff\x00\tfavorites\x02\x00\tthe-clash\x02\x00\x0falways-watching\x02\x00\x05k-pop\x02"),
+	// Unsubscribe packet.
+	[]byte("\xa2$\xff\xff\x00\x06topic1\x00\x06topic2\x00\x06topic3\x00\bsemperfi"),
+	// Suback packet.
+	[]byte("\x90\b\xff\xff\x00\x01\x00\x02\x80\x01"),
+	// Pubrel packet.
+	[]byte("b\x02\f\xa0"),
+	// Pingreq packet.
+	[]byte("\xc0\x00"),
+}
+
 var fuzzCorpus = [][]byte{
 	[]byte("00\x0000"),
 	[]byte("\x90\xa7000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000"),
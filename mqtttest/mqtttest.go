@@ -0,0 +1,137 @@
+// Package mqtttest provides utilities for testing MQTT implementations
+// built on top of natiu-mqtt.
+package mqtttest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"testing"
+
+	mqtt "github.com/soypat/natiu-mqtt"
+)
+
+// AssertRoundTrip decodes a single MQTT packet contained in packet, re-encodes it
+// and fails the test if the encoded bytes differ from packet. It is meant to
+// be used with well formed packets that are expected to be encoded identically
+// by natiu-mqtt, i.e. CONNECT packets must use the default "MQTT" protocol name and level 4.
+func AssertRoundTrip(t testing.TB, packet []byte) {
+	t.Helper()
+	got, err := roundTrip(packet)
+	if err != nil {
+		t.Errorf("round trip of %q: %v", packet, err)
+		return
+	}
+	if !bytes.Equal(got, packet) {
+		idx := firstDiff(got, packet)
+		t.Errorf("round trip mismatch at byte %d:\nwant:\n%sgot:\n%s", idx, hex.Dump(packet), hex.Dump(got))
+	}
+}
+
+// roundTrip decodes packet and returns the result of encoding the decoded packet.
+func roundTrip(packet []byte) ([]byte, error) {
+	r := bytes.NewReader(packet)
+	hdr, _, err := mqtt.DecodeHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if int(hdr.RemainingLength) != r.Len() {
+		return nil, errors.New("remaining length does not match packet length")
+	}
+	dec := mqtt.DecoderNoAlloc{UserBuffer: make([]byte, len(packet))}
+	var out bytes.Buffer
+	var tx mqtt.Tx
+	tx.SetTxTransport(nopCloser{&out})
+
+	switch hdr.Type() {
+	case mqtt.PacketConnect:
+		var vc mqtt.VariablesConnect
+		vc, _, err = dec.DecodeConnect(r)
+		if err == nil {
+			err = tx.WriteConnect(&vc)
+		}
+
+	case mqtt.PacketConnack:
+		var buf [2]byte
+		_, err = io.ReadFull(r, buf[:])
+		if err == nil {
+			err = tx.WriteConnack(mqtt.VariablesConnack{AckFlags: buf[0], ReturnCode: mqtt.ConnectReturnCode(buf[1])})
+		}
+
+	case mqtt.PacketPublish:
+		var vp mqtt.VariablesPublish
+		vp, _, err = dec.DecodePublish(r, hdr.Flags().QoS())
+		if err == nil {
+			payload, _ := io.ReadAll(r)
+			err = tx.WritePublishPayload(hdr, vp, payload)
+		}
+
+	case mqtt.PacketSubscribe:
+		var vs mqtt.VariablesSubscribe
+		vs, _, err = dec.DecodeSubscribe(r, hdr.RemainingLength)
+		if err == nil {
+			err = tx.WriteSubscribe(vs)
+		}
+
+	case mqtt.PacketSuback:
+		var vs mqtt.VariablesSuback
+		var rest []byte
+		rest, err = io.ReadAll(r)
+		if err == nil && len(rest) < 2 {
+			err = mqtt.ErrBadRemainingLen
+		}
+		if err == nil {
+			vs.PacketIdentifier = binary.BigEndian.Uint16(rest)
+			for _, code := range rest[2:] {
+				vs.ReturnCodes = append(vs.ReturnCodes, mqtt.QoSLevel(code))
+			}
+			err = tx.WriteSuback(vs)
+		}
+
+	case mqtt.PacketUnsubscribe:
+		var vu mqtt.VariablesUnsubscribe
+		vu, _, err = dec.DecodeUnsubscribe(r, hdr.RemainingLength)
+		if err == nil {
+			err = tx.WriteUnsubscribe(vu)
+		}
+
+	case mqtt.PacketPuback, mqtt.PacketPubrec, mqtt.PacketPubrel, mqtt.PacketPubcomp, mqtt.PacketUnsuback:
+		var buf [2]byte
+		_, err = io.ReadFull(r, buf[:])
+		if err == nil {
+			err = tx.WriteIdentified(hdr.Type(), binary.BigEndian.Uint16(buf[:]))
+		}
+
+	case mqtt.PacketDisconnect, mqtt.PacketPingreq, mqtt.PacketPingresp:
+		err = tx.WriteSimple(hdr.Type())
+
+	default:
+		err = errors.New("unsupported packet type " + hdr.Type().String())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// firstDiff returns the index of the first byte that differs between a and b.
+func firstDiff(a, b []byte) int {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
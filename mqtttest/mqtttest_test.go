@@ -0,0 +1,64 @@
+package mqtttest
+
+import (
+	"bytes"
+	"testing"
+
+	mqtt "github.com/soypat/natiu-mqtt"
+)
+
+func TestAssertRoundTrip(t *testing.T) {
+	// Packets encoded by natiu-mqtt must round trip identically.
+	var buf bytes.Buffer
+	var tx mqtt.Tx
+	tx.SetTxTransport(nopCloser{&buf})
+	var varConn mqtt.VariablesConnect
+	varConn.SetDefaultMQTT([]byte("salamanca"))
+	pubFlags, _ := mqtt.NewPublishFlags(mqtt.QoS1, false, false)
+	pubHeader, _ := mqtt.NewHeader(mqtt.PacketPublish, pubFlags, 0)
+	vsub := mqtt.VariablesSubscribe{PacketIdentifier: 2, TopicFilters: []mqtt.SubscribeRequest{{TopicFilter: []byte("favorites"), QoS: mqtt.QoS1}}}
+	for _, write := range []func() error{
+		func() error { return tx.WriteConnect(&varConn) },
+		func() error { return tx.WriteConnack(mqtt.VariablesConnack{ReturnCode: mqtt.ReturnCodeConnAccepted}) },
+		func() error {
+			return tx.WritePublishPayload(pubHeader, mqtt.VariablesPublish{TopicName: []byte("now"), PacketIdentifier: 1}, []byte("payload"))
+		},
+		func() error { return tx.WriteSubscribe(vsub) },
+		func() error { return tx.WriteSubackFor(vsub, []mqtt.QoSLevel{mqtt.QoS1}) },
+		func() error {
+			return tx.WriteUnsubscribe(mqtt.VariablesUnsubscribe{PacketIdentifier: 3, Topics: [][]byte{[]byte("favorites")}})
+		},
+		func() error { return tx.WriteIdentified(mqtt.PacketPubrel, 4) },
+		tx.WritePingreq,
+	} {
+		buf.Reset()
+		if err := write(); err != nil {
+			t.Fatal(err)
+		}
+		AssertRoundTrip(t, buf.Bytes())
+	}
+}
+
+func TestAssertRoundTripFails(t *testing.T) {
+	// Malformed packets and packets that are not encoded identically must fail.
+	for _, packet := range [][]byte{
+		[]byte("\x02\x01\x04"),                        // Invalid packet type.
+		[]byte("\x20\x03\x01\x04"),                    // Truncated CONNACK.
+		[]byte("\x10\x0c\x00\x04MQIsdp\x03\x02\x00<"), // Non-default protocol.
+	} {
+		var rec recorder
+		AssertRoundTrip(&rec, packet)
+		if !rec.failed {
+			t.Errorf("expected round trip of %q to fail", packet)
+		}
+	}
+}
+
+type recorder struct {
+	testing.TB
+	failed bool
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...any) { r.failed = true }
@@ -0,0 +1,156 @@
+// Package mqttws adapts WebSocket connections for use as natiu-mqtt transports,
+// enabling MQTT over WebSockets as used by browsers and some cloud brokers.
+//
+// The package does not depend on a WebSocket implementation. Any connection
+// implementing [MessageConn], such as a *websocket.Conn from github.com/gorilla/websocket,
+// may be adapted. The connection should be dialed requesting the "mqtt" subprotocol, see [Subprotocol].
+package mqttws
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	mqtt "github.com/soypat/natiu-mqtt"
+)
+
+// Subprotocol is the WebSocket subprotocol MQTT servers expect clients to
+// request during the WebSocket handshake, i.e. with the Sec-WebSocket-Protocol header.
+const Subprotocol = "mqtt"
+
+// BinaryMessage is the WebSocket message type of binary data messages as defined
+// in RFC 6455, which is also the value used by github.com/gorilla/websocket.
+const BinaryMessage = 2
+
+// MessageConn is a message oriented WebSocket connection.
+type MessageConn interface {
+	// NextReader returns the type of the next message received and a reader for its contents.
+	NextReader() (messageType int, r io.Reader, err error)
+	// NextWriter returns a writer for the next message to send of the argument type.
+	// The message is sent when the writer is closed.
+	NextWriter(messageType int) (io.WriteCloser, error)
+	// Close closes the underlying connection.
+	Close() error
+}
+
+var errNonBinary = errors.New("mqttws: received non-binary websocket message")
+
+// Conn adapts a [MessageConn] into a byte stream suitable as an MQTT transport for
+// [mqtt.Client.Connect], [mqtt.Rx.SetRxTransport] and [mqtt.Tx.SetTxTransport].
+//
+// Reads are served from consecutive binary messages so a single MQTT packet may span
+// several WebSocket messages and a message may hold several packets. Writes are buffered
+// until a whole MQTT packet has been written, which is then sent as a single binary message.
+// Like other transports Conn is not safe for concurrent reads or concurrent writes,
+// though a read may happen concurrently with a write.
+type Conn struct {
+	ws MessageConn
+	// r is the reader of the message being read, nil if none.
+	r io.Reader
+	// wbuf holds written bytes of the packet not yet sent.
+	wbuf bytes.Buffer
+}
+
+// NewConn returns a transport that reads and writes MQTT packets over ws.
+func NewConn(ws MessageConn) *Conn {
+	return &Conn{ws: ws}
+}
+
+// Read implements [io.Reader]. It reads from the current WebSocket message and
+// continues with the next message once it is exhausted.
+// Receiving a non-binary message is an error.
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	for {
+		if c.r == nil {
+			mt, r, err := c.ws.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if mt != BinaryMessage {
+				return 0, errNonBinary
+			}
+			c.r = r
+		}
+		n, err := c.r.Read(b)
+		if err == io.EOF {
+			c.r = nil
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// Write implements [io.Writer]. Data written is buffered until it holds a complete
+// MQTT packet, at which point the packet is sent as a binary WebSocket message.
+// Write returns an error if the data does not start with a valid fixed header.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.wbuf.Write(b)
+	for {
+		size, err := packetSize(c.wbuf.Bytes())
+		if err != nil {
+			c.wbuf.Reset()
+			return 0, err
+		}
+		if size == 0 || c.wbuf.Len() < size {
+			return len(b), nil // Packet incomplete.
+		}
+		err = c.sendMessage(c.wbuf.Next(size))
+		if err != nil {
+			c.wbuf.Reset()
+			return 0, err
+		}
+		if c.wbuf.Len() == 0 {
+			c.wbuf.Reset()
+			return len(b), nil
+		}
+	}
+}
+
+func (c *Conn) sendMessage(packet []byte) error {
+	w, err := c.ws.NextWriter(BinaryMessage)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(packet)
+	if err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// Close closes the underlying WebSocket connection. Buffered data of an incomplete packet is discarded.
+func (c *Conn) Close() error {
+	c.wbuf.Reset()
+	c.r = nil
+	return c.ws.Close()
+}
+
+// packetSize returns the size of the packet starting at buf or 0 if buf does not
+// hold the whole fixed header yet.
+func packetSize(buf []byte) (int, error) {
+	if len(buf) < 2 {
+		return 0, nil
+	}
+	// Header is decoded only once the remaining length is complete so that
+	// a partially written header is not reported as truncated.
+	end := 1
+	for end < len(buf) && end <= 4 && buf[end]&0x80 != 0 {
+		end++
+	}
+	if end > 4 {
+		return 0, mqtt.ErrBadRemainingLen
+	} else if end == len(buf) {
+		return 0, nil
+	}
+	hdr, n, err := mqtt.DecodeHeader(bytes.NewReader(buf[:end+1]))
+	if err != nil {
+		return 0, err
+	}
+	return n + int(hdr.RemainingLength), nil
+}
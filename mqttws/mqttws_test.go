@@ -0,0 +1,118 @@
+package mqttws
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	mqtt "github.com/soypat/natiu-mqtt"
+)
+
+func TestConnWritePacketPerMessage(t *testing.T) {
+	ws := &fakeWS{}
+	conn := NewConn(ws)
+	tx := mqtt.Tx{}
+	tx.SetTxTransport(conn)
+	flags, _ := mqtt.NewPublishFlags(mqtt.QoS1, false, false)
+	payload := bytes.Repeat([]byte("ws"), 100) // Remaining length needs two bytes.
+	vp := mqtt.VariablesPublish{TopicName: []byte("websocket"), PacketIdentifier: 1}
+	hdr, err := mqtt.NewHeader(mqtt.PacketPublish, flags, uint32(vp.Size(mqtt.QoS1)+len(payload)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.WritePublishPayload(hdr, vp, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.WriteSimple(mqtt.PacketPingreq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ws.sent) != 2 {
+		t.Fatalf("got %d messages sent, expected one per packet", len(ws.sent))
+	}
+	if len(ws.sent[0]) != hdr.Size()+int(hdr.RemainingLength) {
+		t.Errorf("first message of %d bytes does not hold complete PUBLISH", len(ws.sent[0]))
+	}
+	if !bytes.Equal(ws.sent[1], []byte{0xc0, 0x00}) {
+		t.Errorf("got second message %q, expected PINGREQ", ws.sent[1])
+	}
+	if conn.wbuf.Len() != 0 {
+		t.Errorf("%d bytes left buffered", conn.wbuf.Len())
+	}
+}
+
+func TestConnReadAcrossMessages(t *testing.T) {
+	pingreq := []byte{0xc0, 0x00}
+	puback := []byte{0x40, 0x02, 0x00, 0x07}
+	ws := &fakeWS{received: [][]byte{
+		puback[:1], puback[1:3], puback[3:], // Packet split across messages.
+		append(append([]byte{}, pingreq...), puback...), // Two packets in one message.
+	}}
+	rx := mqtt.Rx{}
+	rx.SetRxTransport(NewConn(ws))
+	var got []mqtt.PacketType
+	rx.RxCallbacks.OnOther = func(rx *mqtt.Rx, packetIdentifier uint16) error {
+		got = append(got, rx.LastReceivedHeader.Type())
+		return nil
+	}
+	rx.RxCallbacks.OnPuback = rx.RxCallbacks.OnOther
+	for i := 0; i < 3; i++ {
+		_, err := rx.ReadNextPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := []mqtt.PacketType{mqtt.PacketPuback, mqtt.PacketPingreq, mqtt.PacketPuback}
+	for i := range expect {
+		if got[i] != expect[i] {
+			t.Errorf("packet %d: got %s, expected %s", i, got[i], expect[i])
+		}
+	}
+}
+
+func TestConnRejectsTextMessage(t *testing.T) {
+	ws := &fakeWS{received: [][]byte{[]byte("\xc0\x00")}, messageType: 1}
+	_, err := NewConn(ws).Read(make([]byte, 2))
+	if err != errNonBinary {
+		t.Errorf("got %v, expected %v", err, errNonBinary)
+	}
+}
+
+// fakeWS is an in-memory MessageConn.
+type fakeWS struct {
+	received    [][]byte
+	messageType int
+	sent        [][]byte
+}
+
+func (ws *fakeWS) NextReader() (int, io.Reader, error) {
+	if len(ws.received) == 0 {
+		return 0, nil, io.EOF
+	}
+	msg := ws.received[0]
+	ws.received = ws.received[1:]
+	mt := ws.messageType
+	if mt == 0 {
+		mt = BinaryMessage
+	}
+	return mt, bytes.NewReader(msg), nil
+}
+
+func (ws *fakeWS) NextWriter(messageType int) (io.WriteCloser, error) {
+	return &fakeWriter{ws: ws}, nil
+}
+
+func (ws *fakeWS) Close() error { return nil }
+
+type fakeWriter struct {
+	ws  *fakeWS
+	buf bytes.Buffer
+}
+
+func (w *fakeWriter) Write(b []byte) (int, error) { return w.buf.Write(b) }
+
+func (w *fakeWriter) Close() error {
+	w.ws.sent = append(w.ws.sent, w.buf.Bytes())
+	return nil
+}
@@ -0,0 +1,161 @@
+package mqtt
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// Packet is a decoded MQTT packet. Only the fields corresponding to the
+// packet type in Header are set.
+type Packet struct {
+	Header      Header
+	Connect     VariablesConnect
+	Connack     VariablesConnack
+	Publish     VariablesPublish
+	Subscribe   VariablesSubscribe
+	Suback      VariablesSuback
+	Unsubscribe VariablesUnsubscribe
+	// PacketIdentifier is set for PUBACK, PUBREC, PUBREL, PUBCOMP and UNSUBACK packets.
+	PacketIdentifier uint16
+	// Payload contains the Application Message of a PUBLISH packet.
+	Payload []byte
+}
+
+// WriteTo implements [io.WriterTo] by writing the whole packet, fixed header, variable
+// header and payload, to w with a single Write call. The packet is encoded by a [Tx] so
+// it is validated as Tx validates packets and the wire format is identical. The Header's
+// flags are only used for PUBLISH packets and its remaining length, if non-zero, must
+// match the packet contents. Only the fields corresponding to the packet type are encoded.
+// A packet may be serialized once into a [bytes.Buffer] to be written to many transports.
+func (p *Packet) WriteTo(w io.Writer) (int64, error) {
+	cw := countingWriter{w: w}
+	var tx Tx
+	tx.SetTxTransport(&cw)
+	tx.TxCallbacks.OnTxError = func(*Tx, error) {} // w is not ours to close.
+	var err error
+	switch tp := p.Header.Type(); tp {
+	case PacketConnect:
+		err = tx.WriteConnect(&p.Connect)
+	case PacketConnack:
+		err = tx.WriteConnack(p.Connack)
+	case PacketPublish:
+		err = tx.WritePublishPayload(p.Header, p.Publish, p.Payload)
+	case PacketSubscribe:
+		err = tx.WriteSubscribe(p.Subscribe)
+	case PacketSuback:
+		err = tx.WriteSuback(p.Suback)
+	case PacketUnsubscribe:
+		err = tx.WriteUnsubscribe(p.Unsubscribe)
+	case PacketPuback, PacketPubrec, PacketPubrel, PacketPubcomp, PacketUnsuback:
+		err = tx.WriteIdentified(tp, p.PacketIdentifier)
+	case PacketPingreq, PacketPingresp, PacketDisconnect:
+		err = tx.WriteSimple(tp)
+	default:
+		err = errors.New("cannot encode packet of type " + tp.String())
+	}
+	return cw.n, err
+}
+
+// countingWriter counts the bytes written to w. It is used as a Tx transport.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	return n, err
+}
+
+func (cw *countingWriter) Close() error { return nil }
+
+// DecodeError is returned by [DecodeAll] when a malformed packet is found.
+type DecodeError struct {
+	// Offset is the position in the buffer at which the malformed packet starts.
+	Offset int
+	Err    error
+}
+
+// Error implements the error interface.
+func (e *DecodeError) Error() string {
+	return "natiu-mqtt: malformed packet at offset " + strconv.Itoa(e.Offset) + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying decoding error.
+func (e *DecodeError) Unwrap() error { return e.Err }
+
+// DecodeAll decodes all packets contained in buf. It stops at the first malformed
+// packet and returns the packets decoded up to that point along with a [*DecodeError]
+// reporting the offset of the malformed packet. Decoded packets do not reference buf's memory.
+func DecodeAll(buf []byte) ([]Packet, error) {
+	var (
+		packets []Packet
+		pkt     Packet
+		rx      Rx
+	)
+	rx.AcceptedProtocolLevels = []byte{DefaultProtocolLevel, ProtocolLevel5}
+	rx.RxCallbacks = RxCallbacks{
+		OnConnect: func(_ *Rx, vc *VariablesConnect) error {
+			pkt.Connect = *vc
+			return nil
+		},
+		OnConnack: func(_ *Rx, vc VariablesConnack) error {
+			pkt.Connack = vc
+			return nil
+		},
+		OnPub: func(_ *Rx, vp VariablesPublish, r io.Reader) (err error) {
+			pkt.Publish = vp
+			pkt.Payload, err = io.ReadAll(r)
+			return err
+		},
+		OnSub: func(_ *Rx, vs VariablesSubscribe) error {
+			pkt.Subscribe = vs
+			return nil
+		},
+		OnSuback: func(_ *Rx, vs VariablesSuback) error {
+			pkt.Suback = vs
+			return nil
+		},
+		OnUnsub: func(_ *Rx, vu VariablesUnsubscribe) error {
+			pkt.Unsubscribe = vu
+			return nil
+		},
+		OnOther: func(_ *Rx, packetIdentifier uint16) error {
+			pkt.PacketIdentifier = packetIdentifier
+			return nil
+		},
+		OnRxError: func(*Rx, error) {}, // Reader needs no closing.
+	}
+	rx.RxCallbacks.OnPuback = rx.RxCallbacks.OnOther
+	rx.RxCallbacks.OnPubrec = rx.RxCallbacks.OnOther
+	rx.RxCallbacks.OnPubrel = rx.RxCallbacks.OnOther
+	rx.RxCallbacks.OnPubcomp = rx.RxCallbacks.OnOther
+	rx.RxCallbacks.OnUnsuback = rx.RxCallbacks.OnOther
+	offset := 0
+	for offset < len(buf) {
+		hdr, _, err := DecodeHeader(bytes.NewReader(buf[offset:]))
+		if err != nil {
+			return packets, &DecodeError{Offset: offset, Err: err}
+		}
+		r := bytes.NewReader(buf[offset:])
+		rx.SetRxTransport(io.NopCloser(r))
+		// New buffer each packet so decoded strings are not overwritten.
+		rx.userDecoder = DecoderNoAlloc{UserBuffer: make([]byte, hdr.RemainingLength+2)}
+		pkt = Packet{}
+		_, err = rx.ReadNextPacket()
+		consumed := len(buf) - offset - r.Len()
+		if err == nil && consumed != hdr.Size()+int(hdr.RemainingLength) {
+			err = ErrBadRemainingLen
+		}
+		if err != nil {
+			return packets, &DecodeError{Offset: offset, Err: err}
+		}
+		pkt.Header = rx.LastReceivedHeader
+		packets = append(packets, pkt)
+		offset += consumed
+	}
+	return packets, nil
+}
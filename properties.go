@@ -0,0 +1,323 @@
+package mqtt
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// PropertyID identifies an MQTT 5.0 property. Properties are only present
+// in packets with protocol level [ProtocolLevel5].
+type PropertyID byte
+
+// MQTT 5.0 properties that may be present in a CONNECT packet.
+const (
+	PropSessionExpiryInterval PropertyID = 0x11 // Four byte integer.
+	PropAuthenticationMethod  PropertyID = 0x15 // UTF-8 string.
+	PropAuthenticationData    PropertyID = 0x16 // Binary data.
+	PropRequestProblemInfo    PropertyID = 0x17 // Byte.
+	PropRequestResponseInfo   PropertyID = 0x19 // Byte.
+	PropReceiveMaximum        PropertyID = 0x21 // Two byte integer.
+	PropTopicAliasMaximum     PropertyID = 0x22 // Two byte integer.
+	PropUserProperty          PropertyID = 0x26 // UTF-8 string pair.
+	PropMaximumPacketSize     PropertyID = 0x27 // Four byte integer.
+)
+
+// MQTT 5.0 properties that may be present in a PUBLISH packet. Of these only the
+// Topic Alias is encoded and decoded, see [VariablesPublish].TopicAlias. The rest
+// are skipped over when decoding.
+const (
+	PropPayloadFormatIndicator PropertyID = 0x01 // Byte.
+	PropMessageExpiryInterval  PropertyID = 0x02 // Four byte integer.
+	PropContentType            PropertyID = 0x03 // UTF-8 string.
+	PropResponseTopic          PropertyID = 0x08 // UTF-8 string.
+	PropCorrelationData        PropertyID = 0x09 // Binary data.
+	PropSubscriptionIdentifier PropertyID = 0x0b // Variable byte integer.
+	PropTopicAlias             PropertyID = 0x23 // Two byte integer.
+)
+
+// Property is an MQTT 5.0 property key/value pair. Which value field is
+// used depends on the type of the property as given by its ID.
+type Property struct {
+	ID PropertyID
+	// Value is the value of byte, two byte and four byte integer properties.
+	Value uint32
+	// Data is the value of UTF-8 string and binary data properties. For
+	// user properties Data is the name of the property.
+	Data []byte
+	// UserValue is the value of a user property.
+	UserValue []byte
+}
+
+// propertyType is the wire encoding of a property value.
+type propertyType uint8
+
+const (
+	propInvalid propertyType = iota
+	propByte
+	propUint16
+	propUint32
+	propBinary // UTF-8 strings and binary data share the same encoding.
+	propPair
+	propVarint
+)
+
+// connectPropertyType returns the type of a property valid in a CONNECT packet
+// or propInvalid if the property may not be present in a CONNECT packet.
+func connectPropertyType(id PropertyID) propertyType {
+	switch id {
+	case PropRequestProblemInfo, PropRequestResponseInfo:
+		return propByte
+	case PropReceiveMaximum, PropTopicAliasMaximum:
+		return propUint16
+	case PropSessionExpiryInterval, PropMaximumPacketSize:
+		return propUint32
+	case PropAuthenticationMethod, PropAuthenticationData:
+		return propBinary
+	case PropUserProperty:
+		return propPair
+	}
+	return propInvalid
+}
+
+// publishPropertyType returns the type of a property valid in a PUBLISH packet
+// or propInvalid if the property may not be present in a PUBLISH packet.
+func publishPropertyType(id PropertyID) propertyType {
+	switch id {
+	case PropPayloadFormatIndicator:
+		return propByte
+	case PropTopicAlias:
+		return propUint16
+	case PropMessageExpiryInterval:
+		return propUint32
+	case PropContentType, PropResponseTopic, PropCorrelationData:
+		return propBinary
+	case PropUserProperty:
+		return propPair
+	case PropSubscriptionIdentifier:
+		return propVarint
+	}
+	return propInvalid
+}
+
+// propertiesSize returns the size-on-wire of props excluding the property length prefix.
+func propertiesSize(props []Property) (sz int) {
+	for _, p := range props {
+		sz++ // Identifier.
+		switch connectPropertyType(p.ID) {
+		case propByte:
+			sz++
+		case propUint16:
+			sz += 2
+		case propUint32:
+			sz += 4
+		case propBinary:
+			sz += len(p.Data) + 2
+		case propPair:
+			sz += len(p.Data) + len(p.UserValue) + 4
+		}
+	}
+	return sz
+}
+
+// propertyBlockSize returns the size-on-wire of props including the property length prefix.
+func propertyBlockSize(props []Property) int {
+	sz := propertiesSize(props)
+	return RemainingLengthEncodedWidth(uint32(sz)) + sz
+}
+
+func errUnknownProperty(packetType PacketType, id PropertyID) error {
+	return errors.New("unknown " + packetType.String() + " property identifier 0x" + strconv.FormatUint(uint64(id), 16))
+}
+
+// encodeConnectProperties encodes the property length followed by props.
+func encodeConnectProperties(w io.Writer, props []Property) (n int, err error) {
+	sz := propertiesSize(props)
+	if sz > maxRemainingLengthValue {
+		return 0, errors.New("properties too large")
+	}
+	var vbuf [maxRemainingLengthSize]byte
+	n, err = writeSmall(w, vbuf[:encodeRemainingLength(uint32(sz), vbuf[:])])
+	if err != nil {
+		return n, err
+	}
+	for _, p := range props {
+		tp := connectPropertyType(p.ID)
+		if tp == propInvalid {
+			return n, errUnknownProperty(PacketConnect, p.ID)
+		}
+		ngot, err := encodeByte(w, byte(p.ID))
+		n += ngot
+		if err != nil {
+			return n, err
+		}
+		switch tp {
+		case propByte:
+			ngot, err = encodeByte(w, byte(p.Value))
+		case propUint16:
+			ngot, err = encodeUint16(w, uint16(p.Value))
+		case propUint32:
+			ngot, err = encodeUint16(w, uint16(p.Value>>16))
+			if err == nil {
+				n += ngot
+				ngot, err = encodeUint16(w, uint16(p.Value))
+			}
+		case propBinary:
+			ngot, err = encodeMQTTBytes(w, p.Data)
+		case propPair:
+			ngot, err = encodeMQTTBytes(w, p.Data)
+			if err == nil {
+				n += ngot
+				ngot, err = encodeMQTTBytes(w, p.UserValue)
+			}
+		}
+		n += ngot
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// decodeConnectProperties decodes the property length and the CONNECT properties
+// that follow. String and binary values are decoded with vd.
+func (vd *varDecoder) decodeConnectProperties(r io.Reader) (props []Property, n int, err error) {
+	propLen, n, err := decodeRemainingLength(r)
+	if err != nil {
+		return nil, n, err
+	}
+	end := n + int(propLen)
+	for n < end {
+		var ngot int
+		var id byte
+		id, err = decodeByte(r)
+		if err != nil {
+			return nil, n, err
+		}
+		n++
+		p := Property{ID: PropertyID(id)}
+		switch connectPropertyType(p.ID) {
+		case propByte:
+			id, err = decodeByte(r)
+			p.Value = uint32(id)
+			ngot = 1
+		case propUint16:
+			var v uint16
+			v, ngot, err = decodeUint16(r)
+			p.Value = uint32(v)
+		case propUint32:
+			var hi, lo uint16
+			hi, ngot, err = decodeUint16(r)
+			if err == nil {
+				n += ngot
+				lo, ngot, err = decodeUint16(r)
+			}
+			p.Value = uint32(hi)<<16 | uint32(lo)
+		case propBinary:
+			p.Data, ngot, err = vd.decodeBytes(r, 0, nil)
+		case propPair:
+			p.Data, ngot, err = vd.decodeBytes(r, 0, nil)
+			if err == nil {
+				n += ngot
+				p.UserValue, ngot, err = vd.decodeBytes(r, 0, nil)
+			}
+		default:
+			return nil, n, errUnknownProperty(PacketConnect, p.ID)
+		}
+		n += ngot
+		if err != nil {
+			return nil, n, err
+		}
+		props = append(props, p)
+	}
+	if n != end {
+		return nil, n, errors.New("property length does not match properties")
+	}
+	return props, n, nil
+}
+
+// publishPropertiesSize returns the size-on-wire of the PUBLISH properties of varPub
+// including the property length prefix.
+func publishPropertiesSize(varPub VariablesPublish) int {
+	if varPub.TopicAlias != 0 {
+		return 1 + 3 // Length, identifier and two byte integer.
+	}
+	return 1
+}
+
+// encodePublishProperties encodes the property length followed by the PUBLISH properties of varPub.
+func encodePublishProperties(w io.Writer, varPub VariablesPublish) (n int, err error) {
+	if varPub.TopicAlias == 0 {
+		return encodeByte(w, 0)
+	}
+	var buf [4]byte
+	buf[0] = 3
+	buf[1] = byte(PropTopicAlias)
+	binary.BigEndian.PutUint16(buf[2:], varPub.TopicAlias)
+	return writeSmall(w, buf[:])
+}
+
+// decodePublishProperties decodes the property length and the PUBLISH properties that
+// follow. The Topic Alias, if present, is returned and the other properties are discarded.
+func decodePublishProperties(r io.Reader) (topicAlias uint16, n int, err error) {
+	propLen, n, err := decodeRemainingLength(r)
+	if err != nil {
+		return 0, n, err
+	}
+	end := n + int(propLen)
+	for n < end {
+		var id byte
+		id, err = decodeByte(r)
+		if err != nil {
+			return 0, n, err
+		}
+		n++
+		var (
+			ngot int
+			skip uint16
+		)
+		switch publishPropertyType(PropertyID(id)) {
+		case propByte:
+			skip = 1
+		case propUint16: // Topic Alias.
+			topicAlias, ngot, err = decodeUint16(r)
+		case propUint32:
+			skip = 4
+		case propVarint:
+			_, ngot, err = decodeRemainingLength(r)
+		case propBinary:
+			skip, ngot, err = decodeUint16(r)
+		case propPair:
+			// Name length and name are skipped here, value length read below.
+			skip, ngot, err = decodeUint16(r)
+			if err == nil {
+				var nskip int64
+				nskip, err = io.CopyN(io.Discard, r, int64(skip))
+				n += ngot + int(nskip)
+				ngot, skip = 0, 0
+			}
+			if err == nil {
+				skip, ngot, err = decodeUint16(r)
+			}
+		default:
+			return 0, n, errUnknownProperty(PacketPublish, PropertyID(id))
+		}
+		n += ngot
+		if err == nil && skip > 0 {
+			var nskip int64
+			nskip, err = io.CopyN(io.Discard, r, int64(skip))
+			n += int(nskip)
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, n, err
+		}
+	}
+	if n != end {
+		return 0, n, errors.New("property length does not match properties")
+	}
+	return topicAlias, n, nil
+}
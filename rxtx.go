@@ -2,9 +2,17 @@ package mqtt
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 )
 
 // Rx implements a bare minimum MQTT v3.1.1 protocol transport layer handler.
@@ -16,11 +24,20 @@ import (
 // If OnRxError is set the underlying transport is not automatically closed and
 // it becomes the callback's responsibility to close the transport.
 //
-//	Not safe for concurrent use.
+// Rx is not safe for concurrent use. One goroutine may read packets with an Rx while
+// other goroutines write packets with a [Tx] over the same transport, which is the
+// usual case of a client reading in one goroutine and publishing from another, provided:
+//   - The transport supports concurrent calls to Read, Write and Close, as [net.Conn] does.
+//     Rx and Tx may close the transport on error while the other is using it.
+//   - Rx and Tx do not share a [PacketStats] or [PacketRing] instance.
+//   - Rx's fields, such as LastReceivedHeader, are only accessed by the reading goroutine,
+//     i.e. from within RxCallbacks.
 type Rx struct {
 	// Transport over which packets are read and written to.
 	// Not exported since RxTx type might be composed of embedded Rx and Tx types in future. TBD.
-	rxTrp       io.ReadCloser
+	rxTrp io.ReadCloser
+	// body reads the packet after its fixed header from rxTrp, recording transport errors.
+	body        errRecorder
 	RxCallbacks RxCallbacks
 	// User defined decoder for allocating packets.
 	userDecoder Decoder
@@ -29,6 +46,87 @@ type Rx struct {
 	ScratchBuf []byte
 	// LastReceivedHeader contains the last correctly read header.
 	LastReceivedHeader Header
+	// RxStats, if set, accumulates statistics of successfully read packets.
+	RxStats *PacketStats
+	// RxRing, if set, retains the headers of the last packets received, including
+	// packets that failed to decode after the header was read.
+	RxRing *PacketRing
+	// RxTrace, if set, receives a human-readable line for every packet received, i.e:
+	//  < PUBLISH qos=1 id=42 topic=foo/bar len=128
+	RxTrace io.Writer
+	// OnPacketRead, if set, is called with the fixed header of every packet received once
+	// it is decoded, before the packet's contents are read and RxCallbacks are called.
+	// n is the size of the whole packet in bytes. Header's MarshalText method may be used
+	// for structured logging.
+	OnPacketRead func(hdr Header, n int)
+	// MaxUnsubscribeTopics, if non-zero, limits the amount of topics in an UNSUBSCRIBE
+	// packet received. Packets exceeding the limit are handled as malformed. With [DecoderNoAlloc]
+	// and [DecoderAlloc] the packet is rejected before the first topic past the limit is decoded.
+	MaxUnsubscribeTopics int
+	// MaxWillSize, if non-zero, limits the length of the will message of a CONNECT packet
+	// received. Packets exceeding the limit are handled as malformed. With [DecoderNoAlloc]
+	// and [DecoderAlloc] the packet is rejected after reading the will message length, before the message is buffered.
+	MaxWillSize int
+	// MaxPayloadSize, if non-zero, limits the size of PUBLISH payloads read into a buffer
+	// for the OnPubPayload and OnPubBytes callbacks. Packets exceeding the limit are handled
+	// as malformed before a buffer for the payload is obtained or allocated.
+	MaxPayloadSize int
+	// BufferPool, if set, provides the payload buffers passed to the OnPubPayload callback.
+	BufferPool BufferPool
+	// OnWarning, if set, is called when a legal but unusual combination of fields is decoded.
+	// Such combinations often indicate a mistake on the sender's side. Warnings are
+	// informational only and do not affect packet processing.
+	OnWarning func(msg string)
+	// TopicValidator, if set, is called with the topic name of every PUBLISH and
+	// every topic filter of a SUBSCRIBE received. A non-nil error rejects the packet
+	// and is handled as a decoding error.
+	TopicValidator func(topic []byte) error
+	// ResyncOnError, if set, keeps the transport open when a malformed packet is received.
+	// The error is still returned and the next packet read discards bytes until a
+	// plausible fixed header is found, that is a valid packet type and flags followed by
+	// a decodable remaining length. Resynchronization is best-effort: a discarded packet's
+	// payload may contain bytes that look like a fixed header. Transport errors are
+	// handled as usual and callback errors still close the transport.
+	ResyncOnError bool
+	// Strict, if set, enables validation of received packets beyond what is needed to
+	// decode them. SUBSCRIBE packets are rejected with [ErrBadSubscribeOptions] if a
+	// topic filter's options byte has reserved bits set. Rejected packets are handled as malformed.
+	Strict bool
+	// ProtocolLevel is the protocol level of the connection, set when a CONNECT is received.
+	// Over [ProtocolLevel5] connections PUBLISH packets are decoded with their MQTT 5.0 properties,
+	// which requires a [DecoderNoAlloc] or [DecoderAlloc] decoder, and topic aliases are resolved
+	// to their topic names before RxCallbacks are called.
+	ProtocolLevel byte
+	// AcceptedProtocolLevels lists the protocol levels accepted in a CONNECT packet received.
+	// A CONNECT with any other level is read completely and [ErrUnacceptableProtocolLevel] is
+	// returned without calling OnConnect nor OnRxError. The transport is left open so that the
+	// server may respond with a CONNACK with [ReturnCodeUnnaceptableProtocol] and then close
+	// the connection [MQTT-3.1.2-2]. If nil only [DefaultProtocolLevel] is accepted.
+	AcceptedProtocolLevels []byte
+	// TopicAliasMaximum is the Topic Alias Maximum advertised to the sending end of an MQTT 5.0
+	// connection. PUBLISH packets with a greater topic alias are handled as malformed with [ErrTopicAliasMaximum].
+	TopicAliasMaximum uint16
+	// topicAliases maps topic aliases received over the current transport to their topic names.
+	topicAliases map[uint16][]byte
+	// closed is set by CloseRx and cleared by SetRxTransport.
+	closed atomic.Bool
+	// headerDeadline is set during ReadNextPacketTimeout to clear the read deadline once a header is read.
+	headerDeadline readDeadliner
+	// reuseUnsub is set by SetReuseUnsubscribe.
+	reuseUnsub *VariablesUnsubscribe
+}
+
+// BufferPool provides reusable byte buffers, i.e. backed by a [sync.Pool].
+type BufferPool interface {
+	// Get returns a buffer. Its capacity is used, its length is ignored.
+	Get() []byte
+	// Put returns a buffer obtained with Get to the pool.
+	Put([]byte)
+}
+
+// readDeadliner is implemented by transports that support read deadlines such as [net.Conn].
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
 }
 
 // RxCallbacks groups all functionality executed on data receipt, both successful
@@ -41,28 +139,91 @@ type RxCallbacks struct {
 	OnConnack func(*Rx, VariablesConnack) error
 	// OnPub is called on PUBLISH packet receive. The [io.Reader] points to the transport's reader
 	// and is limited to read the amount of bytes in the payload as given by RemainingLength.
+	// If the transport ends before the whole payload is read the reader returns [io.ErrUnexpectedEOF].
 	// One may calculate amount of bytes in the reader like so:
 	//  payloadLen := rx.LastReceivedHeader.RemainingLength - varPub.Size()
 	OnPub func(rx *Rx, varPub VariablesPublish, r io.Reader) error
-	// OnOther takes in the Header of received packet and a packet identifier uint16 if present.
-	// OnOther receives PUBACK, PUBREC, PUBREL, PUBCOMP, UNSUBACK packets containing non-zero packet identfiers
-	// and DISCONNECT, PINGREQ, PINGRESP packets with no packet identifier.
-	OnOther  func(rx *Rx, packetIdentifier uint16) error
-	OnSub    func(*Rx, VariablesSubscribe) error
-	OnSuback func(*Rx, VariablesSuback) error
-	OnUnsub  func(*Rx, VariablesUnsubscribe) error
-	// OnRxError is called if an error is encountered during decoding of packet.
-	// If it is set then it becomes the responsibility of the callback to close the transport.
+	// OnPubPayload, if set, is called on PUBLISH packet receipt instead of OnPub with
+	// the whole payload read into a buffer. The buffer is obtained from Rx's BufferPool
+	// if set, in which case the callback takes ownership of the buffer and should return
+	// it to the pool with Put once done with it. If BufferPool is nil the buffer is allocated.
+	OnPubPayload func(rx *Rx, varPub VariablesPublish, payload []byte) error
+	// OnPubBytes, if set and OnPubPayload is not set, is called on PUBLISH packet receipt
+	// instead of OnPub with the whole payload read into the [DecoderNoAlloc] UserBuffer,
+	// following the topic name. No memory is allocated. The payload slice, like the topic name,
+	// is only valid until the next call to ReadNextPacket. A payload that does not fit in the
+	// UserBuffer is handled as a decoding error with [ErrUserBufferFull].
+	// If the decoder is not a DecoderNoAlloc the payload is allocated.
+	OnPubBytes func(rx *Rx, varPub VariablesPublish, payload []byte) error
+	// OnOther receives DISCONNECT, PINGREQ and PINGRESP packets, which have no packet
+	// identifier so packetIdentifier is always zero. The packet type may be obtained
+	// from the LastReceivedHeader field of rx.
+	OnOther func(rx *Rx, packetIdentifier uint16) error
+	// OnPuback, OnPubrec, OnPubrel, OnPubcomp and OnUnsuback are called on receipt of
+	// the corresponding packet with its packet identifier.
+	OnPuback   func(rx *Rx, packetIdentifier uint16) error
+	OnPubrec   func(rx *Rx, packetIdentifier uint16) error
+	OnPubrel   func(rx *Rx, packetIdentifier uint16) error
+	OnPubcomp  func(rx *Rx, packetIdentifier uint16) error
+	OnUnsuback func(rx *Rx, packetIdentifier uint16) error
+	OnSub      func(*Rx, VariablesSubscribe) error
+	OnSuback   func(*Rx, VariablesSuback) error
+	OnUnsub    func(*Rx, VariablesUnsubscribe) error
+	// OnUnhandled, if set, is called with the header of a correctly decoded packet for
+	// which no callback above is set. If not set such packets are silently discarded.
+	// A PUBLISH payload is discarded after OnUnhandled returns. An error returned
+	// is handled as other callback errors.
+	OnUnhandled func(rx *Rx, hdr Header) error
+	// OnRxError is called if an error is encountered during decoding of packet or
+	// reading from the transport. If it is set then it becomes the responsibility
+	// of the callback to close the transport. OnRxError is not called when one of
+	// the callbacks above returns an error, in which case the transport is closed by Rx.
 	OnRxError func(*Rx, error)
 }
 
 // SetRxTransport sets the rx's reader.
 func (rx *Rx) SetRxTransport(transport io.ReadCloser) {
 	rx.rxTrp = transport
+	rx.topicAliases = nil
+	rx.closed.Store(false)
+}
+
+// CloseRx closes the underlying transport and returns the error returned by its Close method.
+// Reads with rx then return [io.ErrClosedPipe] until a new transport is set with [Rx.SetRxTransport].
+// If rx shares its transport with a [Tx], as is the case for a client or server
+// connection, the Tx is also affected and its writes fail with io.ErrClosedPipe too.
+// A Rx and Tx with distinct transports, i.e. after a [Rx.ShallowCopy] and SetRxTransport,
+// are closed independently. CloseRx may be called concurrently with a read to unblock it,
+// provided the transport supports it as [net.Conn] does.
+func (rx *Rx) CloseRx() error {
+	if rx.rxTrp == nil {
+		return errors.New("nil transport")
+	}
+	rx.closed.Store(true)
+	return rx.rxTrp.Close()
+}
+
+// transportErr returns an error if rx has no transport or it was closed with CloseRx.
+func (rx *Rx) transportErr() error {
+	if rx.rxTrp == nil {
+		return errors.New("nil transport")
+	}
+	if rx.closed.Load() {
+		return io.ErrClosedPipe
+	}
+	return nil
+}
+
+// closedErr returns [io.ErrClosedPipe] if err is the result of using a closed transport,
+// so that reads and writes over a transport closed through a Rx or Tx sharing it fail
+// with the same error as after CloseRx or CloseTx, whatever the transport's errors are.
+func closedErr(err error) error {
+	if err != nil && (errors.Is(err, io.ErrClosedPipe) || errors.Is(err, net.ErrClosed) || errors.Is(err, os.ErrClosed)) {
+		return io.ErrClosedPipe
+	}
+	return err
 }
 
-// Close closes the underlying transport.
-func (rx *Rx) CloseRx() error { return rx.rxTrp.Close() }
 func (rx *Rx) rxErrHandler(err error) {
 	if rx.RxCallbacks.OnRxError != nil {
 		rx.RxCallbacks.OnRxError(rx, err)
@@ -71,42 +232,280 @@ func (rx *Rx) rxErrHandler(err error) {
 	}
 }
 
+// SetReuseUnsubscribe sets vu as the destination of UNSUBSCRIBE packets decoded with
+// [DecoderNoAlloc] so that no allocations are performed once the capacity of vu.Topics
+// is large enough for the topics received. The VariablesUnsubscribe passed to OnUnsub
+// aliases vu's Topics slice and the topics point to the decoder's UserBuffer, so both
+// are overwritten by the next UNSUBSCRIBE received. Callbacks must copy the topics to retain them.
+// A nil vu disables reuse. For allocation-free decoding the transport should also
+// implement [io.ByteReader], i.e. a [bufio.Reader] wrapping the connection.
+func (rx *Rx) SetReuseUnsubscribe(vu *VariablesUnsubscribe) {
+	rx.reuseUnsub = vu
+}
+
+// acceptsProtocolLevel reports whether level is listed in AcceptedProtocolLevels.
+func (rx *Rx) acceptsProtocolLevel(level byte) bool {
+	if rx.AcceptedProtocolLevels == nil {
+		return level == DefaultProtocolLevel
+	}
+	for _, accepted := range rx.AcceptedProtocolLevels {
+		if level == accepted {
+			return true
+		}
+	}
+	return false
+}
+
+// warnConnect calls OnWarning for unusual CONNECT field combinations.
+func (rx *Rx) warnConnect(vc *VariablesConnect) {
+	if !vc.CleanSession && len(vc.ClientID) == 0 {
+		rx.warn("CONNECT with clean session unset and empty client ID")
+	}
+	if len(vc.WillTopic) == 0 && (vc.WillRetain || vc.WillQoS != QoS0) {
+		rx.warn("CONNECT will retain or will QoS set with empty will topic")
+	}
+}
+
+// warn calls OnWarning if set.
+func (rx *Rx) warn(msg string) {
+	if rx.OnWarning != nil {
+		rx.OnWarning(msg)
+	}
+}
+
+// identifiedCallback returns the callback for a PUBACK, PUBREC, PUBREL, PUBCOMP
+// or UNSUBACK packet. It is nil if the dedicated callback is not set.
+func (rx *Rx) identifiedCallback(packetType PacketType) func(*Rx, uint16) error {
+	var cb func(*Rx, uint16) error
+	switch packetType {
+	case PacketPuback:
+		cb = rx.RxCallbacks.OnPuback
+	case PacketPubrec:
+		cb = rx.RxCallbacks.OnPubrec
+	case PacketPubrel:
+		cb = rx.RxCallbacks.OnPubrel
+	case PacketPubcomp:
+		cb = rx.RxCallbacks.OnPubcomp
+	case PacketUnsuback:
+		cb = rx.RxCallbacks.OnUnsuback
+	}
+	return cb
+}
+
+// validateTopic calls the user's TopicValidator if set.
+func (rx *Rx) validateTopic(topic []byte) error {
+	if !utf8.Valid(topic) {
+		return errTopicNotUTF8
+	}
+	if rx.TopicValidator == nil {
+		return nil
+	}
+	return rx.TopicValidator(topic)
+}
+
+// ReadNextPacketTimeout reads the next packet in the transport like [Rx.ReadNextPacket]
+// but returns [ErrIdle] if no packet starts arriving within d. After ErrIdle is returned
+// the transport is left untouched and may be read from again. The transport must
+// implement SetReadDeadline(time.Time) error, as [net.Conn] does.
+// The timeout applies only to the fixed header of the packet, once it is read the
+// rest of the packet is read with no deadline.
+func (rx *Rx) ReadNextPacketTimeout(d time.Duration) (int, error) {
+	if err := rx.transportErr(); err != nil {
+		return 0, err
+	}
+	deadliner, ok := rx.rxTrp.(readDeadliner)
+	if !ok {
+		return 0, errors.New("transport does not support read deadlines")
+	}
+	err := deadliner.SetReadDeadline(time.Now().Add(d))
+	if err != nil {
+		return 0, err
+	}
+	rx.headerDeadline = deadliner
+	n, err := rx.ReadNextPacket()
+	rx.headerDeadline = nil
+	if n == 0 && err != nil {
+		// Header was not read so deadline was not cleared by ReadNextPacket.
+		deadliner.SetReadDeadline(time.Time{})
+		if isTimeout(err) {
+			return 0, ErrIdle
+		}
+	}
+	return n, err
+}
+
+func isTimeout(err error) bool {
+	var timeout interface{ Timeout() bool }
+	return errors.Is(err, os.ErrDeadlineExceeded) || (errors.As(err, &timeout) && timeout.Timeout())
+}
+
+// ReadNextPacketContext reads the next packet in the transport like [Rx.ReadNextPacket]
+// and returns ctx.Err() if ctx ends before the packet is read. If the transport does
+// not implement SetReadDeadline(time.Time) error, as [net.Conn] does, ctx is only
+// checked before reading. If ctx ends before any byte of the packet is read the
+// transport is left untouched and may be read from again, otherwise it is closed
+// as is done for any other error after reading part of a packet.
+func (rx *Rx) ReadNextPacketContext(ctx context.Context) (int, error) {
+	if err := rx.transportErr(); err != nil {
+		return 0, err
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	deadliner, ok := rx.rxTrp.(readDeadliner)
+	if !ok || ctx.Done() == nil {
+		return rx.ReadNextPacket()
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := deadliner.SetReadDeadline(deadline); err != nil {
+			return 0, err
+		}
+	}
+	stop := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			deadliner.SetReadDeadline(time.Unix(1, 0)) // Unblock pending read.
+		case <-stop:
+		}
+	}()
+	n, err := rx.ReadNextPacket()
+	close(stop)
+	<-exited
+	deadliner.SetReadDeadline(time.Time{})
+	if err != nil && isTimeout(err) {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return n, ctxErr
+		}
+		if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+			return n, context.DeadlineExceeded
+		}
+	}
+	return n, err
+}
+
+// ReadUpTo reads and dispatches at most n packets with [Rx.ReadNextPacket] and returns
+// the amount of packets read. It is meant for cooperative schedulers where reading
+// packets until the transport runs dry would starve other tasks. ReadUpTo stops at the
+// first error, which is returned along with the amount of packets read before it.
+func (rx *Rx) ReadUpTo(n int) (packets int, err error) {
+	for packets < n {
+		_, err = rx.ReadNextPacket()
+		if err != nil {
+			return packets, err
+		}
+		packets++
+	}
+	return packets, nil
+}
+
 // ReadNextPacket reads the next packet in the transport. If it fails after reading a
 // non-zero amount of bytes it closes the transport and the underlying transport must be reset.
+// Decoding errors may be matched with [errors.Is] against [ErrForbiddenPacketType],
+// [ErrBadRemainingLen] and [ErrBadUTF8]. If the transport ends mid-packet [io.ErrUnexpectedEOF] is returned.
 func (rx *Rx) ReadNextPacket() (int, error) {
-	if rx.rxTrp == nil {
-		return 0, errors.New("nil transport")
+	if err := rx.transportErr(); err != nil {
+		return 0, err
 	}
 	rx.LastReceivedHeader = Header{}
-	hdr, n, err := DecodeHeader(rx.rxTrp)
+	var (
+		hdr Header
+		n   int
+		err error
+	)
+	if rx.ResyncOnError {
+		hdr, n, err = rx.decodeHeaderResync()
+	} else {
+		hdr, n, err = DecodeHeader(rx.rxTrp)
+	}
+	err = closedErr(err)
+	if rx.headerDeadline != nil && (err == nil || n > 0) {
+		// Deadline only applies to start of packet. Now we read the rest.
+		if derr := rx.headerDeadline.SetReadDeadline(time.Time{}); derr != nil && err == nil {
+			err = derr
+		}
+	}
 	if err != nil {
 		if n > 0 {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
 			rx.rxErrHandler(err)
 		}
 		return n, err
 	}
 	rx.LastReceivedHeader = hdr
+	rx.body = errRecorder{r: rx.rxTrp}
+	if rx.RxRing != nil {
+		rx.RxRing.Record(hdr)
+	}
+	if rx.OnPacketRead != nil {
+		rx.OnPacketRead(hdr, hdr.Size()+int(hdr.RemainingLength))
+	}
 	var (
 		packetType       = hdr.Type()
 		ngot             int
 		packetIdentifier uint16
+		// callbackFailed is set when the error is returned by a user callback.
+		callbackFailed bool
+		// rejected is set when a well formed packet is rejected and the transport is kept open.
+		rejected bool
 	)
 	switch packetType {
 	case PacketPublish:
 		packetFlags := hdr.Flags()
 		qos := packetFlags.QoS()
 		var vp VariablesPublish
-		vp, ngot, err = rx.userDecoder.DecodePublish(rx.rxTrp, qos)
+		if rx.ProtocolLevel == ProtocolLevel5 {
+			vp, ngot, err = rx.decodePublishV5(qos)
+		} else {
+			vp, ngot, err = rx.userDecoder.DecodePublish(&rx.body, qos)
+		}
 		n += ngot
 		if err != nil {
 			break
 		}
+		// Topic name decoded into the UserBuffer, which may differ from the one resolved from an alias.
+		userBufUsed := len(vp.TopicName)
+		if err = rx.resolveTopicAlias(&vp); err != nil {
+			break
+		}
+		if err = rx.validateTopic(vp.TopicName); err != nil {
+			break
+		}
 		payloadLen := int(hdr.RemainingLength) - ngot
-		lr := io.LimitedReader{R: rx.rxTrp, N: int64(payloadLen)}
-		if rx.RxCallbacks.OnPub != nil {
+		if payloadLen < 0 {
+			err = ErrBadRemainingLen
+			break
+		}
+		tracePublish(rx.RxTrace, traceRx, packetFlags, vp, payloadLen)
+		lr := payloadReader{LimitedReader: io.LimitedReader{R: &rx.body, N: int64(payloadLen)}}
+		if rx.RxCallbacks.OnPubPayload != nil {
+			var payload []byte
+			payload, err = rx.readPayload(&lr, payloadLen)
+			if err == nil {
+				err = rx.RxCallbacks.OnPubPayload(rx, vp, payload)
+				callbackFailed = err != nil
+			}
+		} else if rx.RxCallbacks.OnPubBytes != nil {
+			var payload []byte
+			payload, err = rx.readPayloadUserBuffer(&lr, userBufUsed, payloadLen)
+			if err == nil {
+				err = rx.RxCallbacks.OnPubBytes(rx, vp, payload)
+				callbackFailed = err != nil
+			}
+		} else if rx.RxCallbacks.OnPub != nil {
 			err = rx.RxCallbacks.OnPub(rx, vp, &lr)
+			// Errors reading the payload from the transport are not callback errors.
+			callbackFailed = err != nil && lr.transportErr == nil
 		} else {
-			err = rx.exhaustReader(&lr)
+			err = rx.onUnhandled(hdr)
+			callbackFailed = err != nil
+			if err == nil {
+				err = rx.exhaustReader(&lr)
+			}
 		}
 
 		if lr.N != 0 && err == nil {
@@ -120,13 +519,18 @@ func (rx *Rx) ReadNextPacket() (int, error) {
 			break
 		}
 		var vc VariablesConnack
-		vc, ngot, err = decodeConnack(rx.rxTrp)
+		vc, ngot, err = decodeConnack(&rx.body)
 		n += ngot
 		if err != nil {
 			break
 		}
+		traceConnack(rx.RxTrace, traceRx, vc)
 		if rx.RxCallbacks.OnConnack != nil {
 			err = rx.RxCallbacks.OnConnack(rx, vc)
+			callbackFailed = err != nil
+		} else {
+			err = rx.onUnhandled(hdr)
+			callbackFailed = err != nil
 		}
 
 	case PacketConnect:
@@ -135,13 +539,32 @@ func (rx *Rx) ReadNextPacket() (int, error) {
 		// 	break
 		// }
 		var vc VariablesConnect
-		vc, ngot, err = rx.userDecoder.DecodeConnect(rx.rxTrp)
+		if d, ok := rx.userDecoder.(connectDecoder); ok {
+			vc, ngot, err = d.decodeConnect(&rx.body, rx.MaxWillSize)
+		} else {
+			vc, ngot, err = rx.userDecoder.DecodeConnect(&rx.body)
+			if err == nil && rx.MaxWillSize > 0 && len(vc.WillMessage) > rx.MaxWillSize {
+				err = errWillTooLarge
+			}
+		}
 		n += ngot
 		if err != nil {
 			break
 		}
+		traceConnect(rx.RxTrace, traceRx, &vc)
+		if !rx.acceptsProtocolLevel(vc.ProtocolLevel) {
+			err = ErrUnacceptableProtocolLevel{Level: vc.ProtocolLevel}
+			rejected = true
+			break
+		}
+		rx.warnConnect(&vc)
+		rx.ProtocolLevel = vc.ProtocolLevel
 		if rx.RxCallbacks.OnConnect != nil {
 			err = rx.RxCallbacks.OnConnect(rx, &vc)
+			callbackFailed = err != nil
+		} else {
+			err = rx.onUnhandled(hdr)
+			callbackFailed = err != nil
 		}
 
 	case PacketSuback:
@@ -150,35 +573,82 @@ func (rx *Rx) ReadNextPacket() (int, error) {
 			break
 		}
 		var vsbck VariablesSuback
-		vsbck, ngot, err = decodeSuback(rx.rxTrp, hdr.RemainingLength)
+		vsbck, ngot, err = decodeSuback(&rx.body, hdr.RemainingLength)
 		n += ngot
 		if err != nil {
 			break
 		}
+		traceSuback(rx.RxTrace, traceRx, vsbck)
 		if rx.RxCallbacks.OnSuback != nil {
 			err = rx.RxCallbacks.OnSuback(rx, vsbck)
+			callbackFailed = err != nil
+		} else {
+			err = rx.onUnhandled(hdr)
+			callbackFailed = err != nil
 		}
 
 	case PacketSubscribe:
 		var vsbck VariablesSubscribe
-		vsbck, ngot, err = rx.userDecoder.DecodeSubscribe(rx.rxTrp, hdr.RemainingLength)
+		vsbck, ngot, err = rx.userDecoder.DecodeSubscribe(&rx.body, hdr.RemainingLength)
 		n += ngot
 		if err != nil {
 			break
 		}
+		for _, hotTopic := range vsbck.TopicFilters {
+			if err = rx.validateTopic(hotTopic.TopicFilter); err != nil {
+				break
+			}
+			if rx.Strict && hotTopic.QoS > QoS2 {
+				// Reserved bits 2-7 must be zero [MQTT-3.8.3-4], the QoS is decoded alongside them.
+				err = ErrBadSubscribeOptions{Topic: string(hotTopic.TopicFilter), Options: byte(hotTopic.QoS)}
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+		traceSubscribe(rx.RxTrace, traceRx, vsbck)
 		if rx.RxCallbacks.OnSub != nil {
 			err = rx.RxCallbacks.OnSub(rx, vsbck)
+			callbackFailed = err != nil
+		} else {
+			err = rx.onUnhandled(hdr)
+			callbackFailed = err != nil
 		}
 
 	case PacketUnsubscribe:
 		var vunsub VariablesUnsubscribe
-		vunsub, ngot, err = rx.userDecoder.DecodeUnsubscribe(rx.rxTrp, hdr.RemainingLength)
+		if d, ok := rx.userDecoder.(DecoderNoAlloc); ok && rx.reuseUnsub != nil {
+			ngot, err = d.decodeUnsubscribeInto(&rx.body, hdr.RemainingLength, rx.MaxUnsubscribeTopics, rx.reuseUnsub)
+			vunsub = *rx.reuseUnsub
+		} else if d, ok := rx.userDecoder.(unsubscribeDecoder); ok {
+			vunsub, ngot, err = d.decodeUnsubscribe(&rx.body, hdr.RemainingLength, rx.MaxUnsubscribeTopics)
+		} else {
+			vunsub, ngot, err = rx.userDecoder.DecodeUnsubscribe(&rx.body, hdr.RemainingLength)
+			if err == nil && rx.MaxUnsubscribeTopics > 0 && len(vunsub.Topics) > rx.MaxUnsubscribeTopics {
+				err = errManyTopics
+			}
+		}
 		n += ngot
 		if err != nil {
 			break
 		}
+		for _, coldTopic := range vunsub.Topics {
+			if !utf8.Valid(coldTopic) {
+				err = errTopicNotUTF8
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+		traceUnsubscribe(rx.RxTrace, traceRx, vunsub)
 		if rx.RxCallbacks.OnUnsub != nil {
 			err = rx.RxCallbacks.OnUnsub(rx, vunsub)
+			callbackFailed = err != nil
+		} else {
+			err = rx.onUnhandled(hdr)
+			callbackFailed = err != nil
 		}
 
 	case PacketPuback, PacketPubrec, PacketPubrel, PacketPubcomp, PacketUnsuback:
@@ -187,13 +657,18 @@ func (rx *Rx) ReadNextPacket() (int, error) {
 			break
 		}
 		// Only PI, no payload.
-		packetIdentifier, ngot, err = decodeUint16(rx.rxTrp)
+		packetIdentifier, ngot, err = decodeUint16(&rx.body)
 		n += ngot
 		if err != nil {
 			break
 		}
-		if rx.RxCallbacks.OnOther != nil {
-			err = rx.RxCallbacks.OnOther(rx, packetIdentifier)
+		traceOther(rx.RxTrace, traceRx, packetType, packetIdentifier)
+		if onIdentified := rx.identifiedCallback(packetType); onIdentified != nil {
+			err = onIdentified(rx, packetIdentifier)
+			callbackFailed = err != nil
+		} else {
+			err = rx.onUnhandled(hdr)
+			callbackFailed = err != nil
 		}
 
 	case PacketDisconnect, PacketPingreq, PacketPingresp:
@@ -202,8 +677,13 @@ func (rx *Rx) ReadNextPacket() (int, error) {
 			break
 		}
 		// No payload or variable header.
+		traceOther(rx.RxTrace, traceRx, packetType, packetIdentifier)
 		if rx.RxCallbacks.OnOther != nil {
 			err = rx.RxCallbacks.OnOther(rx, packetIdentifier)
+			callbackFailed = err != nil
+		} else {
+			err = rx.onUnhandled(hdr)
+			callbackFailed = err != nil
 		}
 
 	default:
@@ -212,8 +692,143 @@ func (rx *Rx) ReadNextPacket() (int, error) {
 		panic("unreachable")
 	}
 
-	if err != nil {
+	if !callbackFailed && err == io.EOF {
+		// Transport ended after the fixed header was read.
+		err = io.ErrUnexpectedEOF
+	}
+	if callbackFailed {
+		// Callback already knows of its own error, OnRxError is reserved for decoding and transport errors.
+		rx.CloseRx()
+	} else if rejected {
+		// Caller responds to the rejection before closing the transport.
+	} else if err != nil && (!rx.ResyncOnError || rx.body.err != nil) {
+		// Only decoding errors are recovered from by resynchronizing.
 		rx.rxErrHandler(err)
+	} else if err == nil && rx.RxStats != nil {
+		rx.RxStats.Record(hdr)
+	}
+	return n, err
+}
+
+// onUnhandled calls the OnUnhandled callback, if set, for a packet received with no callback set.
+func (rx *Rx) onUnhandled(hdr Header) error {
+	if rx.RxCallbacks.OnUnhandled == nil {
+		return nil
+	}
+	return rx.RxCallbacks.OnUnhandled(rx, hdr)
+}
+
+// decodeHeaderResync decodes a fixed header from the transport. If the bytes read
+// do not form a valid fixed header the first byte is discarded and decoding is retried
+// starting at the next byte until a header is decoded or the transport fails.
+// The amount of bytes returned includes discarded bytes.
+func (rx *Rx) decodeHeaderResync() (Header, int, error) {
+	rr := resyncReader{r: rx.rxTrp}
+	discarded := 0
+	for {
+		rr.off = 0
+		hdr, _, err := DecodeHeader(&rr)
+		n := discarded + rr.n
+		if err == nil || rr.err != nil {
+			if err == nil && discarded > 0 {
+				rx.warn("discarded " + strconv.Itoa(discarded) + " bytes to resynchronize")
+			}
+			return hdr, n, err
+		}
+		// Malformed header. Look for a header starting at the next byte.
+		// Bytes of a header that failed to decode besides the first are
+		// all remaining length continuation bytes so a successful decode
+		// starting at any of them consumes all bytes in the window.
+		copy(rr.window[:], rr.window[1:rr.n])
+		rr.n--
+		discarded++
+	}
+}
+
+// resyncReader reads from r one byte at a time retaining the bytes read in window
+// so that they may be read again.
+type resyncReader struct {
+	r      io.Reader
+	window [1 + maxRemainingLengthSize]byte
+	// n is the amount of bytes in window, off the amount read by the current decode attempt.
+	n, off int
+	// err is the error returned by r, if any.
+	err error
+}
+
+func (rr *resyncReader) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if rr.off < rr.n {
+		b[0] = rr.window[rr.off]
+		rr.off++
+		return 1, nil
+	}
+	if rr.n == len(rr.window) {
+		// Unreachable: DecodeHeader reads at most a full window.
+		return 0, errors.New("resync window full")
+	}
+	n, err := rr.r.Read(b[:1])
+	if n > 0 {
+		rr.window[rr.n] = b[0]
+		rr.n++
+		rr.off++
+	}
+	if err != nil {
+		rr.err = err
+	}
+	return n, err
+}
+
+// errRecorder reads from r recording the first error returned so that transport
+// errors can be told apart from decoding errors. Since r is only read within a packet
+// io.EOF is also recorded, the packet is truncated.
+type errRecorder struct {
+	r   io.Reader
+	err error
+	// buf is used by ReadByte when r does not implement io.ByteReader.
+	buf [1]byte
+}
+
+// ReadByte implements [io.ByteReader] so that decoded integers do not escape to the heap.
+func (er *errRecorder) ReadByte() (b byte, err error) {
+	if br, ok := er.r.(io.ByteReader); ok {
+		b, err = br.ReadByte()
+	} else {
+		_, err = readFull(er.r, er.buf[:])
+		b = er.buf[0]
+	}
+	if err != nil && er.err == nil {
+		er.err = err
+	}
+	return b, err
+}
+
+func (er *errRecorder) Read(b []byte) (int, error) {
+	n, err := er.r.Read(b)
+	if err != nil && er.err == nil {
+		er.err = err
+	}
+	return n, err
+}
+
+// payloadReader reads a PUBLISH payload from the transport. It never reads past
+// the end of the payload and returns [io.ErrUnexpectedEOF] if the transport
+// ends before the whole payload is read.
+type payloadReader struct {
+	io.LimitedReader
+	// transportErr is the first error encountered reading the payload from the transport.
+	transportErr error
+}
+
+func (pr *payloadReader) Read(b []byte) (int, error) {
+	n, err := pr.LimitedReader.Read(b)
+	if err == io.EOF && pr.N > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil && err != io.EOF && pr.transportErr == nil {
+		pr.transportErr = err
 	}
 	return n, err
 }
@@ -223,11 +838,98 @@ func (rx *Rx) RxTransport() io.ReadCloser {
 	return rx.rxTrp
 }
 
+// decodePublishV5 decodes the variable header of an MQTT 5.0 PUBLISH packet.
+func (rx *Rx) decodePublishV5(qos QoSLevel) (VariablesPublish, int, error) {
+	d, ok := rx.userDecoder.(publishV5Decoder)
+	if !ok {
+		return VariablesPublish{}, 0, errors.New("decoder does not support MQTT 5.0 PUBLISH")
+	}
+	return d.decodePublishV5(&rx.body, qos)
+}
+
+// resolveTopicAlias maps vp's topic alias to its topic name if vp has a topic name,
+// otherwise it sets vp's topic name to that mapped to the alias.
+func (rx *Rx) resolveTopicAlias(vp *VariablesPublish) error {
+	alias := vp.TopicAlias
+	switch {
+	case alias == 0:
+		if len(vp.TopicName) == 0 {
+			return errEmptyTopic
+		}
+		return nil
+	case alias > rx.TopicAliasMaximum:
+		return ErrTopicAliasMaximum
+	case len(vp.TopicName) != 0:
+		if rx.topicAliases == nil {
+			rx.topicAliases = make(map[uint16][]byte)
+		}
+		// Topic name is copied since it may reference the decoder's buffer.
+		rx.topicAliases[alias] = append(rx.topicAliases[alias][:0], vp.TopicName...)
+		return nil
+	}
+	topic, ok := rx.topicAliases[alias]
+	if !ok {
+		return errors.New("topic alias " + strconv.Itoa(int(alias)) + " not mapped to a topic name")
+	}
+	vp.TopicName = topic
+	return nil
+}
+
 // ShallowCopy shallow copies rx and underlying transport and decoder. Does not copy callbacks over.
 func (rx *Rx) ShallowCopy() *Rx {
 	return &Rx{rxTrp: rx.rxTrp, userDecoder: rx.userDecoder}
 }
 
+// readPayload reads a payload of payloadLen bytes from r into a buffer obtained
+// from BufferPool if set. Buffers too small for the payload are returned to the pool
+// and a new buffer is allocated. On error the buffer is returned to the pool.
+func (rx *Rx) readPayload(r io.Reader, payloadLen int) ([]byte, error) {
+	if rx.MaxPayloadSize > 0 && payloadLen > rx.MaxPayloadSize {
+		return nil, errPayloadLarge
+	}
+	var buf []byte
+	if rx.BufferPool != nil {
+		buf = rx.BufferPool.Get()
+	}
+	if cap(buf) < payloadLen {
+		if buf != nil {
+			rx.BufferPool.Put(buf)
+		}
+		buf = make([]byte, payloadLen)
+	}
+	buf = buf[:payloadLen]
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		if rx.BufferPool != nil {
+			rx.BufferPool.Put(buf)
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
+// readPayloadUserBuffer reads a payload of payloadLen bytes from r into the
+// DecoderNoAlloc UserBuffer after the first offset bytes, which hold the topic name.
+func (rx *Rx) readPayloadUserBuffer(r io.Reader, offset, payloadLen int) ([]byte, error) {
+	if rx.MaxPayloadSize > 0 && payloadLen > rx.MaxPayloadSize {
+		return nil, errPayloadLarge
+	}
+	var buf []byte
+	if d, ok := rx.userDecoder.(DecoderNoAlloc); ok {
+		if len(d.UserBuffer)-offset < payloadLen {
+			return nil, ErrUserBufferFull
+		}
+		buf = d.UserBuffer[offset : offset+payloadLen]
+	} else {
+		buf = make([]byte, payloadLen)
+	}
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
 func (rx *Rx) exhaustReader(r io.Reader) (err error) {
 	if len(rx.ScratchBuf) == 0 {
 		rx.ScratchBuf = make([]byte, 1024) // Lazy initialization when needed.
@@ -244,14 +946,54 @@ func (rx *Rx) exhaustReader(r io.Reader) (err error) {
 // Tx implements a bare minimum MQTT v3.1.1 protocol transport layer handler for transmitting packets.
 // If there is an error during read/write of a packet the transport is closed
 // and a new transport must be set with [Tx.SetTxTransport].
-// A Tx will not validate data before encoding, that is up to the caller, Malformed packets
-// will be rejected and the connection will be closed immediately. If OnTxError is
+// Aside from topic names and topic filters a Tx will not validate data before encoding,
+// that is up to the caller, Malformed packets will be rejected and the connection
+// will be closed immediately. If OnTxError is
 // set then the underlying transport is not closed and it becomes responsibility
 // of the callback to close the transport.
+//
+// Tx's write methods are safe for concurrent use: each packet is written whole
+// before another write begins, so a PINGREQ can't be spliced into a PUBLISH.
+// TxCallbacks are called with Tx locked and must not call Tx's write methods.
 type Tx struct {
+	// mu serializes writes to the transport.
+	mu          sync.Mutex
 	txTrp       io.WriteCloser
 	TxCallbacks TxCallbacks
-	buffer      bytes.Buffer
+	// TxStats, if set, accumulates statistics of successfully written packets.
+	TxStats *PacketStats
+	// TxRing, if set, retains the headers of the last packets written.
+	TxRing *PacketRing
+	// TxTrace, if set, receives a human-readable line for every packet written, i.e:
+	//  > PUBLISH qos=1 id=42 topic=foo/bar len=128
+	TxTrace io.Writer
+	// OnPacketWrite, if set, is called with the fixed header of every packet fully written
+	// to the transport and the size of the whole packet in bytes. Unlike TxCallbacks it is
+	// called after Tx is unlocked so it may call Tx's write methods.
+	OnPacketWrite func(hdr Header, n int)
+	// SkipTopicValidation disables validation of topic names and topic filters
+	// with [ValidateTopicName] and [ValidateTopicFilter] before encoding.
+	SkipTopicValidation bool
+	// EnforceConnectFirst is meant for the client role. If set all writes other than
+	// CONNECT return [ErrConnectFirst] until a CONNECT is written over the transport.
+	EnforceConnectFirst bool
+	// ProtocolLevel is the protocol level of the connection, set when a CONNECT is written.
+	// Over [ProtocolLevel5] connections PUBLISH packets are encoded with their MQTT 5.0 properties.
+	ProtocolLevel byte
+	// TopicAliasMaximum is the Topic Alias Maximum of the receiving end of an MQTT 5.0
+	// connection. PUBLISH packets with a greater topic alias are not written and [ErrTopicAliasMaximum] is returned.
+	TopicAliasMaximum uint16
+	// connectWritten is set once a CONNECT is written over the current transport.
+	connectWritten bool
+	// topicAliases holds the topic aliases mapped over the current transport.
+	topicAliases map[uint16]struct{}
+	// closed is set by CloseTx and cleared by SetTxTransport.
+	closed atomic.Bool
+	buffer bytes.Buffer
+	// written and nwritten hold the header and amount of packets written
+	// while locked to be passed to OnPacketWrite by unlock.
+	written  Header
+	nwritten int
 }
 
 // TxCallbacks groups functionality executed on transmission success or failure
@@ -271,13 +1013,79 @@ func (tx *Tx) TxTransport() io.WriteCloser {
 
 // SetTxTransport sets the tx's writer.
 func (tx *Tx) SetTxTransport(transport io.WriteCloser) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
 	tx.txTrp = transport
+	tx.closed.Store(false)
+	tx.connectWritten = false
+	tx.topicAliases = nil
+}
+
+// connectFirst returns [ErrConnectFirst] if EnforceConnectFirst is set and no
+// CONNECT has been written over the transport.
+func (tx *Tx) connectFirst() error {
+	if tx.EnforceConnectFirst && !tx.connectWritten {
+		return ErrConnectFirst
+	}
+	return nil
+}
+
+// validateTopicName calls ValidateTopicName unless SkipTopicValidation is set.
+func (tx *Tx) validateTopicName(topic []byte) error {
+	if tx.SkipTopicValidation {
+		return nil
+	}
+	return ValidateTopicName(topic)
+}
+
+// validatePublish validates the topic name of varPub and, over MQTT 5.0 connections,
+// its topic alias. The topic name may be empty if the topic alias is mapped.
+func (tx *Tx) validatePublish(varPub VariablesPublish) error {
+	if tx.ProtocolLevel != ProtocolLevel5 || varPub.TopicAlias == 0 {
+		return tx.validateTopicName(varPub.TopicName)
+	}
+	if varPub.TopicAlias > tx.TopicAliasMaximum {
+		return ErrTopicAliasMaximum
+	}
+	if len(varPub.TopicName) == 0 {
+		if _, ok := tx.topicAliases[varPub.TopicAlias]; !ok {
+			return errors.New("topic alias " + strconv.Itoa(int(varPub.TopicAlias)) + " not mapped to a topic name")
+		}
+		return nil
+	}
+	return tx.validateTopicName(varPub.TopicName)
+}
+
+// mapTopicAlias records the topic alias of a PUBLISH written with a topic name over an MQTT 5.0 connection.
+func (tx *Tx) mapTopicAlias(varPub VariablesPublish) {
+	if tx.ProtocolLevel != ProtocolLevel5 || varPub.TopicAlias == 0 || len(varPub.TopicName) == 0 {
+		return
+	}
+	if tx.topicAliases == nil {
+		tx.topicAliases = make(map[uint16]struct{})
+	}
+	tx.topicAliases[varPub.TopicAlias] = struct{}{}
+}
+
+// validateTopicFilter calls ValidateTopicFilter unless SkipTopicValidation is set.
+func (tx *Tx) validateTopicFilter(filter []byte) error {
+	if tx.SkipTopicValidation {
+		return nil
+	}
+	return ValidateTopicFilter(filter)
 }
 
 // WriteConnack writes a CONNECT packet over the transport.
 func (tx *Tx) WriteConnect(varConn *VariablesConnect) error {
-	if tx.txTrp == nil {
-		return errors.New("nil transport")
+	tx.mu.Lock()
+	defer tx.unlock()
+	if err := tx.transportErr(); err != nil {
+		return err
+	}
+	if varConn.WillFlag() {
+		if err := tx.validateTopicName(varConn.WillTopic); err != nil {
+			return err
+		}
 	}
 	buffer := &tx.buffer
 	buffer.Reset()
@@ -290,19 +1098,27 @@ func (tx *Tx) WriteConnect(varConn *VariablesConnect) error {
 	if err != nil {
 		return err
 	}
-	n, err := buffer.WriteTo(tx.txTrp)
+	n, err := tx.writeFull(buffer.Bytes())
 	if err != nil && n > 0 {
 		tx.prepClose(err)
-	} else if tx.TxCallbacks.OnSuccessfulTx != nil && err == nil {
-		tx.TxCallbacks.OnSuccessfulTx(tx)
+	} else if err == nil {
+		traceConnect(tx.TxTrace, traceTx, varConn)
+		tx.connectWritten = true
+		tx.ProtocolLevel = varConn.ProtocolLevel
+		tx.onSuccessfulTx(h)
 	}
 	return err
 }
 
 // WriteConnack writes a CONNACK packet over the transport.
 func (tx *Tx) WriteConnack(varConnack VariablesConnack) error {
-	if tx.txTrp == nil {
-		return errors.New("nil transport")
+	tx.mu.Lock()
+	defer tx.unlock()
+	if err := tx.transportErr(); err != nil {
+		return err
+	}
+	if err := tx.connectFirst(); err != nil {
+		return err
 	}
 	buffer := &tx.buffer
 	buffer.Reset()
@@ -315,50 +1131,165 @@ func (tx *Tx) WriteConnack(varConnack VariablesConnack) error {
 	if err != nil {
 		return err
 	}
-	n, err := buffer.WriteTo(tx.txTrp)
+	n, err := tx.writeFull(buffer.Bytes())
 	if err != nil && n > 0 {
 		tx.prepClose(err)
-	} else if tx.TxCallbacks.OnSuccessfulTx != nil && err == nil {
-		tx.TxCallbacks.OnSuccessfulTx(tx)
+	} else if err == nil {
+		traceConnack(tx.TxTrace, traceTx, varConnack)
+		tx.onSuccessfulTx(h)
 	}
 	return err
 }
 
 // WritePublishPayload writes a PUBLISH packet over the transport along with the
 // Application Message in the payload. payload can be zero-length.
+// If h's RemainingLength is zero it is computed, otherwise it must equal the size
+// of varPub plus the length of payload or an error is returned and nothing is written.
 func (tx *Tx) WritePublishPayload(h Header, varPub VariablesPublish, payload []byte) error {
-	if tx.txTrp == nil {
-		return errors.New("nil transport")
+	tx.mu.Lock()
+	defer tx.unlock()
+	if err := tx.transportErr(); err != nil {
+		return err
+	}
+	if err := tx.connectFirst(); err != nil {
+		return err
+	}
+	if err := tx.validatePublish(varPub); err != nil {
+		return err
 	}
 	buffer := &tx.buffer
 	buffer.Reset()
 	qos := h.Flags().QoS()
-	h.RemainingLength = uint32(varPub.Size(qos) + len(payload))
-	_, err := h.Encode(buffer)
+	v5 := tx.ProtocolLevel == ProtocolLevel5
+	err := setPublishRemainingLength(&h, varPub, len(payload), v5)
 	if err != nil {
 		return err
 	}
-	_, err = encodePublish(buffer, qos, varPub)
+	_, err = h.Encode(buffer)
 	if err != nil {
 		return err
 	}
-	_, err = writeFull(buffer, payload)
+	_, err = encodePublish(buffer, qos, varPub, v5)
 	if err != nil {
 		return err
 	}
-	n, err := buffer.WriteTo(tx.txTrp)
+	_, err = WriteFull(buffer, payload)
+	if err != nil {
+		return err
+	}
+	n, err := tx.writeFull(buffer.Bytes())
 	if err != nil && n > 0 {
 		tx.prepClose(err)
-	} else if tx.TxCallbacks.OnSuccessfulTx != nil && err == nil {
-		tx.TxCallbacks.OnSuccessfulTx(tx)
+	} else if err == nil {
+		tracePublish(tx.TxTrace, traceTx, h.Flags(), varPub, len(payload))
+		tx.mapTopicAlias(varPub)
+		tx.onSuccessfulTx(h)
+	}
+	return err
+}
+
+// ClearRetained clears the retained message of topic by publishing a QoS0 PUBLISH
+// with the RETAIN flag set and an empty payload. The server removes the retained
+// message of the topic and does not retain the empty message [MQTT-3.3.1-10], [MQTT-3.3.1-11].
+func (tx *Tx) ClearRetained(topic []byte) error {
+	retainFlags, _ := NewPublishFlags(QoS0, false, true)
+	return tx.WritePublishPayload(newHeader(PacketPublish, retainFlags, 0), VariablesPublish{TopicName: topic}, nil)
+}
+
+// setPublishRemainingLength sets the remaining length of the PUBLISH header h from
+// the size of varPub, including its properties if v5 is set, and the payload length.
+// If h already has a non-zero remaining length it must match the computed one so a
+// malformed packet is never written.
+func setPublishRemainingLength(h *Header, varPub VariablesPublish, payloadLen int, v5 bool) error {
+	sz := varPub.Size(h.Flags().QoS())
+	if v5 {
+		sz = varPub.sizeV5(h.Flags().QoS())
+	}
+	rl := uint32(sz + payloadLen)
+	if h.RemainingLength != 0 && h.RemainingLength != rl {
+		return errors.New("PUBLISH header remaining length " + strconv.FormatUint(uint64(h.RemainingLength), 10) +
+			" does not match topic, packet identifier and payload length " + strconv.FormatUint(uint64(rl), 10))
+	}
+	h.RemainingLength = rl
+	return nil
+}
+
+// ForwardPayload writes a PUBLISH packet over the transport with an Application
+// Message of payloadLen bytes read from payload. It is meant for proxying a PUBLISH
+// received in an OnPub callback to another connection without buffering the payload.
+// The payload is copied with [io.CopyN] so the transport's [io.ReaderFrom] fast path
+// is used if available. If payload ends before payloadLen bytes are read
+// [io.ErrUnexpectedEOF] is returned.
+func (tx *Tx) ForwardPayload(h Header, varPub VariablesPublish, payload io.Reader, payloadLen int) error {
+	tx.mu.Lock()
+	defer tx.unlock()
+	if err := tx.transportErr(); err != nil {
+		return err
+	}
+	if err := tx.connectFirst(); err != nil {
+		return err
+	}
+	if payloadLen < 0 {
+		return errors.New("negative payload length")
+	}
+	if err := tx.validatePublish(varPub); err != nil {
+		return err
+	}
+	buffer := &tx.buffer
+	buffer.Reset()
+	qos := h.Flags().QoS()
+	v5 := tx.ProtocolLevel == ProtocolLevel5
+	err := setPublishRemainingLength(&h, varPub, payloadLen, v5)
+	if err != nil {
+		return err
+	}
+	_, err = h.Encode(buffer)
+	if err != nil {
+		return err
+	}
+	_, err = encodePublish(buffer, qos, varPub, v5)
+	if err != nil {
+		return err
+	}
+	n, err := tx.writeFull(buffer.Bytes())
+	if err == nil {
+		var ncopied int64
+		ncopied, err = io.CopyN(tx.txTrp, payload, int64(payloadLen))
+		n += int(ncopied)
+		err = closedErr(err)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	if err != nil && n > 0 {
+		tx.prepClose(err)
+	} else if err == nil {
+		tracePublish(tx.TxTrace, traceTx, h.Flags(), varPub, payloadLen)
+		tx.mapTopicAlias(varPub)
+		tx.onSuccessfulTx(h)
 	}
 	return err
 }
 
-// WriteSubscribe writes an SUBSCRIBE packet over the transport.
+// WriteSubscribe writes an SUBSCRIBE packet over the transport. SUBSCRIBE packets with
+// no topic filters or exceeding the maximum remaining length are rejected before anything is written,
+// in the latter case with [ErrBadRemainingLen].
 func (tx *Tx) WriteSubscribe(varSub VariablesSubscribe) error {
-	if tx.txTrp == nil {
-		return errors.New("nil transport")
+	tx.mu.Lock()
+	defer tx.unlock()
+	if err := tx.transportErr(); err != nil {
+		return err
+	}
+	if err := tx.connectFirst(); err != nil {
+		return err
+	}
+	if err := checkTopicsSize(len(varSub.TopicFilters), varSub.Size()); err != nil {
+		return err
+	}
+	for _, hotTopic := range varSub.TopicFilters {
+		if err := tx.validateTopicFilter(hotTopic.TopicFilter); err != nil {
+			return err
+		}
 	}
 	buffer := &tx.buffer
 	buffer.Reset()
@@ -371,19 +1302,37 @@ func (tx *Tx) WriteSubscribe(varSub VariablesSubscribe) error {
 	if err != nil {
 		return err
 	}
-	n, err := buffer.WriteTo(tx.txTrp)
+	n, err := tx.writeFull(buffer.Bytes())
 	if err != nil && n > 0 {
 		tx.prepClose(err)
-	} else if tx.TxCallbacks.OnSuccessfulTx != nil && err == nil {
-		tx.TxCallbacks.OnSuccessfulTx(tx)
+	} else if err == nil {
+		traceSubscribe(tx.TxTrace, traceTx, varSub)
+		tx.onSuccessfulTx(h)
 	}
 	return err
 }
 
+// checkTopicsSize returns an error if a SUBSCRIBE or UNSUBSCRIBE packet with numTopics
+// topic filters and a remaining length of sz may not be encoded, before anything is written.
+func checkTopicsSize(numTopics, sz int) error {
+	if numTopics == 0 {
+		return errNoTopics // [MQTT-3.8.3-3], [MQTT-3.10.3-2].
+	}
+	if sz > maxRemainingLengthValue {
+		return ErrBadRemainingLen
+	}
+	return nil
+}
+
 // WriteSuback writes an UNSUBACK packet over the transport.
 func (tx *Tx) WriteSuback(varSub VariablesSuback) error {
-	if tx.txTrp == nil {
-		return errors.New("nil transport")
+	tx.mu.Lock()
+	defer tx.unlock()
+	if err := tx.transportErr(); err != nil {
+		return err
+	}
+	if err := tx.connectFirst(); err != nil {
+		return err
 	}
 	if err := varSub.Validate(); err != nil {
 		return err
@@ -399,19 +1348,49 @@ func (tx *Tx) WriteSuback(varSub VariablesSuback) error {
 	if err != nil {
 		return err
 	}
-	n, err := buffer.WriteTo(tx.txTrp)
+	n, err := tx.writeFull(buffer.Bytes())
 	if err != nil && n > 0 {
 		tx.prepClose(err)
-	} else if tx.TxCallbacks.OnSuccessfulTx != nil && err == nil {
-		tx.TxCallbacks.OnSuccessfulTx(tx)
+	} else if err == nil {
+		traceSuback(tx.TxTrace, traceTx, varSub)
+		tx.onSuccessfulTx(h)
 	}
 	return err
 }
 
-// WriteUnsubscribe writes an UNSUBSCRIBE packet over the transport.
+// WriteSubackFor writes the SUBACK response to the SUBSCRIBE vs, granting the
+// QoS at granted[i] to the i'th topic filter of vs. Denied topic filters are
+// granted [QoSSubfail]. The granted QoS may not exceed the QoS requested.
+func (tx *Tx) WriteSubackFor(vs VariablesSubscribe, granted []QoSLevel) error {
+	if len(granted) != len(vs.TopicFilters) {
+		return errors.New("granted QoS count does not match SUBSCRIBE topic filter count")
+	}
+	for i, qos := range granted {
+		if qos != QoSSubfail && qos > vs.TopicFilters[i].QoS {
+			return errors.New("granted QoS exceeds requested QoS")
+		}
+	}
+	return tx.WriteSuback(VariablesSuback{PacketIdentifier: vs.PacketIdentifier, ReturnCodes: granted})
+}
+
+// WriteUnsubscribe writes an UNSUBSCRIBE packet over the transport. UNSUBSCRIBE packets
+// with no topics or exceeding the maximum remaining length are rejected as with [Tx.WriteSubscribe].
 func (tx *Tx) WriteUnsubscribe(varUnsub VariablesUnsubscribe) error {
-	if tx.txTrp == nil {
-		return errors.New("nil transport")
+	tx.mu.Lock()
+	defer tx.unlock()
+	if err := tx.transportErr(); err != nil {
+		return err
+	}
+	if err := tx.connectFirst(); err != nil {
+		return err
+	}
+	if err := checkTopicsSize(len(varUnsub.Topics), varUnsub.Size()); err != nil {
+		return err
+	}
+	for _, coldTopic := range varUnsub.Topics {
+		if err := tx.validateTopicFilter(coldTopic); err != nil {
+			return err
+		}
 	}
 	buffer := &tx.buffer
 	buffer.Reset()
@@ -424,11 +1403,12 @@ func (tx *Tx) WriteUnsubscribe(varUnsub VariablesUnsubscribe) error {
 	if err != nil {
 		return err
 	}
-	n, err := buffer.WriteTo(tx.txTrp)
+	n, err := tx.writeFull(buffer.Bytes())
 	if err != nil && n > 0 {
 		tx.prepClose(err)
-	} else if tx.TxCallbacks.OnSuccessfulTx != nil && err == nil {
-		tx.TxCallbacks.OnSuccessfulTx(tx)
+	} else if err == nil {
+		traceUnsubscribe(tx.TxTrace, traceTx, varUnsub)
+		tx.onSuccessfulTx(h)
 	}
 	return err
 }
@@ -436,64 +1416,194 @@ func (tx *Tx) WriteUnsubscribe(varUnsub VariablesUnsubscribe) error {
 // WriteIdentified writes PUBACK, PUBREC, PUBREL, PUBCOMP, UNSUBACK packets containing non-zero packet identfiers
 // It automatically sets the RemainingLength field to 2.
 func (tx *Tx) WriteIdentified(packetType PacketType, packetIdentifier uint16) (err error) {
-	if tx.txTrp == nil {
-		return errors.New("nil transport")
+	tx.mu.Lock()
+	defer tx.unlock()
+	if err := tx.transportErr(); err != nil {
+		return err
+	}
+	if err := tx.connectFirst(); err != nil {
+		return err
 	}
 	if packetIdentifier == 0 {
 		return errGotZeroPI
 	}
-	// This packet has special QoS1 flag.
-	isPubrelSubUnsub := packetType == PacketPubrel
-	if !(isPubrelSubUnsub || packetType == PacketPuback || packetType == PacketPubrec ||
-		packetType == PacketPubcomp || packetType == PacketUnsuback) {
-		return errors.New("expected a packet type from PUBACK|PUBREL|PUBCOMP|UNSUBACK")
+	flags, err := identifiedPacketFlags(packetType)
+	if err != nil {
+		return err
 	}
 
 	var buf [5 + 2]byte
-	n := newHeader(packetType, PacketFlags(b2u8(isPubrelSubUnsub)<<1), 2).Put(buf[:])
+	h := newHeader(packetType, flags, 2)
+	n := h.Put(buf[:])
 	binary.BigEndian.PutUint16(buf[n:], packetIdentifier)
-	n, err = writeFull(tx.txTrp, buf[:n+2])
+	n, err = tx.writeFull(buf[:n+2])
 
 	if err != nil && n > 0 {
 		tx.prepClose(err)
-	} else if tx.TxCallbacks.OnSuccessfulTx != nil && err == nil {
-		tx.TxCallbacks.OnSuccessfulTx(tx)
+	} else if err == nil {
+		traceOther(tx.TxTrace, traceTx, packetType, packetIdentifier)
+		tx.onSuccessfulTx(h)
 	}
 	return err
 }
 
+// WriteAcks writes a run of PUBACK, PUBREC, PUBREL, PUBCOMP or UNSUBACK packets
+// of the same type, one per packet identifier in order, with a single write to the transport.
+func (tx *Tx) WriteAcks(packetType PacketType, packetIdentifiers []uint16) error {
+	tx.mu.Lock()
+	defer tx.unlock()
+	if err := tx.transportErr(); err != nil {
+		return err
+	}
+	if err := tx.connectFirst(); err != nil {
+		return err
+	}
+	flags, err := identifiedPacketFlags(packetType)
+	if err != nil {
+		return err
+	}
+	buffer := &tx.buffer
+	buffer.Reset()
+	h := newHeader(packetType, flags, 2)
+	var buf [5 + 2]byte
+	for _, packetIdentifier := range packetIdentifiers {
+		if packetIdentifier == 0 {
+			return errGotZeroPI
+		}
+		n := h.Put(buf[:])
+		binary.BigEndian.PutUint16(buf[n:], packetIdentifier)
+		buffer.Write(buf[:n+2])
+	}
+	n, err := tx.writeFull(buffer.Bytes())
+	if err != nil && n > 0 {
+		tx.prepClose(err)
+	} else if err == nil {
+		for _, packetIdentifier := range packetIdentifiers {
+			traceOther(tx.TxTrace, traceTx, packetType, packetIdentifier)
+			tx.onSuccessfulTx(h)
+		}
+	}
+	return err
+}
+
+// identifiedPacketFlags returns the flags of a PUBACK, PUBREC, PUBREL, PUBCOMP or UNSUBACK
+// packet or an error if packetType is not one of these.
+func identifiedPacketFlags(packetType PacketType) (PacketFlags, error) {
+	switch packetType {
+	case PacketPubrel:
+		// This packet has special QoS1 flag.
+		return PacketFlagsPubrelSubUnsub, nil
+	case PacketPuback, PacketPubrec, PacketPubcomp, PacketUnsuback:
+		return 0, nil
+	}
+	return 0, errors.New("expected a packet type from PUBACK|PUBREC|PUBREL|PUBCOMP|UNSUBACK")
+}
+
 // WriteSimple facilitates easy sending of the 2 octet DISCONNECT, PINGREQ, PINGRESP packets.
 // If the packet is not one of these then an error is returned.
 // It also returns an error with encoding step if there was one.
 func (tx *Tx) WriteSimple(packetType PacketType) (err error) {
-	if tx.txTrp == nil {
-		return errors.New("nil transport")
+	tx.mu.Lock()
+	defer tx.unlock()
+	if err := tx.transportErr(); err != nil {
+		return err
+	}
+	if err := tx.connectFirst(); err != nil {
+		return err
 	}
 	isValid := packetType == PacketDisconnect || packetType == PacketPingreq || packetType == PacketPingresp
 	if !isValid {
 		return errors.New("expected packet type from PINGREQ|PINGRESP|DISCONNECT")
 	}
-	n, err := newHeader(packetType, 0, 0).Encode(tx.txTrp)
+	h := newHeader(packetType, 0, 0)
+	n, err := h.Encode(tx.txTrp)
+	err = closedErr(err)
 	if err != nil && n > 0 {
 		tx.prepClose(err)
-	} else if tx.TxCallbacks.OnSuccessfulTx != nil && err == nil {
-		tx.TxCallbacks.OnSuccessfulTx(tx)
+	} else if err == nil {
+		traceOther(tx.TxTrace, traceTx, packetType, 0)
+		tx.onSuccessfulTx(h)
 	}
 	return err
 }
 
-// Close closes the underlying tranport and returns an error if any.
-func (tx *Tx) CloseTx() error { return tx.txTrp.Close() }
+// WriteDisconnect writes a DISCONNECT packet over the transport. See [Tx.WriteSimple].
+func (tx *Tx) WriteDisconnect() error { return tx.WriteSimple(PacketDisconnect) }
+
+// WritePingreq writes a PINGREQ packet over the transport. See [Tx.WriteSimple].
+func (tx *Tx) WritePingreq() error { return tx.WriteSimple(PacketPingreq) }
+
+// WritePingresp writes a PINGRESP packet over the transport. See [Tx.WriteSimple].
+func (tx *Tx) WritePingresp() error { return tx.WriteSimple(PacketPingresp) }
+
+// CloseTx closes the underlying transport and returns the error returned by its Close method.
+// Writes with tx then return [io.ErrClosedPipe] until a new transport is set with [Tx.SetTxTransport].
+// As with [Rx.CloseRx], closing a transport shared with a Rx also affects the Rx,
+// while a Tx and Rx with distinct transports are closed independently.
+// CloseTx does not lock tx so it may be called from TxCallbacks.
+func (tx *Tx) CloseTx() error {
+	if tx.txTrp == nil {
+		return errors.New("nil transport")
+	}
+	tx.closed.Store(true)
+	return tx.txTrp.Close()
+}
+
+// writeFull writes b to the transport. See [closedErr].
+func (tx *Tx) writeFull(b []byte) (int, error) {
+	n, err := WriteFull(tx.txTrp, b)
+	return n, closedErr(err)
+}
+
+// transportErr returns an error if tx has no transport or it was closed with CloseTx.
+func (tx *Tx) transportErr() error {
+	if tx.txTrp == nil {
+		return errors.New("nil transport")
+	}
+	if tx.closed.Load() {
+		return io.ErrClosedPipe
+	}
+	return nil
+}
+
+func (tx *Tx) onSuccessfulTx(h Header) {
+	tx.written = h
+	tx.nwritten++
+	if tx.TxStats != nil {
+		tx.TxStats.Record(h)
+	}
+	if tx.TxRing != nil {
+		tx.TxRing.Record(h)
+	}
+	if tx.TxCallbacks.OnSuccessfulTx != nil {
+		tx.TxCallbacks.OnSuccessfulTx(tx)
+	}
+}
+
+// unlock unlocks tx and calls OnPacketWrite for the packets written while locked.
+func (tx *Tx) unlock() {
+	h, count, hook := tx.written, tx.nwritten, tx.OnPacketWrite
+	tx.nwritten = 0
+	tx.mu.Unlock()
+	if hook == nil {
+		return
+	}
+	for i := 0; i < count; i++ {
+		hook(h, h.Size()+int(h.RemainingLength))
+	}
+}
 
 func (tx *Tx) prepClose(err error) {
 	if tx.TxCallbacks.OnTxError != nil {
 		tx.TxCallbacks.OnTxError(tx, err)
 	} else {
-		tx.txTrp.Close()
+		tx.CloseTx()
 	}
 }
 
 // ShallowCopy shallow copies rx and underlying transport and encoder. Does not copy callbacks over.
+// The copy does not share tx's lock so writes to the shared transport through tx and
+// the copy are not serialized with respect to each other.
 func (tx *Tx) ShallowCopy() *Tx {
 	return &Tx{txTrp: tx.txTrp}
 }
@@ -0,0 +1,79 @@
+package mqtt
+
+// Upper bounds (exclusive) of the packet size histogram buckets in [PacketStats].
+// Packets of size equal or larger than the last bound fall in the last bucket.
+var statsBucketBounds = [...]int{64, 256, 1024, 16 * 1024}
+
+// PacketStats accumulates packet counts and a histogram of packet sizes for each
+// packet type. Arrays are indexed by [PacketType]. Sizes are total packet size,
+// that is the fixed header plus remaining length.
+//
+// The histogram buckets hold packets of size:
+//
+//	0: less than 64 bytes
+//	1: less than 256 bytes
+//	2: less than 1024 bytes
+//	3: less than 16KiB
+//	4: 16KiB or larger
+type PacketStats struct {
+	Count     [16]uint64
+	Bytes     [16]uint64
+	Histogram [16][len(statsBucketBounds) + 1]uint64
+}
+
+// Record adds a packet with header h to the statistics.
+func (ps *PacketStats) Record(h Header) {
+	tp := h.Type() & 0xf
+	size := h.Size() + int(h.RemainingLength)
+	bucket := 0
+	for bucket < len(statsBucketBounds) && size >= statsBucketBounds[bucket] {
+		bucket++
+	}
+	ps.Count[tp]++
+	ps.Bytes[tp] += uint64(size)
+	ps.Histogram[tp][bucket]++
+}
+
+// Reset clears all statistics.
+func (ps *PacketStats) Reset() { *ps = PacketStats{} }
+
+// PacketRing retains the headers of the last packets recorded for post-mortem
+// debugging. It does not allocate after creation with [NewPacketRing].
+type PacketRing struct {
+	headers []Header
+	// next is the index at which the next header is recorded.
+	next int
+	full bool
+}
+
+// NewPacketRing returns a PacketRing that retains the last n headers recorded.
+func NewPacketRing(n int) *PacketRing {
+	if n <= 0 {
+		panic("PacketRing size must be positive")
+	}
+	return &PacketRing{headers: make([]Header, n)}
+}
+
+// Record adds h to the ring, discarding the oldest header if the ring is full.
+func (pr *PacketRing) Record(h Header) {
+	pr.headers[pr.next] = h
+	pr.next++
+	if pr.next == len(pr.headers) {
+		pr.next = 0
+		pr.full = true
+	}
+}
+
+// RecentPackets appends the retained headers to dst, oldest first, and returns the result.
+func (pr *PacketRing) RecentPackets(dst []Header) []Header {
+	if pr.full {
+		dst = append(dst, pr.headers[pr.next:]...)
+	}
+	return append(dst, pr.headers[:pr.next]...)
+}
+
+// Reset discards all retained headers.
+func (pr *PacketRing) Reset() {
+	pr.next = 0
+	pr.full = false
+}
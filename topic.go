@@ -0,0 +1,69 @@
+package mqtt
+
+import (
+	"errors"
+	"unicode/utf8"
+)
+
+var (
+	errTopicNotUTF8      = wrapErr(ErrBadUTF8, "topic")
+	errTopicNull         = errors.New("topic contains null character U+0000")
+	errTopicNameWildcard = errors.New("topic name contains wildcard character")
+	errTopicPlusLevel    = errors.New("'+' wildcard must occupy an entire topic level")
+	errTopicHashLast     = errors.New("'#' wildcard must be the last topic level")
+)
+
+// ValidateTopicName checks topic is a valid PUBLISH topic name. Topic names must
+// be non-empty UTF-8 encoded strings without the null character and must not
+// contain the wildcard characters '+' or '#' [MQTT-3.3.2-2].
+func ValidateTopicName(topic []byte) error {
+	if err := validateTopicString(topic); err != nil {
+		return err
+	}
+	for _, c := range topic {
+		if c == '+' || c == '#' {
+			return errTopicNameWildcard
+		}
+	}
+	return nil
+}
+
+// ValidateTopicFilter checks filter is a valid SUBSCRIBE or UNSUBSCRIBE topic filter.
+// Topic filters must be non-empty UTF-8 encoded strings without the null character.
+// The '+' wildcard must occupy an entire level of the filter [MQTT-4.7.1-3] and the
+// '#' wildcard must occupy the last level of the filter [MQTT-4.7.1-2].
+func ValidateTopicFilter(filter []byte) error {
+	if err := validateTopicString(filter); err != nil {
+		return err
+	}
+	last := len(filter) - 1
+	for i, c := range filter {
+		switch c {
+		case '+':
+			if (i > 0 && filter[i-1] != '/') || (i < last && filter[i+1] != '/') {
+				return errTopicPlusLevel
+			}
+		case '#':
+			if i != last || (i > 0 && filter[i-1] != '/') {
+				return errTopicHashLast
+			}
+		}
+	}
+	return nil
+}
+
+// validateTopicString checks the rules shared by topic names and topic filters [MQTT-4.7.3-1], [MQTT-4.7.3-2].
+func validateTopicString(topic []byte) error {
+	if len(topic) == 0 {
+		return errEmptyTopic
+	}
+	for _, c := range topic {
+		if c == 0 {
+			return errTopicNull
+		}
+	}
+	if !utf8.Valid(topic) {
+		return errTopicNotUTF8
+	}
+	return nil
+}
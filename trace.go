@@ -0,0 +1,120 @@
+package mqtt
+
+import (
+	"io"
+	"strconv"
+)
+
+// Prefixes of trace lines written to Rx.RxTrace and Tx.TxTrace.
+const (
+	traceRx = '<'
+	traceTx = '>'
+)
+
+// traceLine is a single human-readable line of a packet trace, i.e:
+//
+//	> PUBLISH qos=1 id=42 topic=foo/bar len=128
+type traceLine []byte
+
+func newTraceLine(prefix byte, packetType PacketType) traceLine {
+	line := make(traceLine, 0, 64)
+	line = append(line, prefix, ' ')
+	return append(line, packetType.String()...)
+}
+
+func (line traceLine) uint(key string, v uint64) traceLine {
+	line = append(line, ' ')
+	line = append(line, key...)
+	line = append(line, '=')
+	return strconv.AppendUint(line, v, 10)
+}
+
+func (line traceLine) str(key string, v []byte) traceLine {
+	line = append(line, ' ')
+	line = append(line, key...)
+	line = append(line, '=')
+	return append(line, v...)
+}
+
+// writeTo writes the line to w. Trace write errors are ignored.
+func (line traceLine) writeTo(w io.Writer) {
+	w.Write(append(line, '\n'))
+}
+
+func traceConnect(w io.Writer, prefix byte, vc *VariablesConnect) {
+	if w == nil {
+		return
+	}
+	newTraceLine(prefix, PacketConnect).str("clientid", vc.ClientID).uint("keepalive", uint64(vc.KeepAlive)).writeTo(w)
+}
+
+func traceConnack(w io.Writer, prefix byte, vc VariablesConnack) {
+	if w == nil {
+		return
+	}
+	newTraceLine(prefix, PacketConnack).uint("code", uint64(vc.ReturnCode)).writeTo(w)
+}
+
+func tracePublish(w io.Writer, prefix byte, pf PacketFlags, vp VariablesPublish, payloadLen int) {
+	if w == nil {
+		return
+	}
+	line := newTraceLine(prefix, PacketPublish).uint("qos", uint64(pf.QoS()))
+	if pf.QoS() != QoS0 {
+		line = line.uint("id", uint64(vp.PacketIdentifier))
+	}
+	// DUP and RETAIN are only traced when set.
+	if pf.Dup() {
+		line = line.uint("dup", 1)
+	}
+	if pf.Retain() {
+		line = line.uint("retain", 1)
+	}
+	line.str("topic", vp.TopicName).uint("len", uint64(payloadLen)).writeTo(w)
+}
+
+func traceSubscribe(w io.Writer, prefix byte, vs VariablesSubscribe) {
+	if w == nil {
+		return
+	}
+	line := newTraceLine(prefix, PacketSubscribe).uint("id", uint64(vs.PacketIdentifier))
+	for _, hotTopic := range vs.TopicFilters {
+		line = line.str("topic", hotTopic.TopicFilter).uint("qos", uint64(hotTopic.QoS))
+	}
+	line.writeTo(w)
+}
+
+func traceSuback(w io.Writer, prefix byte, vs VariablesSuback) {
+	if w == nil {
+		return
+	}
+	line := newTraceLine(prefix, PacketSuback).uint("id", uint64(vs.PacketIdentifier))
+	for _, qos := range vs.ReturnCodes {
+		line = line.uint("qos", uint64(qos))
+	}
+	line.writeTo(w)
+}
+
+func traceUnsubscribe(w io.Writer, prefix byte, vu VariablesUnsubscribe) {
+	if w == nil {
+		return
+	}
+	line := newTraceLine(prefix, PacketUnsubscribe).uint("id", uint64(vu.PacketIdentifier))
+	for _, coldTopic := range vu.Topics {
+		line = line.str("topic", coldTopic)
+	}
+	line.writeTo(w)
+}
+
+// traceOther traces packets with no variable header other than a packet identifier.
+// packetIdentifier is only traced if non-zero.
+func traceOther(w io.Writer, prefix byte, packetType PacketType, packetIdentifier uint16) {
+	if w == nil {
+		return
+	}
+	line := newTraceLine(prefix, packetType)
+	if packetIdentifier != 0 {
+		line = line.uint("id", uint64(packetIdentifier))
+	}
+	line.writeTo(w)
+}
@@ -0,0 +1,29 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+)
+
+// DialTLS connects to the MQTT server at addr over TLS, i.e. "broker.example.com:8883",
+// and returns a transport suitable for [Client.Connect], [Rx.SetRxTransport] and
+// [Tx.SetTxTransport]. It may be used as the dialer of [Client.DialConnect].
+// ctx bounds both the TCP dial and the TLS handshake. If cfg is nil or its ServerName
+// is empty the host part of addr is used as the server name. cfg is not modified.
+func DialTLS(ctx context.Context, addr string, cfg *tls.Config) (io.ReadWriteCloser, error) {
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		cfg = cfg.Clone()
+		cfg.ServerName = host
+	}
+	dialer := tls.Dialer{Config: cfg}
+	return dialer.DialContext(ctx, "tcp", addr)
+}